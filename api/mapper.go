@@ -1,24 +1,103 @@
 package api
 
 import (
+	"encoding/hex"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/index"
+	"github.com/ag0st/taurus-challenge/store"
 	"github.com/minio/minio-go/v7"
 )
 
 
+// FileItem is a file of the list. The metadata after the size are only given by the
+// index (see index.Entry).
 type FileItem struct {
 	ObjectName string `json:"object_name"`
 	Size int64 `json:"size"`
+	Filename string `json:"filename,omitempty"`
+	PlaintextSize *int64 `json:"plaintext_size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Tags map[string]string `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"`
+}
+
+// FileMetadata is the metadata of a file, read from the object. The filename, the
+// content type, the modification time and the private metadata are decrypted from
+// its header.
+type FileMetadata struct {
+	ObjectName string `json:"object_name"`
+	Size int64 `json:"size"`
+	Filename string `json:"filename,omitempty"`
+	PlaintextSize *int64 `json:"plaintext_size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Tags map[string]string `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	PrivateMetadata map[string]string `json:"private_metadata,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	ModTime *time.Time `json:"mod_time,omitempty"`
+	Modified time.Time `json:"modified"`
 }
 
 type FileUploadSuccess struct {
 	ObjectName string `json:"object_name"`
 	VersionID string `json:"versionID"`
+	SHA256 string `json:"sha256"`
+	CRC32C string `json:"crc32c,omitempty"`
+}
+
+// QuotaUsage is the usage of a caller or of a tenant, a quota of 0 means unlimited.
+type QuotaUsage struct {
+	Name string `json:"name"`
+	Objects uint64 `json:"objects"`
+	Size uint64 `json:"size"`
+	Quota uint64 `json:"quota"`
+}
+
+// Quota is the usage and the quotas of the caller and of its tenant.
+type Quota struct {
+	MaxObjectSize uint64 `json:"max_object_size"`
+	Caller QuotaUsage `json:"caller"`
+	Tenant QuotaUsage `json:"tenant"`
 }
 
 func FileItemFromMinio(list []minio.ObjectInfo) []FileItem {
 	res := make([]FileItem, len(list))
 	for i, it := range list {
-		res[i] = FileItem{ObjectName: it.Key, Size: it.Size}
+		res[i] = FileItem{ObjectName: it.Key, Size: it.Size, Tags: it.UserTags, Metadata: store.CustomMetadata(it)}
+	}
+	return res
+}
+
+func FileItemFromIndex(entries []index.Entry) []FileItem {
+	res := make([]FileItem, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		res[i] = FileItem{ObjectName: e.Object, Size: e.StoredSize, Filename: e.Filename, ContentType: e.ContentType,
+			Owner: e.Owner, Tags: e.Tags, Metadata: e.Metadata, SHA256: e.SHA256, Created: &e.Created, Modified: &e.Modified}
+		if e.Size >= 0 {
+			res[i].PlaintextSize = &e.Size
+		}
+	}
+	return res
+}
+
+func FileMetadataFromStore(m store.ObjectMeta) FileMetadata {
+	res := FileMetadata{ObjectName: m.Name, Size: m.StoredSize, Filename: m.Filename, ContentType: m.ContentType,
+		Owner: m.Owner, Tags: m.Tags, Metadata: m.Metadata, PrivateMetadata: m.PrivateMetadata, Modified: m.LastModified}
+	if size := m.Checksums.PlainSize(); size >= 0 {
+		res.PlaintextSize = &size
+	}
+	if !m.ModTime.IsZero() {
+		res.ModTime = &m.ModTime
+	}
+	if m.Checksums.SHA256 != nil {
+		res.SHA256 = hex.EncodeToString(m.Checksums.SHA256)
 	}
 	return res
 }
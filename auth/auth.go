@@ -0,0 +1,45 @@
+// Package auth carries the identity of the caller of the API along the request.
+//
+// The identity is resolved once per request by the server (e.g. from the subject
+// of the client certificate when mutual TLS is enabled) and stored in the request
+// context. The handlers retrieve it with Caller.
+package auth
+
+import (
+	"context"
+	"net/http"
+)
+
+// Anonymous is the identity given to callers that cannot be identified.
+const Anonymous = "anonymous"
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx carrying the identity of the caller.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// Caller returns the identity of the caller stored in the context, or
+// Anonymous if none has been resolved.
+func Caller(ctx context.Context) string {
+	if c, ok := ctx.Value(callerKey{}).(string); ok && c != "" {
+		return c
+	}
+	return Anonymous
+}
+
+// FromRequest resolves the identity of the caller of the request. If the
+// client presented a verified certificate, it is its subject common name
+// (or the whole subject if it has no common name).
+// It returns false if the caller cannot be identified.
+func FromRequest(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName, true
+	}
+	return subject.String(), true
+}
@@ -11,7 +11,21 @@ It offers the capacity to retrieve the configuration file path from different en
 Particularities:
  1. If both endpoints are detected, it will use environment variable.
  2. If no endpoints explicitly given (no detection of env var & no flag given in argument) it will use the default path
-    "./config.yaml"
+    "./config.yaml". If this file does not exist, the configuration is only built from the overrides.
+
+Every field of the configuration file (except the lists) can be overridden. The precedence order is, from the
+lowest to the highest:
+ 1. Defaults
+ 2. Configuration file
+ 3. Environment variables, prefixed with TAURUS_ (minio.endpoint -> TAURUS_MINIO_ENDPOINT)
+ 4. CLI flags named as the path of the field (-minio.endpoint [value])
+
+The flag -print-config asks to dump the effective configuration with the secrets redacted (see Config.Print).
+The subcommand validate-config only checks the configuration: all the problems are reported at once with the
+path of the field (see ValidationError). The subcommand rebuild-index asks to rebuild the index from the buckets.
+
+The configuration can be reloaded at runtime (see Reload and Watch). The current configuration is swapped
+atomically, GetCurrent can be called concurrently from the handlers.
 
 Below, an example of how to use the package:
 
@@ -30,17 +44,25 @@ Email: romain.agostinelli1@swisscom.com
 package config
 
 import (
-	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
+	"math"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/ag0st/taurus-challenge/logging"
+	"github.com/ag0st/taurus-challenge/tlsconf"
 	"gopkg.in/yaml.v3"
 )
 
-var currentConfig *Config
+// currentConfig is swapped atomically by Reload, the handlers can read it concurrently.
+var currentConfig atomic.Pointer[Config]
 
 // Declaration of the configuration type used inside the program.
 // Using getter instead of public members to prevent the modification
@@ -49,32 +71,227 @@ var currentConfig *Config
 type Config struct {
 	service Service
 	minio   MinIo
+	janitor Janitor
+	tenants []Tenant
+	quotas  Quotas
+	index   Index
+	yml     ConfigYml // effective configuration, used to print it
 }
 
 func (c *Config) Service() *Service { return &c.service }
 func (c *Config) Minio() *MinIo     { return &c.minio }
+func (c *Config) Janitor() *Janitor { return &c.janitor }
 
 type Service struct {
-	address   string
-	chunkSize uint64
-	aesKey    [32]byte
+	address       string
+	adminAddress  string
+	chunkSize     uint64
+	autoChunk     bool
+	upload        Upload
+	limits        Limits
+	dedup         Dedup
+	obfuscation   Obfuscation
+	aesKey        [32]byte
+	key           Key
+	tls           TLS
+	logLevel      logging.Level
+	watchInterval time.Duration
+}
+
+func (s *Service) Address() string         { return s.address }
+func (s *Service) ChunkSize() uint64       { return s.chunkSize }
+func (s *Service) Upload() *Upload         { return &s.upload }
+func (s *Service) Limits() *Limits         { return &s.limits }
+func (s *Service) LogLevel() logging.Level { return s.logLevel }
+
+// AdminAddress gives the listening address of the metrics (/debug/vars), "" if they
+// are not served.
+func (s *Service) AdminAddress() string { return s.adminAddress }
+
+// AutoChunk tells if the chunk size is chosen for each upload from the size of the
+// object (chunk_size: auto), ChunkSize is then 0.
+func (s *Service) AutoChunk() bool { return s.autoChunk }
+
+// WatchInterval gives the interval between two checks of the configuration file
+// for changes. 0 means that the configuration is only reloaded on SIGHUP.
+func (s *Service) WatchInterval() time.Duration { return s.watchInterval }
+
+// AESKey gives the master key. It is not set if the key source is vault.
+func (s *Service) AESKey() [32]byte { return s.aesKey }
+func (s *Service) Key() *Key        { return &s.key }
+func (s *Service) TLS() *TLS        { return &s.tls }
+
+// Upload bounds the chunk sizes chosen per request or automatically.
+type Upload struct {
+	minChunkSize   uint64
+	maxChunkSize   uint64
+	maxWholeSize   uint64
+	wholeThreshold uint64
+	aggregateParts bool
+	partSize       uint64
+	maxBuffered    uint64
+	streamChunk    uint64
+	crc32c         bool
+	compression    string
 }
 
-func (s *Service) Address() string   { return s.address }
-func (s *Service) ChunkSize() uint64 { return s.chunkSize }
-func (s *Service) AESKey() [32]byte  { return s.aesKey }
+func (u *Upload) MinChunkSize() uint64 { return u.minChunkSize }
+func (u *Upload) MaxChunkSize() uint64 { return u.maxChunkSize }
+
+// MaxWholeSize gives the largest object that can be uploaded in whole mode.
+func (u *Upload) MaxWholeSize() uint64 { return u.maxWholeSize }
+
+// WholeThreshold gives the largest object put in whole mode by the automatic choice.
+func (u *Upload) WholeThreshold() uint64 { return u.wholeThreshold }
+
+// AggregateParts tells if several chunks can be grouped into one part of the multipart
+// upload, for the objects needing more than 10'000 chunks.
+func (u *Upload) AggregateParts() bool { return u.aggregateParts }
+
+// PartSize gives the size of the parts of the multipart uploads the encryption chunks
+// are grouped into, 0 means one chunk per part.
+func (u *Upload) PartSize() uint64 { return u.partSize }
+
+// MaxBufferedSize gives the largest object encrypted and uploaded in memory in whole
+// mode. The larger ones are streamed (see StreamChunkSize).
+func (u *Upload) MaxBufferedSize() uint64 { return u.maxBuffered }
+
+// StreamChunkSize gives the size of the chunks of the objects streamed into a single
+// upload.
+func (u *Upload) StreamChunkSize() uint64 { return u.streamChunk }
+
+// CRC32C tells if the CRC32C of the objects is recorded with their SHA-256.
+func (u *Upload) CRC32C() bool { return u.crc32c }
+
+// Compression gives the compression of the files before their encryption: none,
+// zstd or gzip.
+func (u *Upload) Compression() string { return u.compression }
+
+// Limits bounds the rate of the requests and of the bytes transferred per client,
+// and the number of transfers in progress. 0 means unlimited.
+type Limits struct {
+	requestsPerSecond float64
+	requestBurst      int
+	bytesPerSecond    uint64
+	bytesBurst        uint64
+	maxTransfers      int
+}
+
+// RequestsPerSecond gives the number of requests per second a client can sustain.
+func (l *Limits) RequestsPerSecond() float64 { return l.requestsPerSecond }
+
+// RequestBurst gives the number of requests a client can send at once.
+func (l *Limits) RequestBurst() int { return l.requestBurst }
+
+// BytesPerSecond gives the number of bytes per second uploaded and downloaded by a
+// client it can sustain.
+func (l *Limits) BytesPerSecond() uint64 { return l.bytesPerSecond }
+
+// BytesBurst gives the number of bytes a client can transfer at once.
+func (l *Limits) BytesBurst() uint64 { return l.bytesBurst }
+
+// MaxTransfers gives the number of uploads and downloads in progress in the service.
+func (l *Limits) MaxTransfers() int { return l.maxTransfers }
+
+type TLS struct {
+	certFile       string
+	keyFile        string
+	minVersion     uint16
+	clientCAFile   string
+	reloadInterval time.Duration
+}
+
+// Enabled tells if the service must be served over TLS.
+func (t *TLS) Enabled() bool                 { return t.certFile != "" }
+func (t *TLS) CertFile() string              { return t.certFile }
+func (t *TLS) KeyFile() string               { return t.keyFile }
+func (t *TLS) MinVersion() uint16            { return t.minVersion }
+func (t *TLS) ClientCAFile() string          { return t.clientCAFile }
+func (t *TLS) ReloadInterval() time.Duration { return t.reloadInterval }
 
 type MinIo struct {
 	accessKey string
 	secretKey string
 	endpoint  string
 	bucket    string
+
+	secure             bool
+	region             string
+	caFile             string
+	insecureSkipVerify bool
+	transport          MinIoTransport
+	credentials        []Credentials
 }
 
-func (m *MinIo) AccessKey() string { return m.accessKey }
-func (m *MinIo) SecretKey() string { return m.secretKey }
-func (m *MinIo) Endpoint() string  { return m.endpoint }
-func (m *MinIo) Bucket() string    { return m.bucket }
+func (m *MinIo) AccessKey() string          { return m.accessKey }
+func (m *MinIo) SecretKey() string          { return m.secretKey }
+func (m *MinIo) Endpoint() string           { return m.endpoint }
+func (m *MinIo) Bucket() string             { return m.bucket }
+func (m *MinIo) Secure() bool               { return m.secure }
+func (m *MinIo) Region() string             { return m.region }
+func (m *MinIo) CAFile() string             { return m.caFile }
+func (m *MinIo) InsecureSkipVerify() bool   { return m.insecureSkipVerify }
+func (m *MinIo) Transport() *MinIoTransport { return &m.transport }
+
+// Credentials gives the chain of credential sources. If empty, the static
+// access and secret keys are used.
+func (m *MinIo) Credentials() []Credentials { return m.credentials }
+
+// Credentials is a source of credentials for MinIo, see the store package for
+// the meaning of each type.
+type Credentials struct {
+	typ       string
+	accessKey string
+	secretKey string
+	path      string
+	profile   string
+	endpoint  string
+	tokenFile string
+	roleARN   string
+	duration  time.Duration
+}
+
+func (c *Credentials) Type() string            { return c.typ }
+func (c *Credentials) AccessKey() string       { return c.accessKey }
+func (c *Credentials) SecretKey() string       { return c.secretKey }
+func (c *Credentials) Path() string            { return c.path }
+func (c *Credentials) Profile() string         { return c.profile }
+func (c *Credentials) Endpoint() string        { return c.endpoint }
+func (c *Credentials) TokenFile() string       { return c.tokenFile }
+func (c *Credentials) RoleARN() string         { return c.roleARN }
+func (c *Credentials) Duration() time.Duration { return c.duration }
+
+// MinIoTransport is the configuration of the http transport to MinIo.
+// Zero values mean the default of the MinIo SDK.
+type MinIoTransport struct {
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	maxIdleConns          int
+	maxIdleConnsPerHost   int
+	proxy                 string
+}
+
+func (t *MinIoTransport) DialTimeout() time.Duration           { return t.dialTimeout }
+func (t *MinIoTransport) TLSHandshakeTimeout() time.Duration   { return t.tlsHandshakeTimeout }
+func (t *MinIoTransport) ResponseHeaderTimeout() time.Duration { return t.responseHeaderTimeout }
+func (t *MinIoTransport) IdleConnTimeout() time.Duration       { return t.idleConnTimeout }
+func (t *MinIoTransport) MaxIdleConns() int                    { return t.maxIdleConns }
+func (t *MinIoTransport) MaxIdleConnsPerHost() int             { return t.maxIdleConnsPerHost }
+func (t *MinIoTransport) Proxy() string                        { return t.proxy }
+
+type Janitor struct {
+	enabled  bool
+	interval time.Duration
+	maxAge   time.Duration
+	dryRun   bool
+}
+
+func (j *Janitor) Enabled() bool           { return j.enabled }
+func (j *Janitor) Interval() time.Duration { return j.interval }
+func (j *Janitor) MaxAge() time.Duration   { return j.maxAge }
+func (j *Janitor) DryRun() bool            { return j.dryRun }
 
 // ValidateConfigPath just makes sure, that the path provided is a file,
 // that can be read
@@ -93,6 +310,29 @@ func ValidateConfigPath(path string) error {
 	return nil
 }
 
+// ValidateCommand is the subcommand asking to only validate the configuration:
+//
+//	taurus-challenge validate-config -config config.yaml
+const ValidateCommand = "validate-config"
+
+// validateOnly is set by the subcommand validate-config.
+var validateOnly bool
+
+// ValidateRequested tells if the subcommand validate-config has been given.
+func ValidateRequested() bool { return validateOnly }
+
+// RebuildIndexCommand is the subcommand asking to rebuild the index from the buckets
+// and exit:
+//
+//	taurus-challenge rebuild-index -config config.yaml
+const RebuildIndexCommand = "rebuild-index"
+
+// rebuildIndex is set by the subcommand rebuild-index.
+var rebuildIndex bool
+
+// RebuildIndexRequested tells if the subcommand rebuild-index has been given.
+func RebuildIndexRequested() bool { return rebuildIndex }
+
 // ParseFlags will create and parse the CLI flags
 // and return the path to be used elsewhere
 func ParseFlags() (string, error) {
@@ -102,14 +342,42 @@ func ParseFlags() (string, error) {
 	// Set up a CLI flag called "-config" to allow users
 	// to supply the configuration file
 	flag.StringVar(&configPath, "config", "config.yaml", "path to config file")
+	flag.BoolVar(&printConfig, "print-config", false, "print the effective configuration with the secrets redacted and exit")
+	// One flag per field of the configuration to override it
+	registerFieldFlags(flag.CommandLine)
+
+	// The subcommands are given before the flags
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case ValidateCommand:
+			validateOnly = true
+			args = args[1:]
+		case RebuildIndexCommand:
+			rebuildIndex = true
+			args = args[1:]
+		}
+	}
 
 	// Actually parse the flags
-	flag.Parse()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return "", err
+	}
+
+	explicit := false
+	flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "config" })
 
 	getenv := os.Getenv("CONFIG_FILE")
 	if len(getenv) > 0 {
 		// use environment variable instead
 		configPath = getenv
+		explicit = true
+	}
+
+	// Without explicit configuration file, the default one is optional: the
+	// configuration can be given with the environment variables and the flags only.
+	if _, err := os.Stat(configPath); !explicit && os.IsNotExist(err) {
+		return "", nil
 	}
 
 	// Validate the path first
@@ -121,62 +389,354 @@ func ParseFlags() (string, error) {
 	return configPath, nil
 }
 
-// NewConfig returns a new decoded Config struct
+// NewConfig returns a new decoded Config struct. The values of the configuration file
+// are overridden by the environment variables and the flags. If configPath is empty,
+// only the overrides are used. The configuration becomes the current one.
 func NewConfig(configPath string) (*Config, error) {
+	cfg, err := load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	currentConfig.Store(cfg)
+	return cfg, nil
+}
+
+// load reads and converts the configuration without changing the current one.
+func load(configPath string) (*Config, error) {
 	// Create config structure
 	configyml := &ConfigYml{}
 
-	// Open config file
-	file, err := os.Open(configPath)
-	if err != nil {
-		return nil, err
+	if configPath != "" {
+		// Open config file
+		file, err := os.Open(configPath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		// Init new YAML decode
+		d := yaml.NewDecoder(file)
+
+		// Start YAML decoding from file
+		if err := d.Decode(&configyml); err != nil && err != io.EOF {
+			return nil, err
+		}
 	}
-	defer file.Close()
 
-	// Init new YAML decode
-	d := yaml.NewDecoder(file)
+	// Apply the environment variables and the flags, then convert to program
+	// config. All the problems are collected before failing.
+	v := &validation{}
+	applyOverrides(configyml, v)
+	sy := configyml.Service
 
-	// Start YAML decoding from file
-	if err := d.Decode(&configyml); err != nil {
-		return nil, err
+	validateAddress(v, "service.address", sy.Address)
+	if sy.AdminAddress != "" {
+		validateAddress(v, "service.admin_address", sy.AdminAddress)
 	}
 
-	// convert to program config
-	chunkSize, err := extractSize(configyml.Service.ChunkSizeStr)
-	if err != nil {
-		return nil, err
-	} else if chunkSize != 0 && (chunkSize < 5<<20 || chunkSize > 5<<30) {
-		return nil, errs.New("chunk size must be between 5<<20 and 5<<30 (included)")
+	upload := newUpload(sy.Upload, v)
+	limits := newLimits(sy.Limits, v)
+	dedup := newDedup(sy.Dedup, configyml.Index, v)
+	obfuscation := newObfuscation(sy.Obfuscation, v)
+	chunkSize, autoChunk := parseChunkSize(v, "service.chunk_size", sy.ChunkSizeStr, upload)
+
+	keyCfg, key := newKey("service", sy.Key, sy.AESEncryptionKey, v)
+	tlsCfg := newTLS(sy.TLS, v)
+
+	logLevel, err := logging.ParseLevel(sy.LogLevel)
+	v.addErr("service.log_level", err)
+
+	watchInterval := parseDuration(v, "service.config_watch_interval", sy.WatchIntervalStr, 0)
+	if watchInterval < 0 {
+		v.add("service.config_watch_interval", "must be positive")
 	}
 
-	skey, err := hex.DecodeString(configyml.Service.AESEncryptionKey)
-	if err != nil {
-		return nil, err
+	my := configyml.MinIo
+	validateEndpoint(v, "minio.endpoint", my.Endpoint)
+	if my.Bucket != "" || len(configyml.Tenants) == 0 {
+		validateBucket(v, "minio.bucket", my.Bucket)
+	}
+	if len(my.Credentials) == 0 && (my.AccessKey == "" || my.SecretKey == "") {
+		v.add("minio.access_key", "minio.access_key and minio.secret_key are required without minio.credentials")
 	}
-	key := [32]byte{}
-	n := copy(key[:], skey)
-	if n != 32 {
-		return nil, errs.New("cannot convert the aes key into byte array")
+	if my.CAFile != "" && !my.Secure {
+		v.add("minio.ca_file", "requires minio.secure")
+	}
+	transport := newMinIoTransport(my.Transport, v)
+	creds := newCredentials(my.Credentials, v)
+
+	janitor := newJanitor(configyml.Janitor, v)
+	tenants := newTenants(configyml.Tenants, my.Bucket, chunkSize, autoChunk, upload, v)
+	quotas := newQuotas(configyml.Quotas, my.Bucket, tenants, v)
+
+	if err := v.err(); err != nil {
+		return nil, err
 	}
+
 	cfg := Config{
-		service: Service{address: configyml.Service.Address, chunkSize: chunkSize, aesKey: key},
+		service: Service{
+			address: sy.Address, adminAddress: sy.AdminAddress, chunkSize: chunkSize, autoChunk: autoChunk, upload: upload, limits: limits,
+			dedup: dedup, obfuscation: obfuscation, aesKey: key, key: keyCfg, tls: tlsCfg,
+			logLevel: logLevel, watchInterval: watchInterval,
+		},
 		minio: MinIo{
-			accessKey: configyml.MinIo.AccessKey,
-			secretKey: configyml.MinIo.SecretKey,
-			endpoint:  configyml.MinIo.Endpoint,
-			bucket:    configyml.MinIo.Bucket,
+			accessKey: my.AccessKey,
+			secretKey: my.SecretKey,
+			endpoint:  my.Endpoint,
+			bucket:    my.Bucket,
+
+			secure:             my.Secure,
+			region:             my.Region,
+			caFile:             my.CAFile,
+			insecureSkipVerify: my.InsecureSkipVerify,
+			transport:          transport,
+			credentials:        creds,
 		},
+		janitor: janitor,
+		tenants: tenants,
+		quotas:  quotas,
+		index:   Index{path: configyml.Index.Path},
+		yml:     *configyml,
 	}
 
-	currentConfig = &cfg
+	return &cfg, nil
+}
+
+// ChunkSizeAuto is the value of a chunk size chosen for each upload from the size of the object.
+const ChunkSizeAuto = "auto"
 
-	return currentConfig, nil
+// parseChunkSize parses the chunk size of the field, it must be auto, 0 or within the
+// bounds of the uploads. It tells if the chunk size is automatic.
+func parseChunkSize(v *validation, field, s string, up Upload) (uint64, bool) {
+	if strings.EqualFold(strings.TrimSpace(s), ChunkSizeAuto) {
+		return 0, true
+	}
+	chunkSize, err := ParseSize(s)
+	if v.addErr(field, err) && chunkSize != 0 && (chunkSize < up.minChunkSize || chunkSize > up.maxChunkSize) {
+		v.add(field, fmt.Sprintf("must be auto, 0 or between service.upload.min_chunk_size (%d B) and service.upload.max_chunk_size (%d B)",
+			up.minChunkSize, up.maxChunkSize))
+	}
+	return chunkSize, false
+}
+
+// newUpload converts the bounds of the uploads. The chunk sizes default to the limits of
+// MinIo (5 MiB to 5 GiB), the whole mode is accepted up to 5 GiB (maximum size of a single
+// upload on MinIo) and chosen automatically up to 16 MiB. With a part size, the chunks
+// are grouped into parts and can be as small as 4 KiB (64 KiB by default). The whole mode
+// keeps up to 64 MiB in memory and streams the larger objects in chunks of 64 KiB.
+func newUpload(uy UploadYml, v *validation) Upload {
+	u := Upload{minChunkSize: 5 << 20, maxChunkSize: 5 << 30, maxWholeSize: 5 << 30, wholeThreshold: 16 << 20,
+		aggregateParts: uy.AggregateParts, maxBuffered: 64 << 20, streamChunk: 64 << 10, crc32c: uy.CRC32C,
+		compression: "none"}
+	minChunkSize, minLabel := uint64(5<<20), "5 MiB"
+	if uy.PartSizeStr != "" {
+		size, err := ParseSize(uy.PartSizeStr)
+		if v.addErr("service.upload.part_size", err) && size != 0 {
+			u.partSize, u.minChunkSize = size, 64<<10
+			minChunkSize, minLabel = 4<<10, "4 KiB"
+			if size < 5<<20 || size > 5<<30 {
+				v.add("service.upload.part_size", "must be 0 or between 5 MiB and 5 GiB")
+			}
+		}
+	}
+	sizes := []struct {
+		field string
+		str   string
+		dest  *uint64
+	}{
+		{"min_chunk_size", uy.MinChunkSizeStr, &u.minChunkSize},
+		{"max_chunk_size", uy.MaxChunkSizeStr, &u.maxChunkSize},
+		{"max_whole_size", uy.MaxWholeSizeStr, &u.maxWholeSize},
+		{"whole_threshold", uy.WholeThresholdStr, &u.wholeThreshold},
+		{"max_buffered_size", uy.MaxBufferedSizeStr, &u.maxBuffered},
+		{"stream_chunk_size", uy.StreamChunkSizeStr, &u.streamChunk},
+	}
+	for _, s := range sizes {
+		if s.str == "" {
+			continue
+		}
+		size, err := ParseSize(s.str)
+		if v.addErr("service.upload."+s.field, err) {
+			*s.dest = size
+		}
+	}
+	if u.minChunkSize < minChunkSize || u.maxChunkSize > 5<<30 || u.minChunkSize > u.maxChunkSize {
+		v.add("service.upload", "must respect "+minLabel+" <= min_chunk_size <= max_chunk_size <= 5 GiB")
+	}
+	if u.maxWholeSize > 5<<30 {
+		v.add("service.upload.max_whole_size", "must be at most 5 GiB")
+	}
+	if u.wholeThreshold > u.maxWholeSize {
+		v.add("service.upload.whole_threshold", "must be at most service.upload.max_whole_size")
+	}
+	if u.maxBuffered > u.maxWholeSize {
+		v.add("service.upload.max_buffered_size", "must be at most service.upload.max_whole_size")
+	}
+	if u.streamChunk < 4<<10 || u.streamChunk > 5<<30 {
+		v.add("service.upload.stream_chunk_size", "must be between 4 KiB and 5 GiB")
+	}
+	switch uy.Compression {
+	case "":
+	case "none", "zstd", "gzip":
+		u.compression = uy.Compression
+	default:
+		v.add("service.upload.compression", fmt.Sprintf("unknown compression [%s], use [none, zstd, gzip]", uy.Compression))
+	}
+	return u
+}
+
+// newLimits converts the limits of the clients. The bursts default to one second
+// of their rate (at least one request) and can only be given with it.
+func newLimits(ly LimitsYml, v *validation) Limits {
+	l := Limits{requestsPerSecond: ly.RequestsPerSecond, requestBurst: ly.RequestBurst, maxTransfers: ly.MaxTransfers}
+	if l.requestsPerSecond < 0 {
+		v.add("service.limits.requests_per_second", "must be positive")
+	}
+	switch {
+	case l.requestBurst < 0:
+		v.add("service.limits.request_burst", "must be positive")
+	case l.requestBurst != 0 && l.requestsPerSecond == 0:
+		v.add("service.limits.request_burst", "requires service.limits.requests_per_second")
+	case l.requestBurst == 0 && l.requestsPerSecond > 0:
+		l.requestBurst = max(int(math.Ceil(l.requestsPerSecond)), 1)
+	}
+	var err error
+	if ly.BytesPerSecondStr != "" {
+		l.bytesPerSecond, err = ParseSize(ly.BytesPerSecondStr)
+		v.addErr("service.limits.bytes_per_second", err)
+	}
+	if ly.BytesBurstStr != "" {
+		l.bytesBurst, err = ParseSize(ly.BytesBurstStr)
+		if v.addErr("service.limits.bytes_burst", err) && l.bytesBurst != 0 && l.bytesPerSecond == 0 {
+			v.add("service.limits.bytes_burst", "requires service.limits.bytes_per_second")
+		}
+	}
+	if l.bytesBurst == 0 {
+		l.bytesBurst = l.bytesPerSecond
+	}
+	if l.maxTransfers < 0 {
+		v.add("service.limits.max_transfers", "must be positive")
+	}
+	return l
+}
+
+// parseDuration parses the duration of the field in Go format, def is returned if s is empty.
+func parseDuration(v *validation, field, s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		v.add(field, fmt.Sprintf("cannot parse [%s] as a duration (e.g. 30s, 5m, 1h)", s))
+		return def
+	}
+	return d
+}
+
+// newTLS converts the tls section of the service configuration.
+// The certificate and the key must be given together. The minimum version
+// defaults to TLS 1.2 and the files are checked for changes every 30s.
+func newTLS(ty TLSYml, v *validation) TLS {
+	t := TLS{certFile: ty.CertFile, keyFile: ty.KeyFile, clientCAFile: ty.ClientCAFile}
+	if (ty.CertFile == "") != (ty.KeyFile == "") {
+		v.add("service.tls", "cert_file and key_file must be given together")
+	}
+	if ty.ClientCAFile != "" && ty.CertFile == "" {
+		v.add("service.tls.client_ca_file", "requires service.tls.cert_file and service.tls.key_file")
+	}
+	var err error
+	t.minVersion, err = tlsconf.ParseVersion(ty.MinVersion)
+	v.addErr("service.tls.min_version", err)
+	t.reloadInterval = parseDuration(v, "service.tls.reload_interval", ty.ReloadStr, 30*time.Second)
+	if t.reloadInterval <= 0 {
+		v.add("service.tls.reload_interval", "must be greater than 0")
+	}
+	return t
+}
+
+// newMinIoTransport converts the transport section of the MinIo configuration.
+func newMinIoTransport(ty MinIoTransportYml, v *validation) MinIoTransport {
+	t := MinIoTransport{maxIdleConns: ty.MaxIdleConns, maxIdleConnsPerHost: ty.MaxIdleConnsPerHost, proxy: ty.Proxy}
+	if ty.MaxIdleConns < 0 {
+		v.add("minio.transport.max_idle_conns", "must be positive")
+	}
+	if ty.MaxIdleConnsPerHost < 0 {
+		v.add("minio.transport.max_idle_conns_per_host", "must be positive")
+	}
+	durations := []struct {
+		field string
+		str   string
+		dest  *time.Duration
+	}{
+		{"dial_timeout", ty.DialTimeoutStr, &t.dialTimeout},
+		{"tls_handshake_timeout", ty.TLSHandshakeTimeoutStr, &t.tlsHandshakeTimeout},
+		{"response_header_timeout", ty.ResponseHeaderTimeoutStr, &t.responseHeaderTimeout},
+		{"idle_conn_timeout", ty.IdleConnTimeoutStr, &t.idleConnTimeout},
+	}
+	for _, d := range durations {
+		field := "minio.transport." + d.field
+		if *d.dest = parseDuration(v, field, d.str, 0); *d.dest < 0 {
+			v.add(field, "must be positive")
+		}
+	}
+	if ty.Proxy != "" {
+		if u, err := url.Parse(ty.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			v.add("minio.transport.proxy", fmt.Sprintf("[%s] is not an absolute url", ty.Proxy))
+		}
+	}
+	return t
+}
+
+// newCredentials converts the chain of credential sources of the MinIo configuration.
+func newCredentials(cys []CredentialsYml, v *validation) []Credentials {
+	res := make([]Credentials, len(cys))
+	for i, cy := range cys {
+		field := fmt.Sprintf("minio.credentials[%d]", i)
+		c := Credentials{
+			typ: cy.Type, accessKey: cy.AccessKey, secretKey: cy.SecretKey, path: cy.Path, profile: cy.Profile,
+			endpoint: cy.Endpoint, tokenFile: cy.TokenFile, roleARN: cy.RoleARN,
+		}
+		switch cy.Type {
+		case "static":
+			if cy.AccessKey == "" || cy.SecretKey == "" {
+				v.add(field, "access_key and secret_key are required")
+			}
+		case "env", "iam":
+		case "aws_file", "file":
+			if cy.Path == "" && cy.Type == "file" {
+				v.add(field+".path", "is required")
+			}
+		case "web_identity":
+			if cy.Endpoint == "" || cy.TokenFile == "" {
+				v.add(field, "endpoint and token_file are required")
+			}
+			c.duration = parseDuration(v, field+".duration", cy.DurationStr, 0)
+		default:
+			v.add(field+".type", fmt.Sprintf("unknown type [%s], use [static, env, aws_file, file, iam, web_identity]", cy.Type))
+		}
+		res[i] = c
+	}
+	return res
+}
+
+// newJanitor converts the janitor section of the configuration file.
+// The interval defaults to 1h and the maximum age of an upload to 24h.
+func newJanitor(jy JanitorYml, v *validation) Janitor {
+	j := Janitor{enabled: jy.Enabled, dryRun: jy.DryRun}
+	if j.interval = parseDuration(v, "janitor.interval", jy.IntervalStr, time.Hour); j.interval <= 0 {
+		v.add("janitor.interval", "must be greater than 0")
+	}
+	if j.maxAge = parseDuration(v, "janitor.max_age", jy.MaxAgeStr, 24*time.Hour); j.maxAge <= 0 {
+		v.add("janitor.max_age", "must be greater than 0")
+	}
+	return j
 }
 
 // GetCurrent gives the current config. This method panic if NewConfig has not been called before without error
 func GetCurrent() *Config {
-	if currentConfig == nil {
+	cfg := currentConfig.Load()
+	if cfg == nil {
 		panic(errs.New("config not loaded"))
 	}
-	return currentConfig
+	return cfg
 }
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"os"
+)
+
+// Index is the local metadata index of the service.
+type Index struct {
+	path string
+}
+
+func (c *Config) Index() *Index { return &c.index }
+
+// Path gives the file of the index, "" if the service runs without index.
+func (i *Index) Path() string { return i.path }
+
+// Dedup is the deduplication of the identical uploads.
+type Dedup struct {
+	enabled bool
+	key     [32]byte
+}
+
+func (s *Service) Dedup() *Dedup { return &s.dedup }
+
+// Enabled tells if the identical uploads are stored once in a shared blob.
+func (d *Dedup) Enabled() bool { return d.enabled }
+
+// Key gives the key of the HMAC naming the blobs.
+func (d *Dedup) Key() [32]byte { return d.key }
+
+// newDedup converts the deduplication settings. When enabled, the key of the HMAC is
+// given by exactly one of key (hex), key_file or key_env, and the index is required
+// to count the references of the blobs.
+func newDedup(dy DedupYml, iy IndexYml, v *validation) Dedup {
+	d := Dedup{enabled: dy.Enabled}
+	if !d.enabled {
+		return d
+	}
+	if iy.Path == "" {
+		v.add("index.path", "is required by service.dedup")
+	}
+	d.key = newHMACKey("service.dedup", dy.Key, dy.KeyFile, dy.KeyEnv, v)
+	return d
+}
+
+// Obfuscation is the obfuscation of the names of the objects in the buckets.
+type Obfuscation struct {
+	enabled bool
+	key     [32]byte
+}
+
+func (s *Service) Obfuscation() *Obfuscation { return &s.obfuscation }
+
+// Enabled tells if the objects are stored under an HMAC of their name.
+func (o *Obfuscation) Enabled() bool { return o.enabled }
+
+// Key gives the key of the HMAC of the names, from which the key encrypting the
+// names is also derived.
+func (o *Obfuscation) Key() [32]byte { return o.key }
+
+// newObfuscation converts the obfuscation settings. When enabled, the key is given by
+// exactly one of key (hex), key_file or key_env.
+func newObfuscation(oy ObfuscationYml, v *validation) Obfuscation {
+	o := Obfuscation{enabled: oy.Enabled}
+	if o.enabled {
+		o.key = newHMACKey("service.obfuscation", oy.Key, oy.KeyFile, oy.KeyEnv, v)
+	}
+	return o
+}
+
+// newHMACKey reads the key of the section given by exactly one of key (hex), keyFile
+// or keyEnv.
+func newHMACKey(section, key, keyFile, keyEnv string, v *validation) [32]byte {
+	var res [32]byte
+	sources := 0
+	for _, s := range []string{key, keyFile, keyEnv} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		v.add(section, "exactly one of key, key_file or key_env is required")
+		return res
+	}
+	var err error
+	switch {
+	case key != "":
+		res, err = decodeHexKey(key)
+		v.addErr(section+".key", err)
+	case keyFile != "":
+		res, err = readKeyFile(keyFile)
+		v.addErr(section+".key_file", err)
+	default:
+		value, ok := os.LookupEnv(keyEnv)
+		if !ok {
+			v.add(section+".key_env", fmt.Sprintf("environment variable %s not set for the key of %s", keyEnv, section))
+			break
+		}
+		res, err = decodeHexKey(value)
+		v.addErr(section+".key_env", err)
+	}
+	return res
+}
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// Sources of the master key
+const (
+	KeySourceConfig = "config" // hex key in service.aes_encryption_key (default)
+	KeySourceFile   = "file"   // key file, must not be readable by group or others
+	KeySourceEnv    = "env"    // hex key in an environment variable
+	KeySourceVault  = "vault"  // HashiCorp Vault Transit, the service never holds the master key
+)
+
+// DefaultKeyEnv is the environment variable read by the env key source if none is configured.
+const DefaultKeyEnv = "TAURUS_AES_KEY"
+
+// Key is the configuration of the master key wrapping the data keys of the objects.
+type Key struct {
+	source string
+	id     string
+	vault  Vault
+	ring   []RingKey
+}
+
+func (k *Key) Source() string { return k.source }
+func (k *Key) ID() string     { return k.id }
+func (k *Key) Vault() *Vault  { return &k.vault }
+
+// Ring gives the previous master keys, only used to decrypt the existing objects.
+func (k *Key) Ring() []RingKey { return k.ring }
+
+// RingKey is a previous master key kept to decrypt the objects it encrypted.
+type RingKey struct {
+	id  string
+	key [32]byte
+}
+
+func (r *RingKey) ID() string    { return r.id }
+func (r *RingKey) Key() [32]byte { return r.key }
+
+// Vault is the configuration of the Vault Transit key source.
+type Vault struct {
+	address   string
+	mount     string
+	keyName   string
+	token     string
+	tokenFile string
+	caFile    string
+	timeout   time.Duration
+}
+
+func (v *Vault) Address() string        { return v.address }
+func (v *Vault) Mount() string          { return v.mount }
+func (v *Vault) KeyName() string        { return v.keyName }
+func (v *Vault) Token() string          { return v.token }
+func (v *Vault) TokenFile() string      { return v.tokenFile }
+func (v *Vault) CAFile() string         { return v.caFile }
+func (v *Vault) Timeout() time.Duration { return v.timeout }
+
+// newKey converts the key configuration and loads the master key if it is held by the service.
+// The master key is returned only for the sources config, file and env. The section is
+// the path of the parent of the key configuration (service, tenants[0]) and aesKey the
+// value of its aes_encryption_key.
+func newKey(section string, ky KeyYml, aesKey string, v *validation) (Key, [32]byte) {
+	k := Key{source: ky.Source, id: ky.ID}
+	if k.source == "" {
+		k.source = KeySourceConfig
+	}
+	if k.id == "" {
+		k.id = "default"
+	}
+	validateKeyID(v, section+".key.id", k.id)
+	var master [32]byte
+	var err error
+	switch k.source {
+	case KeySourceConfig:
+		master, err = decodeHexKey(aesKey)
+		v.addErr(section+".aes_encryption_key", err)
+	case KeySourceFile:
+		if ky.File == "" {
+			v.add(section+".key.file", "is required for the file key source")
+			break
+		}
+		master, err = readKeyFile(ky.File)
+		v.addErr(section+".key.file", err)
+	case KeySourceEnv:
+		name := ky.Env
+		if name == "" {
+			name = DefaultKeyEnv
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			v.add(section+".key.env", fmt.Sprintf("environment variable %s not set for the aes key", name))
+			break
+		}
+		master, err = decodeHexKey(value)
+		v.addErr(section+".key.env", err)
+	case KeySourceVault:
+		k.vault = newVault(section+".key.vault", ky.Vault, v)
+	default:
+		v.add(section+".key.source", fmt.Sprintf("unknown key source [%s], use [config, file, env, vault]", k.source))
+	}
+	k.ring = newRing(section+".key.ring", ky.Ring, k, v)
+	return k, master
+}
+
+// validateKeyID checks that id can identify a local master key.
+func validateKeyID(v *validation, field, id string) {
+	if id == "" {
+		v.add(field, "is required")
+	} else if strings.Contains(id, ":") {
+		v.add(field, fmt.Sprintf("[%s] must not contain ':'", id))
+	}
+}
+
+// newRing loads the previous master keys. Each of them is given by exactly one
+// of key (hex), file or env. The ids must be unique and differ from the active one.
+func newRing(section string, rys []RingKeyYml, active Key, v *validation) []RingKey {
+	res := make([]RingKey, len(rys))
+	seen := map[string]bool{}
+	if active.source != KeySourceVault {
+		seen[active.id] = true
+	}
+	for i, ry := range rys {
+		field := fmt.Sprintf("%s[%d]", section, i)
+		validateKeyID(v, field+".id", ry.ID)
+		if seen[ry.ID] {
+			v.add(field+".id", fmt.Sprintf("key [%s] given twice", ry.ID))
+		}
+		seen[ry.ID] = true
+		given := 0
+		for _, s := range []string{ry.Key, ry.File, ry.Env} {
+			if s != "" {
+				given++
+			}
+		}
+		if given != 1 {
+			v.add(field, "exactly one of key, file and env is required")
+			continue
+		}
+		var err error
+		switch {
+		case ry.Key != "":
+			res[i].key, err = decodeHexKey(ry.Key)
+			v.addErr(field+".key", err)
+		case ry.File != "":
+			res[i].key, err = readKeyFile(ry.File)
+			v.addErr(field+".file", err)
+		default:
+			value, ok := os.LookupEnv(ry.Env)
+			if !ok {
+				v.add(field+".env", fmt.Sprintf("environment variable %s not set", ry.Env))
+				continue
+			}
+			res[i].key, err = decodeHexKey(value)
+			v.addErr(field+".env", err)
+		}
+		res[i].id = ry.ID
+	}
+	return res
+}
+
+// newVault converts the Vault Transit configuration. If neither a token nor a
+// token file is given, the token is read from the VAULT_TOKEN environment variable.
+func newVault(section string, vy VaultYml, v *validation) Vault {
+	vc := Vault{
+		address: vy.Address, mount: vy.Mount, keyName: vy.KeyName,
+		token: vy.Token, tokenFile: vy.TokenFile, caFile: vy.CAFile,
+	}
+	if vc.address == "" {
+		v.add(section+".address", "is required for the vault key source")
+	} else if u, err := url.Parse(vc.address); err != nil || u.Scheme == "" || u.Host == "" {
+		v.add(section+".address", fmt.Sprintf("[%s] is not an absolute url", vc.address))
+	}
+	if vc.keyName == "" {
+		v.add(section+".key_name", "is required for the vault key source")
+	}
+	if vc.token == "" && vc.tokenFile == "" {
+		vc.token = os.Getenv("VAULT_TOKEN")
+		if vc.token == "" {
+			v.add(section+".token_file", "token_file, token or VAULT_TOKEN is required")
+		}
+	}
+	if vc.timeout = parseDuration(v, section+".timeout", vy.TimeoutStr, 0); vc.timeout < 0 {
+		v.add(section+".timeout", "must be positive")
+	}
+	return vc
+}
+
+// decodeHexKey decodes a hex encoded AES 256 key.
+func decodeHexKey(s string) (key [32]byte, err error) {
+	if s == "" {
+		return key, errs.New("the aes key is empty")
+	}
+	skey, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return key, errs.New("the aes key is not in hex format")
+	}
+	if len(skey) != len(key) {
+		return key, errs.New(fmt.Sprintf("the aes key must be 32 bytes (64 hex characters), got %d bytes", len(skey)))
+	}
+	copy(key[:], skey)
+	return key, nil
+}
+
+// readKeyFile reads the master key from a file. The file contains either the
+// raw 32 bytes of the key or its hex encoding. It must not be accessible by the
+// group or the others.
+func readKeyFile(path string) (key [32]byte, err error) {
+	s, err := os.Stat(path)
+	if err != nil {
+		return key, err
+	}
+	if s.Mode().Perm()&0o077 != 0 {
+		return key, errs.New(fmt.Sprintf("key file %s has permissions %s, it must not be accessible by group or others (e.g. 0600)",
+			path, s.Mode().Perm()))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return key, err
+	}
+	if len(data) == 32 {
+		copy(key[:], data)
+		return key, nil
+	}
+	return decodeHexKey(string(data))
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ag0st/taurus-challenge/errs"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the configuration.
+// The name of the variable is the path of the field in upper case, with "_" instead
+// of ".": minio.endpoint is overridden by TAURUS_MINIO_ENDPOINT.
+const EnvPrefix = "TAURUS_"
+
+// redacted replaces the secrets when printing the configuration.
+const redacted = "<redacted>"
+
+var (
+	// flagOverrides stores the values given with the flags, by field path.
+	flagOverrides = map[string]string{}
+	// printConfig is set by the flag -print-config.
+	printConfig bool
+)
+
+// field is a leaf of the ConfigYml structure that can be overridden.
+type field struct {
+	path   string        // path of the field, as in the yaml file: service.address
+	value  reflect.Value // settable value of the field
+	secret bool          // tagged `secret:"true"`, never given as a flag
+}
+
+// fields lists the fields of the configuration that can be overridden. The lists
+// (minio.credentials) can only be given in the configuration file.
+func fields(v reflect.Value, prefix string) []field {
+	var res []field
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.Struct:
+			res = append(res, fields(fv, path+".")...)
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Float64:
+			res = append(res, field{path: path, value: fv, secret: t.Field(i).Tag.Get("secret") == "true"})
+		}
+	}
+	return res
+}
+
+// envName gives the name of the environment variable overriding the field at path.
+func envName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// set parses raw regarding the type of the field and sets it.
+func (f field) set(raw string) error {
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errs.New(fmt.Sprintf("cannot parse [%s] as a boolean", raw))
+		}
+		f.value.SetBool(b)
+	case reflect.Int:
+		i, err := strconv.Atoi(raw)
+		if err != nil {
+			return errs.New(fmt.Sprintf("cannot parse [%s] as an integer", raw))
+		}
+		f.value.SetInt(int64(i))
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return errs.New(fmt.Sprintf("cannot parse [%s] as a number", raw))
+		}
+		f.value.SetFloat(x)
+	}
+	return nil
+}
+
+// registerFieldFlags registers a flag for each field of the configuration on fs.
+// The values given are stored in flagOverrides. The secrets have no flag: the
+// arguments of the process are readable by the other users of the host and
+// published with the metrics, they are only given by the file or the environment.
+func registerFieldFlags(fs *flag.FlagSet) {
+	for _, f := range fields(reflect.ValueOf(&ConfigYml{}).Elem(), "") {
+		if f.secret {
+			continue
+		}
+		path := f.path
+		usage := fmt.Sprintf("overrides %s (env %s)", path, envName(path))
+		store := func(s string) error {
+			flagOverrides[path] = s
+			return nil
+		}
+		if f.value.Kind() == reflect.Bool {
+			fs.BoolFunc(path, usage, store)
+		} else {
+			fs.Func(path, usage, store)
+		}
+	}
+}
+
+// applyOverrides overrides the values of the configuration file, first with the
+// environment variables and then with the flags. The values that cannot be parsed
+// are reported to v.
+func applyOverrides(cy *ConfigYml, v *validation) {
+	for _, f := range fields(reflect.ValueOf(cy).Elem(), "") {
+		if raw, ok := os.LookupEnv(envName(f.path)); ok {
+			v.addErr(f.path, errs.Wrap(f.set(raw), "environment variable "+envName(f.path)))
+		}
+		if raw, ok := flagOverrides[f.path]; ok {
+			v.addErr(f.path, errs.Wrap(f.set(raw), "flag -"+f.path))
+		}
+	}
+}
+
+// PrintRequested tells if the flag -print-config has been given.
+func PrintRequested() bool { return printConfig }
+
+// Print writes the effective configuration (file, environment variables and flags)
+// in YAML format into w. The secrets are redacted.
+func (c *Config) Print(w io.Writer) error {
+	cy := c.yml
+	redact(reflect.ValueOf(&cy).Elem())
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(cy); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redact replaces the non empty values of the fields tagged `secret:"true"`.
+// The slices are copied before being modified, the caller must give a copy of
+// the structure.
+func redact(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.Struct:
+			redact(fv)
+		case reflect.Slice:
+			cp := reflect.MakeSlice(fv.Type(), fv.Len(), fv.Len())
+			reflect.Copy(cp, fv)
+			fv.Set(cp)
+			for j := 0; j < cp.Len(); j++ {
+				if cp.Index(j).Kind() == reflect.Struct {
+					redact(cp.Index(j))
+				}
+			}
+		case reflect.String:
+			if t.Field(i).Tag.Get("secret") == "true" && fv.String() != "" {
+				fv.SetString(redacted)
+			}
+		}
+	}
+}
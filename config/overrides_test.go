@@ -0,0 +1,96 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `service:
+  address: ':8080'
+  chunk_size: 0 B
+  aes_encryption_key: 000102030405060708090A0B0C0D0E0FF0E0D0C0B0A090807060504030201000
+minio:
+  access_key: 'access'
+  secret_key: 'secret'
+  endpoint: '127.0.0.1:9000'
+  bucket: 'testbucket'
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("cannot write the configuration: %v", err)
+	}
+	return path
+}
+
+// TestOverridesPrecedence tests that the environment variables override the file
+// and that the flags override the environment variables.
+func TestOverridesPrecedence(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	t.Setenv("TAURUS_MINIO_ENDPOINT", "env:9000")
+	t.Setenv("TAURUS_MINIO_BUCKET", "envbucket")
+	t.Setenv("TAURUS_MINIO_SECURE", "true")
+	t.Setenv("TAURUS_MINIO_TRANSPORT_MAX_IDLE_CONNS", "12")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFieldFlags(fs)
+	t.Cleanup(func() { flagOverrides = map[string]string{} })
+	if err := fs.Parse([]string{"-minio.bucket", "flagbucket", "-service.chunk_size", "6 MiB"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg, err := NewConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Minio().Endpoint() != "env:9000" || !cfg.Minio().Secure() || cfg.Minio().Transport().MaxIdleConns() != 12 {
+		t.Fatalf("environment not applied: %s, %v, %d", cfg.Minio().Endpoint(), cfg.Minio().Secure(), cfg.Minio().Transport().MaxIdleConns())
+	}
+	if cfg.Minio().Bucket() != "flagbucket" || cfg.Service().ChunkSize() != 6<<20 {
+		t.Fatalf("flags not applied: %s, %d", cfg.Minio().Bucket(), cfg.Service().ChunkSize())
+	}
+	if cfg.Service().Address() != ":8080" {
+		t.Fatalf("expected the address of the file, got %s", cfg.Service().Address())
+	}
+	for _, secret := range []string{"minio.secret_key", "service.aes_encryption_key", "service.dedup.key", "service.key.vault.token"} {
+		if fs.Lookup(secret) != nil {
+			t.Fatalf("the secret %s must not be given as a flag", secret)
+		}
+	}
+
+	t.Setenv("TAURUS_MINIO_SECURE", "maybe")
+	if _, err := NewConfig(path); err == nil {
+		t.Fatal("expected an error with an invalid boolean")
+	}
+}
+
+// TestPrintRedacted tests that the secrets are not printed.
+func TestPrintRedacted(t *testing.T) {
+	cfg, err := NewConfig(writeConfig(t, testConfig+"  credentials:\n    - type: static\n      access_key: a\n      secret_key: credsecret\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := cfg.Print(&buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"secret'", "secret\n", "credsecret", "000102030405"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("secret %q printed:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "endpoint: 127.0.0.1:9000") || strings.Count(out, redacted) != 3 {
+		t.Fatalf("unexpected output:\n%s", out)
+	}
+	// printing must not alter the configuration
+	if cfg.yml.MinIo.Credentials[0].SecretKey != "credsecret" {
+		t.Fatal("the configuration has been redacted")
+	}
+}
@@ -0,0 +1,76 @@
+package config
+
+import "fmt"
+
+// Quotas limits the size of the objects and the storage used per caller and per bucket.
+type Quotas struct {
+	maxObjectSize uint64
+	callerQuota   uint64
+	callers       map[string]uint64
+	buckets       map[string]uint64
+}
+
+// MaxObjectSize gives the maximum size of an uploaded file, 0 means unlimited.
+func (q *Quotas) MaxObjectSize() uint64 { return q.maxObjectSize }
+
+// Caller gives the maximum size stored by the caller in all the buckets, 0 means
+// unlimited. The callers without their own quota get the default one.
+func (q *Quotas) Caller(caller string) uint64 {
+	if quota, ok := q.callers[caller]; ok {
+		return quota
+	}
+	return q.callerQuota
+}
+
+// Bucket gives the maximum size stored in the bucket, 0 means unlimited. The quota
+// of a tenant is the quota of its bucket.
+func (q *Quotas) Bucket(bucket string) uint64 { return q.buckets[bucket] }
+
+// Quotas gives the limits of the uploads.
+func (c *Config) Quotas() *Quotas { return &c.quotas }
+
+// newQuotas converts the quotas of the configuration. The quotas of the tenants are
+// merged with the ones of quotas.buckets, a bucket cannot have both. The buckets must
+// be the one of minio.bucket or of a tenant.
+func newQuotas(qy QuotasYml, defaultBucket string, tenants []Tenant, v *validation) Quotas {
+	q := Quotas{callers: map[string]uint64{}, buckets: map[string]uint64{}}
+	var err error
+	if qy.MaxObjectSizeStr != "" {
+		q.maxObjectSize, err = ParseSize(qy.MaxObjectSizeStr)
+		v.addErr("quotas.max_object_size", err)
+	}
+	if qy.CallerQuotaStr != "" {
+		q.callerQuota, err = ParseSize(qy.CallerQuotaStr)
+		v.addErr("quotas.caller_quota", err)
+	}
+	for i, cy := range qy.Callers {
+		section := fmt.Sprintf("quotas.callers[%d]", i)
+		if cy.Caller == "" {
+			v.add(section+".caller", "is required")
+		} else if _, ok := q.callers[cy.Caller]; ok {
+			v.add(section+".caller", fmt.Sprintf("caller [%s] given twice", cy.Caller))
+		}
+		q.callers[cy.Caller], err = ParseSize(cy.QuotaStr)
+		v.addErr(section+".quota", err)
+	}
+
+	known := map[string]bool{defaultBucket: defaultBucket != ""}
+	for _, t := range tenants {
+		known[t.bucket] = true
+		if t.quota != 0 {
+			q.buckets[t.bucket] = t.quota
+		}
+	}
+	for i, by := range qy.Buckets {
+		section := fmt.Sprintf("quotas.buckets[%d]", i)
+		switch {
+		case !known[by.Bucket]:
+			v.add(section+".bucket", fmt.Sprintf("bucket [%s] is neither minio.bucket nor the bucket of a tenant", by.Bucket))
+		case q.buckets[by.Bucket] != 0:
+			v.add(section+".bucket", fmt.Sprintf("bucket [%s] already has a quota", by.Bucket))
+		}
+		q.buckets[by.Bucket], err = ParseSize(by.QuotaStr)
+		v.addErr(section+".quota", err)
+	}
+	return q
+}
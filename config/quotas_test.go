@@ -0,0 +1,70 @@
+package config
+
+import "testing"
+
+const testQuotas = `quotas:
+  max_object_size: 1 GiB
+  caller_quota: 5 GiB
+  callers:
+    - caller: 'alice'
+      quota: 20 GiB
+  buckets:
+    - bucket: 'testbucket'
+      quota: 50 GiB
+`
+
+func TestQuotas(t *testing.T) {
+	cfg, err := NewConfig(writeConfig(t, testConfig+testTenants+testQuotas))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	q := cfg.Quotas()
+	if q.MaxObjectSize() != 1<<30 {
+		t.Fatalf("expected a max object size of 1 GiB, got %d", q.MaxObjectSize())
+	}
+	if q.Caller("alice") != 20<<30 || q.Caller("bob") != 5<<30 {
+		t.Fatalf("unexpected caller quotas: %d, %d", q.Caller("alice"), q.Caller("bob"))
+	}
+	if q.Bucket("testbucket") != 50<<30 || q.Bucket("acme-files") != 10<<30 || q.Bucket("public-files") != 0 {
+		t.Fatalf("unexpected bucket quotas: %d, %d, %d", q.Bucket("testbucket"), q.Bucket("acme-files"), q.Bucket("public-files"))
+	}
+
+	// no quotas section means no limit
+	cfg, err = NewConfig(writeConfig(t, testConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if q := cfg.Quotas(); q.MaxObjectSize() != 0 || q.Caller("alice") != 0 || q.Bucket("testbucket") != 0 {
+		t.Fatalf("expected no limit without quotas")
+	}
+}
+
+func TestQuotasValidation(t *testing.T) {
+	invalid := `quotas:
+  max_object_size: 1 XB
+  callers:
+    - caller: 'alice'
+      quota: 1 GiB
+    - caller: 'alice'
+      quota: 2 GiB
+  buckets:
+    - bucket: 'unknown'
+      quota: 1 GiB
+    - bucket: 'acme-files'
+      quota: 1 GiB
+`
+	_, err := NewConfig(writeConfig(t, testConfig+testTenants+invalid))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %T: %v", err, err)
+	}
+	want := []string{"quotas.max_object_size", "quotas.callers[1].caller", "quotas.buckets[0].bucket", "quotas.buckets[1].bucket"}
+	if len(verr.Errors) != len(want) {
+		t.Fatalf("expected %d errors, got:\n%v", len(want), err)
+	}
+	for i, fe := range verr.Errors {
+		if fe.Field != want[i] {
+			t.Fatalf("expected an error on %s, got %s", want[i], fe)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package config
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/logging"
+)
+
+// reloadMu serializes the reloads, the readers only use currentConfig.
+var reloadMu sync.Mutex
+
+// Reload reads the configuration again and swaps it with the current one. The new
+// configuration is validated as a whole, on error the current one is kept.
+// The settings that cannot change without a restart (see RestartRequired) keep
+// their current value and a warning is logged for each of them.
+func Reload(configPath string) (*Config, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if old := currentConfig.Load(); old != nil {
+		for _, field := range RestartRequired(old, cfg) {
+			logging.Warnf("change of %s requires a restart, keeping the current value", field)
+		}
+		keepRestartOnly(old, cfg)
+	}
+	currentConfig.Store(cfg)
+	return cfg, nil
+}
+
+// RestartRequired gives the sections of the configuration that differ between
+// old and next and that are only applied at the start of the service.
+func RestartRequired(old, next *Config) []string {
+	var fields []string
+	if old.yml.Service.Address != next.yml.Service.Address {
+		fields = append(fields, "service.address")
+	}
+	if old.yml.Service.AdminAddress != next.yml.Service.AdminAddress {
+		fields = append(fields, "service.admin_address")
+	}
+	if old.yml.Service.WatchIntervalStr != next.yml.Service.WatchIntervalStr {
+		fields = append(fields, "service.config_watch_interval")
+	}
+	if !reflect.DeepEqual(old.yml.Service.TLS, next.yml.Service.TLS) {
+		fields = append(fields, "service.tls")
+	}
+	if !reflect.DeepEqual(old.yml.Service.Dedup, next.yml.Service.Dedup) {
+		fields = append(fields, "service.dedup")
+	}
+	if old.yml.Service.Obfuscation != next.yml.Service.Obfuscation {
+		fields = append(fields, "service.obfuscation")
+	}
+	if !reflect.DeepEqual(old.yml.MinIo, next.yml.MinIo) {
+		fields = append(fields, "minio")
+	}
+	if !reflect.DeepEqual(old.yml.Janitor, next.yml.Janitor) {
+		fields = append(fields, "janitor")
+	}
+	if old.yml.Index != next.yml.Index {
+		fields = append(fields, "index")
+	}
+	return fields
+}
+
+// keepRestartOnly copies the settings only applied at the start from old to next.
+func keepRestartOnly(old, next *Config) {
+	next.service.address, next.yml.Service.Address = old.service.address, old.yml.Service.Address
+	next.service.adminAddress, next.yml.Service.AdminAddress = old.service.adminAddress, old.yml.Service.AdminAddress
+	next.service.watchInterval, next.yml.Service.WatchIntervalStr = old.service.watchInterval, old.yml.Service.WatchIntervalStr
+	next.service.tls, next.yml.Service.TLS = old.service.tls, old.yml.Service.TLS
+	next.service.dedup, next.yml.Service.Dedup = old.service.dedup, old.yml.Service.Dedup
+	next.service.obfuscation, next.yml.Service.Obfuscation = old.service.obfuscation, old.yml.Service.Obfuscation
+	next.minio, next.yml.MinIo = old.minio, old.yml.MinIo
+	next.janitor, next.yml.Janitor = old.janitor, old.yml.Janitor
+	next.index, next.yml.Index = old.index, old.yml.Index
+}
+
+// Watch reloads the configuration each time a signal is received on trigger and,
+// if interval > 0, when the modification time of the configuration file changes.
+// onReload is called with the new configuration after each successful reload, it
+// applies the settings changeable at runtime. Watch returns when ctx is done.
+func Watch(ctx context.Context, configPath string, interval time.Duration, trigger <-chan os.Signal, onReload func(*Config) error) {
+	var tick <-chan time.Time
+	var mod time.Time
+	if configPath != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		mod = modTime(configPath)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+		case <-tick:
+			m := modTime(configPath)
+			if m.Equal(mod) {
+				continue
+			}
+			mod = m
+		}
+		cfg, err := Reload(configPath)
+		if err != nil {
+			logging.Errorf("cannot reload the configuration, keeping the current one: %v", err)
+			continue
+		}
+		if onReload != nil {
+			if err := onReload(cfg); err != nil {
+				logging.Errorf("cannot apply the reloaded configuration: %v", err)
+				continue
+			}
+		}
+		logging.Infof("configuration reloaded")
+	}
+}
+
+// modTime gives the modification time of the file, the zero time if it cannot be read.
+func modTime(path string) time.Time {
+	s, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return s.ModTime()
+}
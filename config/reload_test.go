@@ -0,0 +1,108 @@
+package config
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/logging"
+)
+
+// TestReload tests that the runtime settings are applied and that the ones
+// requiring a restart keep their current value.
+func TestReload(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	if _, err := NewConfig(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	changed := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 8 MiB\n  log_level: debug", 1)
+	changed = strings.Replace(changed, "':8080'", "':9090'", 1)
+	changed = strings.Replace(changed, "testbucket", "otherbucket", 1)
+	if err := os.WriteFile(path, []byte(changed), 0o600); err != nil {
+		t.Fatalf("cannot write the configuration: %v", err)
+	}
+	cfg, err := Reload(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if GetCurrent() != cfg {
+		t.Fatalf("the reloaded configuration is not the current one")
+	}
+	if cfg.Service().ChunkSize() != 8<<20 || cfg.Service().LogLevel() != logging.LevelDebug {
+		t.Fatalf("runtime settings not applied: %d, %s", cfg.Service().ChunkSize(), cfg.Service().LogLevel())
+	}
+	if cfg.Service().Address() != ":8080" || cfg.Minio().Bucket() != "testbucket" {
+		t.Fatalf("restart settings changed: %s, %s", cfg.Service().Address(), cfg.Minio().Bucket())
+	}
+
+	// an invalid configuration is rejected as a whole
+	invalid := strings.Replace(changed, "chunk_size: 8 MiB", "chunk_size: 1 MiB", 1)
+	if err := os.WriteFile(path, []byte(invalid), 0o600); err != nil {
+		t.Fatalf("cannot write the configuration: %v", err)
+	}
+	if _, err := Reload(path); err == nil {
+		t.Fatalf("expected an error for an invalid chunk size")
+	}
+	if GetCurrent() != cfg {
+		t.Fatalf("the current configuration changed after an invalid reload")
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	old, err := load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	next, err := load(writeConfig(t, strings.Replace(testConfig, "':8080'", "':9090'", 1)+"janitor:\n  enabled: true\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fields := RestartRequired(old, next)
+	if strings.Join(fields, ",") != "service.address,janitor" {
+		t.Fatalf("unexpected fields requiring a restart: %v", fields)
+	}
+}
+
+// TestWatch tests that the configuration is reloaded on a signal and when the file changes.
+func TestWatch(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	if _, err := NewConfig(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trigger := make(chan os.Signal, 1)
+	reloaded := make(chan *Config, 1)
+	go Watch(ctx, path, 10*time.Millisecond, trigger, func(cfg *Config) error {
+		reloaded <- cfg
+		return nil
+	})
+
+	trigger <- os.Interrupt
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatalf("no reload on signal")
+	}
+
+	changed := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 6 MiB", 1)
+	if err := os.WriteFile(path, []byte(changed), 0o600); err != nil {
+		t.Fatalf("cannot write the configuration: %v", err)
+	}
+	// make sure the modification time changes on coarse file systems
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("cannot change the modification time: %v", err)
+	}
+	select {
+	case cfg := <-reloaded:
+		if cfg.Service().ChunkSize() != 6<<20 {
+			t.Fatalf("expected the new chunk size, got %d", cfg.Service().ChunkSize())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no reload on file change")
+	}
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultTenantName is the name of the tenant built from minio.bucket and the
+// service settings. It is used by the callers not assigned to a tenant.
+const DefaultTenantName = "default"
+
+// tenantNameRe is the format of the names of the tenants, used in the paths of the API.
+var tenantNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Tenant is a set of callers sharing a bucket, a chunk size, a master key and a quota.
+type Tenant struct {
+	name      string
+	bucket    string
+	chunkSize uint64
+	autoChunk bool
+	quota     uint64
+	callers   []string
+	key       *Key
+	aesKey    [32]byte
+}
+
+func (t *Tenant) Name() string      { return t.name }
+func (t *Tenant) Bucket() string    { return t.bucket }
+func (t *Tenant) ChunkSize() uint64 { return t.chunkSize }
+
+// AutoChunk tells if the chunk size is chosen for each upload (see Service.AutoChunk).
+func (t *Tenant) AutoChunk() bool { return t.autoChunk }
+
+// Quota gives the maximum size stored in the bucket of the tenant, 0 means unlimited.
+func (t *Tenant) Quota() uint64 { return t.quota }
+
+// Callers gives the identities assigned to the tenant.
+func (t *Tenant) Callers() []string { return t.callers }
+
+// Key gives the configuration of the master key of the tenant, nil if the tenant
+// uses the key of the service.
+func (t *Tenant) Key() *Key { return t.key }
+
+// AESKey gives the master key of the tenant if it is held by the service
+// (see Service.AESKey).
+func (t *Tenant) AESKey() [32]byte { return t.aesKey }
+
+// Allows tells if the caller can access the tenant. A tenant without callers
+// is open to everyone.
+func (t *Tenant) Allows(caller string) bool {
+	if len(t.callers) == 0 {
+		return true
+	}
+	for _, c := range t.callers {
+		if c == caller {
+			return true
+		}
+	}
+	return false
+}
+
+// Tenants gives the tenants defined in the configuration, without the default one.
+func (c *Config) Tenants() []Tenant { return c.tenants }
+
+// DefaultTenant gives the tenant built from minio.bucket and the service settings,
+// nil if minio.bucket is not set.
+func (c *Config) DefaultTenant() *Tenant {
+	if c.minio.bucket == "" {
+		return nil
+	}
+	return &Tenant{name: DefaultTenantName, bucket: c.minio.bucket, chunkSize: c.service.chunkSize, autoChunk: c.service.autoChunk}
+}
+
+// Tenant gives the tenant with the given name, nil if it does not exist.
+func (c *Config) Tenant(name string) *Tenant {
+	if name == DefaultTenantName {
+		return c.DefaultTenant()
+	}
+	for i := range c.tenants {
+		if c.tenants[i].name == name {
+			return &c.tenants[i]
+		}
+	}
+	return nil
+}
+
+// TenantForCaller gives the tenant the caller is assigned to, the default tenant
+// if the caller is not assigned to any. It returns nil if there is no default tenant.
+func (c *Config) TenantForCaller(caller string) *Tenant {
+	for i := range c.tenants {
+		for _, cl := range c.tenants[i].callers {
+			if cl == caller {
+				return &c.tenants[i]
+			}
+		}
+	}
+	return c.DefaultTenant()
+}
+
+// newTenants converts the tenants of the configuration. The names, the buckets and
+// the callers must be unique. The chunk size defaults to the one of the service and
+// the key to the key of the service.
+func newTenants(tys []TenantYml, defaultBucket string, defaultChunkSize uint64, defaultAuto bool, up Upload, v *validation) []Tenant {
+	res := make([]Tenant, len(tys))
+	names := map[string]bool{}
+	buckets := map[string]bool{defaultBucket: defaultBucket != ""}
+	callers := map[string]string{}
+	for i, ty := range tys {
+		section := fmt.Sprintf("tenants[%d]", i)
+		t := Tenant{name: ty.Name, bucket: ty.Bucket, chunkSize: defaultChunkSize, autoChunk: defaultAuto, callers: ty.Callers}
+
+		switch {
+		case !tenantNameRe.MatchString(ty.Name):
+			v.add(section+".name", fmt.Sprintf("[%s] must match %s", ty.Name, tenantNameRe))
+		case ty.Name == DefaultTenantName || ty.Name == "file":
+			v.add(section+".name", fmt.Sprintf("[%s] is reserved", ty.Name))
+		case names[ty.Name]:
+			v.add(section+".name", fmt.Sprintf("tenant [%s] given twice", ty.Name))
+		}
+		names[ty.Name] = true
+
+		validateBucket(v, section+".bucket", ty.Bucket)
+		if buckets[ty.Bucket] {
+			v.add(section+".bucket", fmt.Sprintf("bucket [%s] used by another tenant", ty.Bucket))
+		}
+		buckets[ty.Bucket] = true
+
+		for _, c := range ty.Callers {
+			if other, ok := callers[c]; ok {
+				v.add(section+".callers", fmt.Sprintf("caller [%s] already assigned to tenant [%s]", c, other))
+			}
+			callers[c] = ty.Name
+		}
+
+		if ty.ChunkSizeStr != "" {
+			t.chunkSize, t.autoChunk = parseChunkSize(v, section+".chunk_size", ty.ChunkSizeStr, up)
+		}
+		if ty.QuotaStr != "" {
+			var err error
+			t.quota, err = ParseSize(ty.QuotaStr)
+			v.addErr(section+".quota", err)
+		}
+		if ty.Key.Source != "" || ty.AESEncryptionKey != "" {
+			k, master := newKey(section, ty.Key, ty.AESEncryptionKey, v)
+			t.key, t.aesKey = &k, master
+		}
+		res[i] = t
+	}
+	return res
+}
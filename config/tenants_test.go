@@ -0,0 +1,85 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const testTenants = `tenants:
+  - name: 'acme'
+    bucket: 'acme-files'
+    chunk_size: 8 MiB
+    quota: 10 GiB
+    callers: ['alice', 'bob']
+    aes_encryption_key: 0F0E0D0C0B0A09080706050403020100000102030405060708090A0B0C0D0E0F
+  - name: 'public'
+    bucket: 'public-files'
+`
+
+func TestTenants(t *testing.T) {
+	cfg, err := NewConfig(writeConfig(t, testConfig+testTenants))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	acme := cfg.TenantForCaller("alice")
+	if acme == nil || acme.Name() != "acme" || acme.Bucket() != "acme-files" {
+		t.Fatalf("alice must be assigned to acme, got %+v", acme)
+	}
+	if acme.ChunkSize() != 8<<20 || acme.Quota() != 10<<30 || acme.Key() == nil || acme.AESKey()[0] != 0x0F {
+		t.Fatalf("unexpected settings of acme: %d, %d, %v", acme.ChunkSize(), acme.Quota(), acme.Key())
+	}
+	if acme.Allows("carol") || !acme.Allows("bob") {
+		t.Fatalf("only the callers of acme must be allowed")
+	}
+
+	def := cfg.TenantForCaller("carol")
+	if def == nil || def.Name() != DefaultTenantName || def.Bucket() != "testbucket" {
+		t.Fatalf("carol must use the default tenant, got %+v", def)
+	}
+	public := cfg.Tenant("public")
+	if public == nil || public.ChunkSize() != cfg.Service().ChunkSize() || public.Key() != nil || !public.Allows("carol") {
+		t.Fatalf("public must inherit the service settings and be open, got %+v", public)
+	}
+	if cfg.Tenant("unknown") != nil {
+		t.Fatalf("unknown tenant found")
+	}
+}
+
+// TestTenantsWithoutDefault tests that minio.bucket is optional with tenants.
+func TestTenantsWithoutDefault(t *testing.T) {
+	cfg, err := NewConfig(writeConfig(t, strings.Replace(testConfig, "  bucket: 'testbucket'\n", "", 1)+testTenants))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.DefaultTenant() != nil || cfg.TenantForCaller("carol") != nil || cfg.Tenant(DefaultTenantName) != nil {
+		t.Fatalf("no default tenant expected without minio.bucket")
+	}
+}
+
+func TestTenantsValidation(t *testing.T) {
+	invalid := `tenants:
+  - name: 'file'
+    bucket: 'testbucket'
+    callers: ['alice']
+  - name: 'acme'
+    bucket: 'acme-files'
+    callers: ['alice']
+    chunk_size: 1 MiB
+  - name: 'acme'
+    bucket: 'other-files'
+`
+	_, err := NewConfig(writeConfig(t, testConfig+invalid))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %T: %v", err, err)
+	}
+	want := []string{"tenants[0].name", "tenants[0].bucket", "tenants[1].callers", "tenants[1].chunk_size", "tenants[2].name"}
+	if len(verr.Errors) != len(want) {
+		t.Fatalf("expected %d errors, got:\n%v", len(want), err)
+	}
+	for i, fe := range verr.Errors {
+		if fe.Field != want[i] {
+			t.Fatalf("expected an error on %s, got %s", want[i], fe)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// FieldError is a problem found on a field of the configuration.
+type FieldError struct {
+	Field   string // path of the field, as in the yaml file: minio.credentials[0].type
+	Message string // description of the problem
+}
+
+func (e FieldError) String() string { return e.Field + ": " + e.Message }
+
+// ValidationError aggregates all the problems found in a configuration, so they
+// can be fixed at once.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+// Implementation of the error interface, one problem per line.
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid configuration, %d error(s):", len(e.Errors))
+	for _, fe := range e.Errors {
+		b.WriteString("\n  - " + fe.String())
+	}
+	return b.String()
+}
+
+// validation collects the problems found while converting the configuration.
+type validation struct {
+	errors []FieldError
+}
+
+// add records a problem on the field.
+func (v *validation) add(field, message string) {
+	v.errors = append(v.errors, FieldError{Field: field, Message: message})
+}
+
+// addErr records err as a problem on the field, if not nil. It tells if err was nil.
+func (v *validation) addErr(field string, err error) bool {
+	if err == nil {
+		return true
+	}
+	v.add(field, message(err))
+	return false
+}
+
+// err gives a *ValidationError with the problems found, nil if there is none.
+func (v *validation) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errors}
+}
+
+// message gives the messages of an error chain on one line.
+func message(err error) string {
+	var parts []string
+	for err != nil {
+		e, ok := err.(*errs.Error)
+		if !ok {
+			parts = append(parts, err.Error())
+			break
+		}
+		if e.Message != "" {
+			parts = append(parts, e.Message)
+		}
+		err = e.Err
+	}
+	return strings.Join(parts, ": ")
+}
+
+// validateAddress checks that addr is a listening address: host:port or :port.
+func validateAddress(v *validation, field, addr string) {
+	if addr == "" {
+		v.add(field, "is required")
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.add(field, fmt.Sprintf("malformed address [%s], use host:port or :port", addr))
+		return
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		v.add(field, fmt.Sprintf("invalid port [%s]", port))
+	}
+}
+
+// validateEndpoint checks that endpoint is host or host:port, without scheme nor path.
+func validateEndpoint(v *validation, field, endpoint string) {
+	switch {
+	case endpoint == "":
+		v.add(field, "is required")
+	case strings.Contains(endpoint, "://"):
+		v.add(field, fmt.Sprintf("[%s] must not contain the scheme, use minio.secure for https", endpoint))
+	case strings.Contains(endpoint, "/"):
+		v.add(field, fmt.Sprintf("[%s] must not contain a path", endpoint))
+	case strings.Contains(endpoint, ":"):
+		if _, port, err := net.SplitHostPort(endpoint); err != nil {
+			v.add(field, fmt.Sprintf("malformed endpoint [%s], use host or host:port", endpoint))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			v.add(field, fmt.Sprintf("invalid port [%s]", port))
+		}
+	}
+}
+
+// validateBucket checks that bucket respects the S3 naming rules.
+func validateBucket(v *validation, field, bucket string) {
+	if bucket == "" {
+		v.add(field, "is required")
+		return
+	}
+	v.addErr(field, s3utils.CheckValidBucketNameStrict(bucket))
+}
@@ -0,0 +1,246 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	valid := []struct {
+		size string
+		want uint64
+	}{
+		{"0 B", 0},
+		{"6 MiB", 6 << 20},
+		{"6MiB", 6 << 20},
+		{"5.5 MiB", 5<<20 + 512<<10},
+		{"5 mib", 5 << 20},
+		{"100 MB", 100e6},
+		{"1.5 gb", 1.5e9},
+		{"2 KiB", 2 << 10},
+		{"3 kB", 3000},
+	}
+	for _, tc := range valid {
+		got, err := ParseSize(tc.size)
+		if err != nil {
+			t.Fatalf("unexpected error for [%s]: %v", tc.size, err)
+		}
+		if got != tc.want {
+			t.Fatalf("[%s]: expected %d, got %d", tc.size, tc.want, got)
+		}
+	}
+	for _, size := range []string{"", "MiB", "5", "-5 MiB", "5 XB", "1.2.3 MiB", "0.5 B", "99999999999 GiB"} {
+		if _, err := ParseSize(size); err == nil {
+			t.Fatalf("expected an error for [%s]", size)
+		}
+	}
+}
+
+// TestValidationAggregated tests that all the problems of the configuration are
+// reported at once with the path of their field.
+func TestValidationAggregated(t *testing.T) {
+	invalid := `service:
+  address: 'localhost'
+  admin_address: 'localhost:metrics'
+  chunk_size: 5.5 XB
+  aes_encryption_key: 0001
+  log_level: verbose
+  key:
+    ring:
+      - id: 'old'
+janitor:
+  interval: 1 hour
+minio:
+  endpoint: 'http://127.0.0.1:9000'
+  bucket: ''
+  credentials:
+    - type: 'ldap'
+`
+	_, err := NewConfig(writeConfig(t, invalid))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %T: %v", err, err)
+	}
+	fields := map[string]bool{}
+	for _, fe := range verr.Errors {
+		fields[fe.Field] = true
+	}
+	for _, f := range []string{
+		"service.address", "service.admin_address", "service.chunk_size", "service.aes_encryption_key", "service.log_level",
+		"service.key.ring[0]", "janitor.interval", "minio.endpoint", "minio.bucket", "minio.credentials[0].type",
+	} {
+		if !fields[f] {
+			t.Errorf("no error reported for %s in:\n%v", f, err)
+		}
+	}
+	if !strings.Contains(err.Error(), "\n  - minio.bucket: is required") {
+		t.Errorf("unexpected format of the error:\n%v", err)
+	}
+}
+
+func TestDecodeHexKeyLength(t *testing.T) {
+	if _, err := decodeHexKey(strings.Repeat("00", 33)); err == nil {
+		t.Fatalf("expected an error for a key longer than 32 bytes")
+	}
+	if _, err := decodeHexKey(strings.Repeat("00", 31)); err == nil {
+		t.Fatalf("expected an error for a key shorter than 32 bytes")
+	}
+	if _, err := decodeHexKey(strings.Repeat("00", 32)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// TestChunkSizeAuto tests the automatic chunk size, inherited by the tenants, and
+// the bounds of the uploads.
+func TestChunkSizeAuto(t *testing.T) {
+	auto := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: auto\n  upload:\n    min_chunk_size: 8 MiB\n    aggregate_parts: true\n    crc32c: true\n    compression: zstd", 1)
+	cfg, err := NewConfig(writeConfig(t, auto+testTenants))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.Service().AutoChunk() || cfg.Service().ChunkSize() != 0 || cfg.Service().Upload().MinChunkSize() != 8<<20 {
+		t.Fatalf("unexpected chunk size: %v, %d", cfg.Service().AutoChunk(), cfg.Service().ChunkSize())
+	}
+	if !cfg.Service().Upload().AggregateParts() {
+		t.Fatalf("expected the aggregation of the parts to be enabled")
+	}
+	if !cfg.Service().Upload().CRC32C() {
+		t.Fatalf("expected the CRC32C to be recorded")
+	}
+	if cfg.Service().Upload().Compression() != "zstd" {
+		t.Fatalf("expected the compression zstd, got %s", cfg.Service().Upload().Compression())
+	}
+	if !cfg.Tenant("public").AutoChunk() || cfg.Tenant("acme").AutoChunk() || !cfg.DefaultTenant().AutoChunk() {
+		t.Fatalf("the automatic chunk size must be inherited by the tenants without chunk_size")
+	}
+
+	// the chunk size of acme (8 MiB) is within the bounds, not 6 MiB
+	outOfBounds := auto + strings.Replace(testTenants, "chunk_size: 8 MiB", "chunk_size: 6 MiB", 1)
+	_, err = NewConfig(writeConfig(t, outOfBounds))
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Errors) != 1 || verr.Errors[0].Field != "tenants[0].chunk_size" {
+		t.Fatalf("expected an error on tenants[0].chunk_size, got %v", err)
+	}
+}
+
+// TestPartSize tests that a part size allows chunks smaller than 5 MiB.
+func TestPartSize(t *testing.T) {
+	grouped := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 64 KiB\n  upload:\n    part_size: 16 MiB", 1)
+	cfg, err := NewConfig(writeConfig(t, grouped))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if up := cfg.Service().Upload(); up.PartSize() != 16<<20 || up.MinChunkSize() != 64<<10 || cfg.Service().ChunkSize() != 64<<10 {
+		t.Fatalf("unexpected sizes: part %d, min chunk %d, chunk %d", up.PartSize(), up.MinChunkSize(), cfg.Service().ChunkSize())
+	}
+	if up := cfg.Service().Upload(); up.MaxBufferedSize() != 64<<20 || up.StreamChunkSize() != 64<<10 {
+		t.Fatalf("unexpected defaults of the whole mode: buffered %d, stream chunk %d", up.MaxBufferedSize(), up.StreamChunkSize())
+	}
+
+	// without part size, the chunks must be at least 5 MiB
+	_, err = NewConfig(writeConfig(t, strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 64 KiB", 1)))
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Errors) != 1 || verr.Errors[0].Field != "service.chunk_size" {
+		t.Fatalf("expected an error on service.chunk_size, got %v", err)
+	}
+
+	_, err = NewConfig(writeConfig(t, strings.Replace(grouped, "part_size: 16 MiB", "part_size: 1 MiB", 1)))
+	verr, ok = err.(*ValidationError)
+	if !ok || len(verr.Errors) != 1 || verr.Errors[0].Field != "service.upload.part_size" {
+		t.Fatalf("expected an error on service.upload.part_size, got %v", err)
+	}
+
+	_, err = NewConfig(writeConfig(t, strings.Replace(grouped, "part_size: 16 MiB", "part_size: 16 MiB\n    stream_chunk_size: 1 KiB", 1)))
+	verr, ok = err.(*ValidationError)
+	if !ok || len(verr.Errors) != 1 || verr.Errors[0].Field != "service.upload.stream_chunk_size" {
+		t.Fatalf("expected an error on service.upload.stream_chunk_size, got %v", err)
+	}
+
+	_, err = NewConfig(writeConfig(t, strings.Replace(grouped, "part_size: 16 MiB", "part_size: 16 MiB\n    compression: lz4", 1)))
+	verr, ok = err.(*ValidationError)
+	if !ok || len(verr.Errors) != 1 || verr.Errors[0].Field != "service.upload.compression" {
+		t.Fatalf("expected an error on service.upload.compression, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	limited := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 0 B\n  limits:\n    requests_per_second: 2.5\n    bytes_per_second: 10 MiB\n    max_transfers: 8", 1)
+	cfg, err := NewConfig(writeConfig(t, limited))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := cfg.Service().Limits()
+	if l.RequestsPerSecond() != 2.5 || l.RequestBurst() != 3 || l.BytesPerSecond() != 10<<20 || l.BytesBurst() != 10<<20 || l.MaxTransfers() != 8 {
+		t.Fatalf("unexpected limits: %+v", *l)
+	}
+
+	invalid := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 0 B\n  limits:\n    request_burst: 5\n    bytes_burst: 1 MiB\n    max_transfers: -1", 1)
+	_, err = NewConfig(writeConfig(t, invalid))
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected a *ValidationError, got %T: %v", err, err)
+	}
+	want := []string{"service.limits.request_burst", "service.limits.bytes_burst", "service.limits.max_transfers"}
+	if len(verr.Errors) != len(want) {
+		t.Fatalf("expected %d errors, got:\n%v", len(want), err)
+	}
+	for i, fe := range verr.Errors {
+		if fe.Field != want[i] {
+			t.Fatalf("expected an error on %s, got %s", want[i], fe)
+		}
+	}
+
+	// the rate can be overridden
+	t.Setenv("TAURUS_SERVICE_LIMITS_REQUESTS_PER_SECOND", "0.5")
+	cfg, err = NewConfig(writeConfig(t, limited))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if l := cfg.Service().Limits(); l.RequestsPerSecond() != 0.5 || l.RequestBurst() != 1 {
+		t.Fatalf("unexpected overridden limits: %v, %d", l.RequestsPerSecond(), l.RequestBurst())
+	}
+}
+
+func TestDedup(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	dedup := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 0 B\n  dedup:\n    enabled: true\n    key: "+key, 1) +
+		"index:\n  path: /var/lib/taurus/index.db\n"
+	cfg, err := NewConfig(writeConfig(t, dedup))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d := cfg.Service().Dedup(); !d.Enabled() || d.Key()[0] != 0xab {
+		t.Fatalf("unexpected dedup: %v, %x", d.Enabled(), d.Key())
+	}
+	if cfg.Index().Path() != "/var/lib/taurus/index.db" {
+		t.Fatalf("unexpected index path: %s", cfg.Index().Path())
+	}
+
+	// the index is required, the key must be given once
+	invalid := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 0 B\n  dedup:\n    enabled: true\n    key: "+key+"\n    key_env: DEDUP_KEY", 1)
+	_, err = NewConfig(writeConfig(t, invalid))
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Errors) != 2 || verr.Errors[0].Field != "index.path" || verr.Errors[1].Field != "service.dedup" {
+		t.Fatalf("expected errors on index.path and service.dedup, got %v", err)
+	}
+}
+
+func TestObfuscation(t *testing.T) {
+	t.Setenv("NAMES_KEY", strings.Repeat("cd", 32))
+	obfuscation := strings.Replace(testConfig, "chunk_size: 0 B", "chunk_size: 0 B\n  obfuscation:\n    enabled: true\n    key_env: NAMES_KEY", 1)
+	cfg, err := NewConfig(writeConfig(t, obfuscation))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if o := cfg.Service().Obfuscation(); !o.Enabled() || o.Key()[0] != 0xcd {
+		t.Fatalf("unexpected obfuscation: %v, %x", o.Enabled(), o.Key())
+	}
+
+	// the index is not required, the variable must be set
+	invalid := strings.Replace(obfuscation, "NAMES_KEY", "MISSING_NAMES_KEY", 1)
+	_, err = NewConfig(writeConfig(t, invalid))
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Errors) != 1 || verr.Errors[0].Field != "service.obfuscation.key_env" {
+		t.Fatalf("expected an error on service.obfuscation.key_env, got %v", err)
+	}
+}
@@ -2,7 +2,7 @@ package config
 
 import (
 	"fmt"
-	"strconv"
+	"math/big"
 	"strings"
 
 	"github.com/ag0st/taurus-challenge/errs"
@@ -11,49 +11,210 @@ import (
 // Config is the object used for the configuration in the application. It is used as
 // unmarshall object for the config.yaml file
 type ConfigYml struct {
-	Service ServiceYml `yaml:"service"`
-	MinIo   MinIoYml   `yaml:"minio"`
+	Service ServiceYml  `yaml:"service"`
+	MinIo   MinIoYml    `yaml:"minio"`
+	Janitor JanitorYml  `yaml:"janitor"`
+	Tenants []TenantYml `yaml:"tenants"`
+	Quotas  QuotasYml   `yaml:"quotas"`
+	Index   IndexYml    `yaml:"index"`
 }
 
 type ServiceYml struct {
-	Address          string `yaml:"address"`
-	ChunkSizeStr     string `yaml:"chunk_size"`
-	AESEncryptionKey string `yaml:"aes_encryption_key"`
+	Address          string         `yaml:"address"`
+	AdminAddress     string         `yaml:"admin_address"`
+	ChunkSizeStr     string         `yaml:"chunk_size"`
+	AESEncryptionKey string         `yaml:"aes_encryption_key" secret:"true"`
+	LogLevel         string         `yaml:"log_level"`
+	WatchIntervalStr string         `yaml:"config_watch_interval"`
+	TLS              TLSYml         `yaml:"tls"`
+	Key              KeyYml         `yaml:"key"`
+	Upload           UploadYml      `yaml:"upload"`
+	Limits           LimitsYml      `yaml:"limits"`
+	Dedup            DedupYml       `yaml:"dedup"`
+	Obfuscation      ObfuscationYml `yaml:"obfuscation"`
+}
+
+type UploadYml struct {
+	MinChunkSizeStr    string `yaml:"min_chunk_size"`
+	MaxChunkSizeStr    string `yaml:"max_chunk_size"`
+	MaxWholeSizeStr    string `yaml:"max_whole_size"`
+	WholeThresholdStr  string `yaml:"whole_threshold"`
+	AggregateParts     bool   `yaml:"aggregate_parts"`
+	PartSizeStr        string `yaml:"part_size"`
+	MaxBufferedSizeStr string `yaml:"max_buffered_size"`
+	StreamChunkSizeStr string `yaml:"stream_chunk_size"`
+	CRC32C             bool   `yaml:"crc32c"`
+	Compression        string `yaml:"compression"`
+}
+
+type DedupYml struct {
+	Enabled bool   `yaml:"enabled"`
+	Key     string `yaml:"key" secret:"true"`
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
+}
+
+type ObfuscationYml struct {
+	Enabled bool   `yaml:"enabled"`
+	Key     string `yaml:"key" secret:"true"`
+	KeyFile string `yaml:"key_file"`
+	KeyEnv  string `yaml:"key_env"`
+}
+
+type LimitsYml struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	RequestBurst      int     `yaml:"request_burst"`
+	BytesPerSecondStr string  `yaml:"bytes_per_second"`
+	BytesBurstStr     string  `yaml:"bytes_burst"`
+	MaxTransfers      int     `yaml:"max_transfers"`
+}
+
+type KeyYml struct {
+	Source string       `yaml:"source"`
+	ID     string       `yaml:"id"`
+	File   string       `yaml:"file"`
+	Env    string       `yaml:"env"`
+	Vault  VaultYml     `yaml:"vault"`
+	Ring   []RingKeyYml `yaml:"ring"`
+}
+
+type RingKeyYml struct {
+	ID   string `yaml:"id"`
+	Key  string `yaml:"key" secret:"true"`
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+type VaultYml struct {
+	Address    string `yaml:"address"`
+	Mount      string `yaml:"mount"`
+	KeyName    string `yaml:"key_name"`
+	Token      string `yaml:"token" secret:"true"`
+	TokenFile  string `yaml:"token_file"`
+	CAFile     string `yaml:"ca_file"`
+	TimeoutStr string `yaml:"timeout"`
+}
+
+type TLSYml struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	MinVersion   string `yaml:"min_version"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	ReloadStr    string `yaml:"reload_interval"`
 }
 
 type MinIoYml struct {
 	AccessKey string `yaml:"access_key"`
-	SecretKey string `yaml:"secret_key"`
+	SecretKey string `yaml:"secret_key" secret:"true"`
 	Endpoint  string `yaml:"endpoint"`
 	Bucket    string `yaml:"bucket"`
+
+	Secure             bool              `yaml:"secure"`
+	Region             string            `yaml:"region"`
+	CAFile             string            `yaml:"ca_file"`
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"`
+	Transport          MinIoTransportYml `yaml:"transport"`
+	Credentials        []CredentialsYml  `yaml:"credentials"`
+}
+
+type CredentialsYml struct {
+	Type        string `yaml:"type"`
+	AccessKey   string `yaml:"access_key"`
+	SecretKey   string `yaml:"secret_key" secret:"true"`
+	Path        string `yaml:"path"`
+	Profile     string `yaml:"profile"`
+	Endpoint    string `yaml:"endpoint"`
+	TokenFile   string `yaml:"token_file"`
+	RoleARN     string `yaml:"role_arn"`
+	DurationStr string `yaml:"duration"`
 }
 
-// extractSize take a string formatted size which can be given in the configuration file
+type MinIoTransportYml struct {
+	DialTimeoutStr           string `yaml:"dial_timeout"`
+	TLSHandshakeTimeoutStr   string `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeoutStr string `yaml:"response_header_timeout"`
+	IdleConnTimeoutStr       string `yaml:"idle_conn_timeout"`
+	MaxIdleConns             int    `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost      int    `yaml:"max_idle_conns_per_host"`
+	Proxy                    string `yaml:"proxy"`
+}
+
+type TenantYml struct {
+	Name             string   `yaml:"name"`
+	Bucket           string   `yaml:"bucket"`
+	ChunkSizeStr     string   `yaml:"chunk_size"`
+	QuotaStr         string   `yaml:"quota"`
+	Callers          []string `yaml:"callers"`
+	AESEncryptionKey string   `yaml:"aes_encryption_key" secret:"true"`
+	Key              KeyYml   `yaml:"key"`
+}
+
+type QuotasYml struct {
+	MaxObjectSizeStr string           `yaml:"max_object_size"`
+	CallerQuotaStr   string           `yaml:"caller_quota"`
+	Callers          []CallerQuotaYml `yaml:"callers"`
+	Buckets          []BucketQuotaYml `yaml:"buckets"`
+}
+
+type CallerQuotaYml struct {
+	Caller   string `yaml:"caller"`
+	QuotaStr string `yaml:"quota"`
+}
+
+type BucketQuotaYml struct {
+	Bucket   string `yaml:"bucket"`
+	QuotaStr string `yaml:"quota"`
+}
+
+type IndexYml struct {
+	Path string `yaml:"path"`
+}
+
+type JanitorYml struct {
+	Enabled     bool   `yaml:"enabled"`
+	IntervalStr string `yaml:"interval"`
+	MaxAgeStr   string `yaml:"max_age"`
+	DryRun      bool   `yaml:"dry_run"`
+}
+
+// sizeUnits are the multipliers of the units accepted by ParseSize, by lower case name.
+var sizeUnits = map[string]uint64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// ParseSize take a string formatted size which can be given in the configuration file
 // and format it as int (representing the number of bytes).
-// The size parameter is size formatted in string (with MB, GB, KB suffix) and what is
-// used in log to tell which field failed.
-func extractSize(size string) (uint64, error) {
-	split := strings.Split(size, " ") // space separator
-	if len(split) != 2 {
-		return 0, errs.New(fmt.Sprintf("cannot parse %s, must be of type: \n "+
-			"xx yy : where xx is an int and yy is one of [B, KiB, MiB, GiB]", size))
+// The size is a decimal quantity followed by a unit, optionally separated by a space:
+// "5 MiB", "5.5MiB", "100 mb". The units are case insensitive, KB, MB and GB are powers
+// of 1000 and KiB, MiB and GiB powers of 1024. The result must be a whole number of bytes.
+func ParseSize(size string) (uint64, error) {
+	s := strings.TrimSpace(size)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i <= 0 {
+		return 0, errs.New(fmt.Sprintf("cannot parse [%s], must be of type: "+
+			"xx yy : where xx is a number and yy is one of [B, KB, MB, GB, KiB, MiB, GiB]", size))
+	}
+	quantity, unit := s[:i], strings.TrimSpace(s[i:])
+	mult, ok := sizeUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, errs.New(fmt.Sprintf("unit unknown [%s], use [B, KB, MB, GB, KiB, MiB, GiB]", unit))
+	}
+	q, ok := new(big.Rat).SetString(quantity)
+	if !ok {
+		return 0, errs.New(fmt.Sprintf("cannot parse [%s] as a number", quantity))
 	}
-	var shifter = 0
-	switch split[1] {
-	case "B": // byte
-		break
-	case "KiB": // kilobytes
-		shifter = 10
-	case "MiB": // megabytes
-		shifter = 20
-	case "GiB": // gigabytes
-		shifter = 30
-	default:
-		return 0, errs.New(fmt.Sprintf("unit uknown [%s], use [B, KiB, MiB, GiB]", split[1]))
+	q.Mul(q, new(big.Rat).SetInt(new(big.Int).SetUint64(mult)))
+	if !q.IsInt() {
+		return 0, errs.New(fmt.Sprintf("[%s] is not a whole number of bytes", size))
 	}
-	quantity, err := strconv.Atoi(split[0])
-	if err != nil {
-		return 0, err
+	if !q.Num().IsUint64() {
+		return 0, errs.New(fmt.Sprintf("[%s] is too large", size))
 	}
-	return uint64(quantity) << shifter, nil
+	return q.Num().Uint64(), nil
 }
@@ -122,3 +122,46 @@ func TestReadToWriteTo(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// TestHeaderExtension tests that the records of the header extension are
+// given back on decryption and that they are authenticated.
+func TestHeaderExtension(t *testing.T) {
+	plaintext := []byte("This is a test")
+	wrapped := []byte("local:default:wrapped-key")
+	for _, chunkSize := range []uint64{0, 5} {
+		h := NewHeader(chunkSize, "test.txt")
+		if err := h.SetWrappedKey(wrapped); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if h.ChunkSize() != chunkSize {
+			t.Fatalf("the flags must not change the chunk size, expected %d, got %d", chunkSize, h.ChunkSize())
+		}
+		buf := bytes.NewBuffer([]byte{})
+		ew, _ := NewEncWriter(testKey, h, buf)
+		ew.Write(plaintext)
+		ew.Close()
+		encrypted := buf.Bytes()
+
+		var gotWrapped []byte
+		keyFn := func(w []byte) ([keySize]byte, error) {
+			gotWrapped = w
+			return testKey, nil
+		}
+		dr, _ := NewDecReaderWithKeys(keyFn, bytes.NewReader(encrypted))
+		res, err := io.ReadAll(dr)
+		if err != nil || !bytes.Equal(res, plaintext) {
+			t.Fatalf("chunk size %d: expected %s, got %s (%v)", chunkSize, plaintext, res, err)
+		}
+		if !bytes.Equal(gotWrapped, wrapped) {
+			t.Fatalf("chunk size %d: expected wrapped key %s, got %s", chunkSize, wrapped, gotWrapped)
+		}
+
+		// alter the wrapped key inside the extension
+		tampered := append([]byte{}, encrypted...)
+		tampered[headerSizeByte+extLenSize+recordHeaderSize] ^= 0x1
+		dr, _ = NewDecReaderWithKeys(keyFn, bytes.NewReader(tampered))
+		if _, err := io.ReadAll(dr); err == nil {
+			t.Fatalf("chunk size %d: expected an authentication error on a tampered extension", chunkSize)
+		}
+	}
+}
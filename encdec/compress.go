@@ -0,0 +1,181 @@
+package encdec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The plaintext can be compressed before its encryption. The algorithm is stored in
+// the record compression of the header extension, so the decryption decompresses
+// the data without the caller knowing it.
+//
+// Each chunk is compressed on its own and stays independent of the others. A
+// compressed chunk has no fixed size anymore, it is written with its length:
+//
+//	+--------------+-------------+---------------------------------+
+//	| Seq num (4B) | Length (4B) | Encrypted flag (1B) | data, tag |
+//	+--------------+-------------+---------------------------------+
+//
+// The encrypted flag tells if the data is compressed or stored as is, when the
+// compression does not reduce its size (data already compressed). A chunk takes at
+// most its plaintext size plus 9 bytes on top of the sequence number and the tag.
+// In whole mode, the flag and the data are encrypted as before.
+
+// Compression is the compression algorithm of the plaintext.
+type Compression byte
+
+// Compression algorithms.
+const (
+	CompressionNone Compression = 0x00
+	CompressionZstd Compression = 0x01
+	CompressionGzip Compression = 0x02
+)
+
+// Flags of the compressed data, before the data in the plaintext encrypted.
+const (
+	dataStored     byte = 0x00
+	dataCompressed byte = 0x01
+)
+
+const (
+	recordCompressionSize = 1
+	chunkLenSize          = 4
+)
+
+// Errors declarations
+var (
+	// ErrUnknownCompression error is thrown when the compression algorithm is unknown.
+	ErrUnknownCompression error = errs.New("unknown compression, use [none, zstd, gzip]")
+	// ErrInvalidCompressed error is thrown when compressed data is malformed.
+	ErrInvalidCompressed error = errs.New("invalid compressed data")
+)
+
+// ParseCompression gives the compression algorithm of the given name: none (or
+// empty), zstd or gzip.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "zstd":
+		return CompressionZstd, nil
+	case "gzip":
+		return CompressionGzip, nil
+	}
+	return CompressionNone, errs.WrapWithError(errs.New(fmt.Sprintf("compression [%s]", name)), ErrUnknownCompression)
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionGzip:
+		return "gzip"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+// SetCompression records in the header that the plaintext is compressed with c
+// before its encryption. The size given by EncryptedSize is then only an upper
+// bound of the encrypted size.
+func (h *header) SetCompression(c Compression) error {
+	if c == CompressionNone {
+		return nil
+	}
+	if c != CompressionZstd && c != CompressionGzip {
+		return ErrUnknownCompression
+	}
+	return h.setRecord(recordCompression, []byte{byte(c)})
+}
+
+// Compression gives the compression algorithm of the plaintext, CompressionNone if
+// it is not compressed.
+func (h *header) Compression() Compression {
+	r := h.record(recordCompression)
+	if len(r) != recordCompressionSize {
+		return CompressionNone
+	}
+	return Compression(r[0])
+}
+
+// validCompression tells if the record compression of the header is well formed.
+func (h *header) validCompression() bool {
+	r := h.record(recordCompression)
+	return r == nil || (len(r) == recordCompressionSize &&
+		(Compression(r[0]) == CompressionZstd || Compression(r[0]) == CompressionGzip))
+}
+
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		e, _ := zstd.NewWriter(nil)
+		return e
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		d, _ := zstd.NewReader(nil)
+		return d
+	})
+)
+
+// compress gives the flag and the data compressed with c, or stored as is if the
+// compression does not reduce its size.
+func compress(c Compression, p []byte) []byte {
+	res := make([]byte, 1, len(p)+1)
+	res[0] = dataCompressed
+	switch c {
+	case CompressionZstd:
+		res = zstdEncoder().EncodeAll(p, res)
+	case CompressionGzip:
+		buf := bytes.NewBuffer(res)
+		w := gzip.NewWriter(buf)
+		w.Write(p) // cannot fail, writes into a bytes.Buffer
+		w.Close()
+		res = buf.Bytes()
+	}
+	if len(res) > len(p) {
+		return append([]byte{dataStored}, p...)
+	}
+	return res
+}
+
+// decompress gives the data of the flag and data p compressed with c. It fails if
+// the data exceeds limit bytes, negative for no limit.
+func decompress(c Compression, p []byte, limit int) ([]byte, error) {
+	if len(p) == 0 {
+		return nil, ErrInvalidCompressed
+	}
+	var res []byte
+	var err error
+	switch {
+	case p[0] == dataStored:
+		res = p[1:]
+	case p[0] != dataCompressed:
+		return nil, ErrInvalidCompressed
+	case c == CompressionZstd:
+		res, err = zstdDecoder().DecodeAll(p[1:], nil)
+	case c == CompressionGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(p[1:])); err == nil {
+			src := io.Reader(r)
+			if limit >= 0 {
+				src = io.LimitReader(r, int64(limit)+1)
+			}
+			res, err = io.ReadAll(src)
+		}
+	default:
+		return nil, ErrUnknownCompression
+	}
+	if err != nil {
+		return nil, errs.WrapWithError(err, ErrInvalidCompressed)
+	}
+	if limit >= 0 && len(res) > limit {
+		return nil, ErrInvalidCompressed
+	}
+	return res, nil
+}
@@ -0,0 +1,95 @@
+package encdec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// TestCompression tests that the compressed data is read back in all the modes, with
+// compressible and random data, and that it stays below the size given by EncryptedSize.
+func TestCompression(t *testing.T) {
+	random := make([]byte, 3000)
+	rand.Read(random)
+	inputs := map[string][]byte{
+		"text":   bytes.Repeat([]byte(`{"level":"info","msg":"This is a test"}`), 100),
+		"random": random,
+	}
+	for _, c := range []Compression{CompressionZstd, CompressionGzip} {
+		for name, data := range inputs {
+			for _, chunkSize := range []uint64{0, 7, 1000, 5000} {
+				h := NewHeader(chunkSize, "test.json")
+				if err := h.SetCompression(c); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if err := h.SetChecksums(false); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				buf := bytes.NewBuffer([]byte{})
+				ew, _ := NewEncWriter(testKey, h, buf)
+				if _, err := ew.Write(data); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if err := ew.Close(); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if uint64(buf.Len()) > h.EncryptedSize(uint64(len(data))) {
+					t.Fatalf("%v %s chunk size %d: %d bytes written, more than the %d expected", c, name, chunkSize, buf.Len(), h.EncryptedSize(uint64(len(data))))
+				}
+				if name == "text" && chunkSize != 7 && buf.Len() > len(data)/2 {
+					t.Fatalf("%v chunk size %d: the data is not compressed, %d bytes written", c, chunkSize, buf.Len())
+				}
+
+				dr, _ := NewDecReader(testKey, iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+				res, err := io.ReadAll(dr)
+				if err != nil || !bytes.Equal(res, data) {
+					t.Fatalf("%v %s chunk size %d: cannot read the data back: %v", c, name, chunkSize, err)
+				}
+			}
+		}
+	}
+}
+
+// TestCompressionTampered tests that the compressed chunks are authenticated and must
+// be complete.
+func TestCompressionTampered(t *testing.T) {
+	data := bytes.Repeat([]byte("This is a test"), 100)
+	h := NewHeader(100, "test.txt")
+	h.SetCompression(CompressionZstd)
+	buf := bytes.NewBuffer([]byte{})
+	ew, _ := NewEncWriter(testKey, h, buf)
+	ew.Write(data)
+	ew.Close()
+	encrypted := buf.Bytes()
+	headerSize := len(h.bytes())
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[headerSize+seqNumSize+chunkLenSize] ^= 0x1
+	dr, _ := NewDecReader(testKey, bytes.NewReader(tampered))
+	if _, err := io.ReadAll(dr); err == nil {
+		t.Fatalf("expected an authentication error on a tampered chunk")
+	}
+	// the length of the first chunk is too large
+	tampered = append([]byte{}, encrypted...)
+	tampered[headerSize+seqNumSize] = 0xFF
+	dr, _ = NewDecReader(testKey, bytes.NewReader(tampered))
+	if _, err := io.ReadAll(dr); err != ErrInvalidCompressed {
+		t.Fatalf("expected ErrInvalidCompressed, got %v", err)
+	}
+	// the last chunk is missing
+	first := headerSize + seqNumSize + chunkLenSize
+	first += int(encrypted[first-4])<<24 | int(encrypted[first-3])<<16 | int(encrypted[first-2])<<8 | int(encrypted[first-1])
+	dr, _ = NewDecReader(testKey, bytes.NewReader(encrypted[:first]))
+	if _, err := io.ReadAll(dr); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	// unknown algorithm
+	if err := h.SetCompression(Compression(0x7F)); err != ErrUnknownCompression {
+		t.Fatalf("expected ErrUnknownCompression, got %v", err)
+	}
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Fatalf("expected an error on an unknown compression")
+	}
+}
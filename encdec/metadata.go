@@ -0,0 +1,117 @@
+package encdec
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// The metadata of an object (its filename, content type, modification time and the
+// custom metadata of the client) is sealed in the record metadata of the header
+// extension, as a JSON object encrypted with the key of the data:
+//
+//	+------------------------+-----+
+//	|  Metadata (encrypted)  | Tag |
+//	+------------------------+-----+
+//
+// The metadata is sealed with the IV whose first byte is flipped with 0x02, which is
+// never used by a chunk nor by the trailer, and authenticates the filename and the
+// chunk size of the header. As the other records, it is also authenticated with the
+// data. Only the size of the metadata can be learnt without the key: the filename
+// field of the header is left empty.
+
+// ErrInvalidMetadata error is thrown when the metadata of a header cannot be opened.
+var ErrInvalidMetadata error = errs.New("invalid metadata of the header")
+
+// Metadata is the metadata of an object sealed in its header.
+type Metadata struct {
+	Filename    string            `json:"filename,omitempty"`     // original name of the file
+	ContentType string            `json:"content_type,omitempty"` // content type of the file
+	ModTime     time.Time         `json:"mod_time"`               // modification time of the file, zero if unknown
+	Custom      map[string]string `json:"custom,omitempty"`       // metadata of the client
+}
+
+// isEmpty tells if the metadata has no field set.
+func (m Metadata) isEmpty() bool {
+	return m.Filename == "" && m.ContentType == "" && m.ModTime.IsZero() && len(m.Custom) == 0
+}
+
+// SetMetadata records the metadata in the header, nothing if it is empty. The metadata
+// is sealed with the key of the data by NewEncWriter, the record only reserves its size.
+func (h *header) SetMetadata(m Metadata) error {
+	if m.isEmpty() {
+		return nil
+	}
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := h.setRecord(recordMetadata, make([]byte, len(value)+tagSizeByte)); err != nil {
+		return err
+	}
+	h.metadata, h.plainMetadata = &m, value
+	return nil
+}
+
+// Metadata gives the metadata of the header, nil if none or if it is not opened yet.
+func (h *header) Metadata() *Metadata { return h.metadata }
+
+// SealHeader gives the header alone, its metadata sealed with the key: the header of
+// data stored elsewhere. Its metadata and its filename are read back by a reader of
+// NewDecReader, without any data to read.
+func SealHeader(key [keySize]byte, h header) ([]byte, error) {
+	aesgcm, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.sealMetadata(aesgcm); err != nil {
+		return nil, err
+	}
+	return h.bytes(), nil
+}
+
+// metadataIV gives the IV of the metadata.
+func (h *header) metadataIV() []byte {
+	iv := h.IV()
+	iv[0] ^= 0x02
+	return iv
+}
+
+// metadataAAD gives the additional data authenticated with the metadata.
+func (h *header) metadataAAD() []byte { return h.fixed[:filenameHeaderSize+chunkHeaderSize] }
+
+// sealMetadata seals the metadata set in its record, nothing if none is set.
+func (h *header) sealMetadata(aesgcm cipher.AEAD) error {
+	if h.plainMetadata == nil {
+		return nil
+	}
+	sealed := aesgcm.Seal(nil, h.metadataIV(), h.plainMetadata, h.metadataAAD())
+	return h.setRecord(recordMetadata, sealed)
+}
+
+// openMetadata opens the record metadata of the header, nothing if there is none.
+func (h *header) openMetadata(aesgcm cipher.AEAD) error {
+	r := h.record(recordMetadata)
+	if r == nil {
+		return nil
+	}
+	value, err := aesgcm.Open(nil, h.metadataIV(), r, h.metadataAAD())
+	if err != nil {
+		return errs.WrapWithError(err, ErrInvalidMetadata)
+	}
+	var m Metadata
+	if err := json.Unmarshal(value, &m); err != nil {
+		return errs.WrapWithError(err, ErrInvalidMetadata)
+	}
+	h.metadata = &m
+	return nil
+}
+
+// validMetadata tells if the record metadata of the header is large enough to hold
+// its tag.
+func (h *header) validMetadata() bool {
+	r := h.record(recordMetadata)
+	return r == nil || len(r) >= tagSizeByte
+}
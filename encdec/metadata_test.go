@@ -0,0 +1,92 @@
+package encdec
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestMetadata tests that the metadata of the header is encrypted, read back and
+// authenticated.
+func TestMetadata(t *testing.T) {
+	data := bytes.Repeat([]byte("This is a test"), 10)
+	m := Metadata{
+		Filename:    "secret-report.pdf",
+		ContentType: "application/pdf",
+		ModTime:     time.Date(2026, 10, 18, 9, 12, 3, 0, time.UTC),
+		Custom:      map[string]string{"project": "apollo", "owner": "René"},
+	}
+	for _, chunkSize := range []uint64{0, 50} {
+		h := NewHeader(chunkSize, "")
+		if err := h.SetMetadata(m); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		buf := bytes.NewBuffer([]byte{})
+		ew, _ := NewEncWriter(testKey, h, buf)
+		ew.Write(data)
+		if err := ew.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		encrypted := buf.Bytes()
+		if size := h.EncryptedSize(uint64(len(data))); size != uint64(len(encrypted)) {
+			t.Fatalf("chunk size %d: expected an encrypted size of %d, got %d", chunkSize, len(encrypted), size)
+		}
+		for _, clear := range []string{"secret-report", "application/pdf", "apollo"} {
+			if bytes.Contains(encrypted, []byte(clear)) {
+				t.Fatalf("chunk size %d: %s is stored in clear", chunkSize, clear)
+			}
+		}
+
+		dr, _ := NewDecReader(testKey, bytes.NewReader(encrypted))
+		got, err := dr.Metadata()
+		if err != nil || !reflect.DeepEqual(got, m) {
+			t.Fatalf("chunk size %d: unexpected metadata %+v (%v)", chunkSize, got, err)
+		}
+		if filename, err := dr.Filename(); err != nil || filename != m.Filename {
+			t.Fatalf("chunk size %d: unexpected filename %s (%v)", chunkSize, filename, err)
+		}
+		if res, err := io.ReadAll(dr); err != nil || !bytes.Equal(res, data) {
+			t.Fatalf("chunk size %d: cannot read the data back: %v", chunkSize, err)
+		}
+
+		// alter the sealed metadata, the header is rejected
+		tampered := bytes.Clone(encrypted)
+		tampered[len(h.bytes())-1] ^= 0x01
+		dr, _ = NewDecReader(testKey, bytes.NewReader(tampered))
+		if _, err := dr.Metadata(); err != ErrInvalidMetadata {
+			t.Fatalf("chunk size %d: expected ErrInvalidMetadata on tampered metadata, got %v", chunkSize, err)
+		}
+		// another key cannot open it
+		dr, _ = NewDecReader([keySize]byte{0x42}, bytes.NewReader(encrypted))
+		if _, err := dr.Metadata(); err != ErrInvalidMetadata {
+			t.Fatalf("chunk size %d: expected ErrInvalidMetadata with another key, got %v", chunkSize, err)
+		}
+	}
+
+	// the header alone, for data stored elsewhere
+	h := NewHeader(0, "")
+	h.SetMetadata(m)
+	sealed, err := SealHeader(testKey, h)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("secret-report")) {
+		t.Fatalf("the filename of the header alone is stored in clear")
+	}
+	dr, _ := NewDecReader(testKey, bytes.NewReader(sealed))
+	if got, err := dr.Metadata(); err != nil || !reflect.DeepEqual(got, m) {
+		t.Fatalf("unexpected metadata of the header alone %+v (%v)", got, err)
+	}
+	if filename, err := dr.Filename(); err != nil || filename != m.Filename {
+		t.Fatalf("unexpected filename of the header alone %s (%v)", filename, err)
+	}
+
+	// without metadata, there is no record and the filename is the one of the header
+	h = NewHeader(0, "test.txt")
+	h.SetMetadata(Metadata{})
+	if h.isExtended() || h.Metadata() != nil || h.Filename() != "test.txt" {
+		t.Fatalf("expected no metadata record")
+	}
+}
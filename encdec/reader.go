@@ -37,6 +37,15 @@ type Reader interface {
 	io.WriterTo
 	// Gives the filename of the current file. Must call Read first.
 	Filename() (string, error)
+	// Metadata gives the metadata sealed in the header, the zero Metadata if none.
+	// It reads the header if needed.
+	Metadata() (Metadata, error)
+	// TrailerSize gives the size of the trailer at the end of the encrypted data, 0 if
+	// the checksums of the plaintext are not recorded. It reads the header if needed.
+	TrailerSize() (int, error)
+	// ReadTrailer reads the checksums of the plaintext from src, giving the trailer
+	// (the last TrailerSize bytes of the encrypted data). It reads the header if needed.
+	ReadTrailer(src io.Reader) (Checksums, error)
 }
 
 // subReader is an interface representing a reader inside the
@@ -52,15 +61,17 @@ type subReader interface {
 // with a encdec.EncWriter. Its purpose is to wrap an existing io.Reader containing
 // the encrypted data.
 func NewDecReader(key [keySize]byte, src io.Reader) (Reader, error) {
-	// Create the cipher
-	cipher, err := newCipher(key)
-	if err != nil {
-		return nil, err
-	}
+	return NewDecReaderWithKeys(func([]byte) ([keySize]byte, error) { return key, nil }, src)
+}
+
+// NewDecReaderWithKeys creates a new decryption reader like NewDecReader, but the key is
+// resolved from the wrapped data key stored in the header of the encrypted data when the
+// header is read.
+func NewDecReaderWithKeys(keyFn KeyFunc, src io.Reader) (Reader, error) {
 	return &decModeReader{
 		firstRead: true,
 		src:       src,
-		aesgcm:    cipher,
+		keyFn:     keyFn,
 	}, nil
 }
 
@@ -69,10 +80,11 @@ func NewDecReader(key [keySize]byte, src io.Reader) (Reader, error) {
 // reader on the first read (need to have the header to know which reader
 // to create).
 type decModeReader struct {
-	reader    subReader   // the underlying subReader
-	firstRead bool        // store if the reader has already not yet read something.
-	src       io.Reader   // reader containing the encrypted data.
-	aesgcm    cipher.AEAD // The standard implementation of a cipher AEAD
+	reader    subReader // the underlying subReader
+	firstRead bool      // store if the reader has already not yet read something.
+	src       io.Reader // reader containing the encrypted data.
+	keyFn     KeyFunc   // gives the key regarding the header
+	aesgcm    cipher.AEAD
 }
 
 func (dmr *decModeReader) Read(p []byte) (n int, err error) {
@@ -99,6 +111,50 @@ func (dmr *decModeReader) Filename() (string, error) {
 	return dmr.reader.getHeader().Filename(), nil
 }
 
+func (dmr *decModeReader) Metadata() (Metadata, error) {
+	if err := dmr.ensureHeader(); err != nil {
+		return Metadata{}, err
+	}
+	if m := dmr.reader.getHeader().Metadata(); m != nil {
+		return *m, nil
+	}
+	return Metadata{}, nil
+}
+
+// ensureHeader reads the header if it has not been read yet.
+func (dmr *decModeReader) ensureHeader() error {
+	if !dmr.firstRead {
+		return nil
+	}
+	if _, err := dmr.readHeader(); err != nil {
+		return err
+	}
+	dmr.firstRead = false
+	return nil
+}
+
+func (dmr *decModeReader) TrailerSize() (int, error) {
+	if err := dmr.ensureHeader(); err != nil {
+		return 0, err
+	}
+	return dmr.reader.getHeader().trailerSize(), nil
+}
+
+func (dmr *decModeReader) ReadTrailer(src io.Reader) (Checksums, error) {
+	size, err := dmr.TrailerSize()
+	if err != nil {
+		return Checksums{}, err
+	}
+	if size == 0 {
+		return Checksums{}, ErrInvalidTrailer
+	}
+	trailer := make([]byte, size)
+	if _, err := io.ReadFull(src, trailer); err != nil {
+		return Checksums{}, errs.WrapWithError(err, ErrInvalidTrailer)
+	}
+	return openTrailer(dmr.aesgcm, dmr.reader.getHeader(), trailer)
+}
+
 // WriteTo call the inside WriterTo (reader) method.
 // It also reads the header first before calling WriteTo
 func (dmr *decModeReader) WriteTo(w io.Writer) (int64, error) {
@@ -116,19 +172,35 @@ func (dmr *decModeReader) WriteTo(w io.Writer) (int64, error) {
 // It initialize the inner reader (chunk or whole).
 // PRE : the caller must ensure that dmr.firstRead = true before calling the method.
 func (dmr *decModeReader) readHeader() (int, error) {
-	var h [headerSizeByte]byte
-	n, err := io.ReadFull(dmr.src, h[:])
+	header, n, err := readHeader(dmr.src)
 	if err != nil {
 		return n, err
 	}
-	header := header(h)
+	// resolve the key of the data and create the cipher
+	key, err := dmr.keyFn(header.WrappedKey())
+	if err != nil {
+		return n, err
+	}
+	aesgcm, err := newCipher(key)
+	if err != nil {
+		return n, err
+	}
+	dmr.aesgcm = aesgcm
+	if err := header.openMetadata(aesgcm); err != nil {
+		return n, err
+	}
 
+	// the trailer is not part of the data of the readers
+	src := dmr.src
+	if size := header.trailerSize(); size > 0 {
+		src = &tailReader{src: src, n: size}
+	}
 	// create the correct reader regarding the mode
 	var reader subReader
 	if header.ChunkSize() > 0 {
-		reader = newDecChunkReader(dmr.aesgcm, header, dmr.src)
+		reader = newDecChunkReader(aesgcm, header, src)
 	} else {
-		reader = newDecWholeReader(dmr.aesgcm, header, dmr.src)
+		reader = newDecWholeReader(aesgcm, header, src)
 	}
 	dmr.reader = reader
 	return n, err
@@ -163,22 +235,32 @@ func newDecChunkReader(cipher cipher.AEAD, h header, src io.Reader) subReader {
 }
 
 func (dcr *decChunkReader) Read(p []byte) (n int, err error) {
-	if dcr.isFinished {
+	if dcr.isFinished && len(dcr.buf) == 0 {
 		return 0, io.EOF
 	}
 
 	// While it remains place in p, we decrypt a chunk and put it into p
-	for n < len(p) && !dcr.isFinished {
+	for n < len(p) && (len(dcr.buf) > 0 || !dcr.isFinished) {
 		// If we already decrypted data that have not been passed, give them now
 		if len(dcr.buf) > 0 {
-			n += copy(p, dcr.buf)
+			nc := copy(p[n:], dcr.buf)
+			n += nc
 			// remove the text we just pushed from the buffer
-			dcr.buf = dcr.buf[n:]
+			dcr.buf = dcr.buf[nc:]
 			// it forces to redo the check for us
 			continue
 		}
 		// Here we know that the buffer is empty, if not, we would have returned before.
 
+		// The compressed chunks are read with their length and decompressed into the buffer
+		if dcr.header.Compression() != CompressionNone {
+			if dcr.buf, err = dcr.readCompressedChunk(); err != nil {
+				dcr.isFinished = true
+				return n, err
+			}
+			continue
+		}
+
 		// Create a buffer for encrypted data
 		cipherBuf := make([]byte, dcr.header.ChunkSize()+seqNumSize+tagSizeByte)
 
@@ -200,19 +282,13 @@ func (dcr *decChunkReader) Read(p []byte) (n int, err error) {
 		}
 
 		// Build the correct IV by xoring with the sequence number
-		currentIV := dcr.header.IV()
 		currentSeqNum := binary.BigEndian.Uint32(cipherBuf[:seqNumSize])
-		binary.BigEndian.PutUint32(currentIV[ivHeaderSize-seqNumSize:], binary.BigEndian.Uint32(currentIV[ivHeaderSize-seqNumSize:])^currentSeqNum)
+		currentIV := dcr.chunkIV(currentSeqNum)
 
 		// Check the validity of the sequence number, if we encountered the last chunk, no check
-		if currentSeqNum != dcr.currSeqNum {
-			if currentSeqNum == LAST_CHUNK_SEQ_NUM {
-				dcr.isFinished = true
-			} else {
-				return 0, ErrInvalidSeqNum
-			}
+		if err := dcr.checkSeqNum(currentSeqNum); err != nil {
+			return 0, err
 		}
-		dcr.currSeqNum++
 
 		// Decryption
 
@@ -223,7 +299,6 @@ func (dcr *decChunkReader) Read(p []byte) (n int, err error) {
 			n += nn - seqNumSize - tagSizeByte
 		} else {
 			dcr.buf, err = dcr.aesgcm.Open(nil, currentIV, cipherBuf[seqNumSize:], dcr.header.aad())
-			dcr.buf = dcr.buf[:len(dcr.buf)-tagSizeByte] // remove the tag
 		}
 
 		if err != nil {
@@ -232,12 +307,69 @@ func (dcr *decChunkReader) Read(p []byte) (n int, err error) {
 	}
 
 	// if we finished before filling entirely p, it means we encoutered an UnexpectedEOF.
-	if dcr.isFinished {
+	if dcr.isFinished && len(dcr.buf) == 0 {
 		err = io.EOF
 	}
 	return
 }
 
+// chunkIV builds the IV of a chunk by xoring the IV of the header with its sequence number.
+func (dcr *decChunkReader) chunkIV(seqNum uint32) []byte {
+	iv := dcr.header.IV()
+	binary.BigEndian.PutUint32(iv[ivHeaderSize-seqNumSize:], binary.BigEndian.Uint32(iv[ivHeaderSize-seqNumSize:])^seqNum)
+	return iv
+}
+
+// checkSeqNum checks that the chunk of the sequence number is the next one, or the
+// last one which finishes the reader.
+func (dcr *decChunkReader) checkSeqNum(seqNum uint32) error {
+	if seqNum != dcr.currSeqNum {
+		if seqNum != LAST_CHUNK_SEQ_NUM {
+			return ErrInvalidSeqNum
+		}
+		dcr.isFinished = true
+	}
+	dcr.currSeqNum++
+	return nil
+}
+
+// readCompressedChunk reads the next compressed chunk from the source and gives its
+// plaintext. A chunk holds exactly the chunk size of plaintext, except the last one.
+func (dcr *decChunkReader) readCompressedChunk() ([]byte, error) {
+	var prefix [seqNumSize + chunkLenSize]byte
+	if _, err := io.ReadFull(dcr.src, prefix[:]); err != nil {
+		if err == io.EOF { // the data ends without the last chunk
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	seqNum := binary.BigEndian.Uint32(prefix[:seqNumSize])
+	length := uint64(binary.BigEndian.Uint32(prefix[seqNumSize:]))
+	chunkSize := dcr.header.ChunkSize()
+	if length > chunkSize+1+tagSizeByte {
+		return nil, ErrInvalidCompressed
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(dcr.src, sealed); err != nil {
+		return nil, err
+	}
+	if err := dcr.checkSeqNum(seqNum); err != nil {
+		return nil, err
+	}
+	payload, err := dcr.aesgcm.Open(sealed[:0], dcr.chunkIV(seqNum), sealed, dcr.header.aad())
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decompress(dcr.header.Compression(), payload, int(chunkSize))
+	if err != nil {
+		return nil, err
+	}
+	if seqNum != LAST_CHUNK_SEQ_NUM && uint64(len(plaintext)) != chunkSize {
+		return nil, ErrInvalidCompressed
+	}
+	return plaintext, nil
+}
+
 // WriteTo is the implementation of WriteTo of the io.WriterTo
 func (dcr *decChunkReader) WriteTo(w io.Writer) (n int64, err error) {
 	// Reads chunk by chunk and push them into the writer
@@ -297,6 +429,11 @@ func (dwr *decWholeReader) Read(p []byte) (n int, err error) {
 		}
 		// Remove the tag at the end
 		dwr.buf = dwr.buf[:len(dwr.buf)-tagSizeByte]
+		if c := dwr.header.Compression(); c != CompressionNone {
+			if dwr.buf, err = decompress(c, dwr.buf, -1); err != nil {
+				return 0, err
+			}
+		}
 
 		dwr.decrypted = true
 	}
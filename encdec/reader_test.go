@@ -124,4 +124,41 @@ func testData() ([][]byte, []byte) {
 		res = append(res, e)
 	}
 	return res, []byte("This is a test")
-}
\ No newline at end of file
+}
+// TestChunkReaderSmallBuffer tests the decryption into buffers smaller than a chunk,
+// the plaintext kept between the reads must not be lost.
+func TestChunkReaderSmallBuffer(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("0123456789"), 10)
+	dest := bytes.NewBuffer([]byte{})
+	w, err := NewEncWriter(testKey, NewHeader(16, "test.txt"), dest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, size := range []int{1, 7, 15, 16, 17, 33} {
+		reader, err := NewDecReader(testKey, bytes.NewReader(dest.Bytes()))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var got []byte
+		p := make([]byte, size)
+		for {
+			n, err := reader.Read(p)
+			got = append(got, p[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("buffer of %d bytes: unexpected error: %v", size, err)
+			}
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("buffer of %d bytes: expected %s, got %s", size, plaintext, got)
+		}
+	}
+}
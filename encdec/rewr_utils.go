@@ -30,6 +30,21 @@
 //     +-------------+----------------+------------+
 //     |  Filename   |    Chunk Size  |     IV     |
 //     +-------------+----------------+------------+
+//
+// The most significant byte of the chunk size is never used by a valid chunk size and holds
+// flags. If the flag extended (0x80) is set, the header is followed by an extension block:
+//
+//	70B          74B
+//	+------------+--------------------------------------------+
+//	| Ext length |  Records: type (1B) | length (2B) | value  |
+//	+------------+--------------------------------------------+
+//
+// The extension block is authenticated with the filename and the chunk size. It stores
+// the optional records of the header, as the wrapped data key of the object, the
+// checksums sealed in a trailer after the data (see SetChecksums), the compression
+// of the plaintext (see SetCompression) or the encrypted metadata of the object, as
+// its filename (see SetMetadata).
+// A header without the flag is the original 70 bytes header and stays readable.
 package encdec
 
 import (
@@ -56,35 +71,209 @@ const (
 	keySize                     = 32
 	seqNumSize                  = 4
 	LAST_CHUNK_SEQ_NUM   uint32 = 0xFFFF_FFFF
+
+	flagsHeaderOffset        = chunkHeaderOffset // most significant byte of the chunk size
+	chunkSizeMask     uint64 = 0x00FF_FFFF_FFFF_FFFF
+	flagExtended      byte   = 0x80
+	extLenSize               = 4
+	maxExtSize               = 1 << 16
+	recordHeaderSize         = 3 // type (1B) and length (2B)
+
+	// Types of the records in the extension block
+	recordWrappedKey  byte = 0x01
+	recordTrailer     byte = 0x02 // types of the checksums in the trailer (see SetChecksums)
+	recordCompression byte = 0x03 // compression algorithm of the plaintext (see SetCompression)
+	recordMetadata    byte = 0x04 // metadata of the object, encrypted (see SetMetadata)
 )
 
-var ErrFilenameTooLong error = errs.New(fmt.Sprintf("filename too long, max %d bytes", filenameHeaderSize))
+// MaxHeaderSize is the size of the largest header, extension block included. The
+// header of an object is within its first MaxHeaderSize bytes.
+const MaxHeaderSize = headerSizeByte + extLenSize + maxExtSize
+
+// Errors declarations
+var (
+	ErrFilenameTooLong error = errs.New(fmt.Sprintf("filename too long, max %d bytes", filenameHeaderSize))
+	// ErrInvalidExtension error is thrown when the extension block of a header is malformed.
+	ErrInvalidExtension error = errs.New("invalid header extension")
+	// ErrRecordTooLong error is thrown when a record of the header extension exceeds its maximum size.
+	ErrRecordTooLong error = errs.New("header record too long, max 0xFFFF bytes")
+)
 
-type header [headerSizeByte]byte
+// KeyFunc gives the key to decrypt an object from the wrapped data key stored
+// in its header. The wrapped key is empty for the objects encrypted directly
+// with the master key.
+type KeyFunc func(wrappedKey []byte) ([keySize]byte, error)
 
-func (h header) IV() []byte { return h[ivHeaderOffset : ivHeaderOffset+ivHeaderSize] }
+// header is the header present at the beginning of each encrypted data. It
+// contains the fixed part and the optional extension block.
+type header struct {
+	fixed [headerSizeByte]byte
+	ext   []byte // records of the extension block, present if flagExtended is set
+
+	metadata      *Metadata // metadata set or opened, nil if none (see SetMetadata)
+	plainMetadata []byte    // metadata set, to seal into its record
+}
+
+func (h header) IV() []byte { return h.fixed[ivHeaderOffset : ivHeaderOffset+ivHeaderSize] }
 func (h *header) SetIV(iv [ivHeaderSize]byte) {
-	copy(h[ivHeaderOffset:ivHeaderOffset+ivHeaderSize], iv[:])
+	copy(h.fixed[ivHeaderOffset:ivHeaderOffset+ivHeaderSize], iv[:])
 }
 func (h header) ChunkSize() uint64 {
-	return binary.BigEndian.Uint64(h[chunkHeaderOffset : chunkHeaderOffset+chunkHeaderSize])
+	return binary.BigEndian.Uint64(h.fixed[chunkHeaderOffset:chunkHeaderOffset+chunkHeaderSize]) & chunkSizeMask
 }
 func (h *header) SetChunkSize(size uint64) {
-	binary.BigEndian.PutUint64(h[chunkHeaderOffset:chunkHeaderOffset+chunkHeaderSize], size)
+	flags := h.fixed[flagsHeaderOffset]
+	binary.BigEndian.PutUint64(h.fixed[chunkHeaderOffset:chunkHeaderOffset+chunkHeaderSize], size&chunkSizeMask)
+	h.fixed[flagsHeaderOffset] = flags
+}
+
+// aad gives the additional data authenticated with each chunk.
+func (h *header) aad() []byte {
+	aad := h.fixed[:filenameHeaderSize+chunkHeaderSize]
+	if !h.isExtended() {
+		return aad
+	}
+	res := make([]byte, 0, len(aad)+extLenSize+len(h.ext))
+	res = append(res, aad...)
+	res = binary.BigEndian.AppendUint32(res, uint32(len(h.ext)))
+	return append(res, h.ext...)
 }
-func (h *header) aad() []byte { return h[:filenameHeaderSize+chunkHeaderSize] }
+
+// bytes gives the header as written in front of the encrypted data.
+func (h *header) bytes() []byte {
+	res := make([]byte, 0, headerSizeByte+extLenSize+len(h.ext))
+	res = append(res, h.fixed[:]...)
+	if h.isExtended() {
+		res = binary.BigEndian.AppendUint32(res, uint32(len(h.ext)))
+		res = append(res, h.ext...)
+	}
+	return res
+}
+
+// EncryptedSize gives the size of the data encrypted with the header from a plaintext
+// of the given size, header included. The data can then be streamed into an upload
+// of a known size. With compression, it is the size of the data if no chunk could
+// be compressed, the largest size possible.
+func (h *header) EncryptedSize(size uint64) uint64 {
+	if size == 0 { // nothing is written, not even the header
+		return 0
+	}
+	compressed := h.Compression() != CompressionNone
+	res := uint64(len(h.bytes())) + size + tagSizeByte
+	if compressed {
+		res++ // flag of the compressed data
+	}
+	if chunkSize := h.ChunkSize(); chunkSize > 0 {
+		chunks := (size + chunkSize - 1) / chunkSize
+		perChunk := uint64(seqNumSize + tagSizeByte)
+		if compressed {
+			perChunk += chunkLenSize + 1
+		}
+		res = uint64(len(h.bytes())) + size + chunks*perChunk
+	}
+	return res + uint64(max(h.trailerSize(), 0))
+}
+
 func (h *header) SetFilename(filename string) error {
 	if len(filename) > filenameHeaderSize {
 		return ErrFilenameTooLong
 	}
-	copy(h[filenameHeaderOffset:filenameHeaderOffset+filenameHeaderSize], []byte(filename))
+	copy(h.fixed[filenameHeaderOffset:filenameHeaderOffset+filenameHeaderSize], []byte(filename))
 	return nil
 }
+
+// Filename gives the original name of the file, from the metadata if any.
 func (h *header) Filename() string {
-	filename := h[filenameHeaderOffset : filenameHeaderOffset+filenameHeaderSize]
+	if h.metadata != nil {
+		return h.metadata.Filename
+	}
+	filename := h.fixed[filenameHeaderOffset : filenameHeaderOffset+filenameHeaderSize]
 	return string(bytes.TrimRightFunc(filename, func(r rune) bool { return r == 0x0 }))
 }
 
+// WrappedKey gives the wrapped data key of the object, empty if the object is
+// encrypted directly with the master key.
+func (h *header) WrappedKey() []byte { return h.record(recordWrappedKey) }
+
+// SetWrappedKey stores the wrapped data key of the object in the header.
+func (h *header) SetWrappedKey(wrapped []byte) error {
+	return h.setRecord(recordWrappedKey, wrapped)
+}
+
+func (h *header) isExtended() bool { return h.fixed[flagsHeaderOffset]&flagExtended != 0 }
+
+// record returns the value of the record of type t in the extension block, nil
+// if not present.
+func (h *header) record(t byte) []byte {
+	for off := 0; off+recordHeaderSize <= len(h.ext); {
+		l := int(binary.BigEndian.Uint16(h.ext[off+1 : off+recordHeaderSize]))
+		if h.ext[off] == t {
+			return h.ext[off+recordHeaderSize : off+recordHeaderSize+l]
+		}
+		off += recordHeaderSize + l
+	}
+	return nil
+}
+
+// setRecord adds the record of type t in the extension block, replacing the
+// previous one if any.
+func (h *header) setRecord(t byte, value []byte) error {
+	if len(value) > 0xFFFF {
+		return ErrRecordTooLong
+	}
+	ext := make([]byte, 0, len(h.ext)+recordHeaderSize+len(value))
+	for off := 0; off+recordHeaderSize <= len(h.ext); {
+		l := int(binary.BigEndian.Uint16(h.ext[off+1 : off+recordHeaderSize]))
+		if h.ext[off] != t {
+			ext = append(ext, h.ext[off:off+recordHeaderSize+l]...)
+		}
+		off += recordHeaderSize + l
+	}
+	ext = append(ext, t)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(value)))
+	ext = append(ext, value...)
+	if len(ext) > maxExtSize {
+		return ErrRecordTooLong
+	}
+	h.ext = ext
+	h.fixed[flagsHeaderOffset] |= flagExtended
+	return nil
+}
+
+// readHeader reads a header (and its extension block if any) from r.
+func readHeader(r io.Reader) (header, int, error) {
+	h := header{}
+	n, err := io.ReadFull(r, h.fixed[:])
+	if err != nil || !h.isExtended() {
+		return h, n, err
+	}
+	var l [extLenSize]byte
+	nn, err := io.ReadFull(r, l[:])
+	n += nn
+	if err != nil {
+		return h, n, err
+	}
+	extLen := binary.BigEndian.Uint32(l[:])
+	if extLen > maxExtSize {
+		return h, n, ErrInvalidExtension
+	}
+	h.ext = make([]byte, extLen)
+	nn, err = io.ReadFull(r, h.ext)
+	n += nn
+	if err != nil {
+		return h, n, err
+	}
+	// check that the records are well formed
+	off := 0
+	for off+recordHeaderSize <= len(h.ext) {
+		off += recordHeaderSize + int(binary.BigEndian.Uint16(h.ext[off+1:off+recordHeaderSize]))
+	}
+	if off != len(h.ext) || h.trailerSize() < 0 || !h.validCompression() || !h.validMetadata() {
+		return h, n, ErrInvalidExtension
+	}
+	return h, n, nil
+}
+
 func NewHeader(chunkSize uint64, filename string) header {
 	h := header{}
 	h.SetChunkSize(chunkSize)
@@ -111,11 +300,10 @@ func newCipher(key [keySize]byte) (cipher.AEAD, error) {
 
 }
 
-
 // generateIV creates a new IV
 func generateIV() (iv [ivHeaderSize]byte, err error) {
 	// generate a random IV. The IV is set to the header which is not encrypted but authentified.
 	// The IV is not required to be secret.
 	_, err = io.ReadFull(rand.Reader, iv[:])
 	return
-}
\ No newline at end of file
+}
@@ -0,0 +1,216 @@
+package encdec
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// The checksums of the plaintext are only known once the data has been encrypted,
+// after the header has been written. They are sealed into a trailer written after
+// the last chunk:
+//
+//	+--------------------------------------------+-----+
+//	|  Records: type (1B) | length (2B) | value  | Tag |
+//	+--------------------------------------------+-----+
+//
+// The record trailer of the header extension lists the types of the records of the
+// trailer, which gives its size. The trailer is sealed with the key of the data and
+// the IV whose first byte is flipped, which is never used by a chunk (their IV only
+// differs in the last 4 bytes), and authenticates the header as the chunks.
+
+// Types of the checksums of the plaintext stored in the trailer.
+const (
+	ChecksumSHA256 byte = 0x01
+	ChecksumCRC32C byte = 0x02
+	ChecksumSize   byte = 0x03 // size of the plaintext, uint64 big endian
+)
+
+// checksumSizes gives the size of each type of checksum.
+var checksumSizes = map[byte]int{
+	ChecksumSHA256: sha256.Size,
+	ChecksumCRC32C: crc32.Size,
+	ChecksumSize:   8,
+}
+
+// crc32cTable is the table of the Castagnoli polynomial.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrInvalidTrailer error is thrown when the trailer of an object is missing or malformed.
+var ErrInvalidTrailer error = errs.New("invalid trailer")
+
+// Checksums are the checksums of the plaintext of an object.
+type Checksums struct {
+	SHA256 []byte // SHA-256 of the plaintext, nil if not recorded
+	CRC32C []byte // CRC32C (Castagnoli) of the plaintext in big endian, nil if not recorded
+	Size   []byte // size of the plaintext, uint64 big endian, nil if not recorded
+}
+
+// PlainSize gives the size of the plaintext, -1 if it is not recorded (objects
+// uploaded before the size was added to the trailer).
+func (c Checksums) PlainSize() int64 {
+	if len(c.Size) != checksumSizes[ChecksumSize] {
+		return -1
+	}
+	return int64(binary.BigEndian.Uint64(c.Size))
+}
+
+// Checksummer is implemented by the encryption writers. Once closed, they give the
+// checksums of the plaintext written, recorded in the trailer.
+type Checksummer interface {
+	Checksums() Checksums
+}
+
+// SetChecksums records in the header that the plaintext is followed by a trailer with
+// its SHA-256, its size and, if crc32c is set, its CRC32C.
+func (h *header) SetChecksums(crc32c bool) error {
+	types := []byte{ChecksumSHA256, ChecksumSize}
+	if crc32c {
+		types = append(types, ChecksumCRC32C)
+	}
+	return h.setRecord(recordTrailer, types)
+}
+
+// trailerSize gives the size of the trailer announced by the header, 0 if there is
+// none and -1 if a type of checksum is unknown.
+func (h *header) trailerSize() int {
+	types := h.record(recordTrailer)
+	if len(types) == 0 {
+		return 0
+	}
+	size := tagSizeByte
+	for _, t := range types {
+		s, ok := checksumSizes[t]
+		if !ok {
+			return -1
+		}
+		size += recordHeaderSize + s
+	}
+	return size
+}
+
+// trailerIV gives the IV of the trailer.
+func (h *header) trailerIV() []byte {
+	iv := h.IV()
+	iv[0] ^= 0x01
+	return iv
+}
+
+// checksummer computes the checksums announced by a header on the plaintext written.
+type checksummer struct {
+	types []byte
+	sha   hash.Hash
+	crc   hash.Hash32
+	size  uint64
+}
+
+// newChecksummer creates the checksummer of the header, nil if it has no trailer.
+func newChecksummer(h header) *checksummer {
+	types := h.record(recordTrailer)
+	if len(types) == 0 {
+		return nil
+	}
+	return &checksummer{types: types, sha: sha256.New(), crc: crc32.New(crc32cTable)}
+}
+
+func (c *checksummer) Write(p []byte) (int, error) {
+	c.sha.Write(p)
+	c.size += uint64(len(p))
+	return c.crc.Write(p)
+}
+
+// sums gives the checksums announced of the plaintext written.
+func (c *checksummer) sums() Checksums {
+	res := Checksums{}
+	for _, t := range c.types {
+		switch t {
+		case ChecksumSHA256:
+			res.SHA256 = c.sha.Sum(nil)
+		case ChecksumCRC32C:
+			res.CRC32C = c.crc.Sum(nil)
+		case ChecksumSize:
+			res.Size = binary.BigEndian.AppendUint64(nil, c.size)
+		}
+	}
+	return res
+}
+
+// sealTrailer seals the checksums of the plaintext written into the trailer.
+func (c *checksummer) sealTrailer(aesgcm cipher.AEAD, h *header) []byte {
+	sums := c.sums()
+	var records []byte
+	for _, t := range c.types {
+		value := sums.SHA256
+		switch t {
+		case ChecksumCRC32C:
+			value = sums.CRC32C
+		case ChecksumSize:
+			value = sums.Size
+		}
+		records = append(records, t)
+		records = binary.BigEndian.AppendUint16(records, uint16(len(value)))
+		records = append(records, value...)
+	}
+	return aesgcm.Seal(records[:0], h.trailerIV(), records, h.aad())
+}
+
+// openTrailer authenticates and decrypts the trailer of the header.
+func openTrailer(aesgcm cipher.AEAD, h *header, trailer []byte) (Checksums, error) {
+	if len(trailer) != h.trailerSize() {
+		return Checksums{}, ErrInvalidTrailer
+	}
+	records, err := aesgcm.Open(nil, h.trailerIV(), trailer, h.aad())
+	if err != nil {
+		return Checksums{}, errs.WrapWithError(err, ErrInvalidTrailer)
+	}
+	res := Checksums{}
+	for off := 0; off+recordHeaderSize <= len(records); {
+		l := int(binary.BigEndian.Uint16(records[off+1 : off+recordHeaderSize]))
+		if off+recordHeaderSize+l > len(records) {
+			return Checksums{}, ErrInvalidTrailer
+		}
+		value := records[off+recordHeaderSize : off+recordHeaderSize+l]
+		switch records[off] {
+		case ChecksumSHA256:
+			res.SHA256 = value
+		case ChecksumCRC32C:
+			res.CRC32C = value
+		case ChecksumSize:
+			res.Size = value
+		}
+		off += recordHeaderSize + l
+	}
+	return res, nil
+}
+
+// tailReader reads the data from src but holds back its last n bytes, the trailer.
+type tailReader struct {
+	src io.Reader
+	n   int
+	buf []byte // bytes read from src and not yet given, the trailer at the end
+	err error  // error of the last read from src
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for len(t.buf) <= t.n && t.err == nil {
+		if need := max(len(p), 512); cap(t.buf)-len(t.buf) < need {
+			buf := make([]byte, len(t.buf), len(t.buf)+max(need, t.n))
+			copy(buf, t.buf)
+			t.buf = buf
+		}
+		m, err := t.src.Read(t.buf[len(t.buf):cap(t.buf)])
+		t.buf, t.err = t.buf[:len(t.buf)+m], err
+	}
+	avail := len(t.buf) - t.n
+	if avail <= 0 {
+		return 0, t.err
+	}
+	k := copy(p, t.buf[:avail])
+	t.buf = t.buf[:copy(t.buf, t.buf[k:])]
+	return k, nil
+}
@@ -0,0 +1,95 @@
+package encdec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// TestTrailer tests that the checksums of the plaintext are sealed after the data,
+// that the data stays readable and that the trailer can be read from the end of
+// the encrypted data.
+func TestTrailer(t *testing.T) {
+	data := bytes.Repeat([]byte("This is a test"), 10)
+	sha := sha256.Sum256(data)
+	crc := binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, crc32cTable))
+	for _, chunkSize := range []uint64{0, 7, 14, 200} {
+		for _, withCRC := range []bool{false, true} {
+			h := NewHeader(chunkSize, "test.txt")
+			if err := h.SetChecksums(withCRC); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			buf := bytes.NewBuffer([]byte{})
+			ew, err := NewEncWriter(testKey, h, buf)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if _, err := ew.Write(data); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := ew.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			sums := ew.(Checksummer).Checksums()
+			if !bytes.Equal(sums.SHA256, sha[:]) || withCRC != bytes.Equal(sums.CRC32C, crc) {
+				t.Fatalf("chunk size %d: unexpected checksums of the writer %x, %x", chunkSize, sums.SHA256, sums.CRC32C)
+			}
+			encrypted := buf.Bytes()
+
+			// the trailer is held back even when the encrypted data comes byte per byte
+			dr, _ := NewDecReader(testKey, iotest.OneByteReader(bytes.NewReader(encrypted)))
+			res, err := io.ReadAll(dr)
+			if err != nil || !bytes.Equal(res, data) {
+				t.Fatalf("chunk size %d: cannot read the data back: %v", chunkSize, err)
+			}
+
+			dr, _ = NewDecReader(testKey, bytes.NewReader(encrypted))
+			size, err := dr.TrailerSize()
+			if err != nil || size != h.trailerSize() {
+				t.Fatalf("chunk size %d: expected a trailer of %d bytes, got %d (%v)", chunkSize, h.trailerSize(), size, err)
+			}
+			got, err := dr.ReadTrailer(bytes.NewReader(encrypted[len(encrypted)-size:]))
+			if err != nil {
+				t.Fatalf("chunk size %d: unexpected error: %v", chunkSize, err)
+			}
+			if !bytes.Equal(got.SHA256, sha[:]) || withCRC != bytes.Equal(got.CRC32C, crc) {
+				t.Fatalf("chunk size %d: unexpected checksums of the trailer %x, %x", chunkSize, got.SHA256, got.CRC32C)
+			}
+			if got.PlainSize() != int64(len(data)) {
+				t.Fatalf("chunk size %d: expected the size %d in the trailer, got %d", chunkSize, len(data), got.PlainSize())
+			}
+
+			// alter the trailer
+			tampered := append([]byte{}, encrypted[len(encrypted)-size:]...)
+			tampered[0] ^= 0x1
+			if _, err := dr.ReadTrailer(bytes.NewReader(tampered)); err == nil {
+				t.Fatalf("chunk size %d: expected an authentication error on a tampered trailer", chunkSize)
+			}
+		}
+	}
+}
+
+// TestNoTrailer tests that the objects without checksums have no trailer.
+func TestNoTrailer(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	ew, _ := NewEncWriter(testKey, NewHeader(5, "test.txt"), buf)
+	ew.Write([]byte("This is a test"))
+	ew.Close()
+	if sums := ew.(Checksummer).Checksums(); sums.SHA256 != nil || sums.CRC32C != nil {
+		t.Fatalf("expected no checksums, got %x, %x", sums.SHA256, sums.CRC32C)
+	}
+	if size := ew.(Checksummer).Checksums().PlainSize(); size != -1 {
+		t.Fatalf("expected no size, got %d", size)
+	}
+	dr, _ := NewDecReader(testKey, bytes.NewReader(buf.Bytes()))
+	if size, err := dr.TrailerSize(); err != nil || size != 0 {
+		t.Fatalf("expected no trailer, got %d (%v)", size, err)
+	}
+	if _, err := dr.ReadTrailer(bytes.NewReader(nil)); err != ErrInvalidTrailer {
+		t.Fatalf("expected ErrInvalidTrailer, got %v", err)
+	}
+}
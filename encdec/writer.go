@@ -29,6 +29,9 @@ func NewEncWriter(key [keySize]byte, header header, dest io.Writer) (io.WriteClo
 	if err != nil {
 		return nil, err
 	}
+	if err := header.sealMetadata(cipher); err != nil {
+		return nil, err
+	}
 	if header.ChunkSize() > 0 {
 		return newEncChunkWriter(header, dest, cipher), nil
 	} else {
@@ -47,6 +50,7 @@ func newEncChunkWriter(h header, dest io.Writer, aesgcm cipher.AEAD) *encChunkWr
 		offset:     0,
 		buf:        make([]byte, h.ChunkSize()),
 		firstWrite: true,
+		sums:       newChecksummer(h),
 	}
 }
 
@@ -57,13 +61,14 @@ func newEncChunkWriter(h header, dest io.Writer, aesgcm cipher.AEAD) *encChunkWr
 // where it set last chunk flag and push a last time into the underlying writer before closing.
 type encChunkWriter struct {
 	dest       io.Writer
-	buf        []byte      // buffer to retain at least a chunk. Plaintext
-	isClosed   bool        // indicate if the writer is closed
-	aesgcm     cipher.AEAD // The standard implementation of a cipher AEAD
-	currSeqNum uint32      // current sequence number
-	header     header      // Header that store the configuration of the encryption
-	offset     int         // Greater than 0 if something is into buf
-	firstWrite bool        // used to write the header on the first time
+	buf        []byte       // buffer to retain at least a chunk. Plaintext
+	isClosed   bool         // indicate if the writer is closed
+	aesgcm     cipher.AEAD  // The standard implementation of a cipher AEAD
+	currSeqNum uint32       // current sequence number
+	header     header       // Header that store the configuration of the encryption
+	offset     int          // Greater than 0 if something is into buf
+	firstWrite bool         // used to write the header on the first time
+	sums       *checksummer // checksums of the plaintext, nil without trailer
 }
 
 func (ecw *encChunkWriter) Write(p []byte) (n int, err error) {
@@ -112,11 +117,26 @@ func (ecw *encChunkWriter) Close() error {
 	if ecw.offset == 0 {
 		return ErrNoLastChunk
 	}
-	_, err := ecw.dest.Write(ecw.sealBuf(true))
+	// the trailer is written with the last chunk, both end the last part of the upload
+	last := ecw.sealBuf(true)
+	if ecw.sums != nil {
+		last = append(last, ecw.sums.sealTrailer(ecw.aesgcm, &ecw.header)...)
+	}
+	if _, err := ecw.dest.Write(last); err != nil {
+		return err
+	}
 	if w, ok := ecw.dest.(io.WriteCloser); ok {
 		return w.Close()
 	}
-	return err
+	return nil
+}
+
+// Checksums gives the checksums of the plaintext written, empty without trailer.
+func (ecw *encChunkWriter) Checksums() Checksums {
+	if ecw.sums == nil {
+		return Checksums{}
+	}
+	return ecw.sums.sums()
 }
 
 // ReadFrom is the implementation of io.ReaderFrom for the encChunkWriter.
@@ -150,25 +170,32 @@ func (ecw *encChunkWriter) ReadFrom(r io.Reader) (n int64, err error) {
 func (ecw *encChunkWriter) sealBuf(isFinal bool) []byte {
 	// 1. we need to build the IV for this chunk, embed the sequence number
 	currentIV := ecw.header.IV()
-	var destSize uint64 = seqNumSize + tagSizeByte
 	currentSeqNum := ecw.currSeqNum
 	if isFinal { // if is final chunk, put 0xFFFF_FFFF as sequence number
 		currentSeqNum = LAST_CHUNK_SEQ_NUM
-		destSize += uint64(ecw.offset)
 		ecw.buf = ecw.buf[:ecw.offset] // limit the plaintext to write
-	} else {
-		destSize += ecw.header.ChunkSize()
 	}
 	binary.BigEndian.PutUint32(currentIV[ivHeaderSize-seqNumSize:], binary.BigEndian.Uint32(currentIV[ivHeaderSize-seqNumSize:])^currentSeqNum)
+	if ecw.sums != nil {
+		ecw.sums.Write(ecw.buf)
+	}
+	// a compressed chunk has its own size, written after the sequence number
+	plaintext, prefixSize := ecw.buf, seqNumSize
+	if c := ecw.header.Compression(); c != CompressionNone {
+		plaintext, prefixSize = compress(c, ecw.buf), seqNumSize+chunkLenSize
+	}
 	// 2. Encrypt the data
-	toPush := make([]byte, destSize)
-	ecw.aesgcm.Seal(toPush[seqNumSize:seqNumSize], currentIV, ecw.buf, ecw.header.aad())
+	toPush := make([]byte, prefixSize+len(plaintext)+tagSizeByte)
+	ecw.aesgcm.Seal(toPush[prefixSize:prefixSize], currentIV, plaintext, ecw.header.aad())
 	// 3. Push the encrypted data to the writer
 	binary.BigEndian.PutUint32(toPush[:seqNumSize], currentSeqNum)
+	if prefixSize > seqNumSize {
+		binary.BigEndian.PutUint32(toPush[seqNumSize:prefixSize], uint32(len(plaintext)+tagSizeByte))
+	}
 	// 4. If it is the first write, append the header in the front
 	if ecw.firstWrite {
 		ecw.firstWrite = false
-		return append(ecw.header[:], toPush...)
+		return append(ecw.header.bytes(), toPush...)
 	}
 	return toPush
 }
@@ -178,21 +205,23 @@ func (ecw *encChunkWriter) sealBuf(isFinal bool) []byte {
 // and then encrypt and push to the underlying writer when the Close is called.
 type encWholeWriter struct {
 	dest       io.Writer
-	buf        []byte      // buffer to retain at least a chunk. Plaintext
-	aesgcm     cipher.AEAD // The standard implementation of a cipher AEAD
-	header     header      // Header that store the configuration of the encryption
-	isClosed   bool        // store if the writer has been closed
-	firstWrite bool        // store if the writer is in first write (nothing has yet been written to it)
+	buf        []byte       // buffer to retain at least a chunk. Plaintext
+	aesgcm     cipher.AEAD  // The standard implementation of a cipher AEAD
+	header     header       // Header that store the configuration of the encryption
+	isClosed   bool         // store if the writer has been closed
+	firstWrite bool         // store if the writer is in first write (nothing has yet been written to it)
+	sums       *checksummer // checksums of the plaintext, nil without trailer
 }
 
 // newEncWholeWriter creates a new encWholeWriter
 func newEncWholeWriter(h header, dest io.Writer, aesgcm cipher.AEAD) *encWholeWriter {
 	return &encWholeWriter{
-		dest:     dest,
-		aesgcm:   aesgcm,
-		header:   h,
-		isClosed: false,
+		dest:       dest,
+		aesgcm:     aesgcm,
+		header:     h,
+		isClosed:   false,
 		firstWrite: true,
+		sums:       newChecksummer(h),
 	}
 }
 
@@ -219,13 +248,33 @@ func (eww *encWholeWriter) Close() error {
 		return nil
 	}
 
-	// Seal the data and push it to the underlying writer
-	toPush := eww.aesgcm.Seal(nil, eww.header.IV(), eww.buf, eww.header.aad())
-	_, err := io.Copy(eww.dest, io.MultiReader(bytes.NewReader(eww.header[:]), bytes.NewReader(toPush)))
+	// Seal the data (compressed if needed) and push it to the underlying writer,
+	// followed by the trailer
+	plaintext := eww.buf
+	if c := eww.header.Compression(); c != CompressionNone {
+		plaintext = compress(c, eww.buf)
+	}
+	toPush := eww.aesgcm.Seal(nil, eww.header.IV(), plaintext, eww.header.aad())
+	var trailer []byte
+	if eww.sums != nil {
+		eww.sums.Write(eww.buf)
+		trailer = eww.sums.sealTrailer(eww.aesgcm, &eww.header)
+	}
+	if _, err := io.Copy(eww.dest, io.MultiReader(bytes.NewReader(eww.header.bytes()), bytes.NewReader(toPush), bytes.NewReader(trailer))); err != nil {
+		return err
+	}
 	if w, ok := eww.dest.(io.WriteCloser); ok {
 		return w.Close()
 	}
-	return err
+	return nil
+}
+
+// Checksums gives the checksums of the plaintext written, empty without trailer.
+func (eww *encWholeWriter) Checksums() Checksums {
+	if eww.sums == nil {
+		return Checksums{}
+	}
+	return eww.sums.sums()
 }
 
 // ReadFrom is the implementation of io.ReaderFrom for the encWholeWriter
@@ -2,6 +2,7 @@ package encdec
 
 import (
 	"bytes"
+	"io"
 	"testing"
 )
 
@@ -69,3 +70,39 @@ func TestBytesWritten(t *testing.T) {
 	}
 }
 
+// TestEncryptedSize tests that the size announced is the size written, with and
+// without extension block and trailer.
+func TestEncryptedSize(t *testing.T) {
+	data := bytes.Repeat([]byte("This is a test"), 10)
+	for _, chunkSize := range []uint64{0, 1, 7, 14, 140, 200} {
+		for _, wrapped := range [][]byte{nil, []byte("wrapped key")} {
+			for _, size := range []int{0, 1, 14, len(data)} {
+				dest := bytes.NewBuffer([]byte{})
+				h := NewHeader(chunkSize, "test.txt")
+				if wrapped != nil {
+					if err := h.SetWrappedKey(wrapped); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					// with a trailer
+					if err := h.SetChecksums(true); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+				}
+				w, err := NewEncWriter(testKey, h, dest)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				// as ReadFrom, an empty plaintext is never written
+				if _, err := w.(io.ReaderFrom).ReadFrom(bytes.NewReader(data[:size])); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got := h.EncryptedSize(uint64(size)); got != uint64(dest.Len()) {
+					t.Fatalf("chunk size %d, size %d: expected %d bytes, got %d", chunkSize, size, dest.Len(), got)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Package index is the local metadata index of the service, an embedded bbolt
+// database stored in a single file.
+//
+// It holds the metadata of the objects of each tenant bucket (see Entry), updated on
+// upload and delete, so the files can be listed without reading the bucket. The
+// index can be rebuilt from the objects at any time.
+//
+// It also counts the references of the deduplicated objects to their blob: each
+// object of a tenant bucket referencing a blob is recorded with it, and the number
+// of references of each blob is kept up to date, so a blob is only removed with its
+// last reference (see store.RefIndex).
+package index
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/errs"
+	"go.etcd.io/bbolt"
+)
+
+// Names of the bbolt buckets. Each tenant bucket has its own bucket under refsBucket,
+// holding the blob of each object and the number of references of each blob.
+var (
+	refsBucket    = []byte("refs")
+	objectsBucket = []byte("objects") // key of the object in the bucket -> blob
+	countsBucket  = []byte("counts")  // blob -> number of references (uint64)
+)
+
+// openTimeout is the time waited for the lock of the file, held by another process.
+const openTimeout = time.Second
+
+// Index is the metadata index. It is safe for concurrent use.
+type Index struct {
+	db *bbolt.DB
+}
+
+// Open opens the index stored in the file at path, created if it does not exist.
+// The file is locked while it is open.
+func Open(path string) (*Index, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, errs.Wrap(err, "cannot open the index "+path)
+	}
+	return &Index{db: db}, nil
+}
+
+// Close closes the index.
+func (ix *Index) Close() error { return ix.db.Close() }
+
+// SetRef records that the object of the bucket references the blob, replacing its
+// previous reference. It gives the previous blob ("" if none) and its remaining
+// number of references.
+func (ix *Index) SetRef(bucket, object, blob string) (prev string, prevRefs int, err error) {
+	err = ix.db.Update(func(tx *bbolt.Tx) error {
+		objects, counts, err := tenantBuckets(tx, bucket)
+		if err != nil {
+			return err
+		}
+		prev = string(objects.Get([]byte(object)))
+		if prev == blob {
+			prevRefs = count(counts, blob)
+			return nil
+		}
+		if prev != "" {
+			if prevRefs, err = addCount(counts, prev, -1); err != nil {
+				return err
+			}
+		}
+		if err := objects.Put([]byte(object), []byte(blob)); err != nil {
+			return err
+		}
+		_, err = addCount(counts, blob, 1)
+		return err
+	})
+	return prev, prevRefs, err
+}
+
+// RemoveRef removes the reference of the object of the bucket. It gives the blob it
+// referenced ("" if none) and its remaining number of references.
+func (ix *Index) RemoveRef(bucket, object string) (blob string, refs int, err error) {
+	err = ix.db.Update(func(tx *bbolt.Tx) error {
+		objects, counts, err := tenantBuckets(tx, bucket)
+		if err != nil {
+			return err
+		}
+		blob = string(objects.Get([]byte(object)))
+		if blob == "" {
+			return nil
+		}
+		if err := objects.Delete([]byte(object)); err != nil {
+			return err
+		}
+		refs, err = addCount(counts, blob, -1)
+		return err
+	})
+	return blob, refs, err
+}
+
+// Refs gives the number of references of the blob of the bucket.
+func (ix *Index) Refs(bucket, blob string) (refs int, err error) {
+	err = ix.db.View(func(tx *bbolt.Tx) error {
+		if tb := viewBucket(tx, refsBucket, bucket); tb != nil {
+			refs = count(tb.Bucket(countsBucket), blob)
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// tenantBuckets gives the buckets of the objects and of the counts of the tenant
+// bucket, created if needed.
+func tenantBuckets(tx *bbolt.Tx, bucket string) (objects, counts *bbolt.Bucket, err error) {
+	refs, err := tx.CreateBucketIfNotExists(refsBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	tb, err := refs.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return nil, nil, err
+	}
+	if objects, err = tb.CreateBucketIfNotExists(objectsBucket); err != nil {
+		return nil, nil, err
+	}
+	counts, err = tb.CreateBucketIfNotExists(countsBucket)
+	return objects, counts, err
+}
+
+// count gives the number of references of the blob.
+func count(counts *bbolt.Bucket, blob string) int {
+	if counts == nil {
+		return 0
+	}
+	v := counts.Get([]byte(blob))
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+// addCount adds delta to the number of references of the blob, removed at 0.
+func addCount(counts *bbolt.Bucket, blob string, delta int) (int, error) {
+	n := max(count(counts, blob)+delta, 0)
+	if n == 0 {
+		return 0, counts.Delete([]byte(blob))
+	}
+	return n, counts.Put([]byte(blob), binary.BigEndian.AppendUint64(nil, uint64(n)))
+}
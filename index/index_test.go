@@ -0,0 +1,98 @@
+package index
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func testIndex(t *testing.T) *Index {
+	ix, err := Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { ix.Close() })
+	return ix
+}
+
+func TestRefs(t *testing.T) {
+	ix := testIndex(t)
+	for _, object := range []string{"a.txt", "b.txt", "c.txt"} {
+		if _, _, err := ix.SetRef("bucket", object, "blob1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// the same reference twice does not count
+	if prev, refs, _ := ix.SetRef("bucket", "a.txt", "blob1"); prev != "blob1" || refs != 3 {
+		t.Fatalf("expected blob1 with 3 references, got %q with %d", prev, refs)
+	}
+	if refs, _ := ix.Refs("bucket", "blob1"); refs != 3 {
+		t.Fatalf("expected 3 references, got %d", refs)
+	}
+	// the buckets are independent
+	if refs, _ := ix.Refs("other", "blob1"); refs != 0 {
+		t.Fatalf("expected no reference in another bucket, got %d", refs)
+	}
+
+	// overwrite c.txt with another blob
+	if prev, refs, _ := ix.SetRef("bucket", "c.txt", "blob2"); prev != "blob1" || refs != 2 {
+		t.Fatalf("expected blob1 with 2 references left, got %q with %d", prev, refs)
+	}
+	if blob, refs, _ := ix.RemoveRef("bucket", "a.txt"); blob != "blob1" || refs != 1 {
+		t.Fatalf("expected blob1 with 1 reference left, got %q with %d", blob, refs)
+	}
+	if blob, refs, _ := ix.RemoveRef("bucket", "b.txt"); blob != "blob1" || refs != 0 {
+		t.Fatalf("expected blob1 without reference, got %q with %d", blob, refs)
+	}
+	if blob, _, _ := ix.RemoveRef("bucket", "b.txt"); blob != "" {
+		t.Fatalf("expected no blob for a removed reference, got %q", blob)
+	}
+	if refs, _ := ix.Refs("bucket", "blob2"); refs != 1 {
+		t.Fatalf("expected 1 reference of blob2, got %d", refs)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	ix := testIndex(t)
+	for _, object := range []string{"docs/b.txt", "docs/a.txt", "img.png"} {
+		if err := ix.PutEntry("bucket", Entry{Object: object, Filename: object, Size: 10}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	entries, err := ix.Entries("bucket", "docs/")
+	if err != nil || len(entries) != 2 || entries[0].Object != "docs/a.txt" || entries[1].Object != "docs/b.txt" {
+		t.Fatalf("expected the 2 entries under docs/ sorted by name, got %v (%v)", entries, err)
+	}
+	if e, ok, _ := ix.Entry("bucket", "img.png"); !ok || e.Size != 10 {
+		t.Fatalf("unexpected entry of img.png: %v, %v", e, ok)
+	}
+	if err := ix.DeleteEntry("bucket", "img.png"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok, _ := ix.Entry("bucket", "img.png"); ok {
+		t.Fatalf("expected no entry for a deleted object")
+	}
+	ix.PutEntry("bucket", Entry{Object: "docs/a.txt", StoredSize: 100, Owner: "alice"})
+	ix.PutEntry("bucket", Entry{Object: "docs/b.txt", StoredSize: 50, Owner: "bob"})
+	if count, size, err := ix.Usage("bucket", ""); err != nil || count != 2 || size != 150 {
+		t.Fatalf("expected 2 objects and 150 bytes, got %d and %d (%v)", count, size, err)
+	}
+	if count, size, err := ix.Usage("bucket", "alice"); err != nil || count != 1 || size != 100 {
+		t.Fatalf("expected 1 object and 100 bytes of alice, got %d and %d (%v)", count, size, err)
+	}
+
+	// a reset removes the entries and the references of the bucket only
+	ix.SetRef("bucket", "docs/a.txt", "blob")
+	ix.PutEntry("other", Entry{Object: "c.txt"})
+	if err := ix.Reset("bucket"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entries, _ := ix.Entries("bucket", ""); len(entries) != 0 {
+		t.Fatalf("expected no entry after a reset, got %v", entries)
+	}
+	if refs, _ := ix.Refs("bucket", "blob"); refs != 0 {
+		t.Fatalf("expected no reference after a reset, got %d", refs)
+	}
+	if entries, _ := ix.Entries("other", ""); len(entries) != 1 {
+		t.Fatalf("expected the entries of the other bucket to be kept, got %v", entries)
+	}
+}
@@ -0,0 +1,151 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// metaBucket holds a bucket per tenant bucket, with the entry of each object in JSON.
+var metaBucket = []byte("meta")
+
+// Entry is the metadata of an object, read from the object and its header at the
+// upload or on a rebuild.
+type Entry struct {
+	Object      string            `json:"object"`
+	Filename    string            `json:"filename"`               // original name of the file, from the header
+	Size        int64             `json:"size"`                   // size of the plaintext, -1 if unknown
+	StoredSize  int64             `json:"stored_size"`            // size of the encrypted data (of the blob if deduplicated)
+	ContentType string            `json:"content_type,omitempty"` // content type of the object
+	Owner       string            `json:"owner,omitempty"`        // identity of the caller who uploaded it
+	Tags        map[string]string `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"` // metadata of the client stored with the object
+	SHA256      string            `json:"sha256,omitempty"`   // SHA-256 of the plaintext in hex
+	Blob        string            `json:"blob,omitempty"`     // blob referenced by a deduplicated object
+	Created     time.Time         `json:"created"`            // time of the upload
+	Modified    time.Time         `json:"modified"`           // last change of the object or of its metadata
+}
+
+// PutEntry records the entry of an object of the bucket, replacing the previous one.
+func (ix *Index) PutEntry(bucket string, e Entry) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return ix.db.Update(func(tx *bbolt.Tx) error {
+		b, err := metaTenantBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(e.Object), value)
+	})
+}
+
+// DeleteEntry removes the entry of an object of the bucket, if any.
+func (ix *Index) DeleteEntry(bucket, object string) error {
+	return ix.db.Update(func(tx *bbolt.Tx) error {
+		b, err := metaTenantBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return b.Delete([]byte(object))
+	})
+}
+
+// Entry gives the entry of an object of the bucket, ok is false if it has none.
+func (ix *Index) Entry(bucket, object string) (e Entry, ok bool, err error) {
+	err = ix.db.View(func(tx *bbolt.Tx) error {
+		b := viewBucket(tx, metaBucket, bucket)
+		if b == nil {
+			return nil
+		}
+		value := b.Get([]byte(object))
+		if value == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(value, &e)
+	})
+	return e, ok, err
+}
+
+// Entries gives the entries of the objects of the bucket whose name starts with
+// prefix, sorted by name.
+func (ix *Index) Entries(bucket, prefix string) ([]Entry, error) {
+	var res []Entry
+	err := ix.db.View(func(tx *bbolt.Tx) error {
+		b := viewBucket(tx, metaBucket, bucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			res = append(res, e)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Usage gives the number of objects of the bucket and the total of their stored size
+// (of their blob if deduplicated), only the ones of the owner if it is given.
+func (ix *Index) Usage(bucket, owner string) (count, size uint64, err error) {
+	err = ix.db.View(func(tx *bbolt.Tx) error {
+		b := viewBucket(tx, metaBucket, bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if owner == "" || e.Owner == owner {
+				count, size = count+1, size+uint64(max(e.StoredSize, 0))
+			}
+			return nil
+		})
+	})
+	return count, size, err
+}
+
+// Reset removes the entries and the references of the bucket, before a rebuild.
+func (ix *Index) Reset(bucket string) error {
+	return ix.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{metaBucket, refsBucket} {
+			b := tx.Bucket(name)
+			if b == nil || b.Bucket([]byte(bucket)) == nil {
+				continue
+			}
+			if err := b.DeleteBucket([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// metaTenantBucket gives the bucket of the entries of the tenant bucket, created if needed.
+func metaTenantBucket(tx *bbolt.Tx, bucket string) (*bbolt.Bucket, error) {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return nil, err
+	}
+	return meta.CreateBucketIfNotExists([]byte(bucket))
+}
+
+// viewBucket gives the bucket of the tenant bucket under the bucket name, nil if it
+// does not exist.
+func viewBucket(tx *bbolt.Tx, name []byte, bucket string) *bbolt.Bucket {
+	b := tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return b.Bucket([]byte(bucket))
+}
@@ -0,0 +1,140 @@
+// Package keys provides the data keys used to encrypt the objects.
+//
+// Each object is encrypted with its own random data key. The data key is wrapped
+// (encrypted) by a master key and the wrapped form is stored in the header of the
+// object. To decrypt an object, the wrapped key is given back to the Provider that
+// unwraps it.
+//
+// Two providers are available:
+//   - Local: the master key is held by the service (loaded from the configuration,
+//     a file or an environment variable).
+//   - VaultTransit: the master key never leaves a HashiCorp Vault Transit engine,
+//     the service only asks Vault to generate and to unwrap the data keys.
+//
+// A Ring combines the active provider with the previous local master keys, to
+// rotate the master key without losing the access to the existing objects.
+package keys
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// KeySize is the size of the data keys (AES 256)
+const KeySize = 32
+
+// Errors declarations
+var (
+	// ErrUnknownWrapping error is thrown when a wrapped key has not been produced by the provider.
+	ErrUnknownWrapping = errs.New("the wrapped key has not been produced by this key provider")
+	// ErrNoMasterKey error is thrown when an object encrypted directly with the master key (before
+	// the key wrapping) is read with a provider that does not hold the master key.
+	ErrNoMasterKey = errs.New("the key provider cannot decrypt objects without wrapped key")
+)
+
+// Provider gives the data keys of the objects.
+type Provider interface {
+	// DataKey generates a new data key. It returns the key in plaintext, used to
+	// encrypt the object, and its wrapped form, stored with the object.
+	DataKey(ctx context.Context) (key [KeySize]byte, wrapped []byte, err error)
+	// Unwrap gives back the plaintext data key from its wrapped form. An empty
+	// wrapped key gives the master key used before the key wrapping, if the
+	// provider holds it.
+	Unwrap(ctx context.Context, wrapped []byte) ([KeySize]byte, error)
+}
+
+// localPrefix is the prefix of the keys wrapped by a Local provider.
+const localPrefix = "local:"
+
+// Local is a Provider holding the master key in memory. The data keys are
+// wrapped with AES GCM. The wrapped form is "local:<id>:<base64(nonce|ciphertext)>",
+// the id allows to know which master key wrapped the data key.
+type Local struct {
+	id     string
+	master [KeySize]byte
+	aead   cipher.AEAD
+}
+
+// NewLocal creates a new Local provider with the master key identified by id.
+func NewLocal(id string, master [KeySize]byte) (*Local, error) {
+	if id == "" || strings.Contains(id, ":") {
+		return nil, errs.New("the id of a local key must not be empty nor contain ':'")
+	}
+	block, err := aes.NewCipher(master[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{id: id, master: master, aead: aead}, nil
+}
+
+// ID gives the identifier of the master key.
+func (l *Local) ID() string { return l.id }
+
+// DataKey is the implementation of Provider.
+func (l *Local) DataKey(ctx context.Context) (key [KeySize]byte, wrapped []byte, err error) {
+	if _, err = io.ReadFull(rand.Reader, key[:]); err != nil {
+		return key, nil, err
+	}
+	nonce := make([]byte, l.aead.NonceSize(), l.aead.NonceSize()+KeySize+l.aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return key, nil, err
+	}
+	sealed := l.aead.Seal(nonce, nonce, key[:], []byte(l.id))
+	wrapped = []byte(localPrefix + l.id + ":" + base64.RawStdEncoding.EncodeToString(sealed))
+	return key, wrapped, nil
+}
+
+// Unwrap is the implementation of Provider.
+func (l *Local) Unwrap(ctx context.Context, wrapped []byte) (key [KeySize]byte, err error) {
+	if len(wrapped) == 0 {
+		return l.master, nil
+	}
+	id, sealed, err := parseLocal(wrapped)
+	if err != nil {
+		return key, err
+	}
+	if id != l.id {
+		return key, errs.Wrap(ErrUnknownWrapping, "unknown local key "+id)
+	}
+	if len(sealed) < l.aead.NonceSize() {
+		return key, ErrUnknownWrapping
+	}
+	nonce := sealed[:l.aead.NonceSize()]
+	plain, err := l.aead.Open(nil, nonce, sealed[l.aead.NonceSize():], []byte(l.id))
+	if err != nil {
+		return key, errs.Wrap(err, "cannot unwrap the data key")
+	}
+	if copy(key[:], plain) != KeySize {
+		return key, ErrUnknownWrapping
+	}
+	return key, nil
+}
+
+// parseLocal splits a key wrapped by a Local provider into the id of the master
+// key and the sealed data key.
+func parseLocal(wrapped []byte) (id string, sealed []byte, err error) {
+	rest, ok := strings.CutPrefix(string(wrapped), localPrefix)
+	if !ok {
+		return "", nil, ErrUnknownWrapping
+	}
+	id, enc, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", nil, ErrUnknownWrapping
+	}
+	sealed, err = base64.RawStdEncoding.DecodeString(enc)
+	if err != nil {
+		return "", nil, errs.WrapWithError(err, ErrUnknownWrapping)
+	}
+	return id, sealed, nil
+}
@@ -0,0 +1,198 @@
+package keys
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var testMaster = [KeySize]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+	16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31}
+
+// TestLocal tests the wrapping of data keys with a master key held by the service.
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	l, err := NewLocal("k1", testMaster)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key, wrapped, err := l.DataKey(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if key == testMaster || !strings.HasPrefix(string(wrapped), "local:k1:") {
+		t.Fatalf("unexpected data key %x wrapped as %s", key, wrapped)
+	}
+	unwrapped, err := l.Unwrap(ctx, wrapped)
+	if err != nil || unwrapped != key {
+		t.Fatalf("expected to unwrap %x, got %x (%v)", key, unwrapped, err)
+	}
+
+	// objects without wrapped key are encrypted with the master key
+	if k, err := l.Unwrap(ctx, nil); err != nil || k != testMaster {
+		t.Fatalf("expected the master key, got %x (%v)", k, err)
+	}
+
+	// another master key must not unwrap
+	other, _ := NewLocal("k2", testMaster)
+	if _, err := other.Unwrap(ctx, wrapped); err == nil {
+		t.Fatal("expected an error with another key id")
+	}
+	// tampered key
+	tampered := append([]byte{}, wrapped...)
+	tampered[len(tampered)-2] ^= 0x1
+	if _, err := l.Unwrap(ctx, tampered); err == nil {
+		t.Fatal("expected an error with a tampered key")
+	}
+	if _, err := NewLocal("a:b", testMaster); err == nil {
+		t.Fatal("expected an error with ':' in the id")
+	}
+}
+
+// newVaultStandIn starts a local stand-in of the vault transit engine wrapping
+// the keys with its own master key.
+func newVaultStandIn(t *testing.T, token string) *httptest.Server {
+	t.Helper()
+	var master [KeySize]byte
+	rand.Read(master[:])
+	block, _ := aes.NewCipher(master[:])
+	aead, _ := cipher.NewGCM(block)
+
+	reply := func(w http.ResponseWriter, status int, v any) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			reply(w, http.StatusForbidden, map[string]any{"errors": []string{"permission denied"}})
+			return
+		}
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/v1/transit/datakey/plaintext/taurus":
+			key := make([]byte, KeySize)
+			rand.Read(key)
+			nonce := make([]byte, aead.NonceSize())
+			rand.Read(nonce)
+			ct := "vault:v1:" + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, key, nil))
+			reply(w, http.StatusOK, map[string]any{"data": map[string]string{
+				"plaintext": base64.StdEncoding.EncodeToString(key), "ciphertext": ct,
+			}})
+		case "/v1/transit/decrypt/taurus":
+			ct, _ := body["ciphertext"].(string)
+			sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ct, "vault:v1:"))
+			if err != nil || len(sealed) < aead.NonceSize() {
+				reply(w, http.StatusBadRequest, map[string]any{"errors": []string{"invalid ciphertext"}})
+				return
+			}
+			key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+			if err != nil {
+				reply(w, http.StatusBadRequest, map[string]any{"errors": []string{"cipher: message authentication failed"}})
+				return
+			}
+			reply(w, http.StatusOK, map[string]any{"data": map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}})
+		default:
+			reply(w, http.StatusNotFound, map[string]any{"errors": []string{}})
+		}
+	}))
+}
+
+// TestVaultTransit tests the vault provider against a local stand-in of vault.
+func TestVaultTransit(t *testing.T) {
+	ctx := context.Background()
+	srv := newVaultStandIn(t, "s.token")
+	defer srv.Close()
+
+	vt, err := NewVaultTransit(VaultOptions{Address: srv.URL, KeyName: "taurus", Token: "s.token"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key, wrapped, err := vt.DataKey(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(wrapped), "vault:") {
+		t.Fatalf("expected a vault ciphertext, got %s", wrapped)
+	}
+	unwrapped, err := vt.Unwrap(ctx, wrapped)
+	if err != nil || unwrapped != key {
+		t.Fatalf("expected to unwrap %x, got %x (%v)", key, unwrapped, err)
+	}
+	if _, err := vt.Unwrap(ctx, nil); err != ErrNoMasterKey {
+		t.Fatalf("expected ErrNoMasterKey, got %v", err)
+	}
+	if _, err := vt.Unwrap(ctx, []byte("local:k1:abc")); err != ErrUnknownWrapping {
+		t.Fatalf("expected ErrUnknownWrapping, got %v", err)
+	}
+
+	bad, _ := NewVaultTransit(VaultOptions{Address: srv.URL, KeyName: "taurus", Token: "wrong"})
+	if _, _, err := bad.DataKey(ctx); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected a permission denied error, got %v", err)
+	}
+}
+
+// TestRing tests that the data keys wrapped by a previous master key can still be
+// unwrapped after the rotation and that the legacy objects use the default key.
+func TestRing(t *testing.T) {
+	ctx := context.Background()
+	old, err := NewLocal(LegacyID, [KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	active, err := NewLocal("k2", [KeySize]byte{2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	oldKey, oldWrapped, err := old.DataKey(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ring, err := NewRing(active, old)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key, wrapped, err := ring.DataKey(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(string(wrapped), "local:k2:") {
+		t.Fatalf("the data key is not wrapped by the active key: %s", wrapped)
+	}
+	for _, tc := range []struct {
+		wrapped []byte
+		want    [KeySize]byte
+	}{
+		{wrapped, key},
+		{oldWrapped, oldKey},
+		{nil, [KeySize]byte{1}},
+	} {
+		got, err := ring.Unwrap(ctx, tc.wrapped)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != tc.want {
+			t.Fatalf("wrong key unwrapped for %q", tc.wrapped)
+		}
+	}
+
+	// without the previous key, its objects cannot be read anymore
+	ring, err = NewRing(active)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := ring.Unwrap(ctx, oldWrapped); err == nil {
+		t.Fatalf("expected an error for a key not in the ring")
+	}
+	if _, err := NewRing(active, old, old); err != nil {
+		t.Fatalf("the same key given twice must be accepted: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package keys
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// LegacyID is the id of the local master key used to decrypt the objects
+// encrypted before the key wrapping (without wrapped key).
+const LegacyID = "default"
+
+// Ring is a Provider generating the data keys with its active provider and
+// unwrapping them with the local master key that wrapped them. It allows to
+// rotate the master key: the new key becomes active while the previous ones
+// stay in the ring to read the existing objects.
+type Ring struct {
+	active Provider
+	locals map[string]*Local
+}
+
+// NewRing creates a new ring. The active provider generates the data keys and
+// the locals are only used to unwrap them. If the active provider is a Local,
+// it is added to the locals.
+func NewRing(active Provider, locals ...*Local) (*Ring, error) {
+	r := &Ring{active: active, locals: make(map[string]*Local, len(locals)+1)}
+	if l, ok := active.(*Local); ok {
+		locals = append(locals, l)
+	}
+	for _, l := range locals {
+		if prev, ok := r.locals[l.id]; ok && prev != l {
+			return nil, errs.New("duplicated local key " + l.id + " in the key ring")
+		}
+		r.locals[l.id] = l
+	}
+	return r, nil
+}
+
+// DataKey is the implementation of Provider, the key is generated by the active provider.
+func (r *Ring) DataKey(ctx context.Context) (key [KeySize]byte, wrapped []byte, err error) {
+	return r.active.DataKey(ctx)
+}
+
+// Unwrap is the implementation of Provider. The keys wrapped by a local master key
+// are unwrapped by the key of the ring with the same id, the others by the active
+// provider. An empty wrapped key is unwrapped by the local key LegacyID if the ring
+// contains it, by the active provider otherwise.
+func (r *Ring) Unwrap(ctx context.Context, wrapped []byte) (key [KeySize]byte, err error) {
+	if len(wrapped) == 0 {
+		if l, ok := r.locals[LegacyID]; ok {
+			return l.Unwrap(ctx, wrapped)
+		}
+		return r.active.Unwrap(ctx, wrapped)
+	}
+	if !strings.HasPrefix(string(wrapped), localPrefix) {
+		return r.active.Unwrap(ctx, wrapped)
+	}
+	id, _, err := parseLocal(wrapped)
+	if err != nil {
+		return key, err
+	}
+	l, ok := r.locals[id]
+	if !ok {
+		return key, errs.Wrap(ErrUnknownWrapping, "local key "+id+" not in the key ring")
+	}
+	return l.Unwrap(ctx, wrapped)
+}
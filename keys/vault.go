@@ -0,0 +1,172 @@
+package keys
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// vaultPrefix is the prefix of the ciphertexts produced by Vault Transit.
+const vaultPrefix = "vault:"
+
+// VaultOptions are the options to reach a HashiCorp Vault Transit secrets engine.
+type VaultOptions struct {
+	Address   string        // address of vault, e.g. https://vault:8200
+	Mount     string        // mount path of the transit engine, default "transit"
+	KeyName   string        // name of the transit key wrapping the data keys
+	Token     string        // vault token, prefer TokenFile
+	TokenFile string        // file containing the vault token, read on each request
+	CAFile    string        // optional PEM bundle to verify the vault certificate
+	Timeout   time.Duration // timeout of a request to vault, default 10s
+}
+
+// VaultTransit is a Provider using the Transit secrets engine of HashiCorp Vault.
+// The master key never leaves vault: the data keys are generated by vault
+// (datakey endpoint) and unwrapped by vault (decrypt endpoint).
+type VaultTransit struct {
+	base   *url.URL
+	mount  string
+	key    string
+	token  func() (string, error)
+	client *http.Client
+}
+
+// NewVaultTransit creates a new Provider using Vault Transit.
+func NewVaultTransit(opts VaultOptions) (*VaultTransit, error) {
+	if opts.Address == "" || opts.KeyName == "" {
+		return nil, errs.New("vault address and key name are required")
+	}
+	base, err := url.Parse(opts.Address)
+	if err != nil {
+		return nil, errs.Wrap(err, "cannot parse the vault address")
+	}
+	vt := &VaultTransit{
+		base:   base,
+		mount:  strings.Trim(opts.Mount, "/"),
+		key:    opts.KeyName,
+		client: &http.Client{Timeout: opts.Timeout},
+	}
+	if vt.mount == "" {
+		vt.mount = "transit"
+	}
+	if vt.client.Timeout == 0 {
+		vt.client.Timeout = 10 * time.Second
+	}
+	switch {
+	case opts.TokenFile != "":
+		vt.token = func() (string, error) {
+			t, err := os.ReadFile(opts.TokenFile)
+			return strings.TrimSpace(string(t)), err
+		}
+	case opts.Token != "":
+		vt.token = func() (string, error) { return opts.Token, nil }
+	default:
+		return nil, errs.New("a vault token or token file is required")
+	}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, errs.Wrap(err, "cannot read the vault CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errs.New("no certificate found in the vault CA file")
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+		vt.client.Transport = tr
+	}
+	return vt, nil
+}
+
+// DataKey is the implementation of Provider. It asks vault for a new data key.
+func (vt *VaultTransit) DataKey(ctx context.Context) (key [KeySize]byte, wrapped []byte, err error) {
+	var res struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err = vt.call(ctx, "datakey/plaintext/"+url.PathEscape(vt.key), map[string]any{"bits": KeySize * 8}, &res); err != nil {
+		return key, nil, err
+	}
+	if err = decodeKey(res.Plaintext, &key); err != nil {
+		return key, nil, err
+	}
+	return key, []byte(res.Ciphertext), nil
+}
+
+// Unwrap is the implementation of Provider. It asks vault to decrypt the data key.
+func (vt *VaultTransit) Unwrap(ctx context.Context, wrapped []byte) (key [KeySize]byte, err error) {
+	if len(wrapped) == 0 {
+		return key, ErrNoMasterKey
+	}
+	if !bytes.HasPrefix(wrapped, []byte(vaultPrefix)) {
+		return key, ErrUnknownWrapping
+	}
+	var res struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err = vt.call(ctx, "decrypt/"+url.PathEscape(vt.key), map[string]any{"ciphertext": string(wrapped)}, &res); err != nil {
+		return key, err
+	}
+	return key, decodeKey(res.Plaintext, &key)
+}
+
+// call does a POST request on the transit engine and decodes the data of the response into res.
+func (vt *VaultTransit) call(ctx context.Context, path string, body any, res any) error {
+	token, err := vt.token()
+	if err != nil {
+		return errs.Wrap(err, "cannot read the vault token")
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := vt.base.JoinPath("v1", vt.mount, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := vt.client.Do(req)
+	if err != nil {
+		return errs.Wrap(err, "cannot reach vault")
+	}
+	defer resp.Body.Close()
+
+	var vr struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil {
+		return errs.Wrap(err, fmt.Sprintf("cannot decode the vault response (status %d)", resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errs.New(fmt.Sprintf("vault answered %d: %s", resp.StatusCode, strings.Join(vr.Errors, ", ")))
+	}
+	return json.Unmarshal(vr.Data, res)
+}
+
+// decodeKey decodes a base64 key given by vault.
+func decodeKey(b64 string, key *[KeySize]byte) error {
+	plain, err := base64.StdEncoding.DecodeString(b64)
+	if err != nil {
+		return errs.Wrap(err, "cannot decode the key given by vault")
+	}
+	if len(plain) != KeySize {
+		return errs.New(fmt.Sprintf("vault gave a key of %d bytes, expected %d", len(plain), KeySize))
+	}
+	copy(key[:], plain)
+	return nil
+}
@@ -0,0 +1,87 @@
+// Package logging is a thin leveled layer over the standard logger.
+//
+// The messages are prefixed by their level ([DEBUG], [INFO], [WARN], [ERROR]) and
+// the ones below the current level are dropped. The level can be changed at any
+// time, for example when the configuration is reloaded.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// Level is the severity of a message.
+type Level int32
+
+// Levels, from the most verbose to the least.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = [...]string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// String gives the name of the level as used in the configuration.
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return strings.ToLower(levelNames[l])
+}
+
+// ParseLevel converts the name of a level (debug, info, warn, error) into a Level.
+// An empty name gives LevelInfo.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, errs.New(fmt.Sprintf("unknown log level [%s], use [debug, info, warn, error]", s))
+}
+
+var current atomic.Int32
+
+func init() { current.Store(int32(LevelInfo)) }
+
+// SetLevel changes the minimal level of the messages logged.
+func SetLevel(l Level) { current.Store(int32(l)) }
+
+// GetLevel gives the minimal level of the messages logged.
+func GetLevel() Level { return Level(current.Load()) }
+
+// Enabled tells if the messages of the given level are logged.
+func Enabled(l Level) bool { return l >= GetLevel() }
+
+func logf(l Level, format string, v ...any) {
+	if !Enabled(l) {
+		return
+	}
+	log.Output(3, "["+levelNames[l]+"] "+fmt.Sprintf(format, v...))
+}
+
+// Debugf logs a message at the debug level.
+func Debugf(format string, v ...any) { logf(LevelDebug, format, v...) }
+
+// Infof logs a message at the info level.
+func Infof(format string, v ...any) { logf(LevelInfo, format, v...) }
+
+// Warnf logs a message at the warn level.
+func Warnf(format string, v ...any) { logf(LevelWarn, format, v...) }
+
+// Errorf logs a message at the error level.
+func Errorf(format string, v ...any) { logf(LevelError, format, v...) }
+
+// Fatal logs the message whatever the level and exits the program.
+func Fatal(v ...any) { log.Fatal(v...) }
@@ -2,27 +2,60 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"hash/fnv"
 	"io"
-	"log"
+	"math"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/textproto"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
 
 	"github.com/ag0st/taurus-challenge/api"
+	"github.com/ag0st/taurus-challenge/auth"
 	"github.com/ag0st/taurus-challenge/config"
+	"github.com/ag0st/taurus-challenge/encdec"
 	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/ag0st/taurus-challenge/index"
+	"github.com/ag0st/taurus-challenge/keys"
+	"github.com/ag0st/taurus-challenge/logging"
+	"github.com/ag0st/taurus-challenge/ratelimit"
 	"github.com/ag0st/taurus-challenge/store"
+	"github.com/ag0st/taurus-challenge/tlsconf"
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
 )
 
-// Regexes for API path matching
+// Regexes for API path matching. The files of a tenant are under /api/{tenant}/file,
+// the ones under /api/file belong to the tenant of the caller. The same goes for
+// the usage under /api/quota.
 var (
-	FileRe       = regexp.MustCompile(`^/api/file/*$`)
-	FileReWithID = regexp.MustCompile(`^/api/file/(.)+$`)
+	FileRe             = regexp.MustCompile(`^/api/file/*$`)
+	FileReWithID       = regexp.MustCompile(`^/api/file/(.)+$`)
+	TenantFileRe       = regexp.MustCompile(`^/api/([^/]+)/file/*$`)
+	TenantFileReWithID = regexp.MustCompile(`^/api/([^/]+)/file/(.+)$`)
+	QuotaRe            = regexp.MustCompile(`^/api/quota/*$`)
+	TenantQuotaRe      = regexp.MustCompile(`^/api/([^/]+)/quota/*$`)
 )
 
 // Error declarations. This is the errors we throw back to the client.
@@ -31,11 +64,24 @@ var (
 	ErrAccessForbidden     = errs.NewWithCode("no authorization to the resource", http.StatusForbidden)
 	ErrInvalidFormName     = errs.NewWithCode("invalid form name in multipart/form-data", http.StatusBadRequest)
 	ErrInternalServerError = errs.NewWithCode("internal server error", http.StatusInternalServerError)
+	ErrQuotaExceeded       = errs.NewWithCode("the quota of the tenant is exceeded", http.StatusInsufficientStorage)
+	ErrCallerQuotaExceeded = errs.NewWithCode("the quota of the caller is exceeded", http.StatusInsufficientStorage)
+	ErrObjectTooLarge      = errs.NewWithCode("the file exceeds the maximum object size", http.StatusRequestEntityTooLarge)
+	ErrInvalidUploadMode   = errs.NewWithCode("invalid mode or chunk size for the upload", http.StatusBadRequest)
+	ErrTooManyRequests     = errs.NewWithCode("too many requests, retry later", http.StatusTooManyRequests)
+	ErrInvalidChecksum     = errs.NewWithCode("invalid checksum of the file", http.StatusBadRequest)
+	ErrChecksumMismatch    = errs.NewWithCode("the file does not match its checksum", http.StatusBadRequest)
+	ErrReservedName        = errs.NewWithCode("the name of the object is reserved", http.StatusBadRequest)
+	ErrUploadTooLarge      = errs.NewWithCode("the file is too large for the mode or the chunk size of the upload", http.StatusRequestEntityTooLarge)
+	ErrInvalidMetadata     = errs.NewWithCode("invalid tags or metadata of the file", http.StatusBadRequest)
+	ErrPreconditionFailed  = errs.NewWithCode("the file does not match the conditions of the request", http.StatusPreconditionFailed)
+	ErrFileChanged         = errs.NewWithCode("the file has been replaced during the download, retry", http.StatusConflict)
 )
 
 type storeConfig struct {
-	conn   *store.Connection
-	bucket string
+	conn  *store.Connection
+	index *index.Index // metadata index, nil without index.path
+	locks objectLocks  // serializes the changes of an object with their preconditions
 }
 
 type handlerWithErrorFunc func(http.ResponseWriter, *http.Request) error
@@ -49,7 +95,7 @@ func (f handlerWithErrorFunc) ServeHTTP(w http.ResponseWriter, r *http.Request)
 func toApiError(err error) *errs.Error {
 	// assert that the error is not nil
 	if err == nil {
-		log.Fatal("toApiError : the given error is nil")
+		logging.Fatal("toApiError : the given error is nil")
 	}
 	var nerr error
 	// Here we differentiate the error returned by our service
@@ -57,11 +103,10 @@ func toApiError(err error) *errs.Error {
 	switch err := err.(type) {
 	case *errs.Error:
 		// Check that it is one of the errors that we can throw back
-		// to the client. If not, wrap it with an error
-		switch err {
-		case ErrNotFound, ErrInvalidFormName, ErrInternalServerError:
+		// to the client (declared with a status code). If not, wrap it with an error
+		if err.StatusCode != 0 {
 			nerr = err
-		default:
+		} else {
 			nerr = errs.WrapWithError(err, ErrInternalServerError)
 		}
 	case minio.ErrorResponse:
@@ -84,7 +129,7 @@ func toApiError(err error) *errs.Error {
 	if res, ok := nerr.(*errs.Error); ok {
 		return res
 	} else {
-		log.Fatal("Cannot convert an error to the errs.Error format. Must never happens.")
+		logging.Fatal("Cannot convert an error to the errs.Error format. Must never happens.")
 	}
 	return nil
 }
@@ -97,7 +142,7 @@ func errorHandler(next handlerWithError) http.Handler {
 		if err != nil {
 			nerr := toApiError(err)
 			// print the error
-			log.Printf("[ERROR] %v", err)
+			logging.Errorf("%v", err)
 
 			err = errs.Collaps(errs.WrapPath(err, r.URL.Path))
 			// function to work with incoming errors
@@ -122,17 +167,156 @@ type handlerWithError interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request) error
 }
 
+// identityHandler resolves the identity of the caller (subject of the client
+// certificate when mutual TLS is enabled) and stores it in the request context
+// for the next handlers.
+func identityHandler(next handlerWithError) handlerWithError {
+	fn := func(w http.ResponseWriter, r *http.Request) error {
+		if caller, ok := auth.FromRequest(r); ok {
+			r = r.WithContext(auth.WithCaller(r.Context(), caller))
+		}
+		return next.ServeHTTP(w, r)
+	}
+	return handlerWithErrorFunc(fn)
+}
+
+// clientLimits holds the state of the limits of the clients (see config.Limits).
+type clientLimits struct {
+	requests  *ratelimit.Limiter // requests per client
+	bytes     *ratelimit.Limiter // bytes uploaded and downloaded per client
+	transfers ratelimit.Gate     // uploads and downloads in progress
+}
+
+// limitHandler rejects with a 429 the requests of the clients above their rate of
+// requests, and the uploads and downloads above the number of transfers in
+// progress. The bytes read from the request and written to the response are
+// throttled at the rate of bytes of the client: each chunk waits for its tokens
+// before it is passed through.
+// PRE: the identity of the caller is resolved (see identityHandler).
+func limitHandler(cl *clientLimits, next handlerWithError) handlerWithError {
+	fn := func(w http.ResponseWriter, r *http.Request) error {
+		lc := config.GetCurrent().Service().Limits()
+		key := clientKey(r)
+		requestRate := ratelimit.Rate{PerSecond: lc.RequestsPerSecond(), Burst: float64(lc.RequestBurst())}
+		byteRate := ratelimit.Rate{PerSecond: float64(lc.BytesPerSecond()), Burst: float64(lc.BytesBurst())}
+		if wait, ok := cl.requests.Allow(key, 1, requestRate); !ok {
+			return tooManyRequests(w, wait)
+		}
+		if isTransfer(r) {
+			if !cl.transfers.Enter(lc.MaxTransfers()) {
+				return tooManyRequests(w, time.Second)
+			}
+			defer cl.transfers.Leave()
+		}
+		if !byteRate.Unlimited() {
+			ctx := r.Context()
+			wait := func(n int) error { return cl.bytes.Wait(ctx, key, float64(n), byteRate) }
+			chunk := int(min(throttleChunk, max(byteRate.Burst, 1)))
+			r.Body = &throttledBody{ReadCloser: r.Body, wait: wait, chunk: chunk}
+			w = &throttledWriter{ResponseWriter: w, wait: wait, chunk: chunk}
+		}
+		return next.ServeHTTP(w, r)
+	}
+	return handlerWithErrorFunc(fn)
+}
+
+// clientKey identifies the client of the request for its limits: its identity or,
+// for the anonymous callers, its address.
+func clientKey(r *http.Request) string {
+	if caller := auth.Caller(r.Context()); caller != auth.Anonymous {
+		return "caller:" + caller
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// isTransfer tells if the request is an upload or a download.
+func isTransfer(r *http.Request) bool {
+	path := r.URL.Path
+	return r.Method == http.MethodPost ||
+		r.Method == http.MethodGet && (FileReWithID.MatchString(path) || TenantFileReWithID.MatchString(path))
+}
+
+// tooManyRequests sets the time to wait before retrying, in whole seconds, and
+// gives the error of the answer.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) error {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+	return ErrTooManyRequests
+}
+
+// throttleChunk is the maximum size of the chunks throttled at once, a chunk is
+// passed through once all its bytes are allowed.
+const throttleChunk = 32 << 10
+
+// throttledBody reads the body of a request by chunks, waiting for each chunk read.
+type throttledBody struct {
+	io.ReadCloser
+	wait  func(n int) error
+	chunk int
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p[:min(len(p), b.chunk)])
+	if werr := b.wait(n); werr != nil {
+		return 0, werr
+	}
+	return n, err
+}
+
+// throttledWriter writes a response by chunks, waiting for each chunk before it is
+// written.
+type throttledWriter struct {
+	http.ResponseWriter
+	wait  func(n int) error
+	chunk int
+}
+
+func (tw *throttledWriter) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		chunk := p[n:min(len(p), n+tw.chunk)]
+		if err := tw.wait(len(chunk)); err != nil {
+			return n, err
+		}
+		m, err := tw.ResponseWriter.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Unwrap gives the original writer to http.ResponseController.
+func (tw *throttledWriter) Unwrap() http.ResponseWriter { return tw.ResponseWriter }
+
 // httpHandler is the main handler of the API. It dispatches the call to the right specific handler.
 func httpHandler(sc *storeConfig) handlerWithError {
 	fn := func(w http.ResponseWriter, r *http.Request) error {
+		tenant, res, objectName, err := route(r)
+		if err != nil {
+			return err
+		}
 		// Switch on the type of request
 		switch {
-		case r.Method == http.MethodGet && FileRe.MatchString(r.URL.Path): // List all files
-			return handleListFile(sc, w, r)
-		case r.Method == http.MethodPost && FileRe.MatchString(r.URL.Path): // Add a new file
-			return handleAddFile(sc, w, r)
-		case r.Method == http.MethodGet && FileReWithID.MatchString(r.URL.Path): // Get a file
-			return handleGetFile(sc, w, r)
+		case res == resourceQuota && r.Method == http.MethodGet: // Usage and quotas
+			return handleQuota(sc, tenant, w, r)
+		case res == resourceQuota:
+			return ErrNotFound
+		case r.Method == http.MethodGet && objectName == "": // List all files
+			return handleListFile(sc, tenant, w, r)
+		case r.Method == http.MethodPost && objectName == "": // Add a new file
+			return handleAddFile(sc, tenant, w, r)
+		case r.Method == http.MethodPut && strings.HasSuffix(objectName, tagsSuffix): // Replace the tags of a file
+			return handleSetTags(sc, tenant, strings.TrimSuffix(objectName, tagsSuffix), w, r)
+		case r.Method == http.MethodGet && r.URL.Query().Has("metadata"): // Get the metadata of a file
+			return handleGetMetadata(sc, tenant, objectName, w, r)
+		case r.Method == http.MethodGet: // Get a file
+			return handleGetFile(sc, tenant, objectName, w, r)
+		case r.Method == http.MethodDelete && objectName != "": // Delete a file
+			return handleDeleteFile(sc, tenant, objectName, w, r)
 		default:
 			return ErrNotFound
 		}
@@ -140,14 +324,90 @@ func httpHandler(sc *storeConfig) handlerWithError {
 	return handlerWithErrorFunc(fn)
 }
 
-// handleListFile handles the requests for the list of files.
-func handleListFile(sc *storeConfig, w http.ResponseWriter, r *http.Request) error {
-	files, err := sc.conn.ListFiles(r.Context(), sc.bucket)
+// resource is the kind of resource targeted by a request.
+type resource int
+
+const (
+	resourceFile  resource = iota // the files of a tenant
+	resourceQuota                 // the usage and the quotas of the caller and of a tenant
+)
+
+// route resolves the tenant targeted by the request, the kind of resource and the
+// name of the object (empty for the whole tenant). The tenant is given in the path
+// or, under /api/file and /api/quota, is the one of the caller. The caller must be
+// allowed to access it.
+func route(r *http.Request) (*config.Tenant, resource, string, error) {
+	cfg := config.GetCurrent()
+	caller := auth.Caller(r.Context())
+	var tenant *config.Tenant
+	res := resourceFile
+	objectName := ""
+	switch path := r.URL.Path; {
+	case FileRe.MatchString(path):
+		tenant = cfg.TenantForCaller(caller)
+	case FileReWithID.MatchString(path):
+		tenant = cfg.TenantForCaller(caller)
+		objectName = strings.TrimPrefix(path, "/api/file/")
+	case TenantFileRe.MatchString(path):
+		tenant = cfg.Tenant(TenantFileRe.FindStringSubmatch(path)[1])
+	case TenantFileReWithID.MatchString(path):
+		m := TenantFileReWithID.FindStringSubmatch(path)
+		tenant, objectName = cfg.Tenant(m[1]), m[2]
+	// after the files, /api/file/quota is an object of the tenant of the caller
+	case QuotaRe.MatchString(path):
+		tenant, res = cfg.TenantForCaller(caller), resourceQuota
+	case TenantQuotaRe.MatchString(path):
+		tenant, res = cfg.Tenant(TenantQuotaRe.FindStringSubmatch(path)[1]), resourceQuota
+	default:
+		return nil, res, "", ErrNotFound
+	}
+	if tenant == nil {
+		return nil, res, "", ErrNotFound
+	}
+	if !tenant.Allows(caller) {
+		return nil, res, "", ErrAccessForbidden
+	}
+	return tenant, res, objectName, nil
+}
+
+// handleListFile handles the requests for the list of files. The parameters tag and
+// meta of the query, k=v or k, keep the files having the tag or the metadata k (with
+// the value v). They can be repeated, the files must match all of them.
+func handleListFile(sc *storeConfig, tenant *config.Tenant, w http.ResponseWriter, r *http.Request) error {
+	tagFilters, err := listFilters(r.URL.Query()["tag"])
+	if err != nil {
+		return err
+	}
+	metaFilters, err := listFilters(r.URL.Query()["meta"])
 	if err != nil {
 		return err
 	}
+	var items []api.FileItem
+	if sc.index != nil {
+		// the index gives the metadata of the files without reading the bucket
+		entries, err := sc.index.Entries(tenant.Bucket(), "")
+		if err != nil {
+			return err
+		}
+		items = api.FileItemFromIndex(entries)
+	} else {
+		files, err := sc.conn.ListFiles(r.Context(), tenant.Bucket())
+		if err != nil {
+			return err
+		}
+		items = api.FileItemFromMinio(files)
+	}
+	if len(tagFilters) > 0 || len(metaFilters) > 0 {
+		kept := items[:0]
+		for _, it := range items {
+			if matchFilters(tagFilters, it.Tags) && matchFilters(metaFilters, it.Metadata) {
+				kept = append(kept, it)
+			}
+		}
+		items = kept
+	}
 	// Convert the files for return
-	data, err := json.Marshal(api.FileItemFromMinio(files))
+	data, err := json.Marshal(items)
 	if err != nil {
 		return err
 	}
@@ -156,9 +416,23 @@ func handleListFile(sc *storeConfig, w http.ResponseWriter, r *http.Request) err
 }
 
 // handleAddFile handles the request for adding a new file.
-func handleAddFile(sc *storeConfig, w http.ResponseWriter, r *http.Request) error {
+func handleAddFile(sc *storeConfig, tenant *config.Tenant, w http.ResponseWriter, r *http.Request) error {
+	maxSize := config.GetCurrent().Quotas().MaxObjectSize()
+	limit, err := uploadLimit(sc, tenant, r, maxSize)
+	if err != nil {
+		return err
+	}
+	if limit.err != nil {
+		// the body holds the file and the other fields of the form, its size is not
+		// known if it is chunked
+		r.Body = http.MaxBytesReader(w, r.Body, int64(min(limit.size, math.MaxInt64-formOverhead))+formOverhead)
+	}
 	// Get the multipart form data
-	err := r.ParseMultipartForm(100 << 20) // 100 MiB
+	err = r.ParseMultipartForm(100 << 20) // 100 MiB
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return errs.WrapWithError(err, limit.err)
+	}
 	if err != nil {
 		return err
 	}
@@ -166,10 +440,14 @@ func handleAddFile(sc *storeConfig, w http.ResponseWriter, r *http.Request) erro
 	if err != nil {
 		return errs.WrapWithError(err, ErrInvalidFormName)
 	}
+	if limit.err != nil && uint64(header.Size) > limit.size {
+		_ = reader.Close()
+		return limit.err
+	}
 	defer func(file multipart.File) {
 		err := file.Close()
 		if err != nil {
-			fmt.Printf("cannot close the upload file: %v \n", err)
+			logging.Errorf("cannot close the upload file: %v", err)
 		}
 	}(reader)
 
@@ -182,22 +460,70 @@ func handleAddFile(sc *storeConfig, w http.ResponseWriter, r *http.Request) erro
 	default:
 		objectName = uuid.NewString()
 	}
+	if strings.HasPrefix(objectName, store.DedupPrefix) {
+		return ErrReservedName
+	}
 	filename := objectName
 	if header.Filename != "" {
 		filename = header.Filename
 	}
 
-	data, err := sc.conn.PushObject(r.Context(), reader,
-		config.GetCurrent().Service().ChunkSize(),
-		config.GetCurrent().Minio().Bucket(), objectName, filename,
-		"application/octet-stream")
+	opts, err := uploadOptions(tenant, r, header.Size)
 	if err != nil {
 		return err
 	}
+	opts.Filename = filename
+	if opts.ContentType, err = uploadContentType(header, reader); err != nil {
+		return err
+	}
+	opts.Owner, opts.MaxSize = auth.Caller(r.Context()), maxSize
+	opts.CRC32C = config.GetCurrent().Service().Upload().CRC32C()
+	if opts.ExpectedMD5, opts.ExpectedSHA256, err = expectedChecksums(r, header); err != nil {
+		return err
+	}
+	if opts.Compression, err = uploadCompression(r, opts.ContentType); err != nil {
+		return err
+	}
+	if opts.Tags, opts.Metadata, opts.PrivateMetadata, err = uploadMetadata(r); err != nil {
+		return err
+	}
+	if mtime := r.FormValue("mtime"); mtime != "" {
+		if opts.ModTime, err = time.Parse(time.RFC3339, mtime); err != nil {
+			return errs.WrapWithError(err, ErrInvalidMetadata)
+		}
+	}
+
+	// checked before the upload to fail early, then again when it is committed
+	if err := checkChangePreconditions(sc, tenant, objectName, r); err != nil {
+		return err
+	}
+	opts.Commit = conditionalCommit(sc, tenant, objectName, r)
+	var data store.PushInfo
+	if dc := config.GetCurrent().Service().Dedup(); dc.Enabled() {
+		key := dc.Key()
+		data, err = sc.conn.PushDedup(r.Context(), reader, tenant.Bucket(), objectName, key[:], opts)
+	} else {
+		data, err = sc.conn.PushObject(r.Context(), reader, tenant.Bucket(), objectName, opts)
+	}
+	if _, ok := err.(*store.PartLimitError); ok || err == store.ErrWholeTooLarge {
+		return errs.WrapWithError(err, ErrUploadTooLarge)
+	}
+	if err == store.ErrObjectTooLarge {
+		return errs.WrapWithError(err, ErrObjectTooLarge)
+	}
+	if err == store.ErrChecksumMismatch {
+		return errs.WrapWithError(err, ErrChecksumMismatch)
+	}
+	if err != nil {
+		return err
+	}
+	indexUpload(sc, tenant.Bucket(), objectName, opts, data)
 	// transform the data in json
 	fus := api.FileUploadSuccess{
-		ObjectName: data.Key,
+		ObjectName: objectName,
 		VersionID:  data.VersionID,
+		SHA256:     hex.EncodeToString(data.Checksums.SHA256),
+		CRC32C:     hex.EncodeToString(data.Checksums.CRC32C),
 	}
 	j, err := json.Marshal(fus)
 	if err != nil {
@@ -207,71 +533,1053 @@ func handleAddFile(sc *storeConfig, w http.ResponseWriter, r *http.Request) erro
 	return err
 }
 
-// handleGetFile handles the request for getting all the files
-func handleGetFile(sc *storeConfig, w http.ResponseWriter, r *http.Request) error {
-	objectName := strings.TrimPrefix(r.URL.Path, "/api/file/")
+// Names of the fields of the form, or of the headers, giving the tags and the
+// metadata of an upload.
+const (
+	tagsField               = "tags"
+	metaFieldPrefix         = "meta-"
+	privateMetaFieldPrefix  = "private-meta-"
+	tagsHeader              = "X-Object-Tags"
+	metaHeaderPrefix        = "X-Object-Meta-"
+	privateMetaHeaderPrefix = "X-Object-Private-Meta-"
+)
+
+// Maximum sizes of the names and values of the metadata of an object: the limit of
+// the user metadata of S3 and a share of the extension block of the header.
+const (
+	maxMetadataSize        = 2 << 10
+	maxPrivateMetadataSize = 16 << 10
+)
+
+// metadataKeyRe is the format of the names of the metadata.
+var metadataKeyRe = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// uploadMetadata gives the tags, the metadata and the private metadata of an upload.
+// The tags are given in the field tags of the form or in the header X-Object-Tags,
+// encoded as a query (k1=v1&k2=v2). The metadata are given in the fields meta-{name}
+// of the form or the headers X-Object-Meta-{name}, the private ones in the fields
+// private-meta-{name} or the headers X-Object-Private-Meta-{name}. The metadata are
+// stored with the object in MinIo and given by the list, the private ones are only
+// stored in the authenticated header of the object and given by its metadata. With
+// the deduplication, it is the header of the reference of the caller, never the one
+// of the blob shared with the other uploads of the same content.
+func uploadMetadata(r *http.Request) (t, public, private map[string]string, err error) {
+	value := r.FormValue(tagsField)
+	if value == "" {
+		value = r.Header.Get(tagsHeader)
+	}
+	if value != "" {
+		ot, err := tags.ParseObjectTags(value)
+		if err != nil {
+			return nil, nil, nil, errs.WrapWithError(err, ErrInvalidMetadata)
+		}
+		t = ot.ToMap()
+	}
+	public, private = map[string]string{}, map[string]string{}
+	add := func(name, value string, m map[string]string) error {
+		name = strings.ToLower(name)
+		if !metadataKeyRe.MatchString(name) {
+			return errs.WrapWithError(errs.New(fmt.Sprintf("invalid name of metadata [%s], use [a-z0-9-]", name)), ErrInvalidMetadata)
+		}
+		if _, ok := m[name]; !ok { // the form before the headers
+			m[name] = value
+		}
+		return nil
+	}
+	for k, v := range r.Form {
+		switch {
+		case strings.HasPrefix(k, privateMetaFieldPrefix):
+			err = add(strings.TrimPrefix(k, privateMetaFieldPrefix), v[0], private)
+		case strings.HasPrefix(k, metaFieldPrefix):
+			err = add(strings.TrimPrefix(k, metaFieldPrefix), v[0], public)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	for k, v := range r.Header {
+		switch {
+		case strings.HasPrefix(k, privateMetaHeaderPrefix):
+			err = add(strings.TrimPrefix(k, privateMetaHeaderPrefix), v[0], private)
+		case strings.HasPrefix(k, metaHeaderPrefix):
+			err = add(strings.TrimPrefix(k, metaHeaderPrefix), v[0], public)
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	size := 0
+	for k, v := range public {
+		for _, c := range v {
+			if c < 0x20 || c > 0x7e {
+				return nil, nil, nil, errs.WrapWithError(errs.New("the value of the metadata "+k+" must be printable ASCII"), ErrInvalidMetadata)
+			}
+		}
+		size += len(store.CustomMetadataPrefix) + len(k) + len(v)
+	}
+	if size > maxMetadataSize {
+		return nil, nil, nil, errs.WrapWithError(errs.New(fmt.Sprintf("the metadata exceed %d bytes", maxMetadataSize)), ErrInvalidMetadata)
+	}
+	size = 0
+	for k, v := range private {
+		size += len(k) + len(v)
+	}
+	if size > maxPrivateMetadataSize {
+		return nil, nil, nil, errs.WrapWithError(errs.New(fmt.Sprintf("the private metadata exceed %d bytes", maxPrivateMetadataSize)), ErrInvalidMetadata)
+	}
+	return t, public, private, nil
+}
+
+// listFilter keeps the files having the key, with the value if any is set.
+type listFilter struct {
+	key, value string
+	anyValue   bool
+}
+
+// listFilters parses the filters of a list, given as k=v or k.
+func listFilters(values []string) ([]listFilter, error) {
+	res := make([]listFilter, 0, len(values))
+	for _, v := range values {
+		key, value, found := strings.Cut(v, "=")
+		if key == "" {
+			return nil, errs.WrapWithError(errs.New("the filter ["+v+"] has no key"), ErrInvalidMetadata)
+		}
+		res = append(res, listFilter{key: key, value: value, anyValue: !found})
+	}
+	return res, nil
+}
+
+// matchFilters tells if the map matches all the filters.
+func matchFilters(filters []listFilter, m map[string]string) bool {
+	for _, f := range filters {
+		v, ok := m[f.key]
+		if !ok || (!f.anyValue && v != f.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// sniffSize is the number of bytes read to detect the content type of a file.
+const sniffSize = 512
+
+// uploadContentType gives the content type of an upload: the one given with the file,
+// unless it is missing or application/octet-stream, guessed from the extension of its
+// name otherwise or detected from its first bytes (see http.DetectContentType).
+func uploadContentType(header *multipart.FileHeader, file multipart.File) (string, error) {
+	contentType := header.Header.Get("Content-Type")
+	if contentType != "" && contentType != "application/octet-stream" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return "", errs.WrapWithError(err, ErrInvalidMetadata)
+		}
+		return contentType, nil
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(header.Filename)); contentType != "" {
+		return contentType, nil
+	}
+	// the file is kept by the form, its first bytes are read without consuming it
+	buf := make([]byte, sniffSize)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// uploadCompression chooses the compression of an upload: the one of the configuration,
+// unless the parameter compress of the request (query or form) is false or the file
+// is already compressed from its content type (see uploadContentType).
+func uploadCompression(r *http.Request, contentType string) (encdec.Compression, error) {
+	c, err := encdec.ParseCompression(config.GetCurrent().Service().Upload().Compression())
+	if err != nil {
+		return encdec.CompressionNone, err
+	}
+	if v := r.FormValue("compress"); v != "" {
+		compress, err := strconv.ParseBool(v)
+		if err != nil {
+			return encdec.CompressionNone, errs.WrapWithError(errs.New("compress must be true or false"), ErrInvalidUploadMode)
+		}
+		if !compress {
+			return encdec.CompressionNone, nil
+		}
+	}
+	if !store.Compressible(contentType) {
+		return encdec.CompressionNone, nil
+	}
+	return c, nil
+}
+
+// expectedChecksums gives the checksums of the file given by the client, nil if
+// not given: the form field x-checksum-sha256 (hex), then the headers Content-MD5
+// and Digest (sha-256 and md5, RFC 3230) of the file part, then the ones of the
+// request. The first checksum found of each algorithm is used.
+func expectedChecksums(r *http.Request, header *multipart.FileHeader) (md5Sum, sha256Sum []byte, err error) {
+	if v := r.FormValue("x-checksum-sha256"); v != "" {
+		if sha256Sum, err = hex.DecodeString(v); err != nil || len(sha256Sum) != sha256.Size {
+			return nil, nil, errs.WrapWithError(errs.New("x-checksum-sha256 must be a SHA-256 in hex"), ErrInvalidChecksum)
+		}
+	}
+	for _, h := range []textproto.MIMEHeader{header.Header, textproto.MIMEHeader(r.Header)} {
+		if v := h.Get("Content-MD5"); v != "" && md5Sum == nil {
+			if md5Sum, err = decodeChecksum("Content-MD5", v, md5.Size); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, d := range strings.Split(h.Get("Digest"), ",") {
+			algorithm, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			switch {
+			case strings.EqualFold(algorithm, "sha-256") && sha256Sum == nil:
+				sha256Sum, err = decodeChecksum("Digest sha-256", value, sha256.Size)
+			case strings.EqualFold(algorithm, "md5") && md5Sum == nil:
+				md5Sum, err = decodeChecksum("Digest md5", value, md5.Size)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return md5Sum, sha256Sum, nil
+}
+
+// decodeChecksum decodes the checksum in base64 of the given size.
+func decodeChecksum(name, value string, size int) ([]byte, error) {
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(sum) != size {
+		return nil, errs.WrapWithError(errs.New(name+" must be a checksum in base64"), ErrInvalidChecksum)
+	}
+	return sum, nil
+}
+
+// Upload modes given with the parameter mode of an upload.
+const (
+	modeWhole  = "whole"  // the file is encrypted and uploaded at once
+	modeStream = "stream" // the file is encrypted in small chunks streamed into a single upload
+	modeChunk  = "chunk"  // the file is encrypted and uploaded in chunks
+	modeAuto   = "auto"   // the mode and the chunk size are chosen from the size of the file
+)
+
+// uploadOptions chooses the chunk size of an upload (0 for the whole mode) from the
+// parameters mode and chunk_size of the request (query or form), the default of the
+// tenant and the bounds of the configuration. Without mode, a chunk_size of 0 gives
+// the whole mode. In chunk mode without chunk_size, the default of the tenant is used
+// if it is a chunk size, the smallest chunk size fitting the file otherwise.
+// It also gives the minimal size of the parts if the chunks are grouped, to reach the
+// part size of the configuration or to stay under the limit of parts of MinIo.
+// The files larger than the memory cap of the whole mode are streamed if the whole
+// mode comes from the default of the tenant, rejected if it has been requested.
+func uploadOptions(tenant *config.Tenant, r *http.Request, size int64) (store.PushOptions, error) {
+	uc := config.GetCurrent().Service().Upload()
+	policy := store.ChunkPolicy{
+		MinChunkSize:   uc.MinChunkSize(),
+		MaxChunkSize:   uc.MaxChunkSize(),
+		MaxWholeSize:   uc.MaxWholeSize(),
+		WholeThreshold: uc.WholeThreshold(),
+		Aggregate:      uc.AggregateParts(),
+		TargetPartSize: uc.PartSize(),
+		MaxBuffered:    uc.MaxBufferedSize(),
+	}
+	mode, requested := r.FormValue("mode"), r.FormValue("chunk_size")
+
+	var chunkSize uint64
+	var stream bool
+	var err error
+	switch {
+	case mode != "" && mode != modeWhole && mode != modeStream && mode != modeChunk && mode != modeAuto:
+		return store.PushOptions{}, errs.WrapWithError(errs.New(fmt.Sprintf("unknown mode [%s], use [whole, stream, chunk, auto]", mode)), ErrInvalidUploadMode)
+	case requested != "" && mode != "" && mode != modeChunk:
+		return store.PushOptions{}, errs.WrapWithError(errs.New("chunk_size cannot be given with the mode "+mode), ErrInvalidUploadMode)
+	case requested != "":
+		if chunkSize, err = config.ParseSize(requested); err != nil {
+			return store.PushOptions{}, errs.WrapWithError(err, ErrInvalidUploadMode)
+		}
+		if mode == modeChunk && chunkSize == 0 {
+			return store.PushOptions{}, errs.WrapWithError(errs.New("chunk_size must not be 0 in chunk mode"), ErrInvalidUploadMode)
+		}
+		err = policy.Check(chunkSize, size)
+	case mode == modeWhole:
+		err = policy.Check(0, size)
+	case mode == modeStream:
+		stream, err = true, policy.CheckStream(size)
+	case mode == modeAuto || (mode == "" && tenant.AutoChunk()):
+		chunkSize, err = policy.Auto(size)
+	case mode == modeChunk && (tenant.AutoChunk() || tenant.ChunkSize() == 0):
+		chunkSize, err = policy.Chunked(size)
+	default:
+		chunkSize = tenant.ChunkSize()
+		if err = policy.Check(chunkSize, size); err == store.ErrBufferedTooLarge {
+			stream, err = true, policy.CheckStream(size)
+		}
+	}
+
+	switch err {
+	case nil:
+	case store.ErrWholeTooLarge, store.ErrTooManyParts, store.ErrBufferedTooLarge:
+		return store.PushOptions{}, errs.WrapWithError(err, ErrUploadTooLarge)
+	default:
+		return store.PushOptions{}, errs.WrapWithError(err, ErrInvalidUploadMode)
+	}
+	if stream {
+		return store.PushOptions{ChunkSize: uc.StreamChunkSize(), Stream: true, Size: size}, nil
+	}
+	partSize, err := policy.PartSize(chunkSize, size)
+	return store.PushOptions{ChunkSize: chunkSize, PartSize: partSize, Size: size}, err
+}
+
+// formOverhead is the size allowed to the multipart form above the maximum object size.
+const formOverhead = 1 << 20
+
+// sizeLimit is a maximum size of the file of an upload, err is the error of a larger
+// file (nil if there is no limit).
+type sizeLimit struct {
+	size uint64
+	err  error
+}
+
+// tighter gives the tighter of the limit and of size, failing with err.
+func (l sizeLimit) tighter(size uint64, err error) sizeLimit {
+	if l.err == nil || size < l.size {
+		return sizeLimit{size: size, err: err}
+	}
+	return l
+}
+
+// uploadLimit gives the maximum size of the file of an upload: the tightest of the
+// maximum object size and of the space left by the quotas of the bucket of the
+// tenant and of the caller (in all the buckets). The file is compared to the limit
+// once the form is read, not the size of the request which holds the other fields of
+// the form: the body is bounded by the limit and its overhead as it is read.
+func uploadLimit(sc *storeConfig, tenant *config.Tenant, r *http.Request, maxSize uint64) (sizeLimit, error) {
+	limit := sizeLimit{}
+	if maxSize != 0 {
+		limit = limit.tighter(maxSize, ErrObjectTooLarge)
+	}
+	quotas := config.GetCurrent().Quotas()
+	if quota := quotas.Bucket(tenant.Bucket()); quota != 0 {
+		_, used, err := bucketUsage(r.Context(), sc, tenant.Bucket(), "")
+		if err != nil {
+			return sizeLimit{}, err
+		}
+		limit = limit.tighter(quota-min(used, quota), ErrQuotaExceeded)
+	}
+	caller := auth.Caller(r.Context())
+	if quota := quotas.Caller(caller); quota != 0 {
+		_, used, err := callerUsage(r.Context(), sc, caller)
+		if err != nil {
+			return sizeLimit{}, err
+		}
+		limit = limit.tighter(quota-min(used, quota), ErrCallerQuotaExceeded)
+	}
+	return limit, nil
+}
+
+// bucketUsage gives the number of objects and their total size in the bucket, only
+// the ones of the owner if it is given. They are read from the index if it is
+// enabled, without listing the bucket.
+func bucketUsage(ctx context.Context, sc *storeConfig, bucket, owner string) (count, size uint64, err error) {
+	switch {
+	case sc.index != nil:
+		return sc.index.Usage(bucket, owner)
+	case owner != "":
+		return sc.conn.OwnerUsage(ctx, bucket, owner)
+	default:
+		return sc.conn.Usage(ctx, bucket)
+	}
+}
+
+// callerUsage gives the number of objects and their total size pushed by the caller
+// in all the buckets of the configuration.
+func callerUsage(ctx context.Context, sc *storeConfig, caller string) (count, size uint64, err error) {
+	for _, b := range buckets(config.GetCurrent()) {
+		c, s, err := bucketUsage(ctx, sc, b, caller)
+		if err != nil {
+			return 0, 0, err
+		}
+		count, size = count+c, size+s
+	}
+	return count, size, nil
+}
+
+// handleQuota handles the request for the usage and the quotas of the caller and
+// of the tenant.
+func handleQuota(sc *storeConfig, tenant *config.Tenant, w http.ResponseWriter, r *http.Request) error {
+	quotas := config.GetCurrent().Quotas()
+	caller := auth.Caller(r.Context())
+	callerCount, callerSize, err := callerUsage(r.Context(), sc, caller)
+	if err != nil {
+		return err
+	}
+	tenantCount, tenantSize, err := bucketUsage(r.Context(), sc, tenant.Bucket(), "")
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(api.Quota{
+		MaxObjectSize: quotas.MaxObjectSize(),
+		Caller:        api.QuotaUsage{Name: caller, Objects: callerCount, Size: callerSize, Quota: quotas.Caller(caller)},
+		Tenant:        api.QuotaUsage{Name: tenant.Name(), Objects: tenantCount, Size: tenantSize, Quota: quotas.Bucket(tenant.Bucket())},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// handleGetFile handles the request for getting a file. The file is given as an
+// attachment, displayed by the browser with the parameter inline=true of the query.
+// The headers are set from the header and the trailer of the object before its data
+// is streamed, not streamed if the conditions If-None-Match or If-Modified-Since
+// tell the client has it (304 Not Modified).
+func handleGetFile(sc *storeConfig, tenant *config.Tenant, objectName string, w http.ResponseWriter, r *http.Request) error {
 	// retrieve the file
-	reader, err := sc.conn.GetObject(r.Context(), config.GetCurrent().Minio().Bucket(), objectName)
+	reader, err := sc.conn.GetObject(r.Context(), tenant.Bucket(), objectName)
+	if err == store.ErrObjectNotFound {
+		return errs.WrapWithError(err, ErrNotFound)
+	}
+	if err == store.ErrObjectChanged {
+		return errs.WrapWithError(err, ErrFileChanged)
+	}
+	if err != nil {
+		return errs.WrapWithError(err, ErrInternalServerError)
+	}
+	// the checksums of the plaintext recorded at the upload, to verify the download,
+	// read from the version streamed
+	sums, ok, err := sc.conn.ObjectChecksums(r.Context(), tenant.Bucket(), objectName, reader)
+	if err == store.ErrObjectChanged {
+		return errs.WrapWithError(err, ErrFileChanged)
+	}
 	if err != nil {
 		return errs.WrapWithError(err, ErrInternalServerError)
 	}
+	storedETag, lastModified := store.StoredVersion(reader)
+	etag := objectETag(sums, ok, storedETag)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	// the data is neither read nor decrypted if the client has it
+	notModified, err := checkPreconditions(r, etag, lastModified)
+	if err != nil {
+		return err
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if ok {
+		setChecksumHeaders(w, sums)
+		if size := sums.PlainSize(); size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+	}
+	// the metadata sealed in the header (of the reference of a deduplicated file), the
+	// filename in clear for the older objects
+	metadata, err := reader.Metadata()
+	if err != nil {
+		return errs.WrapWithError(err, ErrInternalServerError)
+	}
+	filename, err := reader.Filename()
+	if err != nil {
+		return errs.WrapWithError(err, ErrInternalServerError)
+	}
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if inline, _ := strconv.ParseBool(r.URL.Query().Get("inline")); inline {
+		// the file is displayed without access to the origin of the service
+		disposition = "inline"
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, filename))
 
 	_, err = reader.WriteTo(w)
 	if err != nil {
 		return errs.WrapWithError(err, ErrInternalServerError)
 	}
-	// Put info in header that it is a file
-	filename, err := reader.Filename()
+	return nil
+}
+
+// contentDisposition gives the header Content-Disposition of a file (RFC 6266). The
+// filename is given in ASCII and, if it is not only printable ASCII, encoded in
+// UTF-8 in filename* (RFC 8187), preferred by the clients knowing it.
+func contentDisposition(disposition, filename string) string {
+	if filename == "" {
+		return disposition
+	}
+	ascii := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+	res := disposition + `; filename="` + ascii + `"`
+	if ascii == filename {
+		return res
+	}
+	var encoded strings.Builder
+	for _, b := range []byte(filename) {
+		// attr-char of RFC 8187, the other bytes are percent-encoded
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return res + "; filename*=UTF-8''" + encoded.String()
+}
+
+// tagsSuffix is the suffix of the path of the tags of a file.
+const tagsSuffix = "/tags"
+
+// maxTagsBody is the maximum size of the body replacing the tags of a file.
+const maxTagsBody = 64 << 10
+
+// handleSetTags handles the request replacing the tags of a file with the ones of
+// the body, a JSON object. An empty object removes them.
+func handleSetTags(sc *storeConfig, tenant *config.Tenant, objectName string, w http.ResponseWriter, r *http.Request) error {
+	if strings.HasPrefix(objectName, store.DedupPrefix) {
+		return ErrReservedName
+	}
+	var t map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxTagsBody)).Decode(&t); err != nil {
+		return errs.WrapWithError(err, ErrInvalidMetadata)
+	}
+	if _, err := tags.MapToObjectTags(t); err != nil {
+		return errs.WrapWithError(err, ErrInvalidMetadata)
+	}
+	err := sc.conn.SetTags(r.Context(), tenant.Bucket(), objectName, t)
+	if err == store.ErrObjectNotFound {
+		return errs.WrapWithError(err, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if sc.index != nil {
+		e, ok, err := sc.index.Entry(tenant.Bucket(), objectName)
+		if err == nil && ok {
+			e.Tags, e.Modified = t, time.Now()
+			err = sc.index.PutEntry(tenant.Bucket(), e)
+		}
+		if err != nil {
+			logging.Errorf("cannot update the tags of %s in the index: %v", objectName, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleGetMetadata handles the request for the metadata of a file, read from the
+// object without its data. Unlike the list, it also gives the private metadata.
+func handleGetMetadata(sc *storeConfig, tenant *config.Tenant, objectName string, w http.ResponseWriter, r *http.Request) error {
+	m, err := sc.conn.ObjectMeta(r.Context(), tenant.Bucket(), objectName)
+	if err == store.ErrObjectNotFound {
+		return errs.WrapWithError(err, ErrNotFound)
+	}
 	if err != nil {
 		return errs.WrapWithError(err, ErrInternalServerError)
 	}
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment;filename=%s", filename))
+	data, err := json.Marshal(api.FileMetadataFromStore(m))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	return err
+}
+
+// handleDeleteFile handles the request for deleting a file. The blob of a deduplicated
+// file is only removed with its last reference.
+func handleDeleteFile(sc *storeConfig, tenant *config.Tenant, objectName string, w http.ResponseWriter, r *http.Request) error {
+	if strings.HasPrefix(objectName, store.DedupPrefix) {
+		return ErrReservedName
+	}
+	err := sc.conn.DeleteObject(r.Context(), tenant.Bucket(), objectName,
+		store.DeleteOptions{Commit: conditionalCommit(sc, tenant, objectName, r)})
+	if err == store.ErrObjectNotFound {
+		return errs.WrapWithError(err, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	if sc.index != nil {
+		if err := sc.index.DeleteEntry(tenant.Bucket(), objectName); err != nil {
+			logging.Errorf("cannot remove %s from the index: %v", objectName, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
 	return nil
 }
 
+// indexUpload records the metadata of an uploaded object in the index, if any. The
+// object is stored even if it fails, the index can be rebuilt.
+func indexUpload(sc *storeConfig, bucket, objectName string, opts store.PushOptions, data store.PushInfo) {
+	if sc.index == nil {
+		return
+	}
+	now := time.Now()
+	e := index.Entry{
+		Object: objectName, Filename: opts.Filename, Size: data.Checksums.PlainSize(), StoredSize: data.Size,
+		ContentType: opts.ContentType, Owner: opts.Owner, Tags: opts.Tags, Metadata: opts.Metadata,
+		SHA256: hex.EncodeToString(data.Checksums.SHA256), Blob: data.Blob, Created: now, Modified: now,
+	}
+	if err := sc.index.PutEntry(bucket, e); err != nil {
+		logging.Errorf("cannot record %s in the index: %v", objectName, err)
+	}
+}
+
+// rebuildIndex rebuilds the entries and the references of the index from the objects
+// of the buckets, reading only their header and trailer.
+func rebuildIndex(ctx context.Context, conn *store.Connection, ix *index.Index, bucketNames []string) error {
+	for _, bucket := range bucketNames {
+		if err := ix.Reset(bucket); err != nil {
+			return err
+		}
+		count := 0
+		err := conn.WalkObjects(ctx, bucket, func(m store.ObjectMeta) error {
+			if m.Blob != "" {
+				if _, _, err := ix.SetRef(bucket, m.Key, m.Blob); err != nil {
+					return err
+				}
+			}
+			count++
+			return ix.PutEntry(bucket, index.Entry{
+				Object: m.Name, Filename: m.Filename, Size: m.Checksums.PlainSize(), StoredSize: m.StoredSize,
+				ContentType: m.ContentType, Owner: m.Owner, Tags: m.Tags, Metadata: m.Metadata,
+				SHA256: hex.EncodeToString(m.Checksums.SHA256), Blob: m.Blob, Created: m.LastModified, Modified: m.LastModified,
+			})
+		})
+		if err != nil {
+			return errs.Wrap(err, "cannot rebuild the index of "+bucket)
+		}
+		logging.Infof("index of %s rebuilt: %d objects", bucket, count)
+	}
+	return nil
+}
+
+// setChecksumHeaders gives the checksums of the plaintext of a download in the
+// header Digest (RFC 3230).
+func setChecksumHeaders(w http.ResponseWriter, sums encdec.Checksums) {
+	digest := "sha-256=" + base64.StdEncoding.EncodeToString(sums.SHA256)
+	if sums.CRC32C != nil {
+		digest += ",crc32c=" + base64.StdEncoding.EncodeToString(sums.CRC32C)
+	}
+	w.Header().Set("Digest", digest)
+}
+
+// objectETag gives the ETag of an object: the SHA-256 of its plaintext in hex, or the
+// ETag of its stored data for the objects without checksums (ok false).
+func objectETag(sums encdec.Checksums, ok bool, storedETag string) string {
+	if ok {
+		return `"` + hex.EncodeToString(sums.SHA256) + `"`
+	}
+	return `"` + strings.Trim(storedETag, `"`) + `"`
+}
+
+// objectLockCount is the number of locks serializing the changes of the objects.
+const objectLockCount = 64
+
+// objectLocks serializes the conditional changes of an object, so the object does not
+// change between the check of their preconditions and their commit (see
+// conditionalCommit). The changes are only serialized within an instance of the
+// service.
+type objectLocks [objectLockCount]sync.Mutex
+
+// lock locks the changes of the object of the bucket and gives the function unlocking.
+func (l *objectLocks) lock(bucket, objectName string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(bucket))
+	h.Write([]byte{0})
+	h.Write([]byte(objectName))
+	mu := &l[h.Sum32()%objectLockCount]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// hasChangePreconditions tells if the upload or the delete has conditions.
+func hasChangePreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Unmodified-Since") != ""
+}
+
+// conditionalCommit gives the commit of an upload or a delete with conditions, nil
+// without: the lock of the object is taken once its data is uploaded and the
+// conditions are checked again before the object is changed.
+func conditionalCommit(sc *storeConfig, tenant *config.Tenant, objectName string, r *http.Request) store.CommitFunc {
+	if !hasChangePreconditions(r) {
+		return nil
+	}
+	return func() (func(), error) {
+		unlock := sc.locks.lock(tenant.Bucket(), objectName)
+		if err := checkChangePreconditions(sc, tenant, objectName, r); err != nil {
+			unlock()
+			return nil, err
+		}
+		return unlock, nil
+	}
+}
+
+// checkChangePreconditions checks the conditions If-Match, If-None-Match and
+// If-Unmodified-Since of an upload or a delete against the current object, read only
+// if the request has some. It fails with ErrPreconditionFailed if they are not met.
+func checkChangePreconditions(sc *storeConfig, tenant *config.Tenant, objectName string, r *http.Request) error {
+	if !hasChangePreconditions(r) {
+		return nil
+	}
+	etag, lastModified := "", time.Time{}
+	m, err := sc.conn.ObjectMeta(r.Context(), tenant.Bucket(), objectName)
+	switch {
+	case err == nil:
+		etag, lastModified = objectETag(m.Checksums, m.Checksums.SHA256 != nil, m.ETag), m.LastModified
+	case err != store.ErrObjectNotFound:
+		return err
+	}
+	_, err = checkPreconditions(r, etag, lastModified)
+	return err
+}
+
+// checkPreconditions evaluates the conditional headers of the request against the
+// current object, of ETag "" if it does not exist, in the order of RFC 9110 (13.2.2).
+// notModified tells a GET must be answered with 304 Not Modified. It fails with
+// ErrPreconditionFailed if a condition is not met.
+func checkPreconditions(r *http.Request, etag string, lastModified time.Time) (notModified bool, err error) {
+	get := r.Method == http.MethodGet || r.Method == http.MethodHead
+	// the dates of HTTP have a precision of one second
+	lastModified = lastModified.Truncate(time.Second)
+	if v := r.Header.Get("If-Match"); v != "" {
+		if !matchETag(v, etag, false) {
+			return false, ErrPreconditionFailed
+		}
+	} else if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && etag != "" && lastModified.After(t) {
+		return false, ErrPreconditionFailed
+	}
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		if !matchETag(v, etag, true) {
+			return false, nil
+		}
+		if get {
+			return true, nil
+		}
+		return false, ErrPreconditionFailed
+	}
+	if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && get && etag != "" && !lastModified.After(t) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// matchETag tells if the ETag of the object, "" if it does not exist, is in the list
+// of the header (or the list is *). The weak comparison ignores the prefix W/ of the
+// ETags, the strong one requires both to be strong.
+func matchETag(list, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" {
+			return true
+		}
+		tag, isWeak := strings.CutPrefix(v, "W/")
+		if (weak || !isWeak) && tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// applyKeys sets the providers of the data keys of the service and of the tenants
+// having their own master key on the connection.
+func applyKeys(conn *store.Connection, cfg *config.Config) error {
+	kp, err := keyProvider(cfg.Service().Key(), cfg.Service().AESKey())
+	if err != nil {
+		return err
+	}
+	bucketKeys := make(map[string]keys.Provider)
+	for _, t := range cfg.Tenants() {
+		if t.Key() == nil {
+			continue
+		}
+		if bucketKeys[t.Bucket()], err = keyProvider(t.Key(), t.AESKey()); err != nil {
+			return errs.Wrap(err, "cannot create the key provider of the tenant "+t.Name())
+		}
+	}
+	conn.SetKeys(kp)
+	conn.SetBucketKeys(bucketKeys)
+	return nil
+}
+
+// keyProvider creates the provider of the data keys regarding the source of the master key.
+// The previous master keys of the ring are kept to decrypt the existing objects.
+func keyProvider(kc *config.Key, aesKey [32]byte) (keys.Provider, error) {
+	active, err := activeKeyProvider(kc, aesKey)
+	if err != nil {
+		return nil, err
+	}
+	ring := make([]*keys.Local, len(kc.Ring()))
+	for i, rk := range kc.Ring() {
+		if ring[i], err = keys.NewLocal(rk.ID(), rk.Key()); err != nil {
+			return nil, err
+		}
+	}
+	return keys.NewRing(active, ring...)
+}
+
+// activeKeyProvider creates the provider generating the data keys of the new objects.
+func activeKeyProvider(kc *config.Key, aesKey [32]byte) (keys.Provider, error) {
+	if kc.Source() != config.KeySourceVault {
+		return keys.NewLocal(kc.ID(), aesKey)
+	}
+	vc := kc.Vault()
+	return keys.NewVaultTransit(keys.VaultOptions{
+		Address:   vc.Address(),
+		Mount:     vc.Mount(),
+		KeyName:   vc.KeyName(),
+		Token:     vc.Token(),
+		TokenFile: vc.TokenFile(),
+		CAFile:    vc.CAFile(),
+		Timeout:   vc.Timeout(),
+	})
+}
+
+// janitors runs the janitors cleaning the incomplete multipart uploads, one per
+// bucket of the tenants. They follow the tenants as they change on reload.
+type janitors struct {
+	mu      sync.Mutex
+	conn    *store.Connection
+	running map[string]runningJanitor // by bucket
+}
+
+// runningJanitor is a janitor and the function stopping it.
+type runningJanitor struct {
+	janitor *store.Janitor
+	stop    context.CancelFunc
+}
+
+func newJanitors(conn *store.Connection) *janitors {
+	return &janitors{conn: conn, running: make(map[string]runningJanitor)}
+}
+
+// update starts the janitors of the buckets of the configuration that have none,
+// and stops the ones of the buckets no longer in it.
+func (js *janitors) update(cfg *config.Config) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	jc := cfg.Janitor()
+	current := make(map[string]bool)
+	for _, bucket := range buckets(cfg) {
+		current[bucket] = true
+		if _, ok := js.running[bucket]; ok {
+			continue
+		}
+		ctx, stop := context.WithCancel(context.Background())
+		janitor := store.NewJanitor(js.conn, bucket, jc.MaxAge(), jc.Interval(), jc.DryRun())
+		js.running[bucket] = runningJanitor{janitor: janitor, stop: stop}
+		go func(bucket string) {
+			if err := janitor.Run(ctx); err != nil && err != context.Canceled {
+				logging.Errorf("janitor of %s stopped: %v", bucket, err)
+			}
+		}(bucket)
+	}
+	for bucket, r := range js.running {
+		if !current[bucket] {
+			r.stop()
+			delete(js.running, bucket)
+			logging.Infof("janitor of %s stopped, the bucket is no longer used", bucket)
+		}
+	}
+}
+
+// metrics gives the metrics of the janitors running, by bucket.
+func (js *janitors) metrics() map[string]store.JanitorMetrics {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	res := make(map[string]store.JanitorMetrics, len(js.running))
+	for bucket, r := range js.running {
+		res[bucket] = r.janitor.Metrics()
+	}
+	return res
+}
+
+// buckets gives the buckets of the default tenant and of the other tenants.
+func buckets(cfg *config.Config) []string {
+	var res []string
+	if t := cfg.DefaultTenant(); t != nil {
+		res = append(res, t.Bucket())
+	}
+	for _, t := range cfg.Tenants() {
+		res = append(res, t.Bucket())
+	}
+	return res
+}
+
+// storeOptions converts the MinIo configuration into the options of the store connection.
+func storeOptions(mc *config.MinIo) store.Options {
+	creds := make([]store.CredentialSource, len(mc.Credentials()))
+	for i, c := range mc.Credentials() {
+		creds[i] = store.CredentialSource{
+			Type: c.Type(), AccessKey: c.AccessKey(), SecretKey: c.SecretKey(), Path: c.Path(), Profile: c.Profile(),
+			Endpoint: c.Endpoint(), TokenFile: c.TokenFile(), RoleARN: c.RoleARN(), Duration: c.Duration(),
+		}
+	}
+	return store.Options{
+		Endpoint:           mc.Endpoint(),
+		AccessKey:          mc.AccessKey(),
+		SecretKey:          mc.SecretKey(),
+		Credentials:        creds,
+		Secure:             mc.Secure(),
+		Region:             mc.Region(),
+		CAFile:             mc.CAFile(),
+		InsecureSkipVerify: mc.InsecureSkipVerify(),
+		Transport: store.TransportOptions{
+			DialTimeout:           mc.Transport().DialTimeout(),
+			TLSHandshakeTimeout:   mc.Transport().TLSHandshakeTimeout(),
+			ResponseHeaderTimeout: mc.Transport().ResponseHeaderTimeout(),
+			IdleConnTimeout:       mc.Transport().IdleConnTimeout(),
+			MaxIdleConns:          mc.Transport().MaxIdleConns(),
+			MaxIdleConnsPerHost:   mc.Transport().MaxIdleConnsPerHost(),
+			Proxy:                 mc.Transport().Proxy(),
+		},
+	}
+}
+
+// configPath is the path of the configuration file, read again on reload.
+var configPath string
+
 // init is the first method called (before main). It parses the configuration and the flags
 func init() {
+	// the tests load their own configuration, the flags are the ones of go test
+	if testing.Testing() {
+		return
+	}
 	// Generate our config based on the config supplied
 	// by the user in the flags
-	cfgPath, err := config.ParseFlags()
+	var err error
+	configPath, err = config.ParseFlags()
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
+	}
+	cfg, err := config.NewConfig(configPath)
+	if config.ValidateRequested() {
+		// only validate the configuration, for the CI
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("configuration is valid")
+		os.Exit(0)
 	}
-	_, err = config.NewConfig(cfgPath)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
+	}
+	logging.SetLevel(cfg.Service().LogLevel())
+	// Only dump the effective configuration if asked
+	if config.PrintRequested() {
+		if err := cfg.Print(os.Stdout); err != nil {
+			logging.Fatal(err)
+		}
+		os.Exit(0)
 	}
 }
 
 func main() {
 	// Create the connection to the database
-	conn, err := store.Connect(
-		config.GetCurrent().Minio().Endpoint(),
-		config.GetCurrent().Minio().AccessKey(),
-		config.GetCurrent().Minio().SecretKey(),
-	)
+	mc := config.GetCurrent().Minio()
+	if mc.Secure() && mc.InsecureSkipVerify() {
+		logging.Warnf("the certificate of the MinIo server is not verified (minio.insecure_skip_verify)")
+	}
+	conn, err := store.Connect(storeOptions(mc))
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(err)
+	}
+	if err := applyKeys(conn, config.GetCurrent()); err != nil {
+		logging.Fatal(err)
+	}
+	// Store the objects under an HMAC of their name
+	if oc := config.GetCurrent().Service().Obfuscation(); oc.Enabled() {
+		names, err := store.NewNames(oc.Key())
+		if err != nil {
+			logging.Fatal(err)
+		}
+		conn.SetNames(names)
 	}
 
-	sc := &storeConfig{conn: conn, bucket: config.GetCurrent().Minio().Bucket()}
+	sc := &storeConfig{conn: conn}
+	// Open the index of the metadata and of the references of the deduplicated objects
+	if path := config.GetCurrent().Index().Path(); path != "" {
+		ix, err := index.Open(path)
+		if err != nil {
+			logging.Fatal(err)
+		}
+		defer ix.Close()
+		conn.SetRefIndex(ix)
+		sc.index = ix
+	}
+	if config.RebuildIndexRequested() {
+		if sc.index == nil {
+			logging.Fatal(errs.New("the subcommand " + config.RebuildIndexCommand + " requires index.path"))
+		}
+		if err := rebuildIndex(context.Background(), conn, sc.index, buckets(config.GetCurrent())); err != nil {
+			logging.Fatal(err)
+		}
+		return
+	}
+
+	// Launch the janitors cleaning the incomplete multipart uploads, one per bucket
+	var js *janitors
+	if config.GetCurrent().Janitor().Enabled() {
+		js = newJanitors(conn)
+		js.update(config.GetCurrent())
+		expvar.Publish("janitor", expvar.Func(func() any { return js.metrics() }))
+	}
+
+	// Reload the configuration on SIGHUP or when the file changes. The chunk size and
+	// the tenants are read on each request, the log level and the keys are applied here
+	// and the janitors follow the buckets of the tenants.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go config.Watch(context.Background(), configPath, config.GetCurrent().Service().WatchInterval(), sighup,
+		func(cfg *config.Config) error {
+			logging.SetLevel(cfg.Service().LogLevel())
+			if js != nil {
+				js.update(cfg)
+			}
+			return errs.Wrap(applyKeys(conn, cfg), "cannot load the keys")
+		})
 
 	// Create the server multiplexer
 	mux := http.NewServeMux()
 
-	handler := errorHandler(httpHandler(sc))
-	mux.Handle(
-		"/api/file",
-		handler,
-	)
+	limits := &clientLimits{requests: ratelimit.New(), bytes: ratelimit.New()}
+	expvar.Publish("transfers", expvar.Func(func() any { return limits.transfers.InProgress() }))
+	handler := errorHandler(identityHandler(limitHandler(limits, httpHandler(sc))))
 	mux.Handle(
-		"/api/file/",
+		"/api/",
 		handler,
 	)
+	// Expose the metrics of the service (janitor, ...) on their own address, never on
+	// the one of the API: they include the command line and the memory statistics
+	if addr := config.GetCurrent().Service().AdminAddress(); addr != "" {
+		admin := http.NewServeMux()
+		admin.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			logging.Fatal(http.ListenAndServe(addr, admin))
+		}()
+	}
 	srv := &http.Server{
 		Addr:    config.GetCurrent().Service().Address(),
 		Handler: mux,
 	}
 
-	log.Fatal(srv.ListenAndServe())
+	tc := config.GetCurrent().Service().TLS()
+	if !tc.Enabled() {
+		logging.Fatal(srv.ListenAndServe())
+	}
+	// Serve over TLS, the certificates are reloaded when they change on disk
+	reloader, err := tlsconf.NewReloader(tc.CertFile(), tc.KeyFile(), tc.ClientCAFile(), tc.MinVersion())
+	if err != nil {
+		logging.Fatal(err)
+	}
+	go reloader.Watch(context.Background(), tc.ReloadInterval())
+	srv.TLSConfig = reloader.TLSConfig()
+	logging.Fatal(srv.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,1072 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/api"
+	"github.com/ag0st/taurus-challenge/auth"
+	"github.com/ag0st/taurus-challenge/config"
+	"github.com/ag0st/taurus-challenge/index"
+	"github.com/ag0st/taurus-challenge/ratelimit"
+	"github.com/ag0st/taurus-challenge/store"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// fakeObject is an object stored by fakeS3.
+type fakeObject struct {
+	data     []byte
+	header   http.Header // Content-Type and the user metadata
+	tags     map[string]string
+	etag     string
+	modified time.Time
+}
+
+// fakeS3 is an S3 server keeping the objects in memory, with the requests used by
+// the store: path-style objects, ranges, If-Match, tagging and listing.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]*fakeObject // by bucket/key
+	heads   map[string]int         // HEAD requests by bucket/key
+	puts    int
+
+	// called before an object is stored, with its bucket/key
+	beforePut func(key string)
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string]*fakeObject{}, heads: map[string]int{}}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+	switch {
+	case key == "" && q.Has("uploads"): // no incomplete upload
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><ListMultipartUploadsResult></ListMultipartUploadsResult>`)
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, bucket, q.Get("prefix"))
+	case q.Has("tagging"):
+		s.tagging(w, r, bucket+"/"+key)
+	case r.Method == http.MethodPut:
+		s.put(w, r, bucket+"/"+key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.get(w, r, bucket+"/"+key)
+	case r.Method == http.MethodDelete:
+		s.mu.Lock()
+		delete(s.objects, bucket+"/"+key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// s3Error answers with the error of S3 of the given code.
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (s *fakeS3) put(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if s.beforePut != nil {
+		s.beforePut(key)
+	}
+	sum := md5.Sum(data)
+	o := &fakeObject{data: data, header: http.Header{}, etag: hex.EncodeToString(sum[:]), modified: time.Now().UTC().Truncate(time.Second)}
+	for k, v := range r.Header {
+		if k == "Content-Type" || strings.HasPrefix(k, "X-Amz-Meta-") {
+			o.header[k] = v
+		}
+	}
+	if v := r.Header.Get("X-Amz-Tagging"); v != "" {
+		t, err := tags.ParseObjectTags(v)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "InvalidTag")
+			return
+		}
+		o.tags = t.ToMap()
+	}
+	s.mu.Lock()
+	s.objects[key] = o
+	s.puts++
+	s.mu.Unlock()
+	w.Header().Set("ETag", `"`+o.etag+`"`)
+}
+
+func (s *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	if r.Method == http.MethodHead {
+		s.heads[key]++
+	}
+	o := s.objects[key]
+	s.mu.Unlock()
+	if o == nil {
+		s3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if v := r.Header.Get("If-Match"); v != "" && strings.Trim(v, `"`) != o.etag {
+		s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	for k, v := range o.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", `"`+o.etag+`"`)
+	w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+	if len(o.tags) > 0 {
+		w.Header().Set("X-Amz-Tagging-Count", strconv.Itoa(len(o.tags)))
+	}
+	start, end, partial := byteRange(r.Header.Get("Range"), len(o.data))
+	w.Header().Set("Content-Length", strconv.Itoa(end-start))
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(o.data)))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(o.data[start:end])
+	}
+}
+
+// byteRange gives the bytes [start, end) of the header Range (bytes=a-b, bytes=a- or
+// bytes=-n) of an object of the given size, the whole object without range.
+func byteRange(h string, size int) (start, end int, partial bool) {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok {
+		return 0, size, false
+	}
+	first, last, _ := strings.Cut(spec, "-")
+	if first == "" {
+		n, _ := strconv.Atoi(last)
+		return max(size-n, 0), size, true
+	}
+	start, _ = strconv.Atoi(first)
+	end = size
+	if last != "" {
+		n, _ := strconv.Atoi(last)
+		end = min(n+1, size)
+	}
+	return min(start, end), end, true
+}
+
+func (s *fakeS3) tagging(w http.ResponseWriter, r *http.Request, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := s.objects[key]
+	if o == nil {
+		s3Error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		t, err := tags.ParseObjectXML(r.Body)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "InvalidTag")
+			return
+		}
+		o.tags = t.ToMap()
+	case http.MethodGet:
+		t, _ := tags.MapToObjectTags(o.tags)
+		data, _ := xml.Marshal(t)
+		_, _ = w.Write(data)
+	case http.MethodDelete:
+		o.tags = nil
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list answers a listing of the bucket (ListObjectsV2) with the metadata and the
+// tags of the objects, as MinIo does with metadata=true.
+func (s *fakeS3) list(w http.ResponseWriter, bucket, prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		if name, ok := strings.CutPrefix(k, bucket+"/"); ok && strings.HasPrefix(name, prefix) {
+			keys = append(keys, name)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><Name>` + bucket + `</Name>`)
+	fmt.Fprintf(&b, `<KeyCount>%d</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>`, len(keys))
+	for _, k := range keys {
+		o := s.objects[bucket+"/"+k]
+		b.WriteString(`<Contents><Key>`)
+		_ = xml.EscapeText(&b, []byte(k))
+		fmt.Fprintf(&b, `</Key><LastModified>%s</LastModified><ETag>"%s"</ETag><Size>%d</Size><UserMetadata>`,
+			o.modified.Format("2006-01-02T15:04:05.000Z"), o.etag, len(o.data))
+		for h, v := range o.header {
+			b.WriteString("<" + h + ">")
+			_ = xml.EscapeText(&b, []byte(v[0]))
+			b.WriteString("</" + h + ">")
+		}
+		b.WriteString(`</UserMetadata>`)
+		if len(o.tags) > 0 {
+			t, _ := tags.MapToObjectTags(o.tags)
+			b.WriteString(`<UserTags>`)
+			_ = xml.EscapeText(&b, []byte(t.String()))
+			b.WriteString(`</UserTags>`)
+		}
+		b.WriteString(`</Contents>`)
+	}
+	b.WriteString(`</ListBucketResult>`)
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, b.String())
+}
+
+// headCount gives the number of HEAD requests of the key of the bucket.
+func (s *fakeS3) headCount(bucket, key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.heads[bucket+"/"+key]
+}
+
+// putCount gives the number of objects stored.
+func (s *fakeS3) putCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts
+}
+
+// testBucket is the bucket of the default tenant of the tests.
+const testBucket = "testbucket"
+
+// testConfig is the configuration of the tests, given the lines added to the
+// service, the endpoint of the fake S3 and the sections added.
+const testConfig = `service:
+  address: ':8080'
+  chunk_size: 0 B
+  aes_encryption_key: 000102030405060708090A0B0C0D0E0FF0E0D0C0B0A090807060504030201000
+%s
+minio:
+  access_key: 'access'
+  secret_key: 'secret'
+  endpoint: '%s'
+  bucket: '` + testBucket + `'
+  secure: true
+  insecure_skip_verify: true
+  region: 'us-east-1'
+%s
+`
+
+// testService is the API served by the handlers of the service over a fake S3.
+type testService struct {
+	s3       *fakeS3
+	endpoint string // of the fake S3
+	sc       *storeConfig
+	limits   *clientLimits
+	handler  http.Handler
+}
+
+// newTestService loads the configuration of the tests, with the lines added to the
+// service (indented) and the sections added, and builds the handlers of the API as
+// main does.
+func newTestService(t *testing.T, service, sections string) *testService {
+	t.Helper()
+	s3 := newFakeS3()
+	srv := httptest.NewTLSServer(s3)
+	t.Cleanup(srv.Close)
+	endpoint := strings.TrimPrefix(srv.URL, "https://")
+	cfg, err := config.NewConfig(writeTestConfig(t, endpoint, service, sections))
+	if err != nil {
+		t.Fatalf("cannot load the configuration: %v", err)
+	}
+	conn, err := store.Connect(storeOptions(cfg.Minio()))
+	if err != nil {
+		t.Fatalf("cannot connect: %v", err)
+	}
+	if err := applyKeys(conn, cfg); err != nil {
+		t.Fatalf("cannot load the keys: %v", err)
+	}
+	ts := &testService{
+		s3:       s3,
+		endpoint: endpoint,
+		sc:       &storeConfig{conn: conn},
+		limits:   &clientLimits{requests: ratelimit.New(), bytes: ratelimit.New()},
+	}
+	ts.handler = errorHandler(identityHandler(limitHandler(ts.limits, httpHandler(ts.sc))))
+	return ts
+}
+
+// writeTestConfig writes the configuration of the tests and gives its path.
+func writeTestConfig(t *testing.T, endpoint, service, sections string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(testConfig, service, endpoint, sections)), 0o600); err != nil {
+		t.Fatalf("cannot write the configuration: %v", err)
+	}
+	return path
+}
+
+// do serves the request.
+func (ts *testService) do(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, r)
+	return w
+}
+
+// upload uploads the file of the given name and content, and fails the test if it
+// is not stored.
+func (ts *testService) upload(t *testing.T, name string, content []byte) {
+	t.Helper()
+	if w := ts.do(uploadRequest(t, "/api/file", name, content, nil)); w.Code != http.StatusOK {
+		t.Fatalf("cannot upload %s: %d %s", name, w.Code, w.Body)
+	}
+}
+
+// etag gives the ETag of the file given by a download.
+func (ts *testService) etag(t *testing.T, name string) string {
+	t.Helper()
+	w := ts.do(httptest.NewRequest(http.MethodGet, "/api/file/"+name, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot download %s: %d %s", name, w.Code, w.Body)
+	}
+	return w.Header().Get("ETag")
+}
+
+// uploadRequest builds the upload of the file of the given name and content, with
+// the other fields of the form.
+func uploadRequest(t *testing.T, target, name string, content []byte, fields map[string]string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// TestConditionalGet tests the conditions of a download: 304 Not Modified if the
+// client has the file, 412 if it does not match If-Match.
+func TestConditionalGet(t *testing.T) {
+	ts := newTestService(t, "", "")
+	ts.upload(t, "a.txt", []byte("some content"))
+	etag := ts.etag(t, "a.txt")
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"none match", "If-None-Match", etag, http.StatusNotModified},
+		{"none match weak", "If-None-Match", "W/" + etag, http.StatusNotModified},
+		{"none match list", "If-None-Match", `"other", ` + etag, http.StatusNotModified},
+		{"none match any", "If-None-Match", "*", http.StatusNotModified},
+		{"none match other", "If-None-Match", `"other"`, http.StatusOK},
+		{"match", "If-Match", etag, http.StatusOK},
+		{"match weak", "If-Match", "W/" + etag, http.StatusPreconditionFailed},
+		{"match stale", "If-Match", `"other"`, http.StatusPreconditionFailed},
+		{"not modified since", "If-Modified-Since", future, http.StatusNotModified},
+		{"modified since", "If-Modified-Since", past, http.StatusOK},
+		{"modified after", "If-Unmodified-Since", past, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/file/a.txt", nil)
+			r.Header.Set(tt.header, tt.value)
+			w := ts.do(r)
+			if w.Code != tt.want {
+				t.Fatalf("expected %d, got %d %s", tt.want, w.Code, w.Body)
+			}
+			if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Fatalf("a 304 must have no body, got %q", w.Body)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != "some content" {
+				t.Fatalf("unexpected content %q", w.Body)
+			}
+		})
+	}
+}
+
+// TestConditionalChange tests the conditions of the uploads and the deletes of an
+// existing file: the file is kept unless they are met. {etag} is replaced with the
+// ETag of the file.
+func TestConditionalChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header string
+		value  string
+		want   int
+		stored string // content of the file after the request, "" if removed
+	}{
+		{"upload none match any", http.MethodPost, "If-None-Match", "*", http.StatusPreconditionFailed, "old"},
+		{"upload match stale", http.MethodPost, "If-Match", `"other"`, http.StatusPreconditionFailed, "old"},
+		{"upload match", http.MethodPost, "If-Match", "{etag}", http.StatusOK, "new"},
+		{"upload none match other", http.MethodPost, "If-None-Match", `"other"`, http.StatusOK, "new"},
+		{"delete match stale", http.MethodDelete, "If-Match", `"other"`, http.StatusPreconditionFailed, "old"},
+		{"delete none match", http.MethodDelete, "If-None-Match", "{etag}", http.StatusPreconditionFailed, "old"},
+		{"delete modified after", http.MethodDelete, "If-Unmodified-Since", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), http.StatusPreconditionFailed, "old"},
+		{"delete match", http.MethodDelete, "If-Match", "{etag}", http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestService(t, "", "")
+			ts.upload(t, "a.txt", []byte("old"))
+			etag := ts.etag(t, "a.txt")
+			var r *http.Request
+			if tt.method == http.MethodPost {
+				r = uploadRequest(t, "/api/file", "a.txt", []byte("new"), nil)
+			} else {
+				r = httptest.NewRequest(tt.method, "/api/file/a.txt", nil)
+			}
+			r.Header.Set(tt.header, strings.ReplaceAll(tt.value, "{etag}", etag))
+			if w := ts.do(r); w.Code != tt.want {
+				t.Fatalf("expected %d, got %d %s", tt.want, w.Code, w.Body)
+			}
+			w := ts.do(httptest.NewRequest(http.MethodGet, "/api/file/a.txt", nil))
+			switch {
+			case tt.stored == "" && w.Code != http.StatusNotFound:
+				t.Fatalf("the file must be removed, got %d", w.Code)
+			case tt.stored != "" && w.Body.String() != tt.stored:
+				t.Fatalf("expected the file %q, got %d %q", tt.stored, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+// TestConditionalUploadRace tests that of two uploads of a new file with
+// If-None-Match: *, both checked before any is stored, only one is stored: the
+// conditions are checked again under the lock of the object before it is stored.
+func TestConditionalUploadRace(t *testing.T) {
+	ts := newTestService(t, "", "")
+	// the first upload is stored once the second one has checked its conditions, the
+	// three stats being the checks of both before the upload and the check of the
+	// first one at its commit
+	ts.s3.beforePut = func(string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for ts.s3.headCount(testBucket, "a.txt") < 3 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	codes := make(chan int, 2)
+	for _, content := range []string{"first", "second"} {
+		go func(content string) {
+			r := uploadRequest(t, "/api/file", "a.txt", []byte(content), nil)
+			r.Header.Set("If-None-Match", "*")
+			codes <- ts.do(r).Code
+		}(content)
+	}
+	got := []int{<-codes, <-codes}
+	sort.Ints(got)
+	if got[0] != http.StatusOK || got[1] != http.StatusPreconditionFailed {
+		t.Fatalf("expected one upload stored and one failed, got %v", got)
+	}
+	if n := ts.s3.putCount(); n != 1 {
+		t.Fatalf("expected one object stored, got %d", n)
+	}
+}
+
+// TestJanitorsFollowTenants tests that the janitors are started for the buckets of
+// the tenants added on reload and stopped for the ones removed.
+func TestJanitorsFollowTenants(t *testing.T) {
+	const janitor = "janitor:\n  enabled: true\n  interval: 1h\n"
+	ts := newTestService(t, "", janitor)
+	js := newJanitors(ts.sc.conn)
+	t.Cleanup(func() {
+		for _, r := range js.running {
+			r.stop()
+		}
+	})
+	js.update(config.GetCurrent())
+	first := js.running[testBucket].janitor
+
+	cfg, err := config.NewConfig(writeTestConfig(t, ts.endpoint, "", janitor+"tenants:\n  - name: other\n    bucket: otherbucket\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	js.update(cfg)
+	if m := js.metrics(); len(m) != 2 {
+		t.Fatalf("expected the janitors of testbucket and otherbucket, got %v", m)
+	}
+	if _, ok := js.metrics()["otherbucket"]; !ok {
+		t.Fatalf("the bucket of the tenant added must have a janitor")
+	}
+	if js.running[testBucket].janitor != first {
+		t.Fatalf("the janitor of a bucket kept must not be replaced")
+	}
+
+	cfg, err = config.NewConfig(writeTestConfig(t, ts.endpoint, "", janitor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	js.update(cfg)
+	if _, ok := js.metrics()["otherbucket"]; ok || len(js.metrics()) != 1 {
+		t.Fatalf("expected the janitor of testbucket only, got %v", js.metrics())
+	}
+}
+
+// TestContentDisposition tests that the filename is given in printable ASCII without
+// quote nor line break, and in UTF-8 in filename* if it had to be changed.
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"none", "", "attachment"},
+		{"ascii", "report 1.pdf", `attachment; filename="report 1.pdf"`},
+		{"non-ascii", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"quote", `a"b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%22b.txt`},
+		{"backslash", `a\b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%5Cb.txt`},
+		{"line break", "a\r\nSet-Cookie: x.txt", `attachment; filename="a__Set-Cookie: x.txt"; filename*=UTF-8''a%0D%0ASet-Cookie%3A%20x.txt`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := contentDisposition("attachment", tt.filename)
+			if got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+			if strings.ContainsAny(got, "\r\n") {
+				t.Fatalf("the header must not contain a line break: %q", got)
+			}
+			if tt.filename == "" {
+				return
+			}
+			// the clients knowing filename* get the name back
+			_, params, err := mime.ParseMediaType(got)
+			if err != nil {
+				t.Fatalf("cannot parse %s: %v", got, err)
+			}
+			if params["filename"] != tt.filename {
+				t.Fatalf("expected the filename %q, got %q", tt.filename, params["filename"])
+			}
+		})
+	}
+	if got := contentDisposition("inline", "a.txt"); got != `inline; filename="a.txt"` {
+		t.Fatalf("unexpected inline disposition %s", got)
+	}
+}
+
+// formFile gives the file of a form with the given name, content type (none if
+// empty) and content.
+func formFile(t *testing.T, name, contentType string, content []byte) (*multipart.FileHeader, multipart.File) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+	if contentType != "" {
+		h.Set("Content-Type", contentType)
+	}
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	form, err := multipart.NewReader(&body, mw.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = form.RemoveAll() })
+	header := form.File["file"][0]
+	file, err := header.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = file.Close() })
+	return header, file
+}
+
+// TestUploadContentType tests that the content type given with the file is kept,
+// and guessed from its name or its content if it is missing or generic.
+func TestUploadContentType(t *testing.T) {
+	pdf := []byte("%PDF-1.4\n%...")
+	tests := []struct {
+		name        string
+		filename    string
+		contentType string
+		content     []byte
+		want        string
+		wantErr     error
+	}{
+		{"given", "a.bin", "text/plain; charset=utf-8", pdf, "text/plain; charset=utf-8", nil},
+		{"invalid", "a.pdf", "text/", pdf, "", ErrInvalidMetadata},
+		{"extension", "a.json", "", []byte("{}"), "application/json", nil},
+		{"generic", "a.json", "application/octet-stream", []byte("{}"), "application/json", nil},
+		{"sniffed", "a", "", pdf, "application/pdf", nil},
+		{"sniffed unknown extension", "a.unknown-ext", "application/octet-stream", []byte("<html><body>"), "text/html; charset=utf-8", nil},
+		{"empty", "a", "", nil, "text/plain; charset=utf-8", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, file := formFile(t, tt.filename, tt.contentType, tt.content)
+			got, err := uploadContentType(header, file)
+			if err != tt.wantErr {
+				t.Fatalf("expected the error %v, got %v", tt.wantErr, err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected %q, got %q", tt.want, got)
+			}
+			// the file is read from its start by the upload
+			data, err := io.ReadAll(file)
+			if err != nil || !bytes.Equal(data, tt.content) {
+				t.Fatalf("the file must not be consumed, read %q (%v)", data, err)
+			}
+		})
+	}
+}
+
+// TestListFilters tests the parsing of the filters k=v and k of a list.
+func TestListFilters(t *testing.T) {
+	got, err := listFilters([]string{"a=1", "b", "c=", "d=x=y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []listFilter{{key: "a", value: "1"}, {key: "b", anyValue: true}, {key: "c"}, {key: "d", value: "x=y"}}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	for _, v := range []string{"=1", ""} {
+		if _, err := listFilters([]string{"a", v}); err != ErrInvalidMetadata {
+			t.Fatalf("the filter %q without key must fail with ErrInvalidMetadata, got %v", v, err)
+		}
+	}
+}
+
+// TestMatchFilters tests that a map must match all the filters.
+func TestMatchFilters(t *testing.T) {
+	m := map[string]string{"a": "1", "b": ""}
+	tests := []struct {
+		filters []listFilter
+		want    bool
+	}{
+		{nil, true},
+		{[]listFilter{{key: "a", value: "1"}}, true},
+		{[]listFilter{{key: "a", value: "2"}}, false},
+		{[]listFilter{{key: "a", anyValue: true}}, true},
+		{[]listFilter{{key: "b"}}, true},
+		{[]listFilter{{key: "c", anyValue: true}}, false},
+		{[]listFilter{{key: "a", value: "1"}, {key: "c", anyValue: true}}, false},
+	}
+	for _, tt := range tests {
+		if got := matchFilters(tt.filters, m); got != tt.want {
+			t.Fatalf("%v: expected %v, got %v", tt.filters, tt.want, got)
+		}
+	}
+	if matchFilters([]listFilter{{key: "a", anyValue: true}}, nil) {
+		t.Fatalf("a file without tags must not match a filter")
+	}
+}
+
+// TestUploadMetadata tests the tags and the metadata of an upload, given in the form
+// or in the headers, and their limits.
+func TestUploadMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		fields      map[string]string
+		headers     map[string]string
+		wantTags    map[string]string
+		wantPublic  map[string]string
+		wantPrivate map[string]string
+		wantErr     bool
+	}{
+		{name: "none", wantPublic: map[string]string{}, wantPrivate: map[string]string{}},
+		{
+			name:     "form",
+			fields:   map[string]string{"tags": "a=1&b=2", "meta-Color": "red", "private-meta-secret": "s"},
+			wantTags: map[string]string{"a": "1", "b": "2"}, wantPublic: map[string]string{"color": "red"}, wantPrivate: map[string]string{"secret": "s"},
+		},
+		{
+			name:     "headers",
+			headers:  map[string]string{"X-Object-Tags": "a=1", "X-Object-Meta-Color": "red", "X-Object-Private-Meta-Secret": "s"},
+			wantTags: map[string]string{"a": "1"}, wantPublic: map[string]string{"color": "red"}, wantPrivate: map[string]string{"secret": "s"},
+		},
+		{
+			name:     "form before headers",
+			fields:   map[string]string{"tags": "a=1", "meta-color": "red"},
+			headers:  map[string]string{"X-Object-Tags": "a=2", "X-Object-Meta-Color": "blue"},
+			wantTags: map[string]string{"a": "1"}, wantPublic: map[string]string{"color": "red"}, wantPrivate: map[string]string{},
+		},
+		{name: "invalid tags", fields: map[string]string{"tags": "a=1&a=2"}, wantErr: true},
+		{name: "invalid name", fields: map[string]string{"meta-a_b": "1"}, wantErr: true},
+		{name: "invalid private name", headers: map[string]string{"X-Object-Private-Meta-A.b": "1"}, wantErr: true},
+		{name: "not printable", fields: map[string]string{"meta-a": "é"}, wantErr: true},
+		{name: "metadata too large", fields: map[string]string{"meta-a": strings.Repeat("x", maxMetadataSize)}, wantErr: true},
+		{
+			name:       "private metadata not printable",
+			fields:     map[string]string{"private-meta-a": "é\n"},
+			wantPublic: map[string]string{}, wantPrivate: map[string]string{"a": "é\n"},
+		},
+		{name: "private metadata too large", fields: map[string]string{"private-meta-a": strings.Repeat("x", maxPrivateMetadataSize)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := uploadRequest(t, "/api/file", "a.txt", []byte("content"), tt.fields)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Fatal(err)
+			}
+			tg, public, private, err := uploadMetadata(r)
+			if tt.wantErr {
+				if err != ErrInvalidMetadata {
+					t.Fatalf("expected ErrInvalidMetadata, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tg, tt.wantTags) || !reflect.DeepEqual(public, tt.wantPublic) || !reflect.DeepEqual(private, tt.wantPrivate) {
+				t.Fatalf("expected %v %v %v, got %v %v %v", tt.wantTags, tt.wantPublic, tt.wantPrivate, tg, public, private)
+			}
+		})
+	}
+}
+
+// listNames lists the files with the query and gives their names.
+func (ts *testService) listNames(t *testing.T, query string) []string {
+	t.Helper()
+	w := ts.do(httptest.NewRequest(http.MethodGet, "/api/file?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cannot list %s: %d %s", query, w.Code, w.Body)
+	}
+	var items []api.FileItem
+	if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+		t.Fatalf("cannot decode %s: %v", w.Body, err)
+	}
+	names := []string{}
+	for _, it := range items {
+		names = append(names, it.ObjectName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestListFiltersAndTags tests the filters of the list and the replacement of the
+// tags, with the listing of the bucket and with the index.
+func TestListFiltersAndTags(t *testing.T) {
+	for _, withIndex := range []bool{false, true} {
+		t.Run(fmt.Sprintf("index %v", withIndex), func(t *testing.T) {
+			ts := newTestService(t, "", "")
+			if withIndex {
+				ix, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { _ = ix.Close() })
+				ts.sc.index = ix
+			}
+			files := []struct {
+				name   string
+				fields map[string]string
+			}{
+				{"a.txt", map[string]string{"tags": "env=prod&team=a", "meta-color": "red"}},
+				{"b.txt", map[string]string{"tags": "env=dev", "meta-color": "blue"}},
+				{"c.txt", nil},
+			}
+			for _, f := range files {
+				if w := ts.do(uploadRequest(t, "/api/file", f.name, []byte(f.name), f.fields)); w.Code != http.StatusOK {
+					t.Fatalf("cannot upload %s: %d %s", f.name, w.Code, w.Body)
+				}
+			}
+			tests := []struct {
+				query string
+				want  []string
+			}{
+				{"", []string{"a.txt", "b.txt", "c.txt"}},
+				{"tag=env", []string{"a.txt", "b.txt"}},
+				{"tag=env=prod", []string{"a.txt"}},
+				{"tag=env=prod&tag=team=b", []string{}},
+				{"tag=env&meta=color=blue", []string{"b.txt"}},
+				{"meta=color=", []string{}},
+			}
+			for _, tt := range tests {
+				if got := ts.listNames(t, tt.query); !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("%s: expected %v, got %v", tt.query, tt.want, got)
+				}
+			}
+			if w := ts.do(httptest.NewRequest(http.MethodGet, "/api/file?tag==prod", nil)); w.Code != http.StatusBadRequest {
+				t.Fatalf("a filter without key must be rejected, got %d", w.Code)
+			}
+
+			setTags := func(name, body string) int {
+				return ts.do(httptest.NewRequest(http.MethodPut, "/api/file/"+name+"/tags", strings.NewReader(body))).Code
+			}
+			if code := setTags("c.txt", `{"env":"prod"}`); code != http.StatusNoContent {
+				t.Fatalf("cannot set the tags: %d", code)
+			}
+			if code := setTags("a.txt", `{}`); code != http.StatusNoContent {
+				t.Fatalf("cannot remove the tags: %d", code)
+			}
+			if got := ts.listNames(t, "tag=env=prod"); !reflect.DeepEqual(got, []string{"c.txt"}) {
+				t.Fatalf("expected the tags replaced, got %v", got)
+			}
+			for body, want := range map[string]int{
+				`not json`: http.StatusBadRequest,
+				`{"a":1}`:  http.StatusBadRequest,
+				`{"` + strings.Repeat("k", 129) + `":"v"}`:          http.StatusBadRequest,
+				`{"a":"` + strings.Repeat("v", 257) + `"}`:          http.StatusBadRequest,
+				`{"a":"b"` + strings.Repeat(" ", maxTagsBody) + `}`: http.StatusBadRequest,
+			} {
+				if code := setTags("b.txt", body); code != want {
+					t.Fatalf("%.20s: expected %d, got %d", body, want, code)
+				}
+			}
+			if code := setTags("missing.txt", `{"a":"b"}`); code != http.StatusNotFound {
+				t.Fatalf("the tags of a missing file: expected 404, got %d", code)
+			}
+			if code := setTags(store.DedupPrefix+"blob", `{"a":"b"}`); code != http.StatusBadRequest {
+				t.Fatalf("the tags of a blob: expected 400, got %d", code)
+			}
+		})
+	}
+}
+
+// TestUploadChecksums tests that an upload not matching the checksums given by the
+// client, or with invalid checksums, is rejected without storing anything.
+func TestUploadChecksums(t *testing.T) {
+	content := []byte("some content")
+	md5Sum, sha256Sum := md5.Sum(content), sha256.Sum256(content)
+	wrongMD5, wrongSHA256 := md5.Sum([]byte("other")), sha256.Sum256([]byte("other"))
+	b64 := base64.StdEncoding.EncodeToString
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		headers map[string]string
+		want    int
+		wantErr string // message of the error, "" if stored
+	}{
+		{"none", nil, nil, http.StatusOK, ""},
+		{"matching", map[string]string{"x-checksum-sha256": hex.EncodeToString(sha256Sum[:])},
+			map[string]string{"Content-MD5": b64(md5Sum[:]), "Digest": "sha-256=" + b64(sha256Sum[:])}, http.StatusOK, ""},
+		{"content-md5", nil, map[string]string{"Content-MD5": b64(wrongMD5[:])}, http.StatusBadRequest, "does not match its checksum"},
+		{"digest sha-256", nil, map[string]string{"Digest": "md5=" + b64(md5Sum[:]) + ", sha-256=" + b64(wrongSHA256[:])}, http.StatusBadRequest, "does not match its checksum"},
+		{"digest md5", nil, map[string]string{"Digest": "MD5=" + b64(wrongMD5[:])}, http.StatusBadRequest, "does not match its checksum"},
+		{"form sha-256", map[string]string{"x-checksum-sha256": hex.EncodeToString(wrongSHA256[:])}, nil, http.StatusBadRequest, "does not match its checksum"},
+		{"form before header", map[string]string{"x-checksum-sha256": hex.EncodeToString(wrongSHA256[:])},
+			map[string]string{"Digest": "sha-256=" + b64(sha256Sum[:])}, http.StatusBadRequest, "does not match its checksum"},
+		{"bad base64", nil, map[string]string{"Content-MD5": "not base64!"}, http.StatusBadRequest, "invalid checksum"},
+		{"bad size", nil, map[string]string{"Digest": "sha-256=" + b64(md5Sum[:])}, http.StatusBadRequest, "invalid checksum"},
+		{"bad hex", map[string]string{"x-checksum-sha256": "xyz"}, nil, http.StatusBadRequest, "invalid checksum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestService(t, "", "")
+			r := uploadRequest(t, "/api/file", "a.txt", content, tt.fields)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			w := ts.do(r)
+			if w.Code != tt.want {
+				t.Fatalf("expected %d, got %d %s", tt.want, w.Code, w.Body)
+			}
+			if tt.wantErr == "" {
+				if n := ts.s3.putCount(); n != 1 {
+					t.Fatalf("expected the file stored, got %d objects", n)
+				}
+				return
+			}
+			if !strings.Contains(w.Body.String(), tt.wantErr) {
+				t.Fatalf("expected the error %q, got %s", tt.wantErr, w.Body)
+			}
+			if n := ts.s3.putCount(); n != 0 {
+				t.Fatalf("nothing must be stored, got %d objects", n)
+			}
+			if w := ts.do(httptest.NewRequest(http.MethodGet, "/api/file/a.txt", nil)); w.Code != http.StatusNotFound {
+				t.Fatalf("the file must not exist, got %d", w.Code)
+			}
+		})
+	}
+}
+
+// TestTransferLimits tests that the bytes of a transfer are throttled at the rate of
+// the client, that a cancelled request stops waiting, and that the transfer leaves
+// the count of the transfers in progress on every path.
+func TestTransferLimits(t *testing.T) {
+	const limits = "  limits:\n    bytes_per_second: 100 KiB\n    bytes_burst: 10 KiB\n    max_transfers: 1"
+	content := bytes.Repeat([]byte("x"), 40<<10)
+
+	t.Run("throttled", func(t *testing.T) {
+		ts := newTestService(t, limits, "")
+		start := time.Now()
+		ts.upload(t, "a.txt", content)
+		// the burst is passed at once, the rest at the rate
+		if d := time.Since(start); d < 250*time.Millisecond {
+			t.Fatalf("the upload of 40 KiB at 100 KiB/s after a burst of 10 KiB took %v", d)
+		}
+		if n := ts.limits.transfers.InProgress(); n != 0 {
+			t.Fatalf("expected no transfer in progress, got %d", n)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		ts := newTestService(t, limits, "")
+		requests := map[string]*http.Request{
+			"missing file": httptest.NewRequest(http.MethodGet, "/api/file/missing.txt", nil),
+			"invalid form": uploadRequest(t, "/api/file?mode=unknown", "a.txt", []byte("a"), nil),
+			"not a form":   httptest.NewRequest(http.MethodPost, "/api/file", strings.NewReader("data")),
+		}
+		for name, r := range requests {
+			if w := ts.do(r); w.Code < 400 {
+				t.Fatalf("%s: expected an error, got %d", name, w.Code)
+			}
+			if n := ts.limits.transfers.InProgress(); n != 0 {
+				t.Fatalf("%s: expected no transfer in progress after the error, got %d", name, n)
+			}
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		// the upload would take 40s
+		ts := newTestService(t, "  limits:\n    bytes_per_second: 1 KiB\n    bytes_burst: 1 KiB\n    max_transfers: 1", "")
+		ctx, cancel := context.WithCancel(context.Background())
+		r := uploadRequest(t, "/api/file", "a.txt", content, nil).WithContext(ctx)
+		done := make(chan int)
+		go func() { done <- ts.do(r).Code }()
+		time.Sleep(50 * time.Millisecond)
+		if n := ts.limits.transfers.InProgress(); n != 1 {
+			t.Fatalf("expected the upload in progress, got %d", n)
+		}
+		// above the transfers in progress
+		if w := ts.do(uploadRequest(t, "/api/file", "b.txt", []byte("b"), nil)); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429 above the transfers in progress, got %d", w.Code)
+		}
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(500 * time.Millisecond):
+			t.Fatalf("the cancelled upload must stop waiting for its bytes")
+		}
+		if n := ts.limits.transfers.InProgress(); n != 0 {
+			t.Fatalf("expected no transfer in progress after the cancel, got %d", n)
+		}
+		if n := ts.s3.putCount(); n != 0 {
+			t.Fatalf("nothing must be stored, got %d objects", n)
+		}
+	})
+}
+
+// TestRoute tests the tenant, the resource and the object resolved from the path of
+// a request, and the tenants the caller cannot access.
+func TestRoute(t *testing.T) {
+	newTestService(t, "", "tenants:\n  - name: team\n    bucket: teambucket\n    callers: ['alice']\n  - name: open\n    bucket: openbucket\n")
+	tests := []struct {
+		path    string
+		caller  string
+		bucket  string
+		res     resource
+		object  string
+		wantErr error
+	}{
+		{path: "/api/file", bucket: testBucket},
+		{path: "/api/file/", bucket: testBucket},
+		{path: "/api/file/a.txt", bucket: testBucket, object: "a.txt"},
+		{path: "/api/file/dir/a.txt", bucket: testBucket, object: "dir/a.txt"},
+		{path: "/api/file/quota", bucket: testBucket, object: "quota"},
+		{path: "/api/file", caller: "alice", bucket: "teambucket"},
+		{path: "/api/quota", bucket: testBucket, res: resourceQuota},
+		{path: "/api/quota/", caller: "alice", bucket: "teambucket", res: resourceQuota},
+		{path: "/api/default/file/a.txt", bucket: testBucket, object: "a.txt"},
+		{path: "/api/open/file", bucket: "openbucket"},
+		{path: "/api/open/file//", bucket: "openbucket"},
+		{path: "/api/open/file/a/b.txt", bucket: "openbucket", object: "a/b.txt"},
+		{path: "/api/open/quota", bucket: "openbucket", res: resourceQuota},
+		{path: "/api/team/file/a.txt", caller: "alice", bucket: "teambucket", object: "a.txt"},
+		{path: "/api/team/file/a.txt", wantErr: ErrAccessForbidden},
+		{path: "/api/team/quota", caller: "bob", wantErr: ErrAccessForbidden},
+		{path: "/api/unknown/file", wantErr: ErrNotFound},
+		{path: "/api/unknown/file/a.txt", wantErr: ErrNotFound},
+		{path: "/api/unknown/quota", wantErr: ErrNotFound},
+		{path: "/api/", wantErr: ErrNotFound},
+		{path: "/api/open", wantErr: ErrNotFound},
+		{path: "/api/files", wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.caller+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.caller != "" {
+				r = r.WithContext(auth.WithCaller(r.Context(), tt.caller))
+			}
+			tenant, res, object, err := route(r)
+			if err != tt.wantErr {
+				t.Fatalf("expected the error %v, got %v", tt.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if tenant.Bucket() != tt.bucket || res != tt.res || object != tt.object {
+				t.Fatalf("expected %s %d %q, got %s %d %q", tt.bucket, tt.res, tt.object, tenant.Bucket(), res, object)
+			}
+		})
+	}
+}
+
+// TestReservedNames tests that the objects under the prefix of the blobs of the
+// deduplication cannot be uploaded, deleted nor tagged.
+func TestReservedNames(t *testing.T) {
+	ts := newTestService(t, "", "")
+	name := store.DedupPrefix + "blob"
+	requests := map[string]*http.Request{
+		"upload": uploadRequest(t, "/api/file", "a.txt", []byte("a"), map[string]string{"object_name": name}),
+		"delete": httptest.NewRequest(http.MethodDelete, "/api/file/"+name, nil),
+		"tags":   httptest.NewRequest(http.MethodPut, "/api/file/"+name+"/tags", strings.NewReader(`{}`)),
+	}
+	for n, r := range requests {
+		if w := ts.do(r); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "reserved") {
+			t.Fatalf("%s: expected the name reserved, got %d %s", n, w.Code, w.Body)
+		}
+	}
+	if n := ts.s3.putCount(); n != 0 {
+		t.Fatalf("nothing must be stored, got %d objects", n)
+	}
+}
@@ -0,0 +1,142 @@
+// Package ratelimit bounds the rate of the requests of the clients of the service
+// and the number of transfers in progress.
+//
+// The Limiter keeps a token bucket per client (identity or address). A bucket is
+// refilled at its rate up to its burst, a request is admitted when the bucket holds
+// enough tokens and the time to wait otherwise gives the Retry-After of the answer,
+// a transfer waits for the tokens of its bytes.
+// The rate and the burst are given on each call so they follow the configuration
+// when it is reloaded. The Gate counts the transfers in progress.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate is the refill rate of a bucket in tokens per second and its capacity.
+// A Rate without PerSecond is unlimited.
+type Rate struct {
+	PerSecond float64
+	Burst     float64
+}
+
+// Unlimited tells if the rate does not limit anything.
+func (r Rate) Unlimited() bool { return r.PerSecond <= 0 }
+
+// sweepInterval is the time between two removals of the idle buckets.
+const sweepInterval = time.Minute
+
+// bucket holds the tokens of a client at the time of its last update.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last update, up to the burst.
+func (b *bucket) refill(now time.Time, rate Rate) {
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*rate.PerSecond, rate.Burst)
+	b.last = now
+}
+
+// Limiter holds a token bucket per key. It is safe for concurrent use.
+type Limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time // replaced in the tests
+}
+
+// New creates a Limiter without any bucket.
+func New() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// get gives the bucket of the key refilled at now, a new bucket is full.
+// PRE: l.mu is held.
+func (l *Limiter) get(key string, now time.Time, rate Rate) *bucket {
+	l.sweep(now, rate)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rate.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.refill(now, rate)
+	return b
+}
+
+// sweep removes, every sweepInterval, the buckets that are full again. A new
+// bucket would be the same.
+// PRE: l.mu is held.
+func (l *Limiter) sweep(now time.Time, rate Rate) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if b.refill(now, rate); b.tokens >= rate.Burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Allow takes n tokens from the bucket of the key if it holds them. Otherwise,
+// nothing is taken and it gives the time to wait until the bucket holds them.
+// n is capped to the burst so a request can always pass once the bucket is full.
+func (l *Limiter) Allow(key string, n float64, rate Rate) (time.Duration, bool) {
+	if rate.Unlimited() {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.get(key, l.now(), rate)
+	n = math.Min(n, rate.Burst)
+	if b.tokens >= n {
+		b.tokens -= n
+		return 0, true
+	}
+	return time.Duration(math.Ceil((n - b.tokens) / rate.PerSecond * float64(time.Second))), false
+}
+
+// Wait takes n tokens from the bucket of the key, waiting until it holds them or
+// until ctx is done. n is capped to the burst as by Allow. It is used to throttle
+// the costs paid as they go, as the bytes transferred.
+func (l *Limiter) Wait(ctx context.Context, key string, n float64, rate Rate) error {
+	for {
+		wait, ok := l.Allow(key, n, rate)
+		if ok {
+			return nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Gate counts the operations in progress. The zero value is ready to use.
+type Gate struct {
+	n atomic.Int64
+}
+
+// Enter starts an operation if less than max are in progress, a max of 0 is
+// unlimited. Each successful Enter must be followed by a Leave.
+func (g *Gate) Enter(max int) bool {
+	if n := g.n.Add(1); max > 0 && n > int64(max) {
+		g.n.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Leave ends an operation started with Enter.
+func (g *Gate) Leave() { g.n.Add(-1) }
+
+// InProgress gives the number of operations in progress.
+func (g *Gate) InProgress() int { return int(g.n.Load()) }
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// testLimiter gives a limiter whose clock is moved by the test.
+func testLimiter() (*Limiter, *time.Time) {
+	now := time.Unix(1_000_000, 0)
+	l := New()
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestAllow(t *testing.T) {
+	l, now := testLimiter()
+	rate := Rate{PerSecond: 2, Burst: 3}
+	for i := 0; i < 3; i++ {
+		if _, ok := l.Allow("alice", 1, rate); !ok {
+			t.Fatalf("request %d within the burst must be allowed", i)
+		}
+	}
+	wait, ok := l.Allow("alice", 1, rate)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %v (allowed %v)", wait, ok)
+	}
+	// the buckets are per key
+	if _, ok := l.Allow("bob", 1, rate); !ok {
+		t.Fatalf("bob must have a bucket of its own")
+	}
+	*now = now.Add(500 * time.Millisecond)
+	if _, ok := l.Allow("alice", 1, rate); !ok {
+		t.Fatalf("the bucket must be refilled after the wait")
+	}
+	// unlimited
+	for i := 0; i < 100; i++ {
+		if _, ok := l.Allow("alice", 1, Rate{}); !ok {
+			t.Fatalf("an unlimited rate must allow everything")
+		}
+	}
+}
+
+// TestWait tests that the tokens are waited for until the bucket holds them.
+func TestWait(t *testing.T) {
+	l := New()
+	rate := Rate{PerSecond: 1000, Burst: 100}
+	ctx := context.Background()
+	start := time.Now()
+	if err := l.Wait(ctx, "alice", 100, rate); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.Wait(ctx, "alice", 50, rate); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Fatalf("expected to wait 50ms for the tokens, waited %v", elapsed)
+	}
+	if _, ok := l.Allow("alice", 0, rate); !ok {
+		t.Fatalf("the bucket must never go into debt")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.Wait(cancelled, "alice", 100, rate); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// TestSweep tests that the full buckets are removed, but not the ones refilling.
+func TestSweep(t *testing.T) {
+	l, now := testLimiter()
+	rate := Rate{PerSecond: 1, Burst: 1000}
+	l.Allow("alice", 1, rate)
+	l.Allow("bob", 1000, rate)
+	*now = now.Add(2 * sweepInterval)
+	l.Allow("carol", 1, rate)
+	if _, ok := l.buckets["alice"]; ok {
+		t.Fatalf("the full bucket of alice must be removed")
+	}
+	if _, ok := l.buckets["bob"]; !ok {
+		t.Fatalf("the bucket of bob still refilling must be kept")
+	}
+}
+
+func TestGate(t *testing.T) {
+	var g Gate
+	if !g.Enter(2) || !g.Enter(2) {
+		t.Fatalf("two operations must be allowed")
+	}
+	if g.Enter(2) {
+		t.Fatalf("a third operation must be refused")
+	}
+	g.Leave()
+	if !g.Enter(2) {
+		t.Fatalf("an operation must be allowed after a leave")
+	}
+	if !g.Enter(0) || g.InProgress() != 3 {
+		t.Fatalf("a max of 0 must be unlimited, got %d in progress", g.InProgress())
+	}
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Types of credential sources
+const (
+	CredentialsStatic      = "static"       // access and secret keys given in the configuration
+	CredentialsEnv         = "env"          // MINIO_ACCESS_KEY / MINIO_SECRET_KEY or AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY
+	CredentialsAWSFile     = "aws_file"     // AWS-style shared credentials file
+	CredentialsFile        = "file"         // json file re-read when it changes (e.g. Kubernetes secret)
+	CredentialsIAM         = "iam"          // IAM role of the instance (EC2, ECS, EKS)
+	CredentialsWebIdentity = "web_identity" // STS AssumeRoleWithWebIdentity with a token read from a file
+)
+
+// ErrUnknownCredentials error is thrown when the type of a credential source is unknown.
+var ErrUnknownCredentials = errs.New(fmt.Sprintf("unknown credentials type, use one of [%s]", strings.Join([]string{
+	CredentialsStatic, CredentialsEnv, CredentialsAWSFile, CredentialsFile, CredentialsIAM, CredentialsWebIdentity,
+}, ", ")))
+
+// CredentialSource describes where to find the credentials of the MinIo connection.
+// Only the fields related to its Type are used.
+type CredentialSource struct {
+	Type      string
+	AccessKey string        // static
+	SecretKey string        // static
+	Path      string        // aws_file, file
+	Profile   string        // aws_file, default profile if empty
+	Endpoint  string        // iam (optional), web_identity (STS endpoint)
+	TokenFile string        // web_identity, file containing the identity token (JWT)
+	RoleARN   string        // web_identity, optional
+	Duration  time.Duration // web_identity, requested validity of the credentials, optional
+}
+
+// newCredentials creates the credentials of the connection from the chain of sources.
+// The sources are tried in order, the first one giving credentials is used.
+// If no source is given, the static access and secret keys of the options are used.
+func newCredentials(opts Options, transport http.RoundTripper) (*credentials.Credentials, error) {
+	if len(opts.Credentials) == 0 {
+		return credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""), nil
+	}
+	providers := make([]credentials.Provider, 0, len(opts.Credentials))
+	for _, src := range opts.Credentials {
+		p, err := newProvider(src, transport)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p...)
+	}
+	if len(providers) == 1 {
+		return credentials.New(providers[0]), nil
+	}
+	return credentials.NewChainCredentials(providers), nil
+}
+
+// newProvider creates the providers corresponding to a source.
+func newProvider(src CredentialSource, transport http.RoundTripper) ([]credentials.Provider, error) {
+	switch src.Type {
+	case CredentialsStatic:
+		return []credentials.Provider{&credentials.Static{Value: credentials.Value{
+			AccessKeyID:     src.AccessKey,
+			SecretAccessKey: src.SecretKey,
+			SignerType:      credentials.SignatureV4,
+		}}}, nil
+	case CredentialsEnv:
+		return []credentials.Provider{&credentials.EnvMinio{}, &credentials.EnvAWS{}}, nil
+	case CredentialsAWSFile:
+		return []credentials.Provider{&credentials.FileAWSCredentials{Filename: src.Path, Profile: src.Profile}}, nil
+	case CredentialsFile:
+		if src.Path == "" {
+			return nil, errs.New("path is required for the file credentials")
+		}
+		return []credentials.Provider{&fileProvider{path: src.Path}}, nil
+	case CredentialsIAM:
+		return []credentials.Provider{&credentials.IAM{
+			Client:   &http.Client{Transport: transport},
+			Endpoint: src.Endpoint,
+		}}, nil
+	case CredentialsWebIdentity:
+		if src.Endpoint == "" || src.TokenFile == "" {
+			return nil, errs.New("endpoint and token_file are required for the web_identity credentials")
+		}
+		return []credentials.Provider{&credentials.STSWebIdentity{
+			Client:              &http.Client{Transport: transport},
+			STSEndpoint:         src.Endpoint,
+			RoleARN:             src.RoleARN,
+			GetWebIDTokenExpiry: tokenFromFile(src.TokenFile, src.Duration),
+		}}, nil
+	default:
+		return nil, errs.Wrap(ErrUnknownCredentials, fmt.Sprintf("cannot use credentials type %s", src.Type))
+	}
+}
+
+// tokenFromFile returns a function reading the web identity token from a file.
+// The file is read on each call as the token is rotated by the platform.
+func tokenFromFile(path string, duration time.Duration) func() (*credentials.WebIdentityToken, error) {
+	return func() (*credentials.WebIdentityToken, error) {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errs.Wrap(err, "cannot read the web identity token")
+		}
+		return &credentials.WebIdentityToken{
+			Token:  strings.TrimSpace(string(token)),
+			Expiry: int(duration.Seconds()),
+		}, nil
+	}
+}
+
+// fileCredentials is the content of the file read by the fileProvider.
+type fileCredentials struct {
+	AccessKey    string `json:"access_key"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token,omitempty"`
+}
+
+// fileProvider is a credentials.Provider reading the credentials from a json file.
+// The credentials expire as soon as the modification time of the file changes,
+// the file is then read again on the next request. It allows to rotate the
+// credentials mounted from a Kubernetes secret without restarting the service.
+type fileProvider struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time // modification time of the file when last read
+}
+
+// Retrieve is the implementation of credentials.Provider, it reads the file.
+func (fp *fileProvider) Retrieve() (credentials.Value, error) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	s, err := os.Stat(fp.path)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	data, err := os.ReadFile(fp.path)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	var fc fileCredentials
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return credentials.Value{}, errs.Wrap(err, "cannot parse the credentials file "+fp.path)
+	}
+	if fc.AccessKey == "" || fc.SecretKey == "" {
+		return credentials.Value{}, errs.New("access_key and secret_key are required in the credentials file " + fp.path)
+	}
+	fp.modTime = s.ModTime()
+	return credentials.Value{
+		AccessKeyID:     fc.AccessKey,
+		SecretAccessKey: fc.SecretKey,
+		SessionToken:    fc.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+// IsExpired is the implementation of credentials.Provider. The credentials
+// are expired if the file has changed since the last read.
+func (fp *fileProvider) IsExpired() bool {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	s, err := os.Stat(fp.path)
+	if err != nil {
+		// keep the current credentials, the file may be in rotation
+		return false
+	}
+	return !s.ModTime().Equal(fp.modTime)
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFileCredentials tests that the credentials are read again when the file changes.
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	write := func(access string, modTime time.Time) {
+		data := fmt.Sprintf(`{"access_key": "%s", "secret_key": "secret"}`, access)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatalf("cannot write credentials: %v", err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	write("first", time.Now().Add(-time.Minute))
+
+	creds, err := newCredentials(Options{Credentials: []CredentialSource{{Type: CredentialsFile, Path: path}}}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v, err := creds.Get()
+	if err != nil || v.AccessKeyID != "first" {
+		t.Fatalf("expected access key first, got %s (%v)", v.AccessKeyID, err)
+	}
+	if creds.IsExpired() {
+		t.Fatal("credentials must not expire while the file is unchanged")
+	}
+	write("second", time.Now())
+	if !creds.IsExpired() {
+		t.Fatal("credentials must expire when the file changes")
+	}
+	if v, err = creds.Get(); err != nil || v.AccessKeyID != "second" {
+		t.Fatalf("expected access key second, got %s (%v)", v.AccessKeyID, err)
+	}
+}
+
+// TestChainCredentials tests that the first source giving credentials is used.
+func TestChainCredentials(t *testing.T) {
+	t.Setenv("MINIO_ACCESS_KEY", "")
+	t.Setenv("MINIO_ROOT_USER", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_ACCESS_KEY", "")
+	creds, err := newCredentials(Options{Credentials: []CredentialSource{
+		{Type: CredentialsEnv},
+		{Type: CredentialsStatic, AccessKey: "static", SecretKey: "secret"},
+	}}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v, _ := creds.Get(); v.AccessKeyID != "static" {
+		t.Fatalf("expected the static credentials without environment, got %s", v.AccessKeyID)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "env")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	creds, _ = newCredentials(Options{Credentials: []CredentialSource{
+		{Type: CredentialsEnv},
+		{Type: CredentialsStatic, AccessKey: "static", SecretKey: "secret"},
+	}}, http.DefaultTransport)
+	if v, _ := creds.Get(); v.AccessKeyID != "env" {
+		t.Fatalf("expected the environment credentials, got %s", v.AccessKeyID)
+	}
+
+	if _, err := newCredentials(Options{Credentials: []CredentialSource{{Type: "unknown"}}}, http.DefaultTransport); err == nil {
+		t.Fatal("expected an error with an unknown type")
+	}
+}
+
+// TestWebIdentityCredentials tests the web identity credentials against a
+// local stand-in of the STS service.
+func TestWebIdentityCredentials(t *testing.T) {
+	const response = `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>sts-access</AccessKeyId>
+      <SecretAccessKey>sts-secret</SecretAccessKey>
+      <SessionToken>sts-token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`
+	var gotToken, gotRole string
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		gotToken, gotRole = r.Form.Get("WebIdentityToken"), r.Form.Get("RoleArn")
+		fmt.Fprintf(w, response, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("jwt-token\n"), 0o600)
+	creds, err := newCredentials(Options{Credentials: []CredentialSource{{
+		Type: CredentialsWebIdentity, Endpoint: sts.URL, TokenFile: tokenFile, RoleARN: "arn:minio:iam:::role/test",
+	}}}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	v, err := creds.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v.AccessKeyID != "sts-access" || v.SecretAccessKey != "sts-secret" || v.SessionToken != "sts-token" {
+		t.Fatalf("unexpected credentials: %+v", v)
+	}
+	if gotToken != "jwt-token" || gotRole != "arn:minio:iam:::role/test" {
+		t.Fatalf("unexpected request to the STS: token=%s role=%s", gotToken, gotRole)
+	}
+}
@@ -0,0 +1,322 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"strconv"
+
+	"github.com/ag0st/taurus-challenge/encdec"
+	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/ag0st/taurus-challenge/keys"
+	"github.com/ag0st/taurus-challenge/logging"
+	"github.com/minio/minio-go/v7"
+)
+
+// The deduplicated objects are stored once in a blob, identified by the HMAC-SHA256
+// of their plaintext with a key of the service: the name of a blob does not tell
+// anything about the content to the readers of the bucket. The blobs are stored in
+// the bucket under DedupPrefix, without anything of the objects referencing them.
+// Each object is a header alone referencing its blob in its metadata: its filename
+// and its metadata are sealed in this header, with a data key of its own. The
+// references are counted in a RefIndex, a blob is removed with its last reference.
+
+// DedupPrefix is the prefix of the blobs of the deduplicated objects in the buckets.
+const DedupPrefix = ".dedup/"
+
+// Metadata of the objects referencing a blob.
+const (
+	BlobMetadata     = "Dedup-Blob" // name of the blob referenced
+	BlobSizeMetadata = "Dedup-Size" // size of the blob, given as size of the object by ListFiles
+)
+
+// blobLocks is the number of locks serializing the operations on the blobs.
+const blobLocks = 64
+
+// ErrNoRefIndex error is thrown when an object is deduplicated without index of the
+// references (see SetRefIndex).
+var ErrNoRefIndex = errs.New("the deduplication requires the index of the references")
+
+// RefIndex counts the references of the objects to the blobs.
+type RefIndex interface {
+	// SetRef records that the object of the bucket references the blob, replacing its
+	// previous reference. It gives the previous blob ("" if none) and its remaining
+	// number of references.
+	SetRef(bucket, object, blob string) (prev string, prevRefs int, err error)
+	// RemoveRef removes the reference of the object of the bucket. It gives the blob
+	// it referenced ("" if none) and its remaining number of references.
+	RemoveRef(bucket, object string) (blob string, refs int, err error)
+	// Refs gives the number of references of the blob of the bucket.
+	Refs(bucket, blob string) (int, error)
+}
+
+// SetRefIndex sets the index of the references of the deduplicated objects. Without
+// index, the objects cannot be deduplicated and deleting an object referencing a blob
+// keeps the blob.
+func (c *Connection) SetRefIndex(refs RefIndex) { c.refs = refs }
+
+// blobLock gives the lock of the operations on the blob.
+func (c *Connection) blobLock(blob string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(blob))
+	mu := &c.blobMu[h.Sum32()%blobLocks]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// PushDedup pushes the data like PushObject, but the data is stored only once in a
+// blob shared by all the objects with the same content. The data is read a first
+// time to compute its HMAC with key, which names the blob, then read again from the
+// beginning to push the blob if it does not exist yet. The object is a header alone
+// referencing the blob, its size in the info given is the size of the blob. The
+// options are the ones of PushObject: the filename, the metadata, the tags and the
+// owner are the ones of the object, the others only apply to a new blob.
+func (c *Connection) PushDedup(ctx context.Context, r io.ReadSeeker, bucketname, objectName string, key []byte, opts PushOptions) (PushInfo, error) {
+	if c.refs == nil {
+		return PushInfo{}, ErrNoRefIndex
+	}
+	// 1. name the blob from the data, verified and bounded as PushObject does
+	var src io.Reader = r
+	if opts.ExpectedMD5 != nil || opts.ExpectedSHA256 != nil {
+		src = newVerifyReader(src, opts.ExpectedMD5, opts.ExpectedSHA256)
+	}
+	if opts.MaxSize != 0 {
+		src = &maxSizeReader{r: src, left: opts.MaxSize}
+	}
+	mac, sha := hmac.New(sha256.New, key), sha256.New()
+	var crc hash.Hash32
+	writers := []io.Writer{mac, sha}
+	if opts.CRC32C {
+		crc = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		writers = append(writers, crc)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), src)
+	if err != nil {
+		return PushInfo{}, err
+	}
+	blob := hex.EncodeToString(mac.Sum(nil))
+	sums := encdec.Checksums{SHA256: sha.Sum(nil), Size: binary.BigEndian.AppendUint64(nil, uint64(size))}
+	if crc != nil {
+		sums.CRC32C = crc.Sum(nil)
+	}
+
+	stored := c.storedKey(bucketname, objectName)
+	info, prev, prevRefs, err := c.pushRef(ctx, r, bucketname, stored, objectName, blob, opts)
+	if err != nil {
+		return PushInfo{}, err
+	}
+	c.removeUnobfuscated(ctx, bucketname, stored, objectName)
+	if prev != "" && prev != blob && prevRefs == 0 {
+		// the object referenced another blob, removed with its last reference
+		if err := c.removeBlob(ctx, bucketname, prev); err != nil {
+			return PushInfo{}, err
+		}
+	}
+	return PushInfo{UploadInfo: info, Checksums: sums, Blob: blob}, nil
+}
+
+// pushRef pushes the blob if it does not exist yet and the object of the given name
+// referencing it under the key. It gives the blob previously referenced by the object
+// and its remaining references. The blob is pushed without its lock, held only to
+// check that it still exists and to reference it: a blob removed with its last
+// reference in the meantime is pushed again.
+func (c *Connection) pushRef(ctx context.Context, r io.ReadSeeker, bucketname, key, objectName, blob string, opts PushOptions) (minio.UploadInfo, string, int, error) {
+	body, err := c.refHeader(ctx, bucketname, opts)
+	if err != nil {
+		return minio.UploadInfo{}, "", 0, err
+	}
+	metadata, err := c.nameMetadata(userMetadataOf(opts), key, objectName)
+	if err != nil {
+		return minio.UploadInfo{}, "", 0, err
+	}
+	if metadata == nil {
+		metadata = make(map[string]string, 2)
+	}
+	pushed := false
+	for attempt := 0; attempt < blobAttempts; attempt++ {
+		if _, err := c.blobInfo(ctx, bucketname, blob); notFound(err) == ErrObjectNotFound {
+			if err := c.pushBlob(ctx, r, bucketname, blob, opts); err != nil {
+				return minio.UploadInfo{}, "", 0, err
+			}
+			pushed = true
+		} else if err != nil {
+			return minio.UploadInfo{}, "", 0, err
+		}
+		info, prev, prevRefs, err := c.putRef(ctx, bucketname, key, blob, body, metadata, opts)
+		if err == errBlobRemoved {
+			continue
+		}
+		if err != nil && pushed {
+			// the blob pushed is removed if it is not referenced
+			if err := c.removeBlob(context.WithoutCancel(ctx), bucketname, blob); err != nil {
+				logging.Errorf("cannot remove the blob %s: %v", blob, err)
+			}
+		}
+		return info, prev, prevRefs, err
+	}
+	return minio.UploadInfo{}, "", 0, errBlobRemoved
+}
+
+// blobAttempts is the number of times a blob is pushed while it is removed by the
+// deletes of its last reference.
+const blobAttempts = 3
+
+// errBlobRemoved error is thrown when a blob is removed before it is referenced.
+var errBlobRemoved = errs.New("the blob has been removed before it is referenced")
+
+// pushBlob pushes the data of the blob. The blob is shared: only the encoding of the
+// upload applies to it, nothing of the object is stored with it (the data is already
+// verified and the object is committed by its reference).
+func (c *Connection) pushBlob(ctx context.Context, r io.ReadSeeker, bucketname, blob string, opts PushOptions) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	blobOpts := PushOptions{ChunkSize: opts.ChunkSize, PartSize: opts.PartSize, Stream: opts.Stream, Size: opts.Size,
+		MaxSize: opts.MaxSize, CRC32C: opts.CRC32C, Compression: opts.Compression}
+	_, err := c.pushObject(ctx, r, bucketname, DedupPrefix+blob, DedupPrefix+blob, blobOpts)
+	return err
+}
+
+// putRef commits the object and puts its reference to the blob, holding the lock of
+// the blob. It fails with errBlobRemoved if the blob does not exist anymore.
+func (c *Connection) putRef(ctx context.Context, bucketname, key, blob string, body []byte, metadata map[string]string,
+	opts PushOptions,
+) (minio.UploadInfo, string, int, error) {
+	// a cancelled upload does not reference the blob
+	if err := ctx.Err(); err != nil {
+		return minio.UploadInfo{}, "", 0, err
+	}
+	release, err := commit(opts.Commit)
+	if err != nil {
+		return minio.UploadInfo{}, "", 0, err
+	}
+	defer release()
+	defer c.blobLock(blob)()
+	blobInfo, err := c.blobInfo(ctx, bucketname, blob)
+	if notFound(err) == ErrObjectNotFound {
+		return minio.UploadInfo{}, "", 0, errBlobRemoved
+	}
+	if err != nil {
+		return minio.UploadInfo{}, "", 0, err
+	}
+	metadata[BlobMetadata], metadata[BlobSizeMetadata] = blob, strconv.FormatInt(blobInfo.Size, 10)
+	info, err := c.client.PutObject(ctx, bucketname, key, bytes.NewReader(body), int64(len(body)),
+		minio.PutObjectOptions{ContentType: StoredContentType, UserMetadata: metadata, UserTags: opts.Tags})
+	if err != nil {
+		return minio.UploadInfo{}, "", 0, err
+	}
+	info.Size = blobInfo.Size // the size of the object is the size of its blob, as listed
+	prev, prevRefs, err := c.refs.SetRef(bucketname, key, blob)
+	return info, prev, prevRefs, err
+}
+
+// refHeader gives the body of a reference: a header alone, sealing the filename and
+// the metadata of the object with a data key of its own.
+func (c *Connection) refHeader(ctx context.Context, bucketname string, opts PushOptions) ([]byte, error) {
+	dataKey, wrapped, err := c.keyProvider(bucketname).DataKey(ctx)
+	if err != nil {
+		return nil, errs.Wrap(err, "cannot get a data key")
+	}
+	h := encdec.NewHeader(0, "")
+	if err := h.SetWrappedKey(wrapped); err != nil {
+		return nil, err
+	}
+	if err := h.SetMetadata(headerMetadataOf(opts)); err != nil {
+		return nil, err
+	}
+	return encdec.SealHeader(dataKey, h)
+}
+
+// refMetadata reads the metadata sealed in the body of a reference of the given size,
+// nil for the references stored empty, whose metadata is the one of their blob.
+func (c *Connection) refMetadata(ctx context.Context, bucketname string, size int64, body io.Reader) (*encdec.Metadata, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	kp := c.keyProvider(bucketname)
+	dec, err := encdec.NewDecReaderWithKeys(func(wrapped []byte) ([keys.KeySize]byte, error) {
+		return kp.Unwrap(ctx, wrapped)
+	}, body)
+	if err != nil {
+		return nil, err
+	}
+	m, err := dec.Metadata()
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// blobInfo gives the size of an existing blob.
+func (c *Connection) blobInfo(ctx context.Context, bucketname, blob string) (minio.UploadInfo, error) {
+	info, err := c.client.StatObject(ctx, bucketname, DedupPrefix+blob, minio.StatObjectOptions{})
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return minio.UploadInfo{Bucket: bucketname, Key: info.Key, Size: info.Size}, nil
+}
+
+// DeleteOptions are the options of a delete, see DeleteObject.
+type DeleteOptions struct {
+	Commit CommitFunc // called before the object is removed, nil for none
+}
+
+// DeleteObject removes the object from the bucket. If it references a blob, the
+// blob is removed with its last reference. It fails with ErrObjectNotFound if the
+// object does not exist.
+func (c *Connection) DeleteObject(ctx context.Context, bucketname, objectName string, opts DeleteOptions) error {
+	release, err := commit(opts.Commit)
+	if err != nil {
+		return err
+	}
+	info, err := c.statObject(ctx, bucketname, objectName)
+	if err == nil {
+		err = c.client.RemoveObject(ctx, bucketname, info.Key, minio.RemoveObjectOptions{})
+	}
+	// released before the blob is removed, under its own lock (an upload takes the
+	// lock of the blob within its commit)
+	release()
+	if err != nil {
+		return err
+	}
+	return c.dropRef(ctx, bucketname, info.Key)
+}
+
+// deleteKey removes the existing object stored under the key, and its reference.
+func (c *Connection) deleteKey(ctx context.Context, bucketname, key string) error {
+	if err := c.client.RemoveObject(ctx, bucketname, key, minio.RemoveObjectOptions{}); err != nil {
+		return err
+	}
+	return c.dropRef(ctx, bucketname, key)
+}
+
+// dropRef removes the reference of the object if it referenced a blob, and the blob
+// with its last reference.
+func (c *Connection) dropRef(ctx context.Context, bucketname, objectName string) error {
+	if c.refs == nil {
+		return nil
+	}
+	blob, refs, err := c.refs.RemoveRef(bucketname, objectName)
+	if err != nil || blob == "" || refs > 0 {
+		return err
+	}
+	return c.removeBlob(ctx, bucketname, blob)
+}
+
+// removeBlob removes the blob if it has no reference. A concurrent upload may have
+// referenced it again since its last reference was removed.
+func (c *Connection) removeBlob(ctx context.Context, bucketname, blob string) error {
+	defer c.blobLock(blob)()
+	refs, err := c.refs.Refs(bucketname, blob)
+	if err != nil || refs > 0 {
+		return err
+	}
+	return c.client.RemoveObject(ctx, bucketname, DedupPrefix+blob, minio.RemoveObjectOptions{})
+}
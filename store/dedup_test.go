@@ -0,0 +1,221 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ag0st/taurus-challenge/encdec"
+	"github.com/ag0st/taurus-challenge/keys"
+	"github.com/minio/minio-go/v7"
+)
+
+// objectsClientMock keeps the data, the size and the metadata of the objects put.
+type objectsClientMock struct {
+	minioClientMock
+	objects map[string]minio.ObjectInfo
+	data    map[string][]byte
+	put     func(objectName string) // called once an object is put, nil for none
+}
+
+func (c *objectsClientMock) PutObject(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64,
+	opts minio.PutObjectOptions,
+) (minio.UploadInfo, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	n := int64(len(data))
+	c.objects[objectName] = minio.ObjectInfo{Key: objectName, Size: n, UserMetadata: opts.UserMetadata}
+	if c.data != nil {
+		c.data[objectName] = data
+	}
+	if c.put != nil {
+		c.put(objectName)
+	}
+	return minio.UploadInfo{Bucket: bucketName, Key: objectName, Size: n}, nil
+}
+
+func (c *objectsClientMock) StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	info, ok := c.objects[objectName]
+	if !ok {
+		return minio.ObjectInfo{}, minio.ErrorResponse{Code: "NoSuchKey", StatusCode: 404}
+	}
+	return info, nil
+}
+
+func (c *objectsClientMock) RemoveObject(ctx context.Context, bucketName, objectName string, opts minio.RemoveObjectOptions) error {
+	delete(c.objects, objectName)
+	return nil
+}
+
+// refIndexMock counts the references in memory, for a single bucket.
+type refIndexMock struct {
+	blobs map[string]string // object -> blob
+}
+
+func (ix *refIndexMock) SetRef(bucket, object, blob string) (string, int, error) {
+	prev := ix.blobs[object]
+	ix.blobs[object] = blob
+	refs, _ := ix.Refs(bucket, prev)
+	return prev, refs, nil
+}
+
+func (ix *refIndexMock) RemoveRef(bucket, object string) (string, int, error) {
+	blob := ix.blobs[object]
+	delete(ix.blobs, object)
+	refs, _ := ix.Refs(bucket, blob)
+	return blob, refs, nil
+}
+
+func (ix *refIndexMock) Refs(bucket, blob string) (int, error) {
+	refs := 0
+	for _, b := range ix.blobs {
+		if b == blob {
+			refs++
+		}
+	}
+	return refs, nil
+}
+
+// blobs gives the names of the blobs stored.
+func (c *objectsClientMock) blobs() []string {
+	var res []string
+	for name := range c.objects {
+		if strings.HasPrefix(name, DedupPrefix) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// TestPushDedup tests that identical uploads share a blob, removed with its last reference.
+func TestPushDedup(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &objectsClientMock{objects: map[string]minio.ObjectInfo{}, data: map[string][]byte{}}
+	conn := &Connection{client: client}
+	conn.SetKeys(kp)
+	data, key := bytes.Repeat([]byte("taurus"), 1000), []byte("dedup key")
+	ctx := context.Background()
+
+	if _, err := conn.PushDedup(ctx, bytes.NewReader(data), "test", "a.txt", key, PushOptions{}); err != ErrNoRefIndex {
+		t.Fatalf("expected ErrNoRefIndex, got %v", err)
+	}
+	conn.SetRefIndex(&refIndexMock{blobs: map[string]string{}})
+	uploads := map[string]PushOptions{
+		"a.txt": {Owner: "alice", Filename: "report.txt", ContentType: "text/plain", PrivateMetadata: map[string]string{"patient": "42"}},
+		"b.txt": {Owner: "bob", Filename: "copy.csv", ContentType: "text/csv", PrivateMetadata: map[string]string{"patient": "7"}},
+	}
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if _, err := conn.PushDedup(ctx, bytes.NewReader(data), "test", name, key, uploads[name]); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	blobs := client.blobs()
+	if len(blobs) != 1 {
+		t.Fatalf("expected a single blob, got %v", blobs)
+	}
+	// nothing of the first upload is stored with the shared blob
+	blob := client.objects[blobs[0]]
+	dec, _ := encdec.NewDecReaderWithKeys(func(wrapped []byte) ([keys.KeySize]byte, error) {
+		return kp.Unwrap(ctx, wrapped)
+	}, bytes.NewReader(client.data[blob.Key]))
+	if m, err := dec.Metadata(); err != nil || !reflect.DeepEqual(m, encdec.Metadata{}) || len(blob.UserMetadata) != 0 {
+		t.Fatalf("unexpected blob %+v with metadata %+v (%v)", blob, m, err)
+	}
+	// each reference seals the filename, the content type and the private metadata of
+	// its own upload
+	for _, name := range []string{"a.txt", "b.txt"} {
+		ref, opts := client.objects[name], uploads[name]
+		if ref.Size == 0 || DedupPrefix+ref.UserMetadata[BlobMetadata] != blob.Key || ref.UserMetadata[OwnerMetadata] != opts.Owner {
+			t.Fatalf("unexpected reference %s: %+v", name, ref)
+		}
+		m, err := conn.refMetadata(ctx, "test", ref.Size, bytes.NewReader(client.data[name]))
+		if err != nil || m == nil || m.Filename != opts.Filename || m.ContentType != opts.ContentType ||
+			!reflect.DeepEqual(m.Custom, opts.PrivateMetadata) {
+			t.Fatalf("unexpected metadata of the reference %s: %+v (%v)", name, m, err)
+		}
+	}
+	// a cancelled upload references nothing, even if its blob exists
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := conn.PushDedup(cancelled, bytes.NewReader(data), "test", "d.txt", key, PushOptions{}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, ok := client.objects["d.txt"]; ok || conn.refs.(*refIndexMock).blobs["d.txt"] != "" {
+		t.Fatalf("the cancelled upload must not reference the blob")
+	}
+	if _, err := conn.PushDedup(cancelled, bytes.NewReader([]byte("new content")), "test", "e.txt", key, PushOptions{}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(client.blobs()) != 1 || conn.refs.(*refIndexMock).blobs["e.txt"] != "" {
+		t.Fatalf("the cancelled upload must not store a blob, got %v", client.blobs())
+	}
+	// the name of the blob depends on the key
+	if _, err := conn.PushDedup(ctx, bytes.NewReader(data), "test", "c.txt", []byte("other key"), PushOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(client.blobs()) != 2 {
+		t.Fatalf("expected a blob per key, got %v", client.blobs())
+	}
+
+	if err := conn.DeleteObject(ctx, "test", "a.txt", DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := client.objects[blob.Key]; !ok {
+		t.Fatalf("the blob must be kept while b.txt references it")
+	}
+	if err := conn.DeleteObject(ctx, "test", "b.txt", DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := client.objects[blob.Key]; ok {
+		t.Fatalf("the blob must be removed with its last reference")
+	}
+	if err := conn.DeleteObject(ctx, "test", "b.txt", DeleteOptions{}); err != ErrObjectNotFound {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+// TestPushDedupBlobRemoved tests that a blob is pushed without its lock and pushed
+// again if it is removed before it is referenced.
+func TestPushDedupBlobRemoved(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &objectsClientMock{objects: map[string]minio.ObjectInfo{}}
+	conn := &Connection{client: client}
+	conn.SetKeys(kp)
+	conn.SetRefIndex(&refIndexMock{blobs: map[string]string{}})
+	pushes := 0
+	client.put = func(name string) {
+		if !strings.HasPrefix(name, DedupPrefix) {
+			return
+		}
+		pushes++
+		// no lock of the blobs is held during the push
+		for i := range conn.blobMu {
+			if !conn.blobMu[i].TryLock() {
+				t.Fatalf("the lock %d is held during the push of the blob", i)
+			}
+			conn.blobMu[i].Unlock()
+		}
+		if pushes == 1 { // removed as by the delete of its last reference
+			delete(client.objects, name)
+		}
+	}
+	if _, err := conn.PushDedup(context.Background(), bytes.NewReader([]byte("taurus")), "test", "a.txt", []byte("key"),
+		PushOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	blob := DedupPrefix + client.objects["a.txt"].UserMetadata[BlobMetadata]
+	if _, ok := client.objects[blob]; !ok || pushes != 2 {
+		t.Fatalf("expected the blob pushed again, pushed %d times", pushes)
+	}
+}
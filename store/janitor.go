@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/ag0st/taurus-challenge/logging"
+)
+
+// ErrJanitorInterval error is thrown when the janitor is started with an interval
+// that is not strictly positive.
+var ErrJanitorInterval = errs.New("janitor interval must be greater than 0")
+
+// JanitorMetrics is a snapshot of the counters of a Janitor since its creation.
+type JanitorMetrics struct {
+	Runs        uint64    `json:"runs"`          // number of sweeps done
+	Scanned     uint64    `json:"scanned"`       // number of incomplete uploads seen
+	Aborted     uint64    `json:"aborted"`       // number of uploads aborted
+	WouldAbort  uint64    `json:"would_abort"`   // number of uploads that would have been aborted in dry-run mode
+	Errors      uint64    `json:"errors"`        // number of errors encountered while listing or aborting
+	LastRun     time.Time `json:"last_run"`      // time at which the last sweep finished
+	LastRunTook string    `json:"last_run_took"` // duration of the last sweep
+}
+
+// Janitor periodically aborts the incomplete multipart uploads of a bucket.
+// If the service crashes between the creation of a multipart upload and its
+// completion, the parts stay on MinIo and consume storage. The janitor
+// removes the ones older than maxAge.
+type Janitor struct {
+	core     Core          // the minio core to list and abort the uploads
+	bucket   string        // bucket to clean
+	maxAge   time.Duration // minimal age of an upload to be aborted
+	interval time.Duration // time between two sweeps
+	dryRun   bool          // if true, only report what would be aborted
+	now      func() time.Time
+
+	runs       atomic.Uint64
+	scanned    atomic.Uint64
+	aborted    atomic.Uint64
+	wouldAbort atomic.Uint64
+	errors     atomic.Uint64
+	lastRun    atomic.Int64 // unix nano
+	lastTook   atomic.Int64 // nano
+}
+
+// NewJanitor creates a new janitor for the given bucket on the connection.
+func NewJanitor(conn *Connection, bucket string, maxAge, interval time.Duration, dryRun bool) *Janitor {
+	return &Janitor{
+		core:     conn.core,
+		bucket:   bucket,
+		maxAge:   maxAge,
+		interval: interval,
+		dryRun:   dryRun,
+		now:      time.Now,
+	}
+}
+
+// Run sweeps the bucket every interval until the context is cancelled.
+// The first sweep is done immediately.
+func (j *Janitor) Run(ctx context.Context) error {
+	if j.interval <= 0 {
+		return ErrJanitorInterval
+	}
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		if err := j.Sweep(ctx); err != nil {
+			logging.Errorf("janitor: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep does one pass over the incomplete uploads of the bucket and aborts
+// the ones older than maxAge. In dry-run mode, nothing is aborted.
+// It returns the last error encountered, the sweep continues on errors.
+func (j *Janitor) Sweep(ctx context.Context) (err error) {
+	start := j.now()
+	defer func() {
+		j.runs.Add(1)
+		j.lastRun.Store(j.now().UnixNano())
+		j.lastTook.Store(int64(j.now().Sub(start)))
+	}()
+
+	for up := range j.core.ListIncompleteUploads(ctx, j.bucket, "", true) {
+		if up.Err != nil {
+			j.errors.Add(1)
+			if up.Err == ctx.Err() {
+				return ctx.Err()
+			}
+			// store the last error, must continue to drain
+			err = up.Err
+			continue
+		}
+		j.scanned.Add(1)
+		if start.Sub(up.Initiated) < j.maxAge {
+			continue
+		}
+		if j.dryRun {
+			j.wouldAbort.Add(1)
+			logging.Infof("janitor (dry-run): would abort upload %s of %s/%s initiated at %s",
+				up.UploadID, j.bucket, up.Key, up.Initiated.Format(time.RFC3339))
+			continue
+		}
+		if abortErr := j.core.AbortMultipartUpload(ctx, j.bucket, up.Key, up.UploadID); abortErr != nil {
+			j.errors.Add(1)
+			err = errs.Wrap(abortErr, "cannot abort upload "+up.UploadID)
+			continue
+		}
+		j.aborted.Add(1)
+		logging.Infof("janitor: aborted upload %s of %s/%s initiated at %s",
+			up.UploadID, j.bucket, up.Key, up.Initiated.Format(time.RFC3339))
+	}
+	return err
+}
+
+// Metrics returns a snapshot of the janitor counters.
+func (j *Janitor) Metrics() JanitorMetrics {
+	m := JanitorMetrics{
+		Runs:        j.runs.Load(),
+		Scanned:     j.scanned.Load(),
+		Aborted:     j.aborted.Load(),
+		WouldAbort:  j.wouldAbort.Load(),
+		Errors:      j.errors.Load(),
+		LastRunTook: time.Duration(j.lastTook.Load()).String(),
+	}
+	if last := j.lastRun.Load(); last > 0 {
+		m.LastRun = time.Unix(0, last)
+	}
+	return m
+}
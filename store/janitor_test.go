@@ -0,0 +1,70 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newJanitorMock creates a core mock with one old and one recent upload in progress,
+// plus one old completed upload that must never be touched.
+func newJanitorMock() (*minioCoreMock, string, string) {
+	oldID, recentID := uuid.NewString(), uuid.NewString()
+	core := &minioCoreMock{uploads: map[string]*multipartUpload{
+		oldID:            {status: inProgress, partCounter: 1, object: "old.txt", initiated: time.Now().Add(-48 * time.Hour)},
+		recentID:         {status: inProgress, partCounter: 1, object: "recent.txt", initiated: time.Now()},
+		uuid.NewString(): {status: completed, partCounter: 1, object: "done.txt", initiated: time.Now().Add(-48 * time.Hour)},
+	}}
+	return core, oldID, recentID
+}
+
+// TestJanitorSweep tests that only the incomplete uploads older than the
+// maximum age are aborted.
+func TestJanitorSweep(t *testing.T) {
+	core, oldID, recentID := newJanitorMock()
+	j := NewJanitor(&Connection{core: core}, "test", 24*time.Hour, time.Hour, false)
+	if err := j.Sweep(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if core.uploads[oldID].status != aborted {
+		t.Fatal("expected the old upload to be aborted")
+	}
+	if core.uploads[recentID].status != inProgress {
+		t.Fatal("expected the recent upload to stay in progress")
+	}
+	m := j.Metrics()
+	if m.Runs != 1 || m.Scanned != 2 || m.Aborted != 1 || m.WouldAbort != 0 || m.Errors != 0 {
+		t.Fatalf("unexpected metrics: %+v", m)
+	}
+}
+
+// TestJanitorDryRun tests that nothing is aborted in dry-run mode.
+func TestJanitorDryRun(t *testing.T) {
+	core, oldID, _ := newJanitorMock()
+	j := NewJanitor(&Connection{core: core}, "test", 24*time.Hour, time.Hour, true)
+	if err := j.Sweep(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if core.uploads[oldID].status != inProgress {
+		t.Fatal("expected the old upload to stay in progress in dry-run mode")
+	}
+	if m := j.Metrics(); m.Aborted != 0 || m.WouldAbort != 1 {
+		t.Fatalf("unexpected metrics: %+v", m)
+	}
+}
+
+// TestJanitorRunInterval tests that the janitor refuses to run without interval
+// and stops on context cancel.
+func TestJanitorRunInterval(t *testing.T) {
+	core, _, _ := newJanitorMock()
+	if err := NewJanitor(&Connection{core: core}, "test", time.Hour, 0, true).Run(context.Background()); err != ErrJanitorInterval {
+		t.Fatalf("expected ErrJanitorInterval, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewJanitor(&Connection{core: core}, "test", time.Hour, time.Hour, true).Run(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
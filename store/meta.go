@@ -0,0 +1,187 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/encdec"
+	"github.com/ag0st/taurus-challenge/keys"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// ObjectMeta is the metadata of an object, read from its info, its header and its
+// trailer without reading its data.
+type ObjectMeta struct {
+	Name         string           // name of the object, decrypted if its key is obfuscated
+	Key          string           // key of the object in the bucket
+	Filename     string           // original name of the file, from the header (of the reference if deduplicated)
+	StoredSize   int64            // size of the encrypted data, of the blob if deduplicated
+	ContentType  string           // content type of the file, from the header (of the object for the older ones)
+	ModTime      time.Time        // modification time of the file given at the upload, from the header
+	Owner        string           // identity of the caller who uploaded it
+	Blob         string           // blob referenced by a deduplicated object, "" otherwise
+	Checksums    encdec.Checksums // checksums and size of the plaintext, empty without trailer
+	ETag         string           // ETag of the stored data given by MinIo, of the blob if deduplicated
+	LastModified time.Time
+
+	Tags            map[string]string // tags of the object
+	Metadata        map[string]string // metadata of the client stored with the object (see CustomMetadata)
+	PrivateMetadata map[string]string // metadata of the client sealed in the header
+}
+
+// ObjectMeta gives the metadata of the object. Only the header and the trailer of
+// the object are read, with range requests. It fails with ErrObjectNotFound if the
+// object does not exist.
+func (c *Connection) ObjectMeta(ctx context.Context, bucketname, objectName string) (ObjectMeta, error) {
+	info, err := c.statObject(ctx, bucketname, objectName)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	return c.objectMeta(ctx, bucketname, info)
+}
+
+// objectMeta reads the metadata of the object described by info. If the object is
+// replaced in the meantime, the metadata of the new version is read.
+func (c *Connection) objectMeta(ctx context.Context, bucketname string, info minio.ObjectInfo) (ObjectMeta, error) {
+	m, err := c.readObjectMeta(ctx, bucketname, info)
+	if err != ErrObjectChanged {
+		return m, err
+	}
+	if info, err = c.client.StatObject(ctx, bucketname, info.Key, minio.StatObjectOptions{}); err != nil {
+		return ObjectMeta{}, notFound(err)
+	}
+	return c.readObjectMeta(ctx, bucketname, info)
+}
+
+// readObjectMeta reads the metadata of the version of the object described by info.
+// It fails with ErrObjectChanged if the object has been replaced.
+func (c *Connection) readObjectMeta(ctx context.Context, bucketname string, info minio.ObjectInfo) (ObjectMeta, error) {
+	name, err := c.objectName(info)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	m := ObjectMeta{Name: name, Key: info.Key, StoredSize: info.Size, ContentType: info.ContentType, Owner: objectOwner(info),
+		Blob: userMetadata(info, BlobMetadata), ETag: info.ETag, LastModified: info.LastModified, Tags: info.UserTags, Metadata: CustomMetadata(info)}
+	if m.ContentType == "" { // the listing gives it with the metadata
+		m.ContentType = userMetadata(info, "Content-Type")
+	}
+	if len(m.Tags) == 0 && info.UserTagCount > 0 { // the stat only counts them
+		t, err := c.client.GetObjectTagging(ctx, bucketname, info.Key, minio.GetObjectTaggingOptions{})
+		if err != nil {
+			return ObjectMeta{}, err
+		}
+		m.Tags = t.ToMap()
+	}
+	key := info.Key
+	var ref *encdec.Metadata
+	if m.Blob != "" {
+		// the filename and the metadata are sealed in the reference
+		if ref, err = c.readRef(ctx, bucketname, info); err != nil {
+			return ObjectMeta{}, err
+		}
+		key = DedupPrefix + m.Blob
+		blob, err := c.client.StatObject(ctx, bucketname, key, minio.StatObjectOptions{})
+		if err != nil {
+			return ObjectMeta{}, err
+		}
+		m.StoredSize, m.ETag = blob.Size, blob.ETag
+	}
+	if m.StoredSize == 0 { // nothing is written for an empty file, not even the header
+		if ref != nil {
+			m.setSealed(*ref)
+		}
+		return m, nil
+	}
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(0, min(m.StoredSize, encdec.MaxHeaderSize)-1); err != nil {
+		return ObjectMeta{}, err
+	}
+	// the header and the trailer of the version listed
+	obj, err := c.getPinned(ctx, bucketname, key, m.ETag, opts)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	defer obj.Close()
+	kp := c.keyProvider(bucketname)
+	dec, err := encdec.NewDecReaderWithKeys(func(wrapped []byte) ([keys.KeySize]byte, error) {
+		return kp.Unwrap(ctx, wrapped)
+	}, obj)
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	r := &objectReader{Reader: dec, key: key, etag: m.ETag}
+	// reads the header, then the trailer at the end of the object
+	if m.Checksums, _, err = c.ObjectChecksums(ctx, bucketname, key, r); err != nil {
+		return ObjectMeta{}, err
+	}
+	if ref != nil {
+		m.setSealed(*ref)
+		return m, nil
+	}
+	sealed, err := r.Metadata()
+	if err != nil {
+		return ObjectMeta{}, err
+	}
+	m.setSealed(sealed)
+	m.Filename, err = r.Filename() // in clear in the header of the older objects
+	return m, err
+}
+
+// setSealed sets the metadata sealed in the header of the object.
+func (m *ObjectMeta) setSealed(sealed encdec.Metadata) {
+	if sealed.ContentType != "" {
+		m.ContentType = sealed.ContentType
+	}
+	m.Filename, m.ModTime, m.PrivateMetadata = sealed.Filename, sealed.ModTime, sealed.Custom
+}
+
+// readRef reads the metadata sealed in the version of the reference described by
+// info, nil if it is stored empty (see refMetadata).
+func (c *Connection) readRef(ctx context.Context, bucketname string, info minio.ObjectInfo) (*encdec.Metadata, error) {
+	if info.Size == 0 {
+		return nil, nil
+	}
+	obj, err := c.getPinned(ctx, bucketname, info.Key, info.ETag, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return c.refMetadata(ctx, bucketname, info.Size, obj)
+}
+
+// SetTags replaces the tags of the object. It fails with ErrObjectNotFound if the
+// object does not exist.
+func (c *Connection) SetTags(ctx context.Context, bucketname, objectName string, t map[string]string) error {
+	info, err := c.statObject(ctx, bucketname, objectName)
+	if err != nil {
+		return err
+	}
+	otags, err := tags.MapToObjectTags(t)
+	if err != nil {
+		return err
+	}
+	return c.client.PutObjectTagging(ctx, bucketname, info.Key, otags, minio.PutObjectTaggingOptions{})
+}
+
+// WalkObjects calls fn with the metadata of each object of the bucket, the blobs of
+// the deduplicated objects excepted. It stops at the first error.
+func (c *Connection) WalkObjects(ctx context.Context, bucketname string, fn func(ObjectMeta) error) error {
+	for ob := range c.client.ListObjects(ctx, bucketname, minio.ListObjectsOptions{Recursive: true, WithMetadata: true}) {
+		if ob.Err != nil {
+			return ob.Err
+		}
+		if strings.HasPrefix(ob.Key, DedupPrefix) {
+			continue
+		}
+		m, err := c.objectMeta(ctx, bucketname, ob)
+		if err != nil {
+			return err
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
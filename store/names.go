@@ -0,0 +1,176 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+
+	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/ag0st/taurus-challenge/logging"
+	"github.com/minio/minio-go/v7"
+)
+
+// With the obfuscation of the names (see SetNames), an object is stored under the
+// HMAC-SHA256 of its bucket and its name in hex, instead of its name: the readers of
+// the bucket do not learn the names of the files. The objects are still addressed by
+// their name, their key is computed from it. The name is kept in the user metadata
+// SealedNameMetadata, encrypted with AES-GCM and authenticated with the key of the
+// object, so the list gives it back without reading the objects. The HMAC and the
+// encryption use two keys derived from the key of the names.
+// The objects stored before keep their name as key: they are found under it when no
+// object is stored under the obfuscated key, and removed when the name is uploaded
+// again.
+
+// SealedNameMetadata is the user metadata holding the encrypted name of an object
+// stored under an obfuscated key.
+const SealedNameMetadata = "Sealed-Name"
+
+// ErrInvalidSealedName error is thrown when the name of an object cannot be decrypted.
+var ErrInvalidSealedName = errs.New("invalid sealed name of the object")
+
+// Names obfuscates the names of the objects.
+type Names struct {
+	macKey []byte
+	aead   cipher.AEAD
+}
+
+// NewNames creates the obfuscation of the names with the key.
+func NewNames(key [32]byte) (*Names, error) {
+	block, err := aes.NewCipher(deriveKey(key, "taurus object names encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Names{macKey: deriveKey(key, "taurus object keys"), aead: aead}, nil
+}
+
+// deriveKey derives the key of the given purpose from the key.
+func deriveKey(key [32]byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Key gives the obfuscated key of the object of the bucket.
+func (n *Names) Key(bucketname, objectName string) string {
+	mac := hmac.New(sha256.New, n.macKey)
+	mac.Write([]byte(bucketname))
+	mac.Write([]byte{0})
+	mac.Write([]byte(objectName))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts the name of the object stored under the key.
+func (n *Names) seal(key, objectName string) (string, error) {
+	nonce := make([]byte, n.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(n.aead.Seal(nonce, nonce, []byte(objectName), []byte(key))), nil
+}
+
+// open decrypts the name of the object stored under the key.
+func (n *Names) open(key, sealed string) (string, error) {
+	value, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(value) < n.aead.NonceSize() {
+		return "", ErrInvalidSealedName
+	}
+	nonce := value[:n.aead.NonceSize()]
+	name, err := n.aead.Open(nil, nonce, value[len(nonce):], []byte(key))
+	if err != nil {
+		return "", errs.WrapWithError(err, ErrInvalidSealedName)
+	}
+	return string(name), nil
+}
+
+// SetNames sets the obfuscation of the names of the objects, nil to store them under
+// their name.
+func (c *Connection) SetNames(n *Names) { c.names = n }
+
+// storedKey gives the key under which the object is uploaded.
+func (c *Connection) storedKey(bucketname, objectName string) string {
+	if c.names == nil {
+		return objectName
+	}
+	return c.names.Key(bucketname, objectName)
+}
+
+// statObject gives the info of the object of the given name, stored under its
+// obfuscated key or under its name if it was stored before the obfuscation. It fails
+// with ErrObjectNotFound if there is none.
+func (c *Connection) statObject(ctx context.Context, bucketname, objectName string) (minio.ObjectInfo, error) {
+	key := c.storedKey(bucketname, objectName)
+	info, err := c.client.StatObject(ctx, bucketname, key, minio.StatObjectOptions{})
+	if err = notFound(err); err != ErrObjectNotFound || key == objectName {
+		return info, err
+	}
+	return c.unobfuscated(ctx, bucketname, objectName)
+}
+
+// unobfuscated gives the info of the object stored under the name before the
+// obfuscation. An obfuscated key given as name is not the object of this name, it
+// fails with ErrObjectNotFound.
+func (c *Connection) unobfuscated(ctx context.Context, bucketname, objectName string) (minio.ObjectInfo, error) {
+	info, err := c.client.StatObject(ctx, bucketname, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		return minio.ObjectInfo{}, notFound(err)
+	}
+	if userMetadata(info, SealedNameMetadata) != "" {
+		return minio.ObjectInfo{}, ErrObjectNotFound
+	}
+	return info, nil
+}
+
+// nameMetadata adds the encrypted name of the object stored under the key to the
+// metadata, nothing if the key is the name.
+func (c *Connection) nameMetadata(metadata map[string]string, key, objectName string) (map[string]string, error) {
+	if key == objectName {
+		return metadata, nil
+	}
+	sealed, err := c.names.seal(key, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		metadata = make(map[string]string, 1)
+	}
+	metadata[SealedNameMetadata] = sealed
+	return metadata, nil
+}
+
+// objectName gives the name of the object described by info: the decrypted name of
+// an object stored under an obfuscated key, its key otherwise.
+func (c *Connection) objectName(info minio.ObjectInfo) (string, error) {
+	sealed := userMetadata(info, SealedNameMetadata)
+	if sealed == "" {
+		return info.Key, nil
+	}
+	if c.names == nil {
+		return "", errs.WrapWithError(errs.New("the obfuscation of the names is disabled"), ErrInvalidSealedName)
+	}
+	return c.names.open(info.Key, sealed)
+}
+
+// removeUnobfuscated removes the object stored under its name before the obfuscation,
+// once the name is uploaded under its obfuscated key.
+func (c *Connection) removeUnobfuscated(ctx context.Context, bucketname, key, objectName string) {
+	if key == objectName {
+		return
+	}
+	_, err := c.unobfuscated(ctx, bucketname, objectName)
+	if err == nil {
+		err = c.deleteKey(ctx, bucketname, objectName)
+	}
+	if err != nil && err != ErrObjectNotFound {
+		logging.Errorf("cannot remove %s stored before the obfuscation: %v", objectName, err)
+	}
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ag0st/taurus-challenge/keys"
+	"github.com/minio/minio-go/v7"
+)
+
+// TestObfuscatedNames tests that the objects are stored under an obfuscated key, found
+// by their name, and that the objects stored before stay reachable.
+func TestObfuscatedNames(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	names, err := NewNames([32]byte{2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &objectsClientMock{objects: map[string]minio.ObjectInfo{}}
+	conn := &Connection{client: client}
+	conn.SetKeys(kp)
+	conn.SetNames(names)
+	ctx := context.Background()
+
+	// stored before the obfuscation
+	client.objects["old.txt"] = minio.ObjectInfo{Key: "old.txt"}
+	client.objects["report.pdf"] = minio.ObjectInfo{Key: "report.pdf"}
+
+	if _, err := conn.PushObject(ctx, strings.NewReader("data"), "test", "report.pdf", PushOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	key := names.Key("test", "report.pdf")
+	stored, ok := client.objects[key]
+	if !ok || key == "report.pdf" || names.Key("other", "report.pdf") == key {
+		t.Fatalf("expected the object under an obfuscated key per bucket, got %v", client.objects)
+	}
+	if _, ok := client.objects["report.pdf"]; ok {
+		t.Fatalf("the object stored before under the name must be replaced")
+	}
+	if name, err := conn.objectName(stored); err != nil || name != "report.pdf" {
+		t.Fatalf("unexpected name %s (%v)", name, err)
+	}
+	// the sealed name is bound to the key of the object
+	stored.Key = "old.txt"
+	if _, err := conn.objectName(stored); err != ErrInvalidSealedName {
+		t.Fatalf("expected ErrInvalidSealedName, got %v", err)
+	}
+
+	// the obfuscated key is not the name of the object
+	if err := conn.DeleteObject(ctx, "test", key, DeleteOptions{}); err != ErrObjectNotFound {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+	for _, name := range []string{"report.pdf", "old.txt"} {
+		if err := conn.DeleteObject(ctx, "test", name, DeleteOptions{}); err != nil {
+			t.Fatalf("unexpected error on %s: %v", name, err)
+		}
+	}
+	if len(client.objects) != 0 {
+		t.Fatalf("expected no object left, got %v", client.objects)
+	}
+}
@@ -0,0 +1,215 @@
+package store
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// Limits of the multipart uploads of MinIo, see PushObject.
+const (
+	MinPartSize = 5 << 20 // minimal size of a part (except the last one)
+	MaxPartSize = 5 << 30 // maximal size of a part
+	MaxParts    = 10000   // maximal number of parts of an upload
+)
+
+// MinChunkSize is the smallest chunk size of the encryption when the chunks are
+// grouped into parts of at least MinPartSize (see ChunkPolicy.TargetPartSize).
+const MinChunkSize = 4 << 10
+
+// chunkRounding is the multiple the automatic chunk sizes are rounded up to.
+const chunkRounding = 1 << 20
+
+// sealedOverhead is the size added to each chunk by the encryption: the sequence
+// number (4B) and the tag (16B), see encdec.
+const sealedOverhead = 4 + 16
+
+// errors declaration
+var (
+	// ErrChunkSizeOutOfBounds error is thrown when the chunk size of an upload is not
+	// within the bounds of the policy.
+	ErrChunkSizeOutOfBounds = errs.New("the chunk size is out of the bounds of the upload policy")
+	// ErrWholeTooLarge error is thrown when an object larger than the maximum size of
+	// the whole mode is uploaded in whole mode.
+	ErrWholeTooLarge = errs.New("the object is too large to be uploaded in whole mode")
+	// ErrTooManyParts error is thrown when an object would need more than MaxParts
+	// parts to be uploaded.
+	ErrTooManyParts = errs.New("the object needs more than 10'000 parts, use a larger chunk or part size")
+	// ErrBufferedTooLarge error is thrown when an object larger than the maximum size
+	// kept in memory is uploaded in whole mode.
+	ErrBufferedTooLarge = errs.New("the object is too large to be encrypted in memory, use the mode stream")
+	// ErrStreamUnknownSize error is thrown when an object of unknown size is streamed.
+	ErrStreamUnknownSize = errs.New("the size of the object must be known to stream it")
+)
+
+// PartLimitError is returned by the chunk writer when an upload reaches MaxParts
+// parts. It is returned before sending the part, the upload is then aborted.
+type PartLimitError struct {
+	ChunksPerPart int    // number of chunks grouped into a part
+	Uploaded      uint64 // number of bytes already uploaded
+}
+
+// Implementation of the error interface
+func (e *PartLimitError) Error() string {
+	return fmt.Sprintf("the upload reached the limit of %d parts after %d bytes, use a larger chunk or part size", MaxParts, e.Uploaded)
+}
+
+// ChunkPolicy bounds the chunk sizes the uploads can use and chooses one from the
+// size of the object. A chunk size of 0 means the whole mode.
+type ChunkPolicy struct {
+	MinChunkSize   uint64 // smallest chunk size accepted, at least MinPartSize (MinChunkSize with TargetPartSize)
+	MaxChunkSize   uint64 // largest chunk size accepted, at most MaxPartSize
+	MaxWholeSize   uint64 // largest object accepted in whole mode
+	WholeThreshold uint64 // largest object put in whole mode by Auto
+	Aggregate      bool   // group several chunks per part if the object needs more than MaxParts parts
+	TargetPartSize uint64 // size of the parts the chunks are grouped into, 0 for one chunk per part
+	MaxBuffered    uint64 // largest object encrypted in memory in whole mode, 0 for MaxWholeSize
+}
+
+// Auto chooses the chunk size of an object of the given size: the whole mode up to
+// WholeThreshold, Chunked above. A negative size means that it is unknown.
+func (p ChunkPolicy) Auto(size int64) (uint64, error) {
+	if size >= 0 && uint64(size) <= p.WholeThreshold && uint64(size) <= p.maxBuffered() {
+		return 0, nil
+	}
+	return p.Chunked(size)
+}
+
+// Chunked chooses the smallest chunk size within the bounds keeping the number of
+// chunks under MaxParts, rounded up to a multiple of 1 MiB. If the size is unknown
+// (negative), or if the chunks are grouped into parts of TargetPartSize and the
+// object fits with the smallest chunks, MinChunkSize is chosen.
+func (p ChunkPolicy) Chunked(size int64) (uint64, error) {
+	if size < 0 || (p.TargetPartSize > 0 && p.Check(p.MinChunkSize, size) == nil) {
+		return p.MinChunkSize, nil
+	}
+	chunkSize := (uint64(size) + MaxParts - 1) / MaxParts
+	chunkSize = (chunkSize + chunkRounding - 1) / chunkRounding * chunkRounding
+	chunkSize = min(max(chunkSize, p.MinChunkSize), p.MaxChunkSize)
+	return chunkSize, p.Check(chunkSize, size)
+}
+
+// Check verifies that an object of the given size can be uploaded with the chunk
+// size. A negative size means that it is unknown, only the bounds are checked.
+func (p ChunkPolicy) Check(chunkSize uint64, size int64) error {
+	if chunkSize == 0 {
+		if size >= 0 && uint64(size) > p.MaxWholeSize {
+			return ErrWholeTooLarge
+		}
+		if size >= 0 && uint64(size) > p.maxBuffered() {
+			return ErrBufferedTooLarge
+		}
+		return nil
+	}
+	if chunkSize < p.MinChunkSize || chunkSize > p.MaxChunkSize {
+		return ErrChunkSizeOutOfBounds
+	}
+	_, err := p.PartSize(chunkSize, size)
+	return err
+}
+
+// CheckStream verifies that an object of the given size can be streamed into a
+// single upload: its size must be known and at most MaxWholeSize.
+func (p ChunkPolicy) CheckStream(size int64) error {
+	if size < 0 {
+		return ErrStreamUnknownSize
+	}
+	if uint64(size) > p.MaxWholeSize {
+		return ErrWholeTooLarge
+	}
+	return nil
+}
+
+// maxBuffered gives the largest object encrypted in memory in whole mode.
+func (p ChunkPolicy) maxBuffered() uint64 {
+	if p.MaxBuffered == 0 {
+		return p.MaxWholeSize
+	}
+	return min(p.MaxBuffered, p.MaxWholeSize)
+}
+
+// PartSize gives the minimal size of the parts of an object of the given size
+// uploaded with the chunk size, 0 for one chunk per part. The chunks smaller than
+// TargetPartSize are grouped to reach it. If the object still needs more than
+// MaxParts parts, with Aggregate, more chunks are grouped per part to stay under
+// the limit. If the size is unknown (negative), the parts grow as the data is
+// uploaded (see storeChunkWriter). The parts are always a whole number of chunks.
+func (p ChunkPolicy) PartSize(chunkSize uint64, size int64) (uint64, error) {
+	if chunkSize == 0 {
+		return 0, nil
+	}
+	perPart := uint64(1)
+	if p.TargetPartSize > chunkSize {
+		perPart = (p.TargetPartSize + chunkSize - 1) / chunkSize
+		perPart = min(perPart, MaxPartSize/(chunkSize+sealedOverhead))
+	}
+	if size >= 0 {
+		n := Parts(uint64(size), chunkSize)
+		if Parts(n, perPart) > MaxParts {
+			perPart = (n + MaxParts - 1) / MaxParts
+			if !p.Aggregate || perPart*(chunkSize+sealedOverhead) > MaxPartSize {
+				return 0, ErrTooManyParts
+			}
+		}
+	}
+	if perPart == 1 {
+		return 0, nil
+	}
+	return perPart * chunkSize, nil
+}
+
+// ChunksPerPart gives the number of chunks grouped into a part of at least
+// partSize bytes, at least one.
+func ChunksPerPart(chunkSize, partSize uint64) int {
+	if chunkSize == 0 || partSize <= chunkSize {
+		return 1
+	}
+	return int((partSize + chunkSize - 1) / chunkSize)
+}
+
+// Parts gives the number of chunks of an object of the given size, at least one.
+func Parts(size, chunkSize uint64) uint64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + chunkSize - 1) / chunkSize
+}
+
+// compressedTypes are the content types whose data is already compressed.
+var compressedTypes = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/zstd":             true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/java-archive":     true,
+	"application/epub+zip":         true,
+	"application/pdf":              true,
+	"font/woff":                    true,
+	"font/woff2":                   true,
+}
+
+// Compressible tells if the data of the content type is worth compressing. The
+// images, videos and audios (except the uncompressed formats) and the archives are
+// already compressed. An unknown or empty content type is compressible.
+func Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	switch mediaType {
+	case "image/svg+xml", "image/bmp", "image/tiff", "audio/wav", "audio/x-wav":
+		return true
+	}
+	if compressedTypes[mediaType] || strings.HasPrefix(mediaType, "application/vnd.openxmlformats-officedocument.") {
+		return false
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	return major != "image" && major != "video" && major != "audio"
+}
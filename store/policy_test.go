@@ -0,0 +1,168 @@
+package store
+
+import "testing"
+
+var testPolicy = ChunkPolicy{
+	MinChunkSize:   MinPartSize,
+	MaxChunkSize:   64 << 20,
+	MaxWholeSize:   100 << 20,
+	WholeThreshold: 16 << 20,
+}
+
+func TestChunkPolicyAuto(t *testing.T) {
+	cases := []struct {
+		size int64
+		want uint64
+		err  error
+	}{
+		{0, 0, nil},
+		{16 << 20, 0, nil},
+		{16<<20 + 1, MinPartSize, nil},
+		{-1, MinPartSize, nil},
+		// 100 GiB needs chunks of at least 10.24 MiB, rounded up to 11 MiB
+		{100 << 30, 11 << 20, nil},
+		{MaxParts * 64 << 20, 64 << 20, nil},
+		{MaxParts*64<<20 + 1, 64 << 20, ErrTooManyParts},
+	}
+	for _, tc := range cases {
+		got, err := testPolicy.Auto(tc.size)
+		if err != tc.err {
+			t.Fatalf("size %d: expected error %v, got %v", tc.size, tc.err, err)
+		}
+		if got != tc.want {
+			t.Fatalf("size %d: expected chunk size %d, got %d", tc.size, tc.want, got)
+		}
+	}
+}
+
+func TestChunkPolicyCheck(t *testing.T) {
+	cases := []struct {
+		chunkSize uint64
+		size      int64
+		err       error
+	}{
+		{0, 100 << 20, nil},
+		{0, 100<<20 + 1, ErrWholeTooLarge},
+		{0, -1, nil},
+		{4 << 20, 10, ErrChunkSizeOutOfBounds},
+		{65 << 20, 10, ErrChunkSizeOutOfBounds},
+		{MinPartSize, MaxParts * MinPartSize, nil},
+		{MinPartSize, MaxParts*MinPartSize + 1, ErrTooManyParts},
+		{MinPartSize, -1, nil},
+	}
+	for _, tc := range cases {
+		if err := testPolicy.Check(tc.chunkSize, tc.size); err != tc.err {
+			t.Fatalf("chunk size %d, size %d: expected error %v, got %v", tc.chunkSize, tc.size, tc.err, err)
+		}
+	}
+}
+
+func TestChunkPolicyPartSize(t *testing.T) {
+	aggregate := testPolicy
+	aggregate.Aggregate = true
+	cases := []struct {
+		policy    ChunkPolicy
+		chunkSize uint64
+		size      int64
+		want      uint64
+		err       error
+	}{
+		{testPolicy, 0, 100 << 20, 0, nil},
+		{testPolicy, MinPartSize, -1, 0, nil},
+		{testPolicy, MinPartSize, MaxParts * MinPartSize, 0, nil},
+		{testPolicy, MinPartSize, MaxParts*MinPartSize + 1, 0, ErrTooManyParts},
+		{aggregate, MinPartSize, MaxParts * MinPartSize, 0, nil},
+		// 10'001 chunks are grouped by 2
+		{aggregate, MinPartSize, MaxParts*MinPartSize + 1, 2 * MinPartSize, nil},
+		{aggregate, MinPartSize, 3 * MaxParts * MinPartSize, 3 * MinPartSize, nil},
+		// the parts would be larger than 5 GiB
+		{aggregate, 64 << 20, MaxParts * MaxPartSize, 0, ErrTooManyParts},
+	}
+	for _, tc := range cases {
+		got, err := tc.policy.PartSize(tc.chunkSize, tc.size)
+		if err != tc.err {
+			t.Fatalf("chunk size %d, size %d: expected error %v, got %v", tc.chunkSize, tc.size, tc.err, err)
+		}
+		if got != tc.want {
+			t.Fatalf("chunk size %d, size %d: expected part size %d, got %d", tc.chunkSize, tc.size, tc.want, got)
+		}
+	}
+}
+
+func TestChunkPolicyTargetPartSize(t *testing.T) {
+	grouped := testPolicy
+	grouped.MinChunkSize = 64 << 10
+	grouped.TargetPartSize = 8 << 20
+	// the smallest chunks are chosen, grouped by 128 into parts of 8 MiB
+	chunkSize, err := grouped.Chunked(1 << 30)
+	if err != nil || chunkSize != 64<<10 {
+		t.Fatalf("expected chunks of 64 KiB, got %d (%v)", chunkSize, err)
+	}
+	if partSize, err := grouped.PartSize(chunkSize, 1<<30); err != nil || partSize != 8<<20 {
+		t.Fatalf("expected parts of 8 MiB, got %d (%v)", partSize, err)
+	}
+	// the parts of 8 MiB hold 80 GiB at most, larger chunks are chosen above
+	chunkSize, err = grouped.Chunked(100 << 30)
+	if err != nil || chunkSize != 11<<20 {
+		t.Fatalf("expected chunks of 11 MiB, got %d (%v)", chunkSize, err)
+	}
+	if partSize, err := grouped.PartSize(chunkSize, 100<<30); err != nil || partSize != 0 {
+		t.Fatalf("expected one chunk per part, got %d (%v)", partSize, err)
+	}
+	// chunks of 3 MiB are grouped by 3 to reach 8 MiB
+	if partSize, err := grouped.PartSize(3<<20, -1); err != nil || partSize != 9<<20 {
+		t.Fatalf("expected parts of 9 MiB, got %d (%v)", partSize, err)
+	}
+	if n := ChunksPerPart(3<<20, 9<<20); n != 3 {
+		t.Fatalf("expected 3 chunks per part, got %d", n)
+	}
+}
+
+func TestChunkPolicyBuffered(t *testing.T) {
+	buffered := testPolicy
+	buffered.MaxBuffered = 8 << 20
+	if err := buffered.Check(0, 8<<20); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := buffered.Check(0, 8<<20+1); err != ErrBufferedTooLarge {
+		t.Fatalf("expected ErrBufferedTooLarge, got %v", err)
+	}
+	if err := buffered.Check(0, 100<<20+1); err != ErrWholeTooLarge {
+		t.Fatalf("expected ErrWholeTooLarge, got %v", err)
+	}
+	// the whole threshold (16 MiB) is above the memory cap
+	if chunkSize, err := buffered.Auto(10 << 20); err != nil || chunkSize != MinPartSize {
+		t.Fatalf("expected chunks of 5 MiB, got %d (%v)", chunkSize, err)
+	}
+	cases := []struct {
+		size int64
+		err  error
+	}{
+		{0, nil}, {100 << 20, nil}, {100<<20 + 1, ErrWholeTooLarge}, {-1, ErrStreamUnknownSize},
+	}
+	for _, tc := range cases {
+		if err := buffered.CheckStream(tc.size); err != tc.err {
+			t.Fatalf("size %d: expected error %v, got %v", tc.size, tc.err, err)
+		}
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	cases := map[string]bool{
+		"":                          true,
+		"application/json":          true,
+		"text/plain; charset=utf-8": true,
+		"image/svg+xml":             true,
+		"application/octet-stream":  true,
+		"image/png":                 false,
+		"video/mp4":                 false,
+		"application/zip":           false,
+		"application/gzip":          false,
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document": false,
+	}
+	for contentType, want := range cases {
+		if got := Compressible(contentType); got != want {
+			t.Fatalf("content type %q: expected compressible %v, got %v", contentType, want, got)
+		}
+	}
+}
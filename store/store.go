@@ -1,21 +1,45 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"hash"
 	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/ag0st/taurus-challenge/config"
 	"github.com/ag0st/taurus-challenge/encdec"
 	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/ag0st/taurus-challenge/keys"
+	"github.com/ag0st/taurus-challenge/logging"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
 )
 
 // errors declaration
 var (
 	// ErrWrongChunkSize error is thrown when the chunk size given does not respect
 	// the limitations.
-	ErrWrongChunkSize = errs.New("wrong chunk size, must be : 5<<20 <= chunkSize <= 5<<30 or equal to 0")
+	ErrWrongChunkSize = errs.New("wrong chunk size, must be : 5<<20 <= chunkSize <= 5<<30 (4<<10 with a part size) or equal to 0")
+	// ErrWrongPartSize error is thrown when the part size given does not respect
+	// the limitations.
+	ErrWrongPartSize = errs.New("wrong part size, must be : 5<<20 <= partSize <= 5<<30 or equal to 0")
+	// ErrWrongStream error is thrown when an object is streamed without chunk size or
+	// without size.
+	ErrWrongStream = errs.New("wrong stream, the chunk size and the size of the data must be given")
+	// ErrObjectTooLarge is returned when the data pushed exceeds PushOptions.MaxSize.
+	ErrObjectTooLarge = errs.New("the object exceeds the maximum size")
+	// ErrChecksumMismatch is returned when the data pushed does not match the checksums
+	// expected by PushOptions.ExpectedMD5 or PushOptions.ExpectedSHA256.
+	ErrChecksumMismatch = errs.New("the checksum of the object does not match the expected one")
+	// ErrObjectNotFound is returned when the object does not exist in the bucket.
+	ErrObjectNotFound = errs.New("the object does not exist")
+	// ErrObjectChanged is returned when the object is replaced while it is read.
+	ErrObjectChanged = errs.New("the object changed while it was read")
 )
 
 // Client represent the essentials methods needed from minio.Client for the store to work
@@ -28,6 +52,10 @@ type Client interface {
 	PutObject(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64,
 		opts minio.PutObjectOptions,
 	) (info minio.UploadInfo, err error)
+	StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error)
+	RemoveObject(ctx context.Context, bucketName, objectName string, opts minio.RemoveObjectOptions) error
+	PutObjectTagging(ctx context.Context, bucketName, objectName string, otags *tags.Tags, opts minio.PutObjectTaggingOptions) error
+	GetObjectTagging(ctx context.Context, bucketName, objectName string, opts minio.GetObjectTaggingOptions) (*tags.Tags, error)
 }
 
 // Core represent the essentials methods needed from a minio.Core for the store to work.
@@ -39,48 +67,271 @@ type Core interface {
 	NewMultipartUpload(ctx context.Context, bucket, object string, opts minio.PutObjectOptions) (uploadID string, err error)
 	CompleteMultipartUpload(ctx context.Context, bucket, object, uploadID string, parts []minio.CompletePart, opts minio.PutObjectOptions) (minio.UploadInfo, error)
 	AbortMultipartUpload(ctx context.Context, bucket, object, uploadID string) error
+	ListIncompleteUploads(ctx context.Context, bucketName, objectPrefix string, recursive bool) <-chan minio.ObjectMultipartInfo
 }
 
 // Connection is the minio core used across the package to communicate with the minio server.
 type Connection struct {
-	client Client
-	core   Core
+	client     Client
+	core       Core
+	keysMu     sync.RWMutex
+	keys       keys.Provider            // gives the data keys to encrypt and decrypt the objects
+	bucketKeys map[string]keys.Provider // providers of the buckets with their own master key
+	refs       RefIndex                 // references of the deduplicated objects, nil without deduplication
+	names      *Names                   // obfuscation of the names of the objects, nil to store them under their name
+	blobMu     [blobLocks]sync.Mutex    // serialize the operations on the blobs, see blobLock
+}
+
+// Options are the options of the connection to the MinIo server.
+type Options struct {
+	Endpoint           string             // host:port of the server
+	AccessKey          string             // static access key, used if no Credentials are given
+	SecretKey          string             // static secret key, used if no Credentials are given
+	Credentials        []CredentialSource // chain of credential sources, tried in order
+	Keys               keys.Provider      // gives the data keys of the objects
+	Secure             bool               // use https to reach the server
+	Region             string             // region of the server, avoids a bucket location lookup if given
+	CAFile             string             // optional PEM bundle used to verify the server certificate
+	InsecureSkipVerify bool               // do not verify the server certificate, for development only
+	Transport          TransportOptions   // configuration of the http transport
 }
 
 // Connect creates a new connection to the server.
-func Connect(endpoint, accessKey, secretKey string) (*Connection, error) {
-	var err error
-	core, err := minio.NewCore(endpoint, &minio.Options{
-		Creds: credentials.NewStaticV4(accessKey, secretKey, ""),
+func Connect(opts Options) (*Connection, error) {
+	transport, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := newCredentials(opts, transport)
+	if err != nil {
+		return nil, err
+	}
+	core, err := minio.NewCore(opts.Endpoint, &minio.Options{
+		Creds:     creds,
+		Secure:    opts.Secure,
+		Region:    opts.Region,
+		Transport: transport,
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &Connection{core: core, client: core.Client}, nil
+	return &Connection{core: core, client: core.Client, keys: opts.Keys}, nil
+}
+
+// SetKeys replaces the provider of the data keys, for example after a rotation of
+// the master key. The uploads and downloads in progress keep the previous one.
+func (c *Connection) SetKeys(p keys.Provider) {
+	c.keysMu.Lock()
+	defer c.keysMu.Unlock()
+	c.keys = p
+}
+
+// SetBucketKeys replaces the providers of the data keys of the buckets having their
+// own master key, by bucket name. The other buckets use the provider given to SetKeys.
+func (c *Connection) SetBucketKeys(m map[string]keys.Provider) {
+	c.keysMu.Lock()
+	defer c.keysMu.Unlock()
+	c.bucketKeys = m
+}
+
+// keyProvider gives the current provider of the data keys of the bucket.
+func (c *Connection) keyProvider(bucketName string) keys.Provider {
+	c.keysMu.RLock()
+	defer c.keysMu.RUnlock()
+	if p, ok := c.bucketKeys[bucketName]; ok {
+		return p
+	}
+	return c.keys
+}
+
+// PushOptions are the options of an upload, see PushObject.
+type PushOptions struct {
+	ChunkSize   uint64    // size of the encryption chunks, 0 for the whole mode
+	PartSize    uint64    // minimal size of the parts, whole number of chunks, 0 for one chunk per part (see ChunkPolicy.PartSize)
+	Filename    string    // original name of the file, sealed in the header
+	ContentType string    // content type of the file, sealed in the header
+	ModTime     time.Time // modification time of the file, sealed in the header, zero if unknown
+	Stream      bool      // stream the chunks into a single upload instead of a multipart upload
+	Size        int64     // size of the data, required to stream, negative if unknown
+	Owner       string    // identity of the caller, stored as metadata to compute its usage (see OwnerUsage)
+	MaxSize     uint64    // maximum size of the data, 0 for no limit
+	CRC32C      bool      // record the CRC32C of the data with its SHA-256
+	// compression of the data before its encryption, ignored if streamed as the size
+	// of the upload must be known
+	Compression encdec.Compression
+
+	// checksums of the data given by the client, nil if not given. The upload is
+	// cancelled with ErrChecksumMismatch if the data does not match them.
+	ExpectedMD5    []byte
+	ExpectedSHA256 []byte
+
+	// metadata of the client: the tags and the metadata are stored with the object in
+	// the bucket, the private metadata sealed in the header of the object (of its
+	// reference if deduplicated, never in the blob shared, see PushDedup)
+	Tags            map[string]string
+	Metadata        map[string]string
+	PrivateMetadata map[string]string
+
+	// called just before the object is committed, nil for none (see CommitFunc)
+	Commit CommitFunc
+}
+
+// CommitFunc is called just before an object is replaced or removed, once its data
+// is uploaded: the object is not changed if it fails, its error is given back as is.
+// Otherwise, release is called once the change is done or has failed. It lets the
+// caller check the object it replaces and serialize the changes without holding a
+// lock during the whole upload.
+type CommitFunc func() (release func(), err error)
+
+// commit calls f if it is set, and gives its release function (doing nothing if f
+// is nil).
+func commit(f CommitFunc) (func(), error) {
+	if f == nil {
+		return func() {}, nil
+	}
+	return f()
+}
+
+// PushInfo describes an object pushed by PushObject.
+type PushInfo struct {
+	minio.UploadInfo
+	Checksums encdec.Checksums // checksums of the plaintext, recorded in the trailer of the object
+	Blob      string           // blob referenced by the object if deduplicated (see PushDedup)
+}
+
+// OwnerMetadata is the user metadata holding the owner of an object.
+const OwnerMetadata = "Owner"
+
+// StoredContentType is the content type of the objects in the buckets, the content
+// type of the file is sealed in their header.
+const StoredContentType = "application/octet-stream"
+
+// CustomMetadataPrefix prefixes the metadata of the client in the user metadata of
+// the objects, apart from the metadata of the service.
+const CustomMetadataPrefix = "Custom-"
+
+// userMetadataOf gives the user metadata of an object pushed with opts, nil if none.
+func userMetadataOf(opts PushOptions) map[string]string {
+	var metadata map[string]string
+	if opts.Owner != "" || len(opts.Metadata) > 0 {
+		metadata = make(map[string]string, len(opts.Metadata)+1)
+	}
+	if opts.Owner != "" {
+		metadata[OwnerMetadata] = opts.Owner
+	}
+	for k, v := range opts.Metadata {
+		metadata[CustomMetadataPrefix+k] = v
+	}
+	return metadata
+}
+
+// headerMetadataOf gives the metadata sealed in the header of an object pushed with
+// opts.
+func headerMetadataOf(opts PushOptions) encdec.Metadata {
+	return encdec.Metadata{Filename: opts.Filename, ContentType: opts.ContentType, ModTime: opts.ModTime, Custom: opts.PrivateMetadata}
 }
 
 // PushObject pushes the data contained in the reader into the minio bucket.
 // It will encrypt it before pushing the data into MinIo.
-// If chunkSize > 0 then the file is encrypted in chunk and each chunk are
-// push in a multipart upload.
+// If opts.ChunkSize > 0 then the file is encrypted in chunk and each chunk are
+// push in a multipart upload. If opts.PartSize > 0, the chunks are grouped into
+// parts of at least opts.PartSize bytes. If opts.Stream is set, the chunks are
+// streamed into a single upload as they are encrypted: the memory used does not
+// depend on the size of the data. The SHA-256 of the data (and its CRC32C if
+// opts.CRC32C is set) is sealed in a trailer at the end of the object and given
+// back with the upload. The data is verified against opts.ExpectedMD5 and
+// opts.ExpectedSHA256 once read and the upload is cancelled before the object is
+// stored if it does not match. If opts.Compression is set, each chunk is compressed
+// before its encryption.
 // PRE:  5<<20 <= chunkSize <= 5<<30 || chunkSize = 0 (limitation of MinIo)
-// PRE: len(data)/chunkSize < 10'000 (limitation of MinIo)
+// PRE:  4<<10 <= chunkSize if 5<<20 <= partSize <= 5<<30 (the chunks are grouped)
+// PRE:  4<<10 <= chunkSize and 0 <= size, encrypted size <= 5<<30 if streamed
+// PRE: len(data)/max(chunkSize, partSize) < 10'000 (limitation of MinIo), otherwise
+// the upload is aborted with a *PartLimitError when it reaches the limit. If opts.Size
+// is unknown (negative), the parts grow as the data is pushed to reach 5 TB.
 // MinIo Limitations:
 // Description here : https://min.io/docs/minio/linux/operations/concepts/thresholds.html
 // Min of 5MiB for chunk is here : https://github.com/minio/minio/blob/b3314e97a64a42d22ba5b939917939d72a28c97d/cmd/utils.go#L273C12-L273C12
 // Max of 10'000 chunk is here : https://github.com/minio/minio/blob/b3314e97a64a42d22ba5b939917939d72a28c97d/cmd/utils.go#L277
-func (c *Connection) PushObject(ctx context.Context, r io.Reader, chunkSize uint64, bucketname, objectName, filename, contentType string) (minio.UploadInfo, error) {
+// With the obfuscation of the names, the object is stored under its obfuscated key
+// (see SetNames).
+func (c *Connection) PushObject(ctx context.Context, r io.Reader, bucketname, objectName string, opts PushOptions) (PushInfo, error) {
+	key := c.storedKey(bucketname, objectName)
+	info, err := c.pushObject(ctx, r, bucketname, key, objectName, opts)
+	if err == nil {
+		c.removeUnobfuscated(ctx, bucketname, key, objectName)
+	}
+	return info, err
+}
+
+// pushObject pushes the object of the given name under the key, see PushObject.
+func (c *Connection) pushObject(ctx context.Context, r io.Reader, bucketname, key, objectName string, opts PushOptions) (PushInfo, error) {
+	chunkSize := opts.ChunkSize
 	// precondition
-	if chunkSize != 0 && (chunkSize < 5<<20 || chunkSize > 5<<30) {
-		return minio.UploadInfo{}, ErrWrongChunkSize
+	minChunkSize := uint64(MinPartSize)
+	if opts.PartSize != 0 || opts.Stream {
+		minChunkSize = MinChunkSize
+	}
+	if opts.Stream && (chunkSize == 0 || opts.Size < 0) {
+		return PushInfo{}, ErrWrongStream
+	}
+	if chunkSize != 0 && (chunkSize < minChunkSize || chunkSize > MaxPartSize) {
+		return PushInfo{}, ErrWrongChunkSize
+	}
+	if opts.PartSize != 0 && (opts.PartSize < MinPartSize || opts.PartSize > MaxPartSize) {
+		return PushInfo{}, ErrWrongPartSize
+	}
+	if opts.MaxSize != 0 && opts.Stream && uint64(opts.Size) > opts.MaxSize {
+		return PushInfo{}, ErrObjectTooLarge
+	}
+	metadata, err := c.nameMetadata(userMetadataOf(opts), key, objectName)
+	if err != nil {
+		return PushInfo{}, err
+	}
+	// each object is encrypted with its own data key, stored wrapped in the header
+	dataKey, wrapped, err := c.keyProvider(bucketname).DataKey(ctx)
+	if err != nil {
+		return PushInfo{}, errs.Wrap(err, "cannot get a data key")
+	}
+	// the filename is only sealed with the metadata, not in clear in the header
+	h := encdec.NewHeader(chunkSize, "")
+	if err := h.SetWrappedKey(wrapped); err != nil {
+		return PushInfo{}, err
+	}
+	if err := h.SetChecksums(opts.CRC32C); err != nil {
+		return PushInfo{}, err
+	}
+	if err := h.SetMetadata(headerMetadataOf(opts)); err != nil {
+		return PushInfo{}, err
+	}
+	// the compressed chunks have no fixed size, they are grouped by size into the
+	// parts to respect the minimal size of a part
+	var minPartBytes uint64
+	if !opts.Stream && opts.Compression != encdec.CompressionNone {
+		if err := h.SetCompression(opts.Compression); err != nil {
+			return PushInfo{}, err
+		}
+		if chunkSize != 0 {
+			minPartBytes = max(MinPartSize, uint64(ChunksPerPart(chunkSize, opts.PartSize))*chunkSize)
+		}
+	}
+	streamSize := int64(h.EncryptedSize(uint64(max(opts.Size, 0))))
+	if opts.Stream && streamSize > MaxPartSize {
+		return PushInfo{}, ErrWholeTooLarge
+	}
+	if opts.ExpectedMD5 != nil || opts.ExpectedSHA256 != nil {
+		r = newVerifyReader(r, opts.ExpectedMD5, opts.ExpectedSHA256)
+	}
+	if opts.MaxSize != 0 {
+		r = &maxSizeReader{r: r, left: opts.MaxSize}
 	}
 	// create a new store writer and wrap it with en encrypt writer.
 	sw := newStoreWriter(ctx, chunkSize, c,
-		uploadConfig{bucketName: bucketname, objectName: objectName, contentType: contentType})
-	h := encdec.NewHeader(chunkSize, filename)
-	ew, err := encdec.NewEncWriter(config.GetCurrent().Service().AESKey(), h, sw)
+		uploadConfig{bucketName: bucketname, objectName: key, contentType: StoredContentType, userMetadata: metadata, userTags: opts.Tags, commit: opts.Commit,
+			chunksPerPart: ChunksPerPart(chunkSize, opts.PartSize), minPartBytes: minPartBytes, growParts: opts.Size < 0, stream: opts.Stream, streamSize: streamSize})
+	ew, err := encdec.NewEncWriter(dataKey, h, sw)
 	if err != nil {
-		return minio.UploadInfo{}, nil
+		return PushInfo{}, err
 	}
 	// Now, we have to copy the content of the reader to the writer.
 	// We use the ReaderFrom interface of the encWriter to do so
@@ -103,24 +354,115 @@ func (c *Connection) PushObject(ctx context.Context, r io.Reader, chunkSize uint
 
 	select {
 	case <-ctx.Done():
-		return minio.UploadInfo{}, nil
+		// the store writer cancels the upload on its next write, nothing is stored
+		return PushInfo{}, ctx.Err()
 	case err := <-writeData():
 		if err != nil {
-			// need to properly close the store writer
-			cancelErr := errs.Wrap(sw.Cancel(), "error during cancel")
-			return minio.UploadInfo{}, errs.WrapWithError(err, cancelErr)
+			return PushInfo{}, cancelUpload(sw, objectName, err)
 		}
 	}
 
 	// now close the writer to finish the transaction
-	ew.Close()
+	if err := ew.Close(); err != nil {
+		return PushInfo{}, cancelUpload(sw, objectName, err)
+	}
+
+	info, err := sw.WaitOnFinished()
+	if err != nil {
+		return PushInfo{}, err
+	}
+	// the object may have referenced a blob before being replaced
+	if err := c.dropRef(ctx, bucketname, key); err != nil {
+		logging.Errorf("cannot remove the reference of %s: %v", objectName, err)
+	}
+	return PushInfo{UploadInfo: info, Checksums: ew.(encdec.Checksummer).Checksums()}, nil
+}
+
+// cancelUpload cancels the upload of the store writer after the error err and
+// gives back err, unchanged so the caller can check its type.
+func cancelUpload(sw storeWriterCloser, objectName string, err error) error {
+	if cancelErr := sw.Cancel(); cancelErr != nil {
+		logging.Errorf("cannot cancel the upload of %s: %v", objectName, cancelErr)
+	}
+	return err
+}
+
+// maxSizeReader reads from r and fails with ErrObjectTooLarge once more than
+// left bytes have been read.
+type maxSizeReader struct {
+	r    io.Reader
+	left uint64
+}
+
+// maxEmptyReads is the number of reads giving nothing in a row after which a reader
+// is considered stuck, as bufio does.
+const maxEmptyReads = 100
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.left == 0 {
+		// the limit is reached, the data must end here: nothing is read into p, the
+		// reader is probed until it gives a byte or an error
+		var b [1]byte
+		for i := 0; i < maxEmptyReads; i++ {
+			n, err := m.r.Read(b[:])
+			if n > 0 {
+				return 0, ErrObjectTooLarge
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.ErrNoProgress
+	}
+	if uint64(len(p)) > m.left {
+		p = p[:m.left]
+	}
+	n, err := m.r.Read(p)
+	m.left -= uint64(n)
+	return n, err
+}
+
+// verifyReader reads from r and, at the end of the data, fails with
+// ErrChecksumMismatch instead of io.EOF if the data does not match the checksums
+// expected. The writer sees the error before it is closed, so the upload is
+// cancelled and the object never stored.
+type verifyReader struct {
+	r        io.Reader
+	hashes   []hash.Hash
+	expected [][]byte
+}
+
+// newVerifyReader creates a verifyReader of the checksums given, nil if not expected.
+func newVerifyReader(r io.Reader, md5Sum, sha256Sum []byte) *verifyReader {
+	v := &verifyReader{r: r}
+	if md5Sum != nil {
+		v.hashes, v.expected = append(v.hashes, md5.New()), append(v.expected, md5Sum)
+	}
+	if sha256Sum != nil {
+		v.hashes, v.expected = append(v.hashes, sha256.New()), append(v.expected, sha256Sum)
+	}
+	return v
+}
 
-	return sw.WaitOnFinished()
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	for _, h := range v.hashes {
+		h.Write(p[:n])
+	}
+	if err == io.EOF {
+		for i, h := range v.hashes {
+			if !bytes.Equal(h.Sum(nil), v.expected[i]) {
+				return n, ErrChecksumMismatch
+			}
+		}
+	}
+	return n, err
 }
 
-// ListFiles list all the files in the bucket, without versionning
+// ListFiles list all the files in the bucket, without versionning. The blobs of the
+// deduplicated objects are not listed, the objects referencing them have their size.
 func (c *Connection) ListFiles(ctx context.Context, bucketname string) (objects []minio.ObjectInfo, err error) {
-	for ob := range c.client.ListObjects(ctx, bucketname, minio.ListObjectsOptions{}) {
+	for ob := range c.client.ListObjects(ctx, bucketname, minio.ListObjectsOptions{WithMetadata: true}) {
 		if ob.Err != nil {
 			if ob.Err == ctx.Err() { // we reached the final object, ctx canceled
 				return nil, ctx.Err()
@@ -128,22 +470,248 @@ func (c *Connection) ListFiles(ctx context.Context, bucketname string) (objects
 				// store the last error, must continue to drain
 				err = ob.Err
 			}
-		} else {
+		} else if !strings.HasPrefix(ob.Key, DedupPrefix) {
+			name, err := c.objectName(ob)
+			if err != nil {
+				logging.Errorf("cannot read the name of %s: %v", ob.Key, err)
+				name = ob.Key
+			}
+			ob.Key, ob.Size = name, listedSize(ob)
 			objects = append(objects, ob)
 		}
 	}
 	return objects, err
 }
 
-// GetObject returns an object. If the object doesn't exist, the result will be pushed into
-// the object structure via read.
+// Usage gives the number of objects and their total size in the bucket, including
+// the objects under prefixes. The size is the stored one (encrypted, with headers),
+// the one of its blob for a deduplicated object (see listedSize).
+func (c *Connection) Usage(ctx context.Context, bucketname string) (count, size uint64, err error) {
+	return c.usage(ctx, bucketname, "")
+}
+
+// OwnerUsage gives the number of objects and their total size in the bucket that
+// were pushed by the owner (see PushOptions.Owner).
+func (c *Connection) OwnerUsage(ctx context.Context, bucketname, owner string) (count, size uint64, err error) {
+	return c.usage(ctx, bucketname, owner)
+}
+
+// usage sums the objects of the bucket, only the ones of the owner if it is given.
+func (c *Connection) usage(ctx context.Context, bucketname, owner string) (count, size uint64, err error) {
+	// the metadata gives the owners and the sizes of the blobs
+	opts := minio.ListObjectsOptions{Recursive: true, WithMetadata: true}
+	for ob := range c.client.ListObjects(ctx, bucketname, opts) {
+		if ob.Err != nil {
+			if ob.Err == ctx.Err() {
+				return 0, 0, ctx.Err()
+			}
+			// store the last error, must continue to drain
+			err = ob.Err
+			continue
+		}
+		if strings.HasPrefix(ob.Key, DedupPrefix) {
+			continue // charged to the objects referencing it
+		}
+		if owner != "" && objectOwner(ob) != owner {
+			continue
+		}
+		count++
+		size += uint64(listedSize(ob))
+	}
+	return count, size, err
+}
+
+// listedSize gives the size of the object listed, the size of its blob if it
+// references one: each object is charged for its data, even if it is stored once.
+func listedSize(ob minio.ObjectInfo) int64 {
+	if size, err := strconv.ParseInt(userMetadata(ob, BlobSizeMetadata), 10, 64); err == nil {
+		return size
+	}
+	return ob.Size
+}
+
+// objectOwner gives the owner stored in the metadata of the object.
+func objectOwner(ob minio.ObjectInfo) string { return userMetadata(ob, OwnerMetadata) }
+
+// CustomMetadata gives the metadata of the client stored with the object, by lower
+// case name, nil if none.
+func CustomMetadata(ob minio.ObjectInfo) map[string]string {
+	var res map[string]string
+	prefix := strings.ToLower(CustomMetadataPrefix)
+	for k, v := range ob.UserMetadata {
+		k = strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-")
+		if name, ok := strings.CutPrefix(k, prefix); ok {
+			if res == nil {
+				res = make(map[string]string)
+			}
+			res[name] = v
+		}
+	}
+	return res
+}
+
+// userMetadata gives the user metadata of the object, the listing gives the metadata
+// with or without the X-Amz-Meta- prefix.
+func userMetadata(ob minio.ObjectInfo, name string) string {
+	for k, v := range ob.UserMetadata {
+		k = strings.TrimPrefix(strings.ToLower(k), "x-amz-meta-")
+		if k == strings.ToLower(name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// notFound gives ErrObjectNotFound if err tells that the object does not exist.
+func notFound(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return errs.WrapWithError(err, ErrObjectNotFound)
+	}
+	return err
+}
+
+// getPinned gets the object only if it still has the ETag given (any if ""). It
+// fails with ErrObjectChanged if the object has been replaced.
+func (c *Connection) getPinned(ctx context.Context, bucketname, key, etag string, opts minio.GetObjectOptions) (*minio.Object, error) {
+	if etag != "" {
+		if err := opts.SetMatchETag(etag); err != nil {
+			return nil, err
+		}
+	}
+	obj, err := c.client.GetObject(ctx, bucketname, key, opts)
+	if err != nil || etag == "" {
+		return obj, err
+	}
+	// an empty read sends the request, its error is the one of the condition. A stat
+	// would be a HEAD without the range, and the reads would then get the whole object.
+	if _, err := obj.Read(nil); err != nil && err != io.EOF {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return nil, errs.WrapWithError(err, ErrObjectChanged)
+		}
+		return nil, notFound(err)
+	}
+	return obj, nil
+}
+
+// objectReader is the reader given by GetObject, with the key of the object read,
+// the blob of a deduplicated object.
+type objectReader struct {
+	encdec.Reader
+	key          string
+	etag         string           // ETag of the stored data
+	lastModified time.Time        // time of the last upload of the object
+	meta         *encdec.Metadata // metadata sealed in the reference of a deduplicated object, nil otherwise
+}
+
+// Metadata gives the metadata of the object, from its reference if it is deduplicated.
+func (r *objectReader) Metadata() (encdec.Metadata, error) {
+	if r.meta != nil {
+		return *r.meta, nil
+	}
+	return r.Reader.Metadata()
+}
+
+// Filename gives the original name of the file, from its reference if it is
+// deduplicated.
+func (r *objectReader) Filename() (string, error) {
+	if r.meta != nil {
+		return r.meta.Filename, nil
+	}
+	return r.Reader.Filename()
+}
+
+// GetObject returns an object, the blob it references if it is deduplicated: its
+// filename and its metadata are then the ones sealed in the reference. It fails with
+// ErrObjectNotFound if the object doesn't exist.
 func (c *Connection) GetObject(ctx context.Context, bucketname, objectName string) (encdec.Reader, error) {
-	obj, err := c.client.GetObject(ctx, bucketname, objectName, minio.GetObjectOptions{})
+	key := c.storedKey(bucketname, objectName)
+	obj, err := c.client.GetObject(ctx, bucketname, key, minio.GetObjectOptions{})
 	if err != nil {
 		return nil, err
 	}
+	// the stat is the response of the request reading the object
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if err = notFound(err); err != ErrObjectNotFound || key == objectName {
+			return nil, err
+		}
+		// stored before the obfuscation of the names
+		if info, err = c.unobfuscated(ctx, bucketname, objectName); err != nil {
+			return nil, err
+		}
+		key = objectName
+		if obj, err = c.getPinned(ctx, bucketname, key, info.ETag, minio.GetObjectOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	etag := info.ETag
+	var meta *encdec.Metadata
+	if blob := userMetadata(info, BlobMetadata); blob != "" {
+		meta, err = c.refMetadata(ctx, bucketname, info.Size, obj)
+		obj.Close()
+		if err != nil {
+			return nil, err
+		}
+		key = DedupPrefix + blob
+		if obj, err = c.client.GetObject(ctx, bucketname, key, minio.GetObjectOptions{}); err != nil {
+			return nil, err
+		}
+		blobInfo, err := obj.Stat()
+		if err != nil {
+			obj.Close()
+			return nil, err
+		}
+		etag = blobInfo.ETag
+	}
 	// create a decryption reader and return this reader
-	return encdec.NewDecReader(config.GetCurrent().Service().AESKey(), obj)
+	kp := c.keyProvider(bucketname)
+	r, err := encdec.NewDecReaderWithKeys(func(wrapped []byte) ([keys.KeySize]byte, error) {
+		return kp.Unwrap(ctx, wrapped)
+	}, obj)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return &objectReader{Reader: r, key: key, etag: etag, lastModified: info.LastModified, meta: meta}, nil
+}
+
+// StoredVersion gives the ETag of the stored data of the object read by r, given by
+// GetObject (of its blob if it is deduplicated), and the time of its last upload.
+func StoredVersion(r encdec.Reader) (etag string, lastModified time.Time) {
+	if or, ok := r.(*objectReader); ok {
+		return or.etag, or.lastModified
+	}
+	return "", time.Time{}
+}
+
+// ObjectChecksums gives the checksums of the plaintext of the object recorded at its
+// upload, read from the trailer at the end of the object. r is the reader of the
+// object given by GetObject, its header is read if needed. ok is false for the
+// objects without trailer, uploaded before the checksums were recorded.
+func (c *Connection) ObjectChecksums(ctx context.Context, bucketname, objectName string, r encdec.Reader) (sums encdec.Checksums, ok bool, err error) {
+	size, err := r.TrailerSize()
+	if err != nil || size == 0 {
+		return encdec.Checksums{}, false, err
+	}
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(0, -int64(size)); err != nil {
+		return encdec.Checksums{}, false, err
+	}
+	etag := ""
+	if or, ok := r.(*objectReader); ok {
+		objectName = or.key // the blob of a deduplicated object
+		etag = or.etag
+	}
+	// the trailer of the version read, not of an object replaced since
+	tail, err := c.getPinned(ctx, bucketname, objectName, etag, opts)
+	if err != nil {
+		return encdec.Checksums{}, false, err
+	}
+	defer tail.Close()
+	sums, err = r.ReadTrailer(tail)
+	return sums, err == nil, err
 }
 
 // CreateBucketIfNotExists creates a new bucket if it does not already exists on the server.
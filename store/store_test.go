@@ -0,0 +1,494 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ag0st/taurus-challenge/encdec"
+	"github.com/ag0st/taurus-challenge/keys"
+	"github.com/minio/minio-go/v7"
+)
+
+// listClientMock lists a fixed set of objects.
+type listClientMock struct {
+	minioClientMock
+	objects []minio.ObjectInfo
+}
+
+func (c *listClientMock) ListObjects(ctx context.Context, bucketName string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	res := make(chan minio.ObjectInfo, len(c.objects))
+	for _, o := range c.objects {
+		res <- o
+	}
+	close(res)
+	return res
+}
+
+// TestOwnerUsage tests that only the objects of the owner are counted, whatever
+// the form of the metadata key.
+func TestOwnerUsage(t *testing.T) {
+	conn := &Connection{client: &listClientMock{objects: []minio.ObjectInfo{
+		{Key: "a", Size: 100, UserMetadata: minio.StringMap{"X-Amz-Meta-Owner": "alice"}},
+		{Key: "b", Size: 200, UserMetadata: minio.StringMap{"Owner": "bob"}},
+		{Key: "dir/c", Size: 300, UserMetadata: minio.StringMap{"owner": "alice"}},
+		{Key: "d", Size: 400},
+	}}}
+	count, size, err := conn.OwnerUsage(context.Background(), "test", "alice")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 2 || size != 400 {
+		t.Fatalf("expected 2 objects and 400 bytes, got %d and %d", count, size)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	conn := &Connection{client: &listClientMock{objects: []minio.ObjectInfo{
+		{Key: "a", Size: 100}, {Key: "dir/b", Size: 250},
+	}}}
+	count, size, err := conn.Usage(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 2 || size != 350 {
+		t.Fatalf("expected 2 objects and 350 bytes, got %d and %d", count, size)
+	}
+}
+
+// TestDedupUsage tests that the deduplicated objects are charged the size of their
+// blob, and that the blobs are not charged.
+func TestDedupUsage(t *testing.T) {
+	conn := &Connection{client: &listClientMock{objects: []minio.ObjectInfo{
+		{Key: "a", Size: 120, UserMetadata: minio.StringMap{"X-Amz-Meta-Owner": "alice", "X-Amz-Meta-Dedup-Blob": "f00d", "X-Amz-Meta-Dedup-Size": "1000"}},
+		{Key: "b", Size: 120, UserMetadata: minio.StringMap{"X-Amz-Meta-Owner": "bob", "X-Amz-Meta-Dedup-Blob": "f00d", "X-Amz-Meta-Dedup-Size": "1000"}},
+		{Key: DedupPrefix + "f00d", Size: 1000},
+		{Key: "c", Size: 50, UserMetadata: minio.StringMap{"X-Amz-Meta-Owner": "alice"}},
+	}}}
+	count, size, err := conn.OwnerUsage(context.Background(), "test", "alice")
+	if err != nil || count != 2 || size != 1050 {
+		t.Fatalf("expected 2 objects and 1050 bytes for alice, got %d and %d (%v)", count, size, err)
+	}
+	count, size, err = conn.Usage(context.Background(), "test")
+	if err != nil || count != 3 || size != 2050 {
+		t.Fatalf("expected 3 objects and 2050 bytes in the bucket, got %d and %d (%v)", count, size, err)
+	}
+}
+
+// TestBucketKeys tests that the buckets with their own master key use it and
+// that the others use the default one.
+func TestBucketKeys(t *testing.T) {
+	def, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	own, err := keys.NewLocal("acme", [keys.KeySize]byte{2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn := &Connection{}
+	conn.SetKeys(def)
+	conn.SetBucketKeys(map[string]keys.Provider{"acme": own})
+	if conn.keyProvider("acme") != keys.Provider(own) {
+		t.Fatalf("the bucket acme must use its own key")
+	}
+	if conn.keyProvider("other") != keys.Provider(def) {
+		t.Fatalf("the bucket other must use the default key")
+	}
+}
+
+func TestPushObjectSizes(t *testing.T) {
+	cases := []struct {
+		opts PushOptions
+		err  error
+	}{
+		{PushOptions{ChunkSize: 64 << 10}, ErrWrongChunkSize},
+		{PushOptions{ChunkSize: 64 << 10, PartSize: 1 << 20}, ErrWrongPartSize},
+		{PushOptions{ChunkSize: 1 << 10, PartSize: MinPartSize}, ErrWrongChunkSize},
+		{PushOptions{ChunkSize: 64 << 10, Stream: true, Size: -1}, ErrWrongStream},
+		{PushOptions{Stream: true, Size: 10}, ErrWrongStream},
+	}
+	for _, tc := range cases {
+		if _, err := mockConn.PushObject(context.Background(), nil, "test", "test.txt", tc.opts); err != tc.err {
+			t.Fatalf("options %+v: expected error %v, got %v", tc.opts, tc.err, err)
+		}
+	}
+}
+
+// bodyClientMock keeps the body, the metadata and the tags of the last single upload.
+type bodyClientMock struct {
+	minioClientMock
+	body     []byte
+	metadata map[string]string
+	tags     map[string]string
+}
+
+func (c *bodyClientMock) PutObject(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64,
+	opts minio.PutObjectOptions,
+) (minio.UploadInfo, error) {
+	body, err := io.ReadAll(io.LimitReader(reader, objectSize))
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+	if int64(len(body)) != objectSize {
+		return minio.UploadInfo{}, fmt.Errorf("expected %d bytes, got %d", objectSize, len(body))
+	}
+	c.body = body
+	c.metadata, c.tags = opts.UserMetadata, opts.UserTags
+	return minio.UploadInfo{Bucket: bucketName, Key: objectName, Size: objectSize}, nil
+}
+
+// TestPushObjectStream tests that a streamed object is a single upload of the
+// announced size that can be decrypted.
+func TestPushObjectStream(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &bodyClientMock{}
+	conn := &Connection{client: client}
+	conn.SetKeys(kp)
+	data := make([]byte, 200<<10+17)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	info, err := conn.PushObject(context.Background(), bytes.NewReader(data), "test", "test.bin",
+		PushOptions{ChunkSize: 64 << 10, Stream: true, Size: int64(len(data)), Filename: "test.bin"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Size != int64(len(client.body)) {
+		t.Fatalf("expected an upload of %d bytes, got %d", len(client.body), info.Size)
+	}
+	if sha := sha256.Sum256(data); !bytes.Equal(info.Checksums.SHA256, sha[:]) || info.Checksums.CRC32C != nil {
+		t.Fatalf("expected the SHA-256 %x of the data, got %x", sha, info.Checksums.SHA256)
+	}
+	reader, err := encdec.NewDecReaderWithKeys(func(wrapped []byte) ([keys.KeySize]byte, error) {
+		return kp.Unwrap(context.Background(), wrapped)
+	}, bytes.NewReader(client.body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("the decrypted data differs from the data pushed")
+	}
+
+	// the size announced does not match the data
+	_, err = conn.PushObject(context.Background(), bytes.NewReader(data[:100]), "test", "test.bin",
+		PushOptions{ChunkSize: 64 << 10, Stream: true, Size: int64(len(data))})
+	if err == nil {
+		t.Fatalf("expected an error when the data is shorter than announced")
+	}
+}
+
+// TestPushObjectCompression tests that the data is compressed in whole mode and that
+// the streamed objects are not compressed, their size must be known.
+func TestPushObjectCompression(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := bytes.Repeat([]byte(`{"level":"info","msg":"This is a test"}`), 5000)
+	for _, stream := range []bool{false, true} {
+		client := &bodyClientMock{}
+		conn := &Connection{client: client}
+		conn.SetKeys(kp)
+		opts := PushOptions{Compression: encdec.CompressionZstd}
+		if stream {
+			opts.ChunkSize, opts.Stream, opts.Size = 64<<10, true, int64(len(data))
+		}
+		if _, err := conn.PushObject(context.Background(), bytes.NewReader(data), "test", "test.json", opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if compressed := len(client.body) < len(data)/2; compressed == stream {
+			t.Fatalf("stream %v: unexpected size of the object %d", stream, len(client.body))
+		}
+		reader, _ := encdec.NewDecReaderWithKeys(func(wrapped []byte) ([keys.KeySize]byte, error) {
+			return kp.Unwrap(context.Background(), wrapped)
+		}, bytes.NewReader(client.body))
+		if got, err := io.ReadAll(reader); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("stream %v: cannot read the data back: %v", stream, err)
+		}
+	}
+}
+
+// TestPushObjectMetadata tests that the tags and the metadata are stored with the
+// object, the filename and the private metadata encrypted in its header only.
+func TestPushObjectMetadata(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &bodyClientMock{}
+	conn := &Connection{client: client}
+	conn.SetKeys(kp)
+	opts := PushOptions{
+		Filename:        "scan.pdf",
+		ContentType:     "application/pdf",
+		Owner:           "alice",
+		Tags:            map[string]string{"project": "taurus"},
+		Metadata:        map[string]string{"source": "scanner"},
+		PrivateMetadata: map[string]string{"patient": "42"},
+	}
+	if _, err := conn.PushObject(context.Background(), strings.NewReader("data"), "test", "test.txt", opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(client.tags, opts.Tags) {
+		t.Fatalf("expected the tags %v, got %v", opts.Tags, client.tags)
+	}
+	info := minio.ObjectInfo{UserMetadata: client.metadata}
+	if got := CustomMetadata(info); !reflect.DeepEqual(got, opts.Metadata) || objectOwner(info) != "alice" {
+		t.Fatalf("unexpected metadata %v", client.metadata)
+	}
+	for _, clear := range []string{"scan.pdf", "application/pdf", "patient"} {
+		if strings.Contains(string(client.body), clear) {
+			t.Fatalf("%s is stored in clear", clear)
+		}
+	}
+	reader, err := encdec.NewDecReaderWithKeys(func(wrapped []byte) ([keys.KeySize]byte, error) {
+		return kp.Unwrap(context.Background(), wrapped)
+	}, bytes.NewReader(client.body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := reader.Metadata()
+	if err != nil || got.Filename != opts.Filename || got.ContentType != opts.ContentType || !reflect.DeepEqual(got.Custom, opts.PrivateMetadata) {
+		t.Fatalf("unexpected sealed metadata %+v (%v)", got, err)
+	}
+}
+
+// TestPushObjectMaxSize tests that the data above the maximum size aborts the upload
+// and that the owner is stored with the object.
+func TestPushObjectMaxSize(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &bodyClientMock{}
+	conn := &Connection{client: client}
+	conn.SetKeys(kp)
+	data := make([]byte, 1000)
+
+	_, err = conn.PushObject(context.Background(), bytes.NewReader(data), "test", "test.bin",
+		PushOptions{Owner: "alice", MaxSize: 1000})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.metadata[OwnerMetadata] != "alice" {
+		t.Fatalf("expected the owner alice in the metadata, got %v", client.metadata)
+	}
+
+	_, err = conn.PushObject(context.Background(), bytes.NewReader(data), "test", "test.bin",
+		PushOptions{MaxSize: 999})
+	if err != ErrObjectTooLarge {
+		t.Fatalf("expected ErrObjectTooLarge, got %v", err)
+	}
+	_, err = conn.PushObject(context.Background(), bytes.NewReader(data), "test", "test.bin",
+		PushOptions{ChunkSize: 64 << 10, Stream: true, Size: int64(len(data)), MaxSize: 999})
+	if err != ErrObjectTooLarge {
+		t.Fatalf("expected ErrObjectTooLarge for a stream, got %v", err)
+	}
+}
+
+// emptyReadsReader gives its data, then reads giving nothing before the rest.
+type emptyReadsReader struct {
+	data, rest []byte
+	empty      int
+}
+
+func (r *emptyReadsReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	if r.empty > 0 {
+		r.empty--
+		return 0, nil
+	}
+	if len(r.rest) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.rest)
+	r.rest = r.rest[n:]
+	return n, nil
+}
+
+// TestMaxSizeReader tests that nothing is read past the limit, even if the reader
+// gives nothing at the limit before the rest of the data.
+func TestMaxSizeReader(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		r    *emptyReadsReader
+		err  error
+	}{
+		{"end", &emptyReadsReader{data: make([]byte, 10), empty: 3}, nil},
+		{"more", &emptyReadsReader{data: make([]byte, 10), empty: 3, rest: make([]byte, 5)}, ErrObjectTooLarge},
+		{"stuck", &emptyReadsReader{data: make([]byte, 10), empty: maxEmptyReads}, io.ErrNoProgress},
+	} {
+		res, err := io.ReadAll(&maxSizeReader{r: tc.r, left: 10})
+		if err != tc.err || len(res) != 10 {
+			t.Fatalf("%s: expected %v after 10 bytes, got %v after %d bytes", tc.name, tc.err, err, len(res))
+		}
+	}
+}
+
+// TestPushObjectExpected tests that the data is verified against the checksums given
+// and that the upload is cancelled if it does not match.
+func TestPushObjectExpected(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := make([]byte, 100<<10)
+	md5Sum, shaSum := md5.Sum(data), sha256.Sum256(data)
+	wrong := sha256.Sum256([]byte("corrupted"))
+
+	tests := []struct {
+		name string
+		opts PushOptions
+		err  error
+	}{
+		{"md5", PushOptions{ExpectedMD5: md5Sum[:]}, nil},
+		{"sha256", PushOptions{ExpectedMD5: md5Sum[:], ExpectedSHA256: shaSum[:]}, nil},
+		{"wrong sha256", PushOptions{ExpectedMD5: md5Sum[:], ExpectedSHA256: wrong[:]}, ErrChecksumMismatch},
+		{"wrong md5", PushOptions{ExpectedMD5: wrong[:16]}, ErrChecksumMismatch},
+		{"wrong stream", PushOptions{ChunkSize: 64 << 10, Stream: true, Size: int64(len(data)), ExpectedSHA256: wrong[:]}, ErrChecksumMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &bodyClientMock{}
+			conn := &Connection{client: client}
+			conn.SetKeys(kp)
+			_, err := conn.PushObject(context.Background(), bytes.NewReader(data), "test", "test.bin", tt.opts)
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if tt.err != nil && !tt.opts.Stream && client.body != nil {
+				t.Fatalf("the object must not be stored")
+			}
+		})
+	}
+}
+
+// storedClientMock records when an upload is stored.
+type storedClientMock struct {
+	bodyClientMock
+	stored atomic.Bool
+}
+
+func (c *storedClientMock) PutObject(ctx context.Context, bucketName, objectName string, reader io.Reader, objectSize int64,
+	opts minio.PutObjectOptions,
+) (minio.UploadInfo, error) {
+	info, err := c.bodyClientMock.PutObject(ctx, bucketName, objectName, reader, objectSize, opts)
+	c.stored.Store(err == nil)
+	return info, err
+}
+
+// TestPushObjectCommit tests that the commit is called once the data is uploaded but
+// before the object is stored, and that the object is not stored if it fails.
+func TestPushObjectCommit(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := make([]byte, 6<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	errCommit := errors.New("precondition failed")
+	for _, tc := range []struct {
+		name string
+		opts PushOptions
+	}{
+		{"whole", PushOptions{}},
+		{"stream", PushOptions{ChunkSize: 64 << 10, Stream: true, Size: int64(len(data))}},
+		{"chunk", PushOptions{ChunkSize: 5 << 20}},
+	} {
+		for _, fail := range []bool{false, true} {
+			client := &storedClientMock{}
+			core := &minioCoreMock{uploads: make(map[string]*multipartUpload)}
+			conn := &Connection{client: client, core: core}
+			conn.SetKeys(kp)
+			stored := func() bool {
+				if tc.opts.ChunkSize != 0 && !tc.opts.Stream {
+					for _, u := range core.uploads {
+						if u.status == completed {
+							return true
+						}
+					}
+					return false
+				}
+				return client.stored.Load()
+			}
+			commits, releases := 0, 0
+			opts := tc.opts
+			opts.Commit = func() (func(), error) {
+				commits++
+				if stored() {
+					t.Errorf("%s: the object is stored before the commit", tc.name)
+				}
+				if fail {
+					return nil, errCommit
+				}
+				return func() { releases++ }, nil
+			}
+			_, err := conn.PushObject(context.Background(), bytes.NewReader(data), "test", "test.bin", opts)
+			if fail {
+				if err != errCommit || stored() {
+					t.Fatalf("%s: expected the error of the commit and no object, got %v", tc.name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", tc.name, err)
+			}
+			if commits != 1 || releases != 1 || !stored() {
+				t.Fatalf("%s: expected one commit and one release, got %d and %d", tc.name, commits, releases)
+			}
+		}
+	}
+}
+
+// blockingReader blocks until its channel is closed.
+type blockingReader chan struct{}
+
+func (b blockingReader) Read(p []byte) (int, error) {
+	<-b
+	return 0, io.EOF
+}
+
+// TestPushObjectCancelled tests that a push cancelled by its context fails, so the
+// object is never taken for stored.
+func TestPushObjectCancelled(t *testing.T) {
+	kp, err := keys.NewLocal("default", [keys.KeySize]byte{1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := &bodyClientMock{}
+	conn := &Connection{client: client}
+	conn.SetKeys(kp)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := make(blockingReader)
+	defer close(r)
+	if _, err := conn.PushObject(ctx, r, "test", "test.bin", PushOptions{}); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if client.body != nil {
+		t.Fatalf("the object must not be stored")
+	}
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/errs"
+)
+
+// ErrInvalidCA error is thrown when the CA bundle given for the MinIo connection
+// does not contain any certificate.
+var ErrInvalidCA = errs.New("no certificate found in the MinIo CA file")
+
+// TransportOptions configures the http.Transport used to reach the MinIo server.
+// Zero values are replaced by the defaults of the MinIo SDK.
+type TransportOptions struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	Proxy                 string // proxy url, if empty the proxy is taken from the environment (HTTPS_PROXY, ...)
+}
+
+// newTransport creates the http.Transport to reach the MinIo server regarding the options.
+func newTransport(opts Options) (*http.Transport, error) {
+	to := opts.Transport
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   orDefault(to.DialTimeout, 30*time.Second),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          orDefault(to.MaxIdleConns, 256),
+		MaxIdleConnsPerHost:   orDefault(to.MaxIdleConnsPerHost, 16),
+		ResponseHeaderTimeout: orDefault(to.ResponseHeaderTimeout, time.Minute),
+		IdleConnTimeout:       orDefault(to.IdleConnTimeout, time.Minute),
+		TLSHandshakeTimeout:   orDefault(to.TLSHandshakeTimeout, 10*time.Second),
+		ExpectContinueTimeout: 10 * time.Second,
+		// Set this value so that the underlying transport round-tripper
+		// doesn't try to auto decode the body of objects with
+		// content-encoding set to `gzip`.
+		DisableCompression: true,
+	}
+	if to.Proxy != "" {
+		proxy, err := url.Parse(to.Proxy)
+		if err != nil {
+			return nil, errs.Wrap(err, "cannot parse the proxy url")
+		}
+		tr.Proxy = http.ProxyURL(proxy)
+	}
+
+	if opts.Secure {
+		tr.TLSClientConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: opts.InsecureSkipVerify,
+		}
+		if opts.CAFile != "" {
+			pem, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, errs.Wrap(err, "cannot read the MinIo CA file")
+			}
+			// trust the system CA and the given ones
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, ErrInvalidCA
+			}
+			tr.TLSClientConfig.RootCAs = pool
+		}
+	}
+	return tr, nil
+}
+
+// orDefault returns v if it is set, def otherwise.
+func orDefault[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
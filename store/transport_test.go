@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTLSMinio starts a https server answering to every request with 200 and
+// writes its certificate in a CA file.
+func newTLSMinio(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, pemData, 0o600); err != nil {
+		t.Fatalf("cannot write the CA file: %v", err)
+	}
+	return srv, caFile
+}
+
+// TestConnectTLS tests the verification of the server certificate
+// with a custom CA, without it and when skipping the verification.
+func TestConnectTLS(t *testing.T) {
+	srv, caFile := newTLSMinio(t)
+	defer srv.Close()
+
+	testCases := []struct {
+		caFile             string
+		insecureSkipVerify bool
+		expectErr          bool
+	}{
+		{caFile, false, false},
+		{"", false, true},
+		{"", true, false},
+	}
+	for i, tc := range testCases {
+		conn, err := Connect(Options{
+			Endpoint:           srv.Listener.Addr().String(),
+			AccessKey:          "access",
+			SecretKey:          "secret",
+			Secure:             true,
+			Region:             "us-east-1",
+			CAFile:             tc.caFile,
+			InsecureSkipVerify: tc.insecureSkipVerify,
+			Transport:          TransportOptions{DialTimeout: time.Second},
+		})
+		if err != nil {
+			t.Fatalf("test case %d: unexpected error: %v", i, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = conn.client.BucketExists(ctx, "test")
+		cancel()
+		if tc.expectErr && err == nil {
+			t.Fatalf("test case %d: expected a certificate error", i)
+		} else if !tc.expectErr && err != nil {
+			t.Fatalf("test case %d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+// TestTransportOptions tests the options given to the http transport.
+func TestTransportOptions(t *testing.T) {
+	if _, err := newTransport(Options{Secure: true, CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Fatal("expected an error with a missing CA file")
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0o600)
+	if _, err := newTransport(Options{Secure: true, CAFile: empty}); err != ErrInvalidCA {
+		t.Fatalf("expected ErrInvalidCA, got %v", err)
+	}
+
+	tr, err := newTransport(Options{Transport: TransportOptions{
+		MaxIdleConnsPerHost: 4, IdleConnTimeout: time.Second, Proxy: "http://proxy.local:3128",
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tr.MaxIdleConnsPerHost != 4 || tr.IdleConnTimeout != time.Second || tr.MaxIdleConns != 256 {
+		t.Fatalf("transport options not applied: %d, %v, %d", tr.MaxIdleConnsPerHost, tr.IdleConnTimeout, tr.MaxIdleConns)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://minio.local", nil)
+	if proxy, err := tr.Proxy(req); err != nil || proxy.Host != "proxy.local:3128" {
+		t.Fatalf("expected proxy.local:3128, got %v (%v)", proxy, err)
+	}
+	if tr.TLSClientConfig != nil {
+		t.Fatal("expected no tls configuration on an insecure connection")
+	}
+}
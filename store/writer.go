@@ -25,9 +25,17 @@ type storeWriterCloser interface {
 // uploadConfig is a configuration given to a writer containing the informations
 // on the minio service and the content type of its upload.
 type uploadConfig struct {
-	bucketName  string
-	objectName  string
-	contentType string
+	bucketName    string
+	objectName    string
+	contentType   string
+	userMetadata  map[string]string // metadata stored with the object
+	userTags      map[string]string // tags of the object
+	chunksPerPart int               // number of writes grouped into a part of a multipart upload, 0 or 1 for one write per part
+	minPartBytes  uint64            // if > 0, the writes are grouped into parts of at least minPartBytes instead of chunksPerPart writes
+	growParts     bool              // double the size of the parts every partsPerGrowth parts, the size of the upload is unknown
+	stream        bool              // stream the writes into a single upload of streamSize bytes
+	streamSize    int64             // size of the streamed upload
+	commit        CommitFunc        // called before the upload is completed, nil for none
 }
 
 // uploadFinished structure contains the informations on a finished upload.
@@ -41,6 +49,9 @@ type uploadFinished struct {
 // newStoreWriter creates the right type of storeWriter regarding the
 // configuration.
 func newStoreWriter(ctx context.Context, chunkSize uint64, conn *Connection, config uploadConfig) storeWriterCloser {
+	if config.stream {
+		return newStreamWriter(ctx, conn.client, config)
+	}
 	if chunkSize > 0 {
 		return newChunckWriter(ctx, chunkSize, conn.core, config)
 	} else {
@@ -50,14 +61,26 @@ func newStoreWriter(ctx context.Context, chunkSize uint64, conn *Connection, con
 
 // storeChunkWriter is an implementation of a storeWriterCloser that
 // upload each write as a chunk to the minio bucket.
-// Each writes are writen as a chunk.
+// Each writes are writen as a chunk, or grouped by chunksPerPart into a part. The
+// encryption chunks can then be smaller than the minimal size of a part. The writes
+// of variable size (compressed chunks) are grouped into parts of at least minPartBytes.
 // It uses the minio implementation of MultiPart upload and is constraint
-// to its limitations.
+// to its limitations: it fails with a *PartLimitError before sending the part MaxParts+1.
+// If the size of the upload is unknown, the size of the parts is doubled every
+// partsPerGrowth parts to push the limit.
 type storeChunkWriter struct {
 	bucketName  string               // destination bucket
 	objectName  string               // name of the object to upload
 	contentType string               // content type of the object
+	metadata    map[string]string    // user metadata of the object
+	tags        map[string]string    // tags of the object
 	chunkSize   uint64               // size of the chunks
+	perPart     int                  // number of writes grouped into a part
+	minPart     uint64               // minimal size of a part, replaces perPart if > 0
+	grow        bool                 // double perPart and minPart every partsPerGrowth parts
+	pending     int                  // number of writes waiting in buf
+	buf         []byte               // writes waiting to be grouped into a part
+	uploaded    uint64               // number of bytes uploaded
 	parts       []minio.CompletePart // stores informations on all the chunks that have been uploaded.
 	cnt         int                  // cnt is an internal counter to assign identifier to each chunk
 	uploadId    string               // the current upload id for the mulitpart upload.
@@ -66,6 +89,7 @@ type storeChunkWriter struct {
 	ctx         context.Context      // current context for cancelation
 	fchan       chan uploadFinished  // fchan is a channel to indicate when the upload is finished
 	core        Core                 // the minio core to create new upload
+	commit      CommitFunc           // called before the upload is completed, nil for none
 }
 
 // newChunkWriter creates a new storeWriterCloser implementing the chunk technique.
@@ -74,24 +98,31 @@ func newChunckWriter(ctx context.Context, chunkSize uint64, core Core, config up
 		bucketName:  config.bucketName,
 		objectName:  config.objectName,
 		contentType: config.contentType,
+		metadata:    config.userMetadata,
+		tags:        config.userTags,
 		firstWrite:  true,
 		ctx:         ctx,
 		chunkSize:   chunkSize,
+		perPart:     max(config.chunksPerPart, 1),
+		minPart:     config.minPartBytes,
+		grow:        config.growParts,
 		cnt:         1, // counter must begin at 1 (see MinIo documentation)
 		isClosed:    false,
 		fchan:       make(chan uploadFinished, 1), // do not block on write
 		core:        core,
+		commit:      config.commit,
 	}
 }
 
 // Write writes a chunk on minio. The size of p must be of size of the chunk.
+// If the writer groups the chunks, p is kept until there is enough for a part.
 func (scw *storeChunkWriter) Write(p []byte) (n int, err error) {
 	if scw.isClosed {
 		return 0, ErrWriterClosed
 	}
 	// If it is the first write, we need to instanciate a new multipart upload
 	if scw.firstWrite {
-		scw.uploadId, err = scw.core.NewMultipartUpload(scw.ctx, scw.bucketName, scw.objectName, minio.PutObjectOptions{ContentType: scw.contentType})
+		scw.uploadId, err = scw.core.NewMultipartUpload(scw.ctx, scw.bucketName, scw.objectName, minio.PutObjectOptions{ContentType: scw.contentType, UserMetadata: scw.metadata, UserTags: scw.tags})
 		if err != nil {
 			return 0, err
 		}
@@ -102,28 +133,69 @@ func (scw *storeChunkWriter) Write(p []byte) (n int, err error) {
 		scw.Cancel()
 		return 0, scw.ctx.Err()
 	default:
-		op, err := scw.core.PutObjectPart(scw.ctx, scw.bucketName,
-			scw.objectName, scw.uploadId,
-			scw.cnt, bytes.NewReader(p), int64(len(p)),
-			minio.PutObjectPartOptions{})
-		if err != nil {
-			return 0, err
+		part := p
+		if scw.perPart > 1 || scw.minPart > 0 {
+			scw.buf = append(scw.buf, p...)
+			scw.pending++
+			if (scw.minPart == 0 && scw.pending < scw.perPart) || uint64(len(scw.buf)) < scw.minPart {
+				return len(p), nil
+			}
+			part = scw.buf
 		}
-		cp := minio.CompletePart{
-			PartNumber:     op.PartNumber,
-			ETag:           op.ETag,
-			ChecksumCRC32:  op.ChecksumCRC32,
-			ChecksumCRC32C: op.ChecksumCRC32C,
-			ChecksumSHA1:   op.ChecksumSHA1,
-			ChecksumSHA256: op.ChecksumSHA256,
+		if err := scw.putPart(part); err != nil {
+			return 0, err
 		}
-		scw.parts = append(scw.parts, cp)
-		scw.cnt++
+		scw.buf, scw.pending = scw.buf[:0], 0
 		return len(p), nil
 	}
 }
 
-// Close is the implementation of io.Closer. It finalize the upload on minio.
+// putPart uploads p as the next part of the multipart upload.
+func (scw *storeChunkWriter) putPart(p []byte) error {
+	if scw.cnt > MaxParts {
+		return &PartLimitError{ChunksPerPart: scw.perPart, Uploaded: scw.uploaded}
+	}
+	op, err := scw.core.PutObjectPart(scw.ctx, scw.bucketName,
+		scw.objectName, scw.uploadId,
+		scw.cnt, bytes.NewReader(p), int64(len(p)),
+		minio.PutObjectPartOptions{})
+	if err != nil {
+		return err
+	}
+	cp := minio.CompletePart{
+		PartNumber:     op.PartNumber,
+		ETag:           op.ETag,
+		ChecksumCRC32:  op.ChecksumCRC32,
+		ChecksumCRC32C: op.ChecksumCRC32C,
+		ChecksumSHA1:   op.ChecksumSHA1,
+		ChecksumSHA256: op.ChecksumSHA256,
+	}
+	scw.parts = append(scw.parts, cp)
+	scw.cnt++
+	scw.uploaded += uint64(len(p))
+	if scw.grow && (scw.cnt-1)%partsPerGrowth == 0 {
+		scw.growParts()
+	}
+	return nil
+}
+
+// partsPerGrowth is the number of parts of an upload of unknown size after which the
+// size of its parts is doubled: 1'000 parts of 5 MiB, then 1'000 of 10 MiB, ... reach
+// 5 TB within MaxParts parts.
+const partsPerGrowth = 1000
+
+// growParts doubles the number of chunks grouped into the next parts and their
+// minimal size, keeping the room of one more chunk under MaxPartSize.
+func (scw *storeChunkWriter) growParts() {
+	maxPerPart := max(MaxPartSize/(scw.chunkSize+sealedOverhead), 2) - 1
+	scw.perPart = int(min(uint64(scw.perPart)*2, maxPerPart))
+	if scw.minPart > 0 {
+		scw.minPart = min(scw.minPart*2, maxPerPart*scw.chunkSize)
+	}
+}
+
+// Close is the implementation of io.Closer. It uploads the chunks waiting to be
+// grouped as the last part and finalize the upload on minio.
 func (scw *storeChunkWriter) Close() error {
 	// close the multipart upload
 	scw.isClosed = true
@@ -132,10 +204,21 @@ func (scw *storeChunkWriter) Close() error {
 		scw.Cancel()
 		return scw.ctx.Err()
 	default:
-		go func() {
-			info, err := scw.core.CompleteMultipartUpload(scw.ctx, scw.bucketName, scw.objectName, scw.uploadId, scw.parts, minio.PutObjectOptions{})
+		if len(scw.buf) > 0 {
+			if err := scw.putPart(scw.buf); err != nil {
+				return err
+			}
+			scw.buf = nil
+		}
+		release, err := commit(scw.commit)
+		if err != nil {
+			return err
+		}
+		go func(uploadId string) {
+			info, err := scw.core.CompleteMultipartUpload(scw.ctx, scw.bucketName, scw.objectName, uploadId, scw.parts, minio.PutObjectOptions{})
+			release()
 			scw.fchan <- uploadFinished{info, err}
-		}()
+		}(scw.uploadId)
 		return nil
 	}
 }
@@ -151,8 +234,14 @@ func (scw *storeChunkWriter) WaitOnFinished() (minio.UploadInfo, error) {
 
 func (scw *storeChunkWriter) Cancel() error {
 	scw.isClosed = true
+	// nothing to abort if the upload has not started or is already aborted
+	if scw.uploadId == "" {
+		return nil
+	}
 	// if not finished, we need to abort the current upload
-	return scw.core.AbortMultipartUpload(context.Background(), scw.bucketName, scw.objectName, scw.uploadId)
+	uploadId := scw.uploadId
+	scw.uploadId = ""
+	return scw.core.AbortMultipartUpload(context.Background(), scw.bucketName, scw.objectName, uploadId)
 }
 
 // storeAutoWriter is a storeWriter that stores the data written to it inside a buffer
@@ -161,11 +250,14 @@ type storeAutoWriter struct {
 	bucketName  string
 	objectName  string
 	contentType string
+	metadata    map[string]string
+	tags        map[string]string
 	isClosed    bool
 	ctx         context.Context
 	fchan       chan uploadFinished
 	client      Client
 	buf         []byte
+	commit      CommitFunc
 }
 
 // newAutoWriter creates a new auto writer.
@@ -174,10 +266,13 @@ func newAutoWriter(ctx context.Context, client Client, config uploadConfig) stor
 		bucketName:  config.bucketName,
 		objectName:  config.objectName,
 		contentType: config.contentType,
+		metadata:    config.userMetadata,
+		tags:        config.userTags,
 		isClosed:    false,
 		ctx:         ctx,
 		fchan:       make(chan uploadFinished, 1), // do not block on write
 		client:      client,
+		commit:      config.commit,
 	}
 }
 
@@ -218,13 +313,154 @@ func (saw *storeAutoWriter) Close() error {
 	case <-saw.ctx.Done():
 		return saw.ctx.Err()
 	default:
+		release, err := commit(saw.commit)
+		if err != nil {
+			return err
+		}
+		defer release()
 		info, err := saw.client.PutObject(saw.ctx, saw.bucketName,
 			saw.objectName, bytes.NewReader(saw.buf), int64(len(saw.buf)), minio.PutObjectOptions{
 				PartSize:         uint64(len(saw.buf)),
 				DisableMultipart: true,
+				UserMetadata:     saw.metadata,
+				UserTags:         saw.tags,
 			})
 		// post to the channel if somebody is waiting
 		saw.fchan <- uploadFinished{info, err}
 		return err
 	}
 }
+
+// ErrUploadCanceled error is given to the streamed upload when the writer is canceled.
+var ErrUploadCanceled = errs.New("upload canceled")
+
+// storeStreamWriter is a storeWriterCloser that streams the data written to it into
+// a single upload of a known size. It only holds the data of the current write: each
+// write blocks until the upload has read it.
+type storeStreamWriter struct {
+	bucketName  string
+	objectName  string
+	contentType string
+	metadata    map[string]string
+	tags        map[string]string
+	size        int64 // size of the upload, the writes must sum to it
+	written     int64 // number of bytes written into the upload
+	started     bool  // the upload has been started by the first write
+	isClosed    bool
+	commit      CommitFunc
+	held        []byte // last byte of the upload, held until the commit
+	ctx         context.Context
+	fchan       chan uploadFinished
+	client      Client
+	pw          *io.PipeWriter // writes into the body of the upload
+	pr          *io.PipeReader
+}
+
+// newStreamWriter creates a new stream writer, the upload begins on the first write.
+func newStreamWriter(ctx context.Context, client Client, config uploadConfig) storeWriterCloser {
+	pr, pw := io.Pipe()
+	return &storeStreamWriter{
+		bucketName:  config.bucketName,
+		objectName:  config.objectName,
+		contentType: config.contentType,
+		metadata:    config.userMetadata,
+		tags:        config.userTags,
+		size:        config.streamSize,
+		ctx:         ctx,
+		fchan:       make(chan uploadFinished, 1), // do not block on write
+		client:      client,
+		pw:          pw,
+		pr:          pr,
+		commit:      config.commit,
+	}
+}
+
+// start launches the upload reading the pipe, if not already done.
+func (ssw *storeStreamWriter) start() {
+	if ssw.started {
+		return
+	}
+	ssw.started = true
+	go func() {
+		info, err := ssw.client.PutObject(ssw.ctx, ssw.bucketName, ssw.objectName, ssw.pr, ssw.size,
+			minio.PutObjectOptions{ContentType: ssw.contentType, DisableMultipart: true, UserMetadata: ssw.metadata, UserTags: ssw.tags})
+		// unblock the writer if the upload stopped before reading everything
+		ssw.pr.CloseWithError(errs.Wrap(err, "upload stopped"))
+		ssw.fchan <- uploadFinished{info, err}
+	}()
+}
+
+// Write is the implementation of the io.Writer interface. It returns once the
+// upload has read p. With a commit, the last byte of the upload is held until Close:
+// the object cannot be stored before the commit.
+func (ssw *storeStreamWriter) Write(p []byte) (n int, err error) {
+	if ssw.isClosed {
+		return 0, ErrWriterClosed
+	}
+	select {
+	case <-ssw.ctx.Done():
+		ssw.Cancel()
+		return 0, ssw.ctx.Err()
+	default:
+		ssw.start()
+		q := p
+		if ssw.commit != nil && len(p) > 0 && ssw.written+int64(len(p)) >= ssw.size {
+			ssw.held, q = []byte{p[len(p)-1]}, p[:len(p)-1]
+		}
+		n, err := ssw.pw.Write(q)
+		ssw.written += int64(n)
+		if err != nil {
+			return n, err
+		}
+		return len(p), nil
+	}
+}
+
+// Close is the implementation of io.Closer. It ends the body of the upload. With a
+// commit, the held byte is written once committed and the upload is waited before
+// the release.
+func (ssw *storeStreamWriter) Close() error {
+	ssw.isClosed = true
+	select {
+	case <-ssw.ctx.Done():
+		ssw.Cancel()
+		return ssw.ctx.Err()
+	default:
+		ssw.start()
+		if ssw.commit == nil {
+			return ssw.pw.Close()
+		}
+		release, err := ssw.commit()
+		if err != nil {
+			ssw.Cancel()
+			return err
+		}
+		defer release()
+		if _, err := ssw.pw.Write(ssw.held); err != nil {
+			return err
+		}
+		if err := ssw.pw.Close(); err != nil {
+			return err
+		}
+		// the upload always ends, with the context at the latest
+		res := <-ssw.fchan
+		ssw.fchan <- res
+		return nil
+	}
+}
+
+func (ssw *storeStreamWriter) WaitOnFinished() (minio.UploadInfo, error) {
+	select {
+	case <-ssw.ctx.Done():
+		return minio.UploadInfo{}, ssw.ctx.Err()
+	case res := <-ssw.fchan:
+		return res.info, res.err
+	}
+}
+
+// Cancel fails the body of the upload: a single upload is not stored if its body is
+// incomplete.
+func (ssw *storeStreamWriter) Cancel() error {
+	ssw.isClosed = true
+	return ssw.pw.CloseWithError(ErrUploadCanceled)
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
 )
 
 type uploadStatus int
@@ -32,6 +33,7 @@ type multipartUpload struct {
 	partCounter int
 	object      string
 	totalSize   int64
+	initiated   time.Time
 }
 
 type minioCoreMock struct {
@@ -110,7 +112,7 @@ func (c *minioCoreMock) NewMultipartUpload(ctx context.Context, bucket, object s
 		return "", ctx.Err()
 	case <-time.After(time.Millisecond * 100):
 		uploadID = uuid.NewString()
-		c.uploads[uploadID] = &multipartUpload{status: inProgress, partCounter: 1, object: object}
+		c.uploads[uploadID] = &multipartUpload{status: inProgress, partCounter: 1, object: object, initiated: time.Now()}
 		return uploadID, nil
 	}
 }
@@ -176,6 +178,29 @@ func (c *minioCoreMock) AbortMultipartUpload(ctx context.Context, bucket, object
 	}
 }
 
+func (c *minioCoreMock) ListIncompleteUploads(ctx context.Context, bucketName, objectPrefix string, recursive bool) <-chan minio.ObjectMultipartInfo {
+	// snapshot the uploads in progress, the caller may abort them while listing
+	var infos []minio.ObjectMultipartInfo
+	for id, mu := range c.uploads {
+		if mu.status == inProgress {
+			infos = append(infos, minio.ObjectMultipartInfo{Key: mu.object, UploadID: id, Initiated: mu.initiated})
+		}
+	}
+	res := make(chan minio.ObjectMultipartInfo, 1)
+	go func() {
+		defer close(res)
+		for _, info := range infos {
+			select {
+			case <-ctx.Done():
+				res <- minio.ObjectMultipartInfo{Err: ctx.Err()}
+				return
+			case res <- info:
+			}
+		}
+	}()
+	return res
+}
+
 type minioClientMock struct {
 	numberOfObjects int
 	getObjectError  bool
@@ -208,6 +233,18 @@ func (c *minioClientMock) GetObject(ctx context.Context, bucketName, objectName
 	return &minio.Object{}, nil
 
 }
+func (c *minioClientMock) StatObject(ctx context.Context, bucketName, objectName string, opts minio.StatObjectOptions) (minio.ObjectInfo, error) {
+	return minio.ObjectInfo{Key: objectName}, nil
+}
+func (c *minioClientMock) RemoveObject(ctx context.Context, bucketName, objectName string, opts minio.RemoveObjectOptions) error {
+	return nil
+}
+func (c *minioClientMock) PutObjectTagging(ctx context.Context, bucketName, objectName string, otags *tags.Tags, opts minio.PutObjectTaggingOptions) error {
+	return nil
+}
+func (c *minioClientMock) GetObjectTagging(ctx context.Context, bucketName, objectName string, opts minio.GetObjectTaggingOptions) (*tags.Tags, error) {
+	return tags.NewTags(nil, true)
+}
 func (c *minioClientMock) BucketExists(ctx context.Context, bucketName string) (bool, error) {
 	select {
 	case <-ctx.Done():
@@ -364,3 +401,146 @@ func TestContextCancel(t *testing.T) {
 		tc.finalFunction(writer, tc.chunckSize)
 	}
 }
+
+func TestAggregateParts(t *testing.T) {
+	core := &minioCoreMock{uploads: make(map[string]*multipartUpload)}
+	conn := Connection{core: core}
+	conf := upConf
+	conf.chunksPerPart = 3
+	writer := newStoreWriter(context.Background(), 10, &conn, conf)
+	// 7 chunks of 10 bytes, grouped by 3
+	for i := 0; i < 7; i++ {
+		if _, err := writer.Write(make([]byte, 10)); err != nil {
+			t.Fatalf("unexpected error : %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	info, err := writer.WaitOnFinished()
+	if err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	if info.Size != 70 {
+		t.Fatalf("expected 70 bytes uploaded, got %d", info.Size)
+	}
+	for _, mu := range core.uploads {
+		if len(mu.parts) != 3 {
+			t.Fatalf("expected 3 parts, got %d", len(mu.parts))
+		}
+	}
+}
+
+// TestMinPartBytes tests that the writes of variable size are grouped by size.
+func TestMinPartBytes(t *testing.T) {
+	core := &minioCoreMock{uploads: make(map[string]*multipartUpload)}
+	conn := Connection{core: core}
+	conf := upConf
+	conf.minPartBytes = 10
+	writer := newStoreWriter(context.Background(), 10, &conn, conf)
+	// parts of 4+4+4, 9+1 and 3
+	for _, size := range []int{4, 4, 4, 9, 1, 3} {
+		if _, err := writer.Write(make([]byte, size)); err != nil {
+			t.Fatalf("unexpected error : %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	info, err := writer.WaitOnFinished()
+	if err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	if info.Size != 25 {
+		t.Fatalf("expected 25 bytes uploaded, got %d", info.Size)
+	}
+	for _, mu := range core.uploads {
+		if len(mu.parts) != 3 {
+			t.Fatalf("expected 3 parts, got %d", len(mu.parts))
+		}
+	}
+}
+
+// TestGrowParts tests that the parts of an upload of unknown size are doubled every
+// partsPerGrowth parts.
+func TestGrowParts(t *testing.T) {
+	core := &minioCoreMock{uploads: make(map[string]*multipartUpload)}
+	conn := Connection{core: core}
+	conf := upConf
+	conf.growParts = true
+	writer := newStoreWriter(context.Background(), 10, &conn, conf)
+	if _, err := writer.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	// simulate an upload that already sent partsPerGrowth-1 parts
+	scw := writer.(*storeChunkWriter)
+	scw.cnt = partsPerGrowth
+	for _, mu := range core.uploads {
+		mu.partCounter = partsPerGrowth
+	}
+	if _, err := writer.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	if scw.perPart != 2 {
+		t.Fatalf("expected 2 chunks per part after %d parts, got %d", partsPerGrowth, scw.perPart)
+	}
+	// 3 chunks grouped by 2
+	for i := 0; i < 3; i++ {
+		if _, err := writer.Write(make([]byte, 10)); err != nil {
+			t.Fatalf("unexpected error : %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	if _, err := writer.WaitOnFinished(); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	for _, mu := range core.uploads {
+		if len(mu.parts) != 4 {
+			t.Fatalf("expected 4 parts, got %d", len(mu.parts))
+		}
+	}
+	// the parts stay under MaxPartSize
+	scw = &storeChunkWriter{chunkSize: 2 << 30, perPart: 1, minPart: 2 << 30}
+	scw.growParts()
+	if scw.perPart != 1 || scw.minPart != 2<<30 {
+		t.Fatalf("expected a single chunk of 2 GiB per part, got %d chunks of at least %d bytes", scw.perPart, scw.minPart)
+	}
+	scw = &storeChunkWriter{chunkSize: MinPartSize, perPart: 1000}
+	scw.growParts()
+	if uint64(scw.perPart+1)*(MinPartSize+sealedOverhead) > MaxPartSize {
+		t.Fatalf("%d chunks of 5 MiB per part exceed the maximum size of a part", scw.perPart)
+	}
+}
+
+func TestPartLimit(t *testing.T) {
+	core := &minioCoreMock{uploads: make(map[string]*multipartUpload)}
+	conn := Connection{core: core}
+	writer := newStoreWriter(context.Background(), 10, &conn, upConf)
+	if _, err := writer.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	// simulate an upload that already sent all the parts accepted by MinIo
+	writer.(*storeChunkWriter).cnt = MaxParts + 1
+	_, err := writer.Write(make([]byte, 10))
+	limitErr, ok := err.(*PartLimitError)
+	if !ok {
+		t.Fatalf("expected a *PartLimitError, got %v", err)
+	}
+	if limitErr.Uploaded != 10 {
+		t.Fatalf("expected 10 bytes uploaded, got %d", limitErr.Uploaded)
+	}
+	if err := writer.Cancel(); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+	for _, mu := range core.uploads {
+		if mu.status != aborted {
+			t.Fatal("expected the upload to be aborted")
+		}
+	}
+	// a second cancel does nothing
+	if err := writer.Cancel(); err != nil {
+		t.Fatalf("unexpected error : %v", err)
+	}
+}
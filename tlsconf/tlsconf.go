@@ -0,0 +1,194 @@
+// Package tlsconf builds the TLS configuration of the HTTP server from certificate
+// files and keeps it up to date when the files change on disk.
+//
+// The Reloader watches the certificate, the key and the optional client CA bundle
+// (mutual TLS) by polling their modification time. On a change, the files are
+// reloaded and the new material is used for the next handshakes. If the new files
+// cannot be loaded (e.g. the certificate has been written but not yet the key),
+// the previous material is kept and the reload is retried on the next poll.
+package tlsconf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/errs"
+	"github.com/ag0st/taurus-challenge/logging"
+)
+
+// Errors declarations
+var (
+	// ErrNoCertificate error is thrown when no certificate or key file is given.
+	ErrNoCertificate = errs.New("tls certificate and key files are required")
+	// ErrInvalidClientCA error is thrown when the client CA bundle does not contain any certificate.
+	ErrInvalidClientCA = errs.New("no certificate found in the client CA file")
+	// ErrUnknownVersion error is thrown when the TLS version is not supported.
+	ErrUnknownVersion = errs.New("unknown tls version, use one of [1.0, 1.1, 1.2, 1.3]")
+)
+
+// ParseVersion converts a TLS version as written in the configuration ("1.2")
+// into its crypto/tls value. An empty version gives TLS 1.2.
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, errs.Wrap(ErrUnknownVersion, fmt.Sprintf("cannot parse tls version %s", version))
+	}
+}
+
+// material is the content loaded from the files at a given time.
+type material struct {
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+}
+
+// Reloader holds the TLS material of the server and reloads it when the
+// files change.
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string // optional, enables mutual TLS
+	minVersion   uint16
+
+	mu       sync.RWMutex
+	current  material
+	modTimes map[string]time.Time // last modification time seen for each file
+}
+
+// NewReloader creates a new Reloader and loads the files a first time.
+// If clientCAFile is not empty, the clients must present a certificate signed
+// by one of the CA of the bundle.
+func NewReloader(certFile, keyFile, clientCAFile string, minVersion uint16) (*Reloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, ErrNoCertificate
+	}
+	r := &Reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		minVersion:   minVersion,
+		modTimes:     make(map[string]time.Time, 3),
+	}
+	if _, err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns a tls.Config using the material of the reloader. The
+// configuration is resolved on each handshake, so reloads are taken into
+// account without restarting the server.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.material().cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			m := r.material()
+			cfg := &tls.Config{
+				MinVersion:   r.minVersion,
+				Certificates: []tls.Certificate{*m.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if m.clientCA != nil {
+				cfg.ClientCAs = m.clientCA
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// material returns the material currently in use.
+func (r *Reloader) material() material {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.current
+}
+
+// Watch polls the files every interval and reloads them on change until
+// the context is cancelled.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reloadIfChanged()
+			if err != nil {
+				logging.Errorf("cannot reload tls material, keeping the previous one: %v", err)
+			} else if reloaded {
+				logging.Infof("tls material reloaded")
+			}
+		}
+	}
+}
+
+// reloadIfChanged reloads the material if one of the files has a new
+// modification time. It returns true if the material has been replaced.
+func (r *Reloader) reloadIfChanged() (bool, error) {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	modTimes := make(map[string]time.Time, len(files))
+	changed := false
+	for _, f := range files {
+		s, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		modTimes[f] = s.ModTime()
+		if !s.ModTime().Equal(r.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	m, err := r.load()
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.current = m
+	r.modTimes = modTimes
+	r.mu.Unlock()
+	return true, nil
+}
+
+// load reads the files and builds the material.
+func (r *Reloader) load() (material, error) {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return material{}, errs.Wrap(err, "cannot load the tls certificate")
+	}
+	m := material{cert: &cert}
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return material{}, errs.Wrap(err, "cannot read the client CA file")
+		}
+		m.clientCA = x509.NewCertPool()
+		if !m.clientCA.AppendCertsFromPEM(pem) {
+			return material{}, ErrInvalidClientCA
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,161 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ag0st/taurus-challenge/auth"
+)
+
+// testCert is a certificate with its key, encoded in PEM.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert creates a certificate signed by parent (self-signed if parent is nil).
+func newTestCert(t *testing.T, cn string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("cannot write %s: %v", path, err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("cannot change time of %s: %v", path, err)
+	}
+}
+
+// TestReload tests that the certificate is replaced when the files change.
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	first := newTestCert(t, "first", false, nil)
+	writeFile(t, certFile, first.certPEM, time.Now().Add(-time.Minute))
+	writeFile(t, keyFile, first.keyPEM, time.Now().Add(-time.Minute))
+
+	r, err := NewReloader(certFile, keyFile, "", tls.VersionTLS12)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reloaded, err := r.reloadIfChanged(); reloaded || err != nil {
+		t.Fatalf("expected no reload without change, got reloaded=%v, err=%v", reloaded, err)
+	}
+
+	// A certificate without its key must not replace the current material
+	second := newTestCert(t, "second", false, nil)
+	writeFile(t, certFile, second.certPEM, time.Now())
+	if _, err := r.reloadIfChanged(); err == nil {
+		t.Fatal("expected an error with mismatching certificate and key")
+	}
+	if leaf, _ := x509.ParseCertificate(r.material().cert.Certificate[0]); leaf.Subject.CommonName != "first" {
+		t.Fatalf("expected to keep the first certificate, got %s", leaf.Subject.CommonName)
+	}
+
+	writeFile(t, keyFile, second.keyPEM, time.Now())
+	if reloaded, err := r.reloadIfChanged(); !reloaded || err != nil {
+		t.Fatalf("expected a reload, got reloaded=%v, err=%v", reloaded, err)
+	}
+	if leaf, _ := x509.ParseCertificate(r.material().cert.Certificate[0]); leaf.Subject.CommonName != "second" {
+		t.Fatalf("expected the second certificate, got %s", leaf.Subject.CommonName)
+	}
+}
+
+// TestMutualTLS tests that a client must present a certificate signed by the
+// client CA and that its subject is available as caller identity.
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	ca := newTestCert(t, "ca", true, nil)
+	server := newTestCert(t, "localhost", false, ca)
+	client := newTestCert(t, "alice", false, ca)
+	writeFile(t, certFile, server.certPEM, time.Now())
+	writeFile(t, keyFile, server.keyPEM, time.Now())
+	writeFile(t, caFile, ca.certPEM, time.Now())
+
+	r, err := NewReloader(certFile, keyFile, caFile, tls.VersionTLS12)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		caller, _ := auth.FromRequest(req)
+		io.WriteString(w, caller)
+	}))
+	srv.TLS = r.TLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientCert, _ := tls.X509KeyPair(client.certPEM, client.keyPEM)
+
+	// without client certificate, the handshake must fail
+	noCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if _, err := noCert.Get(srv.URL); err == nil {
+		t.Fatal("expected an error without client certificate")
+	}
+
+	withCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: roots, Certificates: []tls.Certificate{clientCert},
+	}}}
+	resp, err := withCert.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "alice" {
+		t.Fatalf("expected caller alice, got %s", body)
+	}
+}